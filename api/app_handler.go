@@ -147,7 +147,7 @@ func (a *Application) PutAppHandler(c echo.Context) error {
 	}
 	app.ID = id
 	err = WithSegment("db-update", c, func() error {
-		_, err = a.DB.Model(&app).Column("name").Column("bundle_id").Column("updated_at").Returning("*").Update()
+		_, err = a.DB.Model(&app).Column("name").Column("bundle_id").Column("gcm_format").Column("rate_limit").Column("frequency_cap_limit").Column("frequency_cap_window").Column("quiet_hours").Column("holdout").Column("updated_at").Returning("*").Update()
 		return err
 	})
 	if err != nil {
@@ -222,6 +222,19 @@ var _ = Describe("App Handler", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(response["reason"]).To(Equal("invalid bundleId"))
 			})
+
+			It("should return 422 if holdout is not lower than 1", func() {
+				payload := GetAppPayload()
+				payload["holdout"] = 1.0
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, "/apps", string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid holdout"))
+			})
 		})
 	})
 
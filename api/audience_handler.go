@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/messages"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+// GetAudienceHandler is the method called when a get to /apps/:aid/audience is called
+// it estimates the number of tokens of the service matched by the filters or the filter expression
+func (a *Application) GetAudienceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "audienceHandler"),
+		zap.String("operation", "getAudience"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	service := c.QueryParam("service")
+	if _, err := messages.GetPushService(service); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: model.InvalidField("service").Error()})
+	}
+	var expression *model.FilterExpression
+	if rawExpression := c.QueryParam("filterExpression"); rawExpression != "" {
+		err = json.Unmarshal([]byte(rawExpression), &expression)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: model.InvalidField("filterExpression").Error()})
+		}
+	} else if rawFilters := c.QueryParam("filters"); rawFilters != "" {
+		filters := map[string]interface{}{}
+		err = json.Unmarshal([]byte(rawFilters), &filters)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: model.InvalidField("filters").Error()})
+		}
+		expression, err = model.NewFilterExpressionFromFilters(filters)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: model.InvalidField(fmt.Sprintf("filters: %s", err.Error())).Error()})
+		}
+	}
+
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
+	}
+
+	tableName := worker.GetPushDBTableName(app.Name, service)
+	columns, err := worker.GetPushDBColumns(a.PushDB, tableName)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	_, err = worker.BuildFilterQuery(expression, columns)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: model.InvalidField(fmt.Sprintf("filters: %s", err.Error())).Error()})
+	}
+
+	var audience *worker.AudienceEstimate
+	err = WithSegment("push-db-select", c, func() error {
+		audience, err = worker.EstimateAudience(a.PushDB, tableName, expression, a.Config.GetInt("api.audience.sampleThreshold"))
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to estimate audience.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Estimated audience successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("audience", audience))
+	})
+	return c.JSON(http.StatusOK, audience)
+}
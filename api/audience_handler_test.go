@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Audience Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var baseRoute string
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		existingApp = CreateTestApp(app.DB)
+		baseRoute = fmt.Sprintf("/apps/%s/audience", existingApp.ID)
+	})
+
+	Describe("Get /apps/:aid/audience", func() {
+		Describe("Sucesfully", func() {
+			It("should return 200 and the audience matched by the filters", func() {
+				filters := url.QueryEscape(`{"locale":"pt"}`)
+				status, body := Get(app, fmt.Sprintf("%s?service=apns&filters=%s", baseRoute, filters), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var audience worker.AudienceEstimate
+				err := json.Unmarshal([]byte(body), &audience)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(audience.Total).To(Equal(6))
+				Expect(audience.Sampled).To(BeFalse())
+				Expect(audience.ByRegion).To(Equal(map[string]int{"BR": 6}))
+				Expect(audience.ByTz).To(Equal(map[string]int{"-0300": 4, "-0500": 2}))
+			})
+
+			It("should return 200 and the whole audience if there are no filters", func() {
+				status, body := Get(app, fmt.Sprintf("%s?service=apns", baseRoute), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var audience worker.AudienceEstimate
+				err := json.Unmarshal([]byte(body), &audience)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(audience.Total).To(Equal(28))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if the service is invalid", func() {
+				status, _ := Get(app, fmt.Sprintf("%s?service=blabla", baseRoute), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the filters are not valid json", func() {
+				status, _ := Get(app, fmt.Sprintf("%s?service=apns&filters=blabla", baseRoute), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if a filter is not a string", func() {
+				filters := url.QueryEscape(`{"locale":1}`)
+				status, _ := Get(app, fmt.Sprintf("%s?service=apns&filters=%s", baseRoute, filters), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 404 if the app does not exist", func() {
+				status, _ := Get(app, fmt.Sprintf("/apps/%s/audience?service=apns", uuid.NewV4()), "test@test.com")
+				Expect(status).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
+})
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+// appHoldoutPageSize is the number of users of the app holdout read at a time by its download
+const appHoldoutPageSize = 10000
+
+// writeCSV returns the rows as a csv file to be downloaded with the file name
+func writeCSV(c echo.Context, fileName string, header []string, rows [][]string) error {
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%s", fileName))
+	return c.Blob(http.StatusOK, "text/csv", buffer.Bytes())
+}
+
+// GetJobControlGroupHandler is the method called when a get to /apps/:aid/jobs/:jid/control-group is called
+// it returns a csv with the users of the job control group, the users of the app holdout are in the app holdout csv
+func (a *Application) GetJobControlGroupHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "controlGroupHandler"),
+		zap.String("operation", "getJobControlGroup"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("jobId", c.Param("jid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	job := &model.Job{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(job).Column("job.id").Where("job.id = ? AND job.app_id = ?", jid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+
+	users := []model.ControlGroupUser{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&users).Where("job_id = ?", jid).Order("user_id").Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list job control group.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	rows := make([][]string, len(users))
+	for idx, user := range users {
+		rows[idx] = []string{user.UserID, user.Reason}
+	}
+	log.D(l, "Retrieved job control group successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("users", len(users)))
+	})
+	return writeCSV(c, fmt.Sprintf("job-%s-control-group.csv", jid.String()), []string{"userId", "reason"}, rows)
+}
+
+// GetAppHoldoutHandler is the method called when a get to /apps/:aid/holdout is called
+// it streams a csv with the users of the app holdout that were held out of at least one job
+func (a *Application) GetAppHoldoutHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "controlGroupHandler"),
+		zap.String("operation", "getAppHoldout"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+
+	// the holdout is written a page at a time so the whole holdout is never held in memory
+	getPage := func(after string) ([]string, error) {
+		var userIDs []string
+		err := WithSegment("db-select", c, func() error {
+			_, err := a.DB.Query(
+				&userIDs,
+				"SELECT user_id FROM app_holdout_users WHERE app_id = ? AND user_id > ? ORDER BY user_id LIMIT ?",
+				aid, after, appHoldoutPageSize,
+			)
+			return err
+		})
+		return userIDs, err
+	}
+	userIDs, err := getPage("")
+	if err != nil {
+		log.E(l, "Failed to list app holdout.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/csv")
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=app-%s-holdout.csv", aid.String()))
+	response.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(response)
+	writer.Write([]string{"userId"})
+	users := 0
+	for {
+		for _, userID := range userIDs {
+			writer.Write([]string{userID})
+		}
+		writer.Flush()
+		if err = writer.Error(); err != nil {
+			break
+		}
+		response.Flush()
+		users += len(userIDs)
+		if len(userIDs) < appHoldoutPageSize {
+			break
+		}
+		userIDs, err = getPage(userIDs[len(userIDs)-1])
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		// the status was already sent so the download is cut short
+		log.E(l, "Failed to write app holdout.", func(cm log.CM) {
+			cm.Write(zap.Int("users", users), zap.Error(err))
+		})
+		return err
+	}
+	log.D(l, "Retrieved app holdout successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("users", users))
+	})
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Control Group Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var job *model.Job
+
+	holdOut := func(job *model.Job, userID, reason string) {
+		err := app.DB.Insert(&model.ControlGroupUser{
+			JobID:  job.ID,
+			UserID: userID,
+			AppID:  job.AppID,
+			Reason: reason,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	holdOutOfApp := func(userID string) {
+		err := app.DB.Insert(&model.AppHoldoutUser{
+			AppID:  existingApp.ID,
+			UserID: userID,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+
+		existingApp = CreateTestApp(app.DB, map[string]interface{}{"holdout": 0.1})
+		template := CreateTestTemplate(app.DB, existingApp.ID)
+		job = CreateTestJob(app.DB, existingApp.ID, template.Name, map[string]interface{}{"controlGroup": 0.2})
+	})
+
+	Describe("Get /apps/:aid/jobs/:jid/control-group", func() {
+		It("should return 200 and a csv with the users of the job control group", func() {
+			holdOut(job, "user-2", model.JobControlGroupReason)
+			holdOut(job, "user-4", model.JobControlGroupReason)
+			holdOutOfApp("user-1")
+			anotherJob := CreateTestJob(app.DB, existingApp.ID, job.TemplateName)
+			holdOut(anotherJob, "user-3", model.JobControlGroupReason)
+
+			status, body := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/control-group", existingApp.ID, job.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(strings.Split(strings.TrimSpace(body), "\n")).To(Equal([]string{
+				"userId,reason",
+				"user-2,job",
+				"user-4,job",
+			}))
+		})
+
+		It("should return 200 and only the header if no user was held out", func() {
+			status, body := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/control-group", existingApp.ID, job.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(strings.TrimSpace(body)).To(Equal("userId,reason"))
+		})
+
+		It("should return 404 if the job is not from the app", func() {
+			status, _ := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/control-group", uuid.NewV4(), job.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+
+		It("should return 422 if the job id is not a uuid", func() {
+			status, _ := Get(app, fmt.Sprintf("/apps/%s/jobs/not-a-uuid/control-group", existingApp.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+
+	Describe("Get /apps/:aid/holdout", func() {
+		It("should return 200 and a csv with the users of the app holdout", func() {
+			holdOutOfApp("user-2")
+			holdOutOfApp("user-1")
+			holdOut(job, "user-3", model.JobControlGroupReason)
+			otherApp := CreateTestApp(app.DB, map[string]interface{}{"holdout": 0.1})
+			err := app.DB.Insert(&model.AppHoldoutUser{AppID: otherApp.ID, UserID: "user-4"})
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := Get(app, fmt.Sprintf("/apps/%s/holdout", existingApp.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(strings.Split(strings.TrimSpace(body), "\n")).To(Equal([]string{
+				"userId",
+				"user-1",
+				"user-2",
+			}))
+		})
+
+		It("should return all the users of a holdout bigger than a page", func() {
+			_, err := app.DB.Exec(
+				"INSERT INTO app_holdout_users (app_id, user_id, created_at) SELECT ?, 'user-' || lpad(i::text, 5, '0'), 0 FROM generate_series(1, 10001) AS i",
+				existingApp.ID,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := Get(app, fmt.Sprintf("/apps/%s/holdout", existingApp.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			lines := strings.Split(strings.TrimSpace(body), "\n")
+			Expect(lines).To(HaveLen(10002))
+			Expect(lines[1]).To(Equal("user-00001"))
+			Expect(lines[10001]).To(Equal("user-10001"))
+		})
+
+		It("should return 404 if the app does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("/apps/%s/holdout", uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
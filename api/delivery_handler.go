@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+// maxListedDeliveries is the max number of deliveries of a job returned at once, the most recent first
+const maxListedDeliveries = 1000
+
+// ListJobDeliveriesHandler is the method called when a get to /apps/:aid/jobs/:jid/deliveries is called
+// it lists the deliveries of the job kept in the delivery log, optionally of a single user
+func (a *Application) ListJobDeliveriesHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "deliveryHandler"),
+		zap.String("operation", "listJobDeliveries"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("jobId", c.Param("jid")),
+		zap.String("userId", c.QueryParam("userId")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	job := &model.Job{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(job).Column("job.id").Where("job.id = ? AND job.app_id = ?", jid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+
+	deliveries := []model.Delivery{}
+	query := a.DB.Model(&deliveries).Where("delivery.job_id = ?", jid)
+	if userID := c.QueryParam("userId"); userID != "" {
+		query.Where("delivery.user_id = ?", userID)
+	}
+	err = WithSegment("db-select", c, func() error {
+		return query.Order("delivery.produced_at DESC").Limit(maxListedDeliveries).Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list job deliveries.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed job deliveries successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("deliveries", len(deliveries)))
+	})
+	return c.JSON(http.StatusOK, deliveries)
+}
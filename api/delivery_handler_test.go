@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Delivery Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var existingJob *model.Job
+	var baseRoute string
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM deliveries;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+
+		existingApp = CreateTestApp(app.DB)
+		existingTemplate := CreateTestTemplate(app.DB, existingApp.ID)
+		existingJob = CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+		baseRoute = fmt.Sprintf("/apps/%s/jobs/%s/deliveries", existingApp.ID, existingJob.ID)
+	})
+
+	Describe("Get /apps/:aid/jobs/:jid/deliveries", func() {
+		BeforeEach(func() {
+			deliveries := []*model.Delivery{
+				model.NewDelivery(existingJob.ID, "user-1", "token-1", "muid-1"),
+				model.NewDelivery(existingJob.ID, "user-2", "token-2", "muid-2"),
+				model.NewDelivery(uuid.NewV4(), "user-1", "token-1", "muid-3"),
+			}
+			err := model.InsertDeliveries(app.DB, deliveries)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should return 200 and the deliveries of the job", func() {
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []model.Delivery
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+			for _, delivery := range response {
+				Expect(delivery.JobID).To(Equal(existingJob.ID))
+				Expect(delivery.Result).To(Equal(model.SentDeliveryResult))
+				Expect(delivery.TokenHash).To(Equal(model.HashToken(fmt.Sprintf("token-%s", delivery.UserID[5:]))))
+			}
+		})
+
+		It("should return 200 and the deliveries of the user in the job", func() {
+			status, body := Get(app, fmt.Sprintf("%s?userId=user-1", baseRoute), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []model.Delivery
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(1))
+			Expect(response[0].UserID).To(Equal("user-1"))
+			Expect(response[0].MUID).To(Equal("muid-1"))
+		})
+
+		It("should return 404 if the job is not of the app", func() {
+			anotherApp := CreateTestApp(app.DB)
+			route := fmt.Sprintf("/apps/%s/jobs/%s/deliveries", anotherApp.ID, existingJob.ID)
+			status, _ := Get(app, route, "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+
+		It("should return 422 if the job id is not a uuid", func() {
+			route := fmt.Sprintf("/apps/%s/jobs/not-uuid/deliveries", existingApp.ID)
+			status, _ := Get(app, route, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+})
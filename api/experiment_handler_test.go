@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Experiment Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var controlTemplate *model.Template
+	var variantTemplate *model.Template
+
+	getExperiment := func() map[string]interface{} {
+		return map[string]interface{}{
+			"variants": []map[string]interface{}{
+				{"name": "control", "templateName": controlTemplate.Name, "weight": 1},
+				{"name": "b", "templateName": variantTemplate.Name, "weight": 3},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+
+		existingApp = CreateTestApp(app.DB)
+		controlTemplate = CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"locale": "en"})
+		variantTemplate = CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"locale": "en"})
+	})
+
+	Describe("Post /apps/:aid/jobs with an experiment", func() {
+		It("should return 201 and create the job with the templates of the variants", func() {
+			payload := GetJobPayload()
+			payload["experiment"] = getExperiment()
+			pl, _ := json.Marshal(payload)
+			status, body := Post(app, fmt.Sprintf("/apps/%s/jobs", existingApp.ID), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+
+			var job model.Job
+			err := json.Unmarshal([]byte(body), &job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.TemplateName).To(Equal(strings.Join([]string{controlTemplate.Name, variantTemplate.Name}, ",")))
+
+			dbJob := &model.Job{ID: job.ID}
+			err = app.DB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.Experiment.Variants).To(HaveLen(2))
+			Expect(dbJob.Experiment.Variants[1].Weight).To(Equal(3))
+		})
+
+		It("should return 422 if the experiment has a single variant", func() {
+			experiment := getExperiment()
+			experiment["variants"] = experiment["variants"].([]map[string]interface{})[:1]
+			payload := GetJobPayload()
+			payload["experiment"] = experiment
+			pl, _ := json.Marshal(payload)
+			status, body := Post(app, fmt.Sprintf("/apps/%s/jobs", existingApp.ID), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			Expect(body).To(ContainSubstring("invalid experiment"))
+		})
+
+		It("should return 422 if a variant template does not exist", func() {
+			experiment := getExperiment()
+			experiment["variants"].([]map[string]interface{})[1]["templateName"] = "not-a-template"
+			payload := GetJobPayload()
+			payload["experiment"] = experiment
+			pl, _ := json.Marshal(payload)
+			status, _ := Post(app, fmt.Sprintf("/apps/%s/jobs", existingApp.ID), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+
+	Describe("Get /apps/:aid/jobs/:jid/experiment", func() {
+		var job *model.Job
+
+		BeforeEach(func() {
+			job = CreateTestJob(app.DB, existingApp.ID, fmt.Sprintf("%s,%s", controlTemplate.Name, variantTemplate.Name))
+			job.Experiment = &model.Experiment{
+				Variants: []*model.Variant{
+					{Name: "control", TemplateName: controlTemplate.Name, Weight: 1},
+					{Name: "b", TemplateName: variantTemplate.Name, Weight: 1},
+				},
+			}
+			err := app.DB.Update(job)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should return 200 and the conversion of each variant compared to the control", func() {
+			err := app.DB.Insert(&model.ExperimentVariant{JobID: job.ID, Name: "control", Sent: 1000, Delivered: 990, Opened: 100})
+			Expect(err).NotTo(HaveOccurred())
+			err = app.DB.Insert(&model.ExperimentVariant{JobID: job.ID, Name: "b", Sent: 1000, Delivered: 995, Failed: 5, Opened: 150})
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/experiment", existingApp.ID, job.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response struct {
+				JobID    uuid.UUID             `json:"jobId"`
+				Variants []model.VariantResult `json:"variants"`
+			}
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.JobID).To(Equal(job.ID))
+			Expect(response.Variants).To(HaveLen(2))
+
+			control := response.Variants[0]
+			Expect(control.Name).To(Equal("control"))
+			Expect(control.ConversionRate).To(BeNumerically("~", 0.1, 0.0001))
+			Expect(control.ConfidenceInterval[0]).To(BeNumerically("~", 0.0828, 0.001))
+			Expect(control.ConfidenceInterval[1]).To(BeNumerically("~", 0.1203, 0.001))
+			Expect(control.Significant).To(BeFalse())
+
+			variant := response.Variants[1]
+			Expect(variant.Name).To(Equal("b"))
+			Expect(variant.Failed).To(Equal(5))
+			Expect(variant.ConversionRate).To(BeNumerically("~", 0.15, 0.0001))
+			Expect(variant.Lift).To(BeNumerically("~", 0.5, 0.0001))
+			Expect(variant.PValue).To(BeNumerically("<", 0.001))
+			Expect(variant.Significant).To(BeTrue())
+		})
+
+		It("should return 200 and empty results if no push was sent yet", func() {
+			status, body := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/experiment", existingApp.ID, job.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response struct {
+				Variants []model.VariantResult `json:"variants"`
+			}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Variants).To(HaveLen(2))
+			for _, variant := range response.Variants {
+				Expect(variant.Sent).To(Equal(0))
+				Expect(variant.ConversionRate).To(Equal(0.0))
+				Expect(variant.PValue).To(Equal(1.0))
+			}
+		})
+
+		It("should return 200 and the results of all the jobs of the job group", func() {
+			groupID := uuid.NewV4()
+			anotherJob := CreateTestJob(app.DB, existingApp.ID, fmt.Sprintf("%s,%s", controlTemplate.Name, variantTemplate.Name))
+			anotherJob.Experiment = job.Experiment
+			Expect(app.DB.Update(anotherJob)).To(Succeed())
+			otherGroupJob := CreateTestJob(app.DB, existingApp.ID, fmt.Sprintf("%s,%s", controlTemplate.Name, variantTemplate.Name))
+			for _, j := range []*model.Job{job, anotherJob} {
+				_, err := app.DB.Model(j).Set("job_group_id = ?", groupID).Where("id = ?", j.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for _, counter := range []*model.ExperimentVariant{
+				{JobID: job.ID, Name: "control", Sent: 100, Delivered: 90, Opened: 10},
+				{JobID: job.ID, Name: "b", Sent: 100, Delivered: 100, Opened: 20},
+				{JobID: anotherJob.ID, Name: "control", Sent: 300, Delivered: 290, Failed: 10, Opened: 30},
+				{JobID: otherGroupJob.ID, Name: "b", Sent: 1000, Delivered: 1000, Opened: 1000},
+			} {
+				Expect(app.DB.Insert(counter)).To(Succeed())
+			}
+
+			status, body := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/experiment", existingApp.ID, anotherJob.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response struct {
+				Variants []model.VariantResult `json:"variants"`
+			}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Variants).To(HaveLen(2))
+			control := response.Variants[0]
+			Expect(control.Sent).To(Equal(400))
+			Expect(control.Delivered).To(Equal(380))
+			Expect(control.Failed).To(Equal(10))
+			Expect(control.Opened).To(Equal(40))
+			variant := response.Variants[1]
+			Expect(variant.Sent).To(Equal(100))
+			Expect(variant.Opened).To(Equal(20))
+		})
+
+		It("should return 404 if the job has no experiment", func() {
+			anotherJob := CreateTestJob(app.DB, existingApp.ID, controlTemplate.Name)
+			status, _ := Get(app, fmt.Sprintf("/apps/%s/jobs/%s/experiment", existingApp.ID, anotherJob.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
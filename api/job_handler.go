@@ -25,6 +25,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,12 +41,14 @@ import (
 )
 
 // ListJobsHandler is the method called when a get to /apps/:aid/templates/:templateName/jobs is called
+// the jobs can be filtered by template name and by segment
 func (a *Application) ListJobsHandler(c echo.Context) error {
 	l := a.Logger.With(
 		zap.String("source", "jobHandler"),
 		zap.String("operation", "listJobs"),
 		zap.String("appId", c.Param("aid")),
 		zap.String("template", c.QueryParam("template")),
+		zap.String("segment", c.QueryParam("segment")),
 	)
 	aid, err := uuid.FromString(c.Param("aid"))
 	if err != nil {
@@ -57,6 +60,13 @@ func (a *Application) ListJobsHandler(c echo.Context) error {
 	if templateName != "" {
 		query.Where("job.template_name = ?", templateName)
 	}
+	if segment := c.QueryParam("segment"); segment != "" {
+		sid, err := uuid.FromString(segment)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+		}
+		query.Where("job.segment_id = ?", sid)
+	}
 	err = WithSegment("db-select", c, func() error {
 		return query.Select()
 	})
@@ -66,12 +76,28 @@ func (a *Application) ListJobsHandler(c echo.Context) error {
 		})
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
 	}
+	for idx := range jobs {
+		jobs[idx].SetExpectedCompletedAt()
+	}
 	log.D(l, "Listed jobs successfully.", func(cm log.CM) {
 		cm.Write(zap.Object("jobs", jobs))
 	})
 	return c.JSON(http.StatusOK, jobs)
 }
 
+// withTimezones restricts the filter expression of a localized job to the users of the timezones
+func withTimezones(expression *model.FilterExpression, tzs []string) *model.FilterExpression {
+	values := make([]interface{}, len(tzs))
+	for i, tz := range tzs {
+		values[i] = tz
+	}
+	tzExpression := &model.FilterExpression{Column: "tz", Op: "in", Value: values}
+	if expression == nil {
+		return tzExpression
+	}
+	return &model.FilterExpression{And: []*model.FilterExpression{expression, tzExpression}}
+}
+
 // PostJobHandler is the method called when a post to /apps/:aid/templates/:templateName/jobs is called
 func (a *Application) PostJobHandler(c echo.Context) error {
 	l := a.Logger.With(
@@ -80,9 +106,91 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 		zap.String("appId", c.Param("aid")),
 		zap.String("template", c.QueryParam("template")),
 	)
+	job, skip, err := a.parseJob(l, c)
+	if err != nil || skip {
+		return err
+	}
+	app := &job.App
+	aid := job.AppID
+
+	err = WithSegment("create-job", c, func() error {
+		scheduleJob := job.StartsAt
+
+		jobGroup := model.JobGroup{
+			ID:    uuid.NewV4(),
+			AppID: app.ID,
+		}
+		err := WithSegment("create-group", c, func() error {
+			return a.DB.Insert(&jobGroup)
+		})
+		if err != nil {
+			return err
+		}
+		job.JobGroupID = jobGroup.ID
+
+		if scheduleJob == 0 || !job.Localized {
+			log.I(l, "Create a simple job.")
+			return a.createJob(job, c)
+		}
+
+		// create a job for each group of timezones of the users reaching the start time together
+		tzs, err := worker.GetJobTimezones(a.PushDB, worker.GetPushDBTableName(app.Name, job.Service), job)
+		if err != nil {
+			return err
+		}
+		expression := job.FilterExpression
+		audience := job.Audience
+		if job.Filters == nil {
+			job.Filters = map[string]interface{}{}
+		}
+		for _, send := range worker.GetLocalizedSends(tzs, scheduleJob, job.PastTimeStrategy, time.Now()) {
+			job.StartsAt = send.StartsAt
+			job.Filters["tz"] = strings.Join(send.Timezones, ",")
+			switch {
+			case audience != nil:
+				tzAudience := &model.Audience{FilterExpression: withTimezones(nil, send.Timezones)}
+				job.Audience = &model.Audience{Intersect: []*model.Audience{audience, tzAudience}}
+			case len(job.CSVPath) == 0:
+				job.FilterExpression = withTimezones(expression, send.Timezones)
+			}
+			job.ID = uuid.NewV4()
+			log.I(l, "Create a timezone job.")
+
+			err = a.createJob(job, c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.E(l, "Failed to send job to create_batches_worker.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
+	}
+
+	if a.SendgridClient != nil {
+		log.D(l, "sending email with job info")
+		app := &model.App{ID: aid}
+		a.DB.Select(&app)
+
+		err := email.SendCreatedJobEmail(a.SendgridClient, job, app)
+		if err != nil {
+			log.E(l, "Failed to send email with job info.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+		}
+		log.I(l, "Successfully sent email with job info.")
+	}
+	return c.JSON(http.StatusCreated, job)
+}
+
+func (a *Application) parseJob(l zap.Logger, c echo.Context) (*model.Job, bool, error) {
 	aid, err := uuid.FromString(c.Param("aid"))
 	if err != nil {
-		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
 	}
 
 	app := &model.App{ID: aid}
@@ -91,18 +199,15 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 	})
 	if err != nil {
 		if err.Error() == RecordNotFoundString {
-			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
+			return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
 		}
 		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
 			cm.Write(zap.Error(err))
 		})
-		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
+		return nil, true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
 	}
 
 	templateName := c.QueryParam("template")
-	if templateName == "" {
-		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "template name must be specified"})
-	}
 	userEmail := c.Get("user-email").(string)
 	job := &model.Job{
 		ID:           uuid.NewV4(),
@@ -118,94 +223,166 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 		return decodeAndValidate(c, job)
 	})
 	if err != nil {
-		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
 	}
 
-	skip, err := a.checkFilters(job, c)
+	// the templates of experiments are the ones of their variants
+	if job.Experiment != nil {
+		templateName = strings.Join(job.Experiment.TemplateNames(), ",")
+		job.TemplateName = templateName
+	}
+	if templateName == "" {
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "template name must be specified"})
+	}
+
+	skip, err := a.applySegment(job, c)
 	if err != nil || skip {
-		return err
+		return nil, true, err
+	}
+
+	skip, err = a.checkFilters(job, c)
+	if err != nil || skip {
+		return nil, true, err
+	}
+
+	skip, err = a.checkAudience(job, c)
+	if err != nil || skip {
+		return nil, true, err
 	}
 
 	skip, err = a.checkTemplateName(templateName, job, c)
 	if err != nil || skip {
-		return err
+		return nil, true, err
 	}
 
 	if job.StartsAt == 0 && job.Localized {
 		localeErr := "Job can not be localized and don't have an start time"
-		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: localeErr, Value: job})
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: localeErr, Value: job})
 	}
+	return job, false, nil
+}
 
-	err = WithSegment("create-job", c, func() error {
-		scheduleJob := job.StartsAt
-
-		jobGroup := model.JobGroup{
-			ID:    uuid.NewV4(),
-			AppID: app.ID,
-		}
-		err := WithSegment("create-group", c, func() error {
-			return a.DB.Insert(&jobGroup)
-		})
-		if err != nil {
-			return err
+// PreviewJobHandler is the method called when a post to /apps/:aid/jobs/preview is called
+// it renders the job pushes for a sample of its users without creating the job
+func (a *Application) PreviewJobHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "jobHandler"),
+		zap.String("operation", "previewJob"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("template", c.QueryParam("template")),
+	)
+	sampleSize := a.Config.GetInt("api.preview.defaultSampleSize")
+	if sample := c.QueryParam("sample"); sample != "" {
+		var err error
+		sampleSize, err = strconv.Atoi(sample)
+		if err != nil || sampleSize <= 0 || sampleSize > a.Config.GetInt("api.preview.maxSampleSize") {
+			reason := fmt.Sprintf("sample must be between 1 and %d", a.Config.GetInt("api.preview.maxSampleSize"))
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: reason})
 		}
-		job.JobGroupID = jobGroup.ID
+	}
 
-		if scheduleJob == 0 || !job.Localized {
-			log.I(l, "Create a simple job.")
-			return a.createJob(job, c)
-		}
+	job, skip, err := a.parseJob(l, c)
+	if err != nil || skip {
+		return err
+	}
 
-		// create a job for each tz
-		for i := -12; i <= 14; i++ {
-			tzs := []string{
-				fmt.Sprintf("%+.4d", i*100-55), // 100 - 55 = 45
-				fmt.Sprintf("%+.4d", i*100),
-				fmt.Sprintf("%+.4d", i*100+15),
-				fmt.Sprintf("%+.4d", i*100+30),
-			}
-			sendTime := time.Unix(0, scheduleJob).Add(time.Duration(i) * time.Hour)
-			if sendTime.Before(time.Now()) {
-				if job.PastTimeStrategy == "skip" {
-					continue
+	var templatesByNameAndLocale map[string]map[string]model.Template
+	err = WithSegment("db-select", c, func() error {
+		templatesByNameAndLocale, err = job.GetJobTemplatesByNameAndLocale(a.DB)
+		return err
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
+	}
+
+	preview := &worker.JobPreview{}
+	var users []worker.User
+	if job.Audience != nil || len(job.CSVPath) > 0 {
+		var userIDs []string
+		err = WithSegment("s3-get", c, func() error {
+			if job.Audience != nil {
+				tableName := worker.GetPushDBTableName(job.App.Name, job.Service)
+				steps, err := worker.ResolveAudience(a.PushDB, a.S3Client, tableName, job.Audience, func(page []string) (bool, error) {
+					userIDs = append(userIDs, page...)
+					return len(userIDs) < sampleSize, nil
+				})
+				if err != nil {
+					return err
 				}
-				sendTime = sendTime.Add(time.Duration(24) * time.Hour)
+				preview.EstimatedAudienceSize = steps[0].Count
+				return nil
 			}
-
-			job.StartsAt = sendTime.UnixNano()
-			job.Filters["tz"] = strings.Join(tzs, ",")
-			job.ID = uuid.NewV4()
-			log.I(l, "Create a timezone job.")
-
-			err = a.createJob(job, c)
+			csv, err := a.S3Client.GetObject(job.CSVPath)
 			if err != nil {
 				return err
 			}
+			userIDs, err = worker.ParseCSVUserIDs(csv)
+			preview.EstimatedAudienceSize = len(userIDs)
+			return err
+		})
+		if err != nil {
+			log.E(l, "Failed to read job users.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
 		}
-		return nil
-	})
-
+		if len(userIDs) > sampleSize {
+			userIDs = userIDs[:sampleSize]
+		}
+		err = WithSegment("push-db-select", c, func() error {
+			users, err = worker.GetUsersByIDs(a.PushDB, job, userIDs)
+			return err
+		})
+	} else {
+		err = WithSegment("push-db-select", c, func() error {
+			tableName := worker.GetPushDBTableName(job.App.Name, job.Service)
+			audience, err := worker.EstimateAudience(a.PushDB, tableName, job.FilterExpression, a.Config.GetInt("api.audience.sampleThreshold"))
+			if err != nil {
+				return err
+			}
+			preview.EstimatedAudienceSize = audience.Total
+			users, err = worker.SampleUsers(a.PushDB, job, sampleSize)
+			return err
+		})
+	}
 	if err != nil {
-		log.E(l, "Failed to send job to create_batches_worker.", func(cm log.CM) {
+		log.E(l, "Failed to retrieve users from push db.", func(cm log.CM) {
 			cm.Write(zap.Error(err))
 		})
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 	}
 
-	if a.SendgridClient != nil {
-		log.D(l, "sending email with job info")
-		app := &model.App{ID: aid}
-		a.DB.Select(&app)
+	preview.Messages, err = worker.PreviewJob(job, templatesByNameAndLocale, users)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+	}
+	log.D(l, "Previewed job successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("estimatedAudienceSize", preview.EstimatedAudienceSize))
+	})
+	return c.JSON(http.StatusOK, preview)
+}
 
-		err := email.SendCreatedJobEmail(a.SendgridClient, job, app)
-		if err != nil {
-			log.E(l, "Failed to send email with job info.", func(cm log.CM) {
-				cm.Write(zap.Error(err))
-			})
+// applySegment copies the filter expression or the csv of the segment targeted by the job
+func (a *Application) applySegment(job *model.Job, c echo.Context) (bool, error) {
+	if job.SegmentID == uuid.Nil {
+		return false, nil
+	}
+	segment := &model.Segment{}
+	err := WithSegment("db-select", c, func() error {
+		return a.DB.Model(&segment).Where("id = ? AND app_id = ?", job.SegmentID, job.AppID).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "segment does not exist", Value: job})
 		}
-		log.I(l, "Successfully sent email with job info.")
+		return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 	}
-	return c.JSON(http.StatusCreated, job)
+	if segment.Service != job.Service {
+		return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "segment service must be the same of the job", Value: job})
+	}
+	job.FilterExpression = segment.FilterExpression
+	job.CSVPath = segment.CSVPath
+	return false, nil
 }
 
 func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error) {
@@ -229,7 +406,7 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 			"isLowerCase": strings.ToLower(region) == region,
 		}
 
-		if job.Filters["locale"] != nil {
+		if _, ok := job.Filters["locale"].(string); ok {
 			if localeSettings["isUpperCase"] && !localeSettings["isLowerCase"] {
 				job.Filters["locale"] = strings.ToUpper(job.Filters["locale"].(string))
 			} else if localeSettings["isLowerCase"] && !localeSettings["isUpperCase"] {
@@ -239,7 +416,7 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 			}
 		}
 
-		if job.Filters["NOTlocale"] != nil {
+		if _, ok := job.Filters["NOTlocale"].(string); ok {
 			if localeSettings["isUpperCase"] && !localeSettings["isLowerCase"] {
 				job.Filters["NOTlocale"] = strings.ToUpper(job.Filters["NOTlocale"].(string))
 			} else if localeSettings["isLowerCase"] && !localeSettings["isUpperCase"] {
@@ -249,7 +426,7 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 			}
 		}
 
-		if job.Filters["region"] != nil {
+		if _, ok := job.Filters["region"].(string); ok {
 			if regionSettings["isUpperCase"] && !regionSettings["isLowerCase"] {
 				job.Filters["region"] = strings.ToUpper(job.Filters["region"].(string))
 			} else if regionSettings["isLowerCase"] && !regionSettings["isUpperCase"] {
@@ -259,7 +436,7 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 			}
 		}
 
-		if job.Filters["NOTregion"] != nil {
+		if _, ok := job.Filters["NOTregion"].(string); ok {
 			if regionSettings["isUpperCase"] && !regionSettings["isLowerCase"] {
 				job.Filters["NOTregion"] = strings.ToUpper(job.Filters["NOTregion"].(string))
 			} else if regionSettings["isLowerCase"] && !regionSettings["isUpperCase"] {
@@ -269,6 +446,50 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 			}
 		}
 	}
+
+	// the flat filters are kept as sent but the workers use the expression
+	if job.FilterExpression == nil && len(job.Filters) > 0 {
+		expression, err := model.NewFilterExpressionFromFilters(job.Filters)
+		if err != nil {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+		}
+		job.FilterExpression = expression
+	}
+
+	if job.FilterExpression != nil {
+		columns, err := worker.GetPushDBColumns(a.PushDB, worker.GetPushDBTableName(job.App.Name, job.Service))
+		if err != nil {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+		}
+		_, err = worker.BuildFilterQuery(job.FilterExpression, columns)
+		if err != nil {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+		}
+	}
+	return false, nil
+}
+
+// checkAudience checks the columns of the filter expressions of the audience of the job
+func (a *Application) checkAudience(job *model.Job, c echo.Context) (bool, error) {
+	if job.Audience == nil {
+		return false, nil
+	}
+	columns, err := worker.GetPushDBColumns(a.PushDB, worker.GetPushDBTableName(job.App.Name, job.Service))
+	if err != nil {
+		return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+	}
+	nodes := []*model.Audience{job.Audience}
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = append(nodes[1:], node.Children()...)
+		if node.FilterExpression == nil {
+			continue
+		}
+		_, err = worker.BuildFilterQuery(node.FilterExpression, columns)
+		if err != nil {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
+		}
+	}
 	return false, nil
 }
 
@@ -295,26 +516,23 @@ func (a *Application) checkTemplateName(templateName string, job *model.Job, c e
 			}
 			return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 		}
-	}
-	return false, nil
-}
 
-func (a *Application) createJobWorkers(job *model.Job, c echo.Context) error {
-	var err error
-	if job.StartsAt != 0 {
-		if len(job.CSVPath) > 0 {
-			_, err = a.Worker.ScheduleCSVSplitJob(job, job.StartsAt)
-		} else {
-			err = a.Worker.ScheduleDirectBatchesJob(job, job.StartsAt)
+		templates := []model.Template{}
+		err = WithSegment("db-select", c, func() error {
+			return a.DB.Model(&templates).Column("template.*").Where("template.app_id = ?", job.AppID).Where("template.name = ?", tpl).Select()
+		})
+		if err != nil {
+			return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 		}
-	} else {
-		if len(job.CSVPath) > 0 {
-			_, err = a.Worker.CreateCSVSplitJob(job)
-		} else {
-			err = a.Worker.CreateDirectBatchesJob(job)
+		for _, t := range templates {
+			err = worker.ValidatePushOptions(job, t)
+			if err != nil {
+				reason := fmt.Sprintf("invalid push options for template %s and locale %s: %s", t.Name, t.Locale, err.Error())
+				return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: reason, Value: job})
+			}
 		}
 	}
-	return err
+	return false, nil
 }
 
 func (a *Application) createJob(job *model.Job, c echo.Context) error {
@@ -331,7 +549,7 @@ func (a *Application) createJob(job *model.Job, c echo.Context) error {
 		}
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 	}
-	a.createJobWorkers(job, c)
+	a.Worker.StartJob(job)
 
 	return nil
 }
@@ -369,6 +587,7 @@ func (a *Application) GetJobHandler(c echo.Context) error {
 		})
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 	}
+	job.SetExpectedCompletedAt()
 	log.D(l, "Retrieved job successfully.", func(cm log.CM) {
 		cm.Write(zap.Object("job", job))
 	})
@@ -29,6 +29,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
 	"github.com/topfreegames/marathon/model"
 	. "github.com/topfreegames/marathon/testing"
 	"github.com/topfreegames/marathon/worker"
@@ -260,6 +261,57 @@ var _ = Describe("Job Handler", func() {
 				}
 			})
 
+			It("should return 201 and the created job with a filter expression", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				delete(payload, "filters")
+				payload["filterExpression"] = map[string]interface{}{
+					"or": []interface{}{
+						map[string]interface{}{"column": "locale", "op": "eq", "value": "pt"},
+						map[string]interface{}{"not": map[string]interface{}{"column": "region", "op": "in", "value": []interface{}{"BR", "US"}}},
+					},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var job map[string]interface{}
+				err := json.Unmarshal([]byte(body), &job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(job["filterExpression"]).To(Equal(payload["filterExpression"]))
+
+				id, err := uuid.FromString(job["id"].(string))
+				Expect(err).NotTo(HaveOccurred())
+				dbJob := &model.Job{ID: id}
+				err = app.DB.Select(&dbJob)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dbJob.FilterExpression.Or).To(HaveLen(2))
+				Expect(dbJob.FilterExpression.Or[1].Not.Column).To(Equal("region"))
+			})
+
+			It("should return 201 and store the flat filters converted to a filter expression", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				payload["filters"] = map[string]interface{}{
+					"locale":    "pt",
+					"NOTregion": "US,CA",
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var job map[string]interface{}
+				err := json.Unmarshal([]byte(body), &job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(job["filters"]).To(Equal(payload["filters"]))
+				Expect(job["filterExpression"]).To(Equal(map[string]interface{}{
+					"and": []interface{}{
+						map[string]interface{}{"column": "region", "op": "notIn", "value": []interface{}{"US", "CA"}},
+						map[string]interface{}{"column": "locale", "op": "eq", "value": "pt"},
+					},
+				}))
+			})
+
 			It("should return 201 and the created job with filter converting filters to the correct case", func() {
 				payload := GetJobPayload()
 				payload["service"] = "gcm"
@@ -337,6 +389,7 @@ var _ = Describe("Job Handler", func() {
 				payload := GetJobPayload()
 				payload["startsAt"] = time.Now().Add(1 * time.Hour).UnixNano()
 				payload["localized"] = true
+				payload["filters"] = map[string]interface{}{"locale": "en"}
 				delete(payload, "csvPath")
 				pl, _ := json.Marshal(payload)
 				status, body := Post(app, baseRoute, string(pl), "success@test.com")
@@ -354,7 +407,35 @@ var _ = Describe("Job Handler", func() {
 				err = app.DB.Select(&dbJob)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(dbJob.Localized).To(Equal(true))
+				Expect(dbJob.FilterExpression.And).To(HaveLen(2))
+				Expect(dbJob.FilterExpression.And[1].Column).To(Equal("tz"))
+				Expect(dbJob.FilterExpression.And[1].Value).To(ContainElement(dbJob.Filters["tz"].(string)))
+				Expect(dbJob.StartsAt).To(Equal(payload["startsAt"].(int64) + int64(5*time.Hour)))
+			})
+
+			It("should create a localized job for each timezone of the job users", func() {
+				startsAt := time.Now().Add(1 * time.Hour).UnixNano()
+				payload := GetJobPayload()
+				payload["startsAt"] = startsAt
+				payload["localized"] = true
+				payload["filters"] = map[string]interface{}{"locale": "en"}
+				delete(payload, "csvPath")
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
 
+				var job map[string]interface{}
+				err := json.Unmarshal([]byte(body), &job)
+				Expect(err).NotTo(HaveOccurred())
+
+				var jobs []model.Job
+				err = app.DB.Model(&jobs).Where("job_group_id = ?", job["jobGroupId"]).Order("starts_at").Select()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(jobs).To(HaveLen(2))
+				Expect(jobs[0].Filters["tz"]).To(Equal("-0300"))
+				Expect(jobs[0].StartsAt).To(Equal(startsAt + int64(3*time.Hour)))
+				Expect(jobs[1].Filters["tz"]).To(Equal("-0500"))
+				Expect(jobs[1].StartsAt).To(Equal(startsAt + int64(5*time.Hour)))
 			})
 
 			It("should return 201 and the created job with control group set to value between 0.0 and 1.0", func() {
@@ -687,7 +768,7 @@ var _ = Describe("Job Handler", func() {
 
 				res, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(res)).To(BeEquivalentTo(27))
+				Expect(len(res)).To(BeEquivalentTo(3))
 				res1, err := w.RedisClient.LLen("queue:csv_split_worker").Result()
 				Expect(err).NotTo(HaveOccurred())
 				Expect(res1).To(BeEquivalentTo(0))
@@ -710,7 +791,7 @@ var _ = Describe("Job Handler", func() {
 
 				res, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(res)).To(BeEquivalentTo(15))
+				Expect(len(res)).To(BeEquivalentTo(3))
 				res1, err := w.RedisClient.LLen("queue:csv_split_worker").Result()
 				Expect(err).NotTo(HaveOccurred())
 				Expect(res1).To(BeEquivalentTo(0))
@@ -732,13 +813,13 @@ var _ = Describe("Job Handler", func() {
 
 				res, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(res)).To(BeEquivalentTo(27))
+				Expect(len(res)).To(BeEquivalentTo(3))
 				var result map[string]interface{}
-				err = json.Unmarshal([]byte(res[26]), &result)
+				err = json.Unmarshal([]byte(res[2]), &result)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(result["queue"]).To(Equal("csv_split_worker"))
 				Expect(result["args"].(string)).To(Equal(job["id"]))
-				Expect(result["at"].(float64)).To(Equal(float64(payload["startsAt"].(int64))/1000000000.0 + 14*60*60.0))
+				Expect(result["at"].(float64)).To(Equal(float64(payload["startsAt"].(int64))/1000000000.0 + 8*60*60.0))
 
 				res1, err := w.RedisClient.LLen("queue:csv_split_worker").Result()
 				Expect(err).NotTo(HaveOccurred())
@@ -773,6 +854,62 @@ var _ = Describe("Job Handler", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(res1).To(BeEquivalentTo(0))
 			})
+
+			It("should create audience worker job if the audience has csv files", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				delete(payload, "startsAt")
+				delete(payload, "filters")
+				payload["audience"] = map[string]interface{}{
+					"subtract": []interface{}{
+						map[string]interface{}{"filterExpression": map[string]interface{}{"column": "region", "op": "eq", "value": "BR"}},
+						map[string]interface{}{"csvPath": "test/suppressed.csv"},
+					},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var job map[string]interface{}
+				err := json.Unmarshal([]byte(body), &job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(job["audience"]).To(Equal(payload["audience"]))
+
+				res, err := w.RedisClient.LPop("queue:audience_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				var result map[string]interface{}
+				err = json.Unmarshal([]byte(res), &result)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result["args"].(string)).To(Equal(job["id"]))
+
+				res1, err := w.RedisClient.LLen("queue:direct_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res1).To(BeEquivalentTo(0))
+			})
+
+			It("should create direct worker jobs if the audience has only filters", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				delete(payload, "startsAt")
+				delete(payload, "filters")
+				payload["audience"] = map[string]interface{}{
+					"union": []interface{}{
+						map[string]interface{}{"filterExpression": map[string]interface{}{"column": "locale", "op": "eq", "value": "pt"}},
+						map[string]interface{}{"filterExpression": map[string]interface{}{"column": "locale", "op": "eq", "value": "en"}},
+					},
+				}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				res, err := w.RedisClient.LLen("queue:direct_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res).To(BeNumerically(">", 0))
+
+				res1, err := w.RedisClient.LLen("queue:audience_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res1).To(BeEquivalentTo(0))
+			})
 		})
 
 		Describe("Unsucesfully", func() {
@@ -793,6 +930,124 @@ var _ = Describe("Job Handler", func() {
 				app.DB = goodDB
 			})
 
+			It("should return 422 if a filter column does not exist in push db", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				payload["filters"] = map[string]interface{}{
+					`locale"='en' OR "region`: "BR",
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("unknown column"))
+			})
+
+			It("should return 422 if both filters and filter expression are given", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				payload["filters"] = map[string]interface{}{"locale": "pt"}
+				payload["filterExpression"] = map[string]interface{}{"column": "locale", "op": "eq", "value": "pt"}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the filter expression is invalid", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				delete(payload, "filters")
+				payload["filterExpression"] = map[string]interface{}{
+					"and": []interface{}{
+						map[string]interface{}{"column": "locale", "op": "eq", "value": "pt", "or": []interface{}{}},
+					},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("filterExpression"))
+			})
+
+			It("should return 422 if the quiet hours are invalid", func() {
+				payload := GetJobPayload()
+				payload["quietHours"] = map[string]interface{}{"start": "22:00", "end": "8h"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("quietHours"))
+			})
+
+			It("should return 422 if the optimal send time strategy is used with a localized job", func() {
+				payload := GetJobPayload()
+				payload["localized"] = true
+				payload["sendTimeStrategy"] = "optimal"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("sendTimeStrategy"))
+			})
+
+			It("should return 422 if both audience and filters are given", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				payload["filters"] = map[string]interface{}{"locale": "pt"}
+				payload["audience"] = map[string]interface{}{"csvPath": "test/suppressed.csv"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("audience cannot be used with filters"))
+			})
+
+			It("should return 422 if an audience filter column does not exist in push db", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				delete(payload, "filters")
+				payload["audience"] = map[string]interface{}{
+					"intersect": []interface{}{
+						map[string]interface{}{"csvPath": "test/suppressed.csv"},
+						map[string]interface{}{"filterExpression": map[string]interface{}{"column": "unknown", "op": "eq", "value": "pt"}},
+					},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("unknown column"))
+			})
+
+			It("should return 422 if a filter operator is invalid", func() {
+				payload := GetJobPayload()
+				delete(payload, "csvPath")
+				payload["filters"] = map[string]interface{}{
+					"created_at": map[string]interface{}{"between": "2019-01-01"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
 			It("should return 422 if app id is not UUID", func() {
 				payload := GetJobPayload()
 				pl, _ := json.Marshal(payload)
@@ -1000,6 +1255,110 @@ var _ = Describe("Job Handler", func() {
 		})
 	})
 
+	Describe("Post /apps/:id/jobs/preview?template=:templateName", func() {
+		var previewRoute string
+
+		BeforeEach(func() {
+			previewRoute = fmt.Sprintf("/apps/%s/jobs/preview?template=%s", existingApp.ID, existingTemplate.Name)
+			CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{
+				"name":   existingTemplate.Name,
+				"locale": "pt",
+				"body":   map[string]interface{}{"alert": "{{name}} ganhou!"},
+			})
+		})
+
+		Describe("Sucesfully", func() {
+			It("should return 200 and the rendered messages of users matching the filters", func() {
+				payload := GetJobPayload(map[string]interface{}{
+					"filters": map[string]interface{}{"locale": "pt"},
+					"context": map[string]interface{}{"name": "Someone"},
+				})
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, fmt.Sprintf("%s&sample=2", previewRoute), string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var preview worker.JobPreview
+				err := json.Unmarshal([]byte(body), &preview)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(preview.EstimatedAudienceSize).To(Equal(6))
+				Expect(preview.Messages).To(HaveLen(2))
+				for _, msg := range preview.Messages {
+					Expect(msg.Locale).To(Equal("pt"))
+					Expect(msg.TemplateName).To(Equal(existingTemplate.Name))
+
+					var apnsMessage messages.APNSMessage
+					err = json.Unmarshal(msg.Message, &apnsMessage)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(apnsMessage.DeviceToken).NotTo(BeEmpty())
+					Expect(apnsMessage.Payload.Aps["alert"]).To(Equal("Someone ganhou!"))
+					Expect(apnsMessage.Metadata["userId"]).To(Equal(msg.UserID))
+				}
+
+				var jobs []model.Job
+				err = app.DB.Model(&jobs).Where("app_id = ?", existingApp.ID).Select()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(jobs).To(BeEmpty())
+			})
+
+			It("should return 200 and the rendered messages of users in the csv", func() {
+				fakeS3 := NewFakeS3(app.Config)
+				s3Client := app.S3Client
+				app.S3Client = fakeS3
+				defer func() { app.S3Client = s3Client }()
+				csv := []byte("userIds\n9e558649-9c23-469d-a11c-59b05813e3d5\n57be9009-e616-42c6-9cfe-505508ede2d0\n")
+				_, err := fakeS3.PutObject("test/jobs/preview.csv", &csv)
+				Expect(err).NotTo(HaveOccurred())
+
+				payload := GetJobPayload(map[string]interface{}{
+					"csvPath": "test/jobs/preview.csv",
+				})
+				delete(payload, "filters")
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, previewRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var preview worker.JobPreview
+				err = json.Unmarshal([]byte(body), &preview)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(preview.EstimatedAudienceSize).To(Equal(2))
+				Expect(preview.Messages).To(HaveLen(2))
+				locales := []string{preview.Messages[0].Locale, preview.Messages[1].Locale}
+				Expect(locales).To(ConsistOf("pt", "en"))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if sample is invalid", func() {
+				payload := GetJobPayload()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, fmt.Sprintf("%s&sample=1000", previewRoute), string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the job is invalid", func() {
+				payload := GetJobPayload(map[string]interface{}{
+					"service": "blabla",
+				})
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, previewRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the csv does not exist", func() {
+				s3Client := app.S3Client
+				app.S3Client = NewFakeS3(app.Config)
+				defer func() { app.S3Client = s3Client }()
+				payload := GetJobPayload(map[string]interface{}{
+					"csvPath": "test/jobs/unexistent.csv",
+				})
+				delete(payload, "filters")
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, previewRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+	})
+
 	Describe("Get /apps/:id/jobs/:jid", func() {
 		Describe("Sucesfully", func() {
 			It("should return 200 and the requested job", func() {
@@ -1040,6 +1399,27 @@ var _ = Describe("Job Handler", func() {
 				for key := range plMetadata {
 					Expect(tempMetadata[key]).To(Equal(plMetadata[key]))
 				}
+				Expect(job["expectedCompletedAt"]).To(BeEquivalentTo(0))
+			})
+
+			It("should return the expected completion time if the job is rate limited", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+					"rateLimit": 10,
+					"startsAt":  int64(0),
+				})
+				_, err := app.DB.Model(&model.Job{}).Set("total_tokens = 100").Set("completed_tokens = 50").Where("id = ?", existingJob.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+				before := time.Now().UnixNano()
+				status, body := Get(app, fmt.Sprintf("%s/%s", baseRouteWithoutTemplate, existingJob.ID), "success@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var job map[string]interface{}
+				err = json.Unmarshal([]byte(body), &job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(job["rateLimit"]).To(BeEquivalentTo(10))
+				expected := int64(job["expectedCompletedAt"].(float64))
+				Expect(expected).To(BeNumerically(">=", before+int64(5*time.Second)))
+				Expect(expected).To(BeNumerically("<=", time.Now().UnixNano()+int64(5*time.Second)))
 			})
 		})
 
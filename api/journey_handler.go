@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5/types"
+)
+
+// ListJourneysHandler is the method called when a get to /apps/:aid/journeys is called
+func (a *Application) ListJourneysHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "journeyHandler"),
+		zap.String("operation", "listJourneys"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	journeys := []model.Journey{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&journeys).Where("app_id = ?", aid).Order("created_at DESC").Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list journeys.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed journeys successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("journeys", journeys))
+	})
+	return c.JSON(http.StatusOK, journeys)
+}
+
+// PostJourneyHandler is the method called when a post to /apps/:aid/journeys is called
+// the job of each step is checked like the jobs created directly and the first step is scheduled
+func (a *Application) PostJourneyHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "journeyHandler"),
+		zap.String("operation", "postJourney"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
+	}
+
+	email := c.Get("user-email").(string)
+	journey := &model.Journey{
+		CreatedBy: email,
+		CreatedAt: time.Now().UnixNano(),
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, journey)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: journey})
+	}
+	journey.ID = uuid.NewV4()
+	journey.AppID = aid
+	journey.Status = model.ActiveJourneyStatus
+	journey.CurrentStep = 0
+	if journey.Filters == nil {
+		journey.Filters = map[string]interface{}{}
+	}
+	for _, step := range journey.Steps {
+		if step.Context == nil {
+			step.Context = map[string]interface{}{}
+		}
+		if step.Metadata == nil {
+			step.Metadata = map[string]interface{}{}
+		}
+	}
+
+	job := journey.NewJob(0, 0)
+	job.App = *app
+	skip, err := a.applySegment(job, c)
+	if err != nil || skip {
+		return err
+	}
+	skip, err = a.checkFilters(job, c)
+	if err != nil || skip {
+		return err
+	}
+	for _, step := range journey.Steps {
+		skip, err = a.checkTemplateName(step.TemplateName, job, c)
+		if err != nil || skip {
+			return err
+		}
+	}
+	// the segment and the normalized filters are kept as the jobs created directly keep them
+	journey.Filters = job.Filters
+	journey.FilterExpression = job.FilterExpression
+	journey.CSVPath = job.CSVPath
+
+	startsAt := journey.StartsAt
+	if startsAt == 0 {
+		startsAt = time.Now().UnixNano()
+	}
+	err = WithSegment("create-journey", c, func() error {
+		err := WithSegment("db-insert", c, func() error {
+			return a.DB.Insert(&journey)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = a.Worker.ScheduleJourneyJob(journey, 0, startsAt)
+		return err
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: journey})
+		}
+		log.E(l, "Failed to create journey.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: journey})
+	}
+	log.D(l, "Created journey successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("journey", journey))
+	})
+	return c.JSON(http.StatusCreated, journey)
+}
+
+// getJourney retrieves the journey of the :aid and :jid params
+func (a *Application) getJourney(l zap.Logger, c echo.Context) (*model.Journey, bool, error) {
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	journey := &model.Journey{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&journey).Where("id = ? AND app_id = ?", jid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return nil, true, c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve journey.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return nil, true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return journey, false, nil
+}
+
+// GetJourneyHandler is the method called when a get to /apps/:aid/journeys/:jid is called
+// the journey is returned with the funnel of its steps
+func (a *Application) GetJourneyHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "journeyHandler"),
+		zap.String("operation", "getJourney"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("journeyId", c.Param("jid")),
+	)
+	journey, skip, err := a.getJourney(l, c)
+	if err != nil || skip {
+		return err
+	}
+	err = WithSegment("db-select", c, func() error {
+		return journey.LoadFunnel(a.DB)
+	})
+	if err != nil {
+		log.E(l, "Failed to retrieve journey funnel.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return c.JSON(http.StatusOK, journey)
+}
+
+// StopJourneyHandler is the method called when a put to /apps/:aid/journeys/:jid/stop is called
+// stopped journeys create no more step jobs, the jobs already created are not changed
+func (a *Application) StopJourneyHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "journeyHandler"),
+		zap.String("operation", "stopJourney"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("journeyId", c.Param("jid")),
+	)
+	journey, skip, err := a.getJourney(l, c)
+	if err != nil || skip {
+		return err
+	}
+	if journey.Status != model.ActiveJourneyStatus {
+		return c.JSON(http.StatusForbidden, &Error{Reason: fmt.Sprintf("cannot stop %s journey", journey.Status)})
+	}
+	journey.Status = model.StoppedJourneyStatus
+	journey.UpdatedAt = time.Now().UnixNano()
+	err = WithSegment("db-update", c, func() error {
+		_, err := a.DB.Model(&journey).Column("status").Column("updated_at").Returning("*").Update()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to update journey.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: journey})
+	}
+	log.D(l, "Stopped journey successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("journey", journey))
+	})
+	return c.JSON(http.StatusOK, journey)
+}
+
+// DeleteJourneyHandler is the method called when a delete to /apps/:aid/journeys/:jid is called
+// the jobs already created by the journey are kept
+func (a *Application) DeleteJourneyHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "journeyHandler"),
+		zap.String("operation", "deleteJourney"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("journeyId", c.Param("jid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	journey := &model.Journey{}
+	var res *types.Result
+	err = WithSegment("db-delete", c, func() error {
+		res, err = a.DB.Model(&journey).Where("id = ? AND app_id = ?", jid, aid).Delete()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to delete journey.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	if res.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Deleted journey successfully.", func(cm log.CM) {
+		cm.Write(zap.String("journeyId", jid.String()))
+	})
+	return c.JSON(http.StatusNoContent, "")
+}
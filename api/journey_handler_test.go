@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Journey Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var existingTemplates []*model.Template
+	var templateNames []string
+	var baseRoute string
+
+	w := worker.NewWorker(logger, GetConfPath())
+
+	getJourneyPayload := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name":    "onboarding",
+			"service": "apns",
+			"filters": map[string]interface{}{"locale": "en"},
+			"steps": []map[string]interface{}{
+				{
+					"templateName": existingTemplates[0].Name,
+					"context":      map[string]interface{}{"value": "welcome"},
+				},
+				{
+					"templateName": existingTemplates[1].Name,
+					"delay":        24,
+					"condition":    model.NotOpenedJourneyCondition,
+				},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM journeys;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		w.RedisClient.FlushAll()
+
+		existingApp = CreateTestApp(app.DB)
+		existingTemplates = []*model.Template{
+			CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"locale": "en"}),
+			CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"locale": "en"}),
+		}
+		templateNames = []string{existingTemplates[0].Name, existingTemplates[1].Name}
+		baseRoute = fmt.Sprintf("/apps/%s/journeys", existingApp.ID)
+	})
+
+	Describe("Get /apps/:aid/journeys", func() {
+		It("should return 200 and the journeys of the app", func() {
+			CreateTestJourney(app.DB, existingApp.ID, templateNames)
+			CreateTestJourney(app.DB, existingApp.ID, templateNames)
+			anotherApp := CreateTestApp(app.DB)
+			CreateTestJourney(app.DB, anotherApp.ID, templateNames)
+
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+		})
+	})
+
+	Describe("Post /apps/:aid/journeys", func() {
+		Describe("Sucesfully", func() {
+			It("should return 201 and schedule the first step of the journey", func() {
+				pl, _ := json.Marshal(getJourneyPayload())
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var journey model.Journey
+				err := json.Unmarshal([]byte(body), &journey)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(journey.ID).NotTo(Equal(uuid.Nil))
+				Expect(journey.AppID).To(Equal(existingApp.ID))
+				Expect(journey.Status).To(Equal(model.ActiveJourneyStatus))
+				Expect(journey.Steps).To(HaveLen(2))
+				Expect(journey.Steps[1].Condition).To(Equal(model.NotOpenedJourneyCondition))
+				Expect(journey.CreatedBy).To(Equal("test@test.com"))
+
+				dbJourney := &model.Journey{ID: journey.ID}
+				err = app.DB.Select(&dbJourney)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dbJourney.Steps[0].TemplateName).To(Equal(existingTemplates[0].Name))
+
+				scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scheduled).To(HaveLen(1))
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(scheduled[0]), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg["queue"]).To(Equal("journey_worker"))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if the journey has no steps", func() {
+				payload := getJourneyPayload()
+				payload["steps"] = []map[string]interface{}{}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid steps"))
+			})
+
+			It("should return 422 if a step after the first one has no delay", func() {
+				payload := getJourneyPayload()
+				delete(payload["steps"].([]map[string]interface{})[1], "delay")
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid steps[1]: delay"))
+			})
+
+			It("should return 422 if the condition of a step is invalid", func() {
+				payload := getJourneyPayload()
+				payload["steps"].([]map[string]interface{})[1]["condition"] = "clicked"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid steps[1]: condition"))
+			})
+
+			It("should return 422 if the service is invalid", func() {
+				payload := getJourneyPayload()
+				payload["service"] = "email"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid service"))
+			})
+
+			It("should return 422 if the template of a step does not exist", func() {
+				payload := getJourneyPayload()
+				payload["steps"].([]map[string]interface{})[1]["templateName"] = uuid.NewV4().String()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+	})
+
+	Describe("Get /apps/:aid/journeys/:jid", func() {
+		It("should return 200 and the journey with the funnel of its steps", func() {
+			existingJourney := CreateTestJourney(app.DB, existingApp.ID, templateNames, map[string]interface{}{
+				"currentStep": 1,
+			})
+			job := CreateTestJob(app.DB, existingApp.ID, existingTemplates[0].Name)
+			_, err := app.DB.Model(job).Set("journey_id = ?", existingJourney.ID).Set("total_users = 3").Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			for idx, outcome := range []struct{ delivered, opened bool }{{true, true}, {true, false}, {false, false}} {
+				_, err = app.DB.Exec(
+					"INSERT INTO journey_users (journey_id, step, user_id, delivered, opened) VALUES (?, 0, ?, ?, ?)",
+					existingJourney.ID, fmt.Sprintf("user%d", idx), outcome.delivered, outcome.opened,
+				)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			status, body := Get(app, fmt.Sprintf("%s/%s", baseRoute, existingJourney.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var journey model.Journey
+			err = json.Unmarshal([]byte(body), &journey)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(journey.ID).To(Equal(existingJourney.ID))
+			Expect(journey.Funnel).To(HaveLen(2))
+			Expect(journey.Funnel[0].JobID).To(Equal(job.ID))
+			Expect(journey.Funnel[0].TotalUsers).To(Equal(3))
+			Expect(journey.Funnel[0].Delivered).To(Equal(2))
+			Expect(journey.Funnel[0].Opened).To(Equal(1))
+			Expect(journey.Funnel[1].JobID).To(Equal(uuid.Nil))
+			Expect(journey.Funnel[1].Delivered).To(Equal(0))
+		})
+
+		It("should return 404 if the journey does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Put /apps/:aid/journeys/:jid/stop", func() {
+		It("should return 200 and stop the journey", func() {
+			existingJourney := CreateTestJourney(app.DB, existingApp.ID, templateNames)
+			status, body := Put(app, fmt.Sprintf("%s/%s/stop", baseRoute, existingJourney.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var journey model.Journey
+			err := json.Unmarshal([]byte(body), &journey)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(journey.Status).To(Equal(model.StoppedJourneyStatus))
+		})
+
+		It("should return 403 if the journey is not active", func() {
+			existingJourney := CreateTestJourney(app.DB, existingApp.ID, templateNames, map[string]interface{}{
+				"status": model.FinishedJourneyStatus,
+			})
+			status, _ := Put(app, fmt.Sprintf("%s/%s/stop", baseRoute, existingJourney.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Delete /apps/:aid/journeys/:jid", func() {
+		It("should return 204 and delete the journey", func() {
+			existingJourney := CreateTestJourney(app.DB, existingApp.ID, templateNames)
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, existingJourney.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			count, err := app.DB.Model(&model.Journey{}).Where("id = ?", existingJourney.ID).Count()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(0))
+		})
+
+		It("should return 404 if the journey does not exist", func() {
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -76,6 +76,12 @@ func GetApplication(host string, port int, debug bool, l zap.Logger, configPath
 	return a
 }
 
+func (a *Application) loadConfigurationDefaults() {
+	a.Config.SetDefault("api.preview.defaultSampleSize", 10)
+	a.Config.SetDefault("api.preview.maxSampleSize", 100)
+	a.Config.SetDefault("api.audience.sampleThreshold", 1000000)
+}
+
 func (a *Application) loadConfiguration() error {
 	a.Config.SetConfigFile(a.ConfigPath)
 	a.Config.SetEnvPrefix("marathon")
@@ -94,6 +100,7 @@ func (a *Application) loadConfiguration() error {
 }
 
 func (a *Application) configure() error {
+	a.loadConfigurationDefaults()
 	err := a.loadConfiguration()
 	if err != nil {
 		return err
@@ -195,21 +202,61 @@ func (a *Application) configureApplication() {
 	appGroup.GET("/:aid", a.GetAppHandler)
 	appGroup.PUT("/:aid", a.PutAppHandler)
 	appGroup.DELETE("/:aid", a.DeleteAppHandler)
+	appGroup.GET("/:aid/holdout", a.GetAppHoldoutHandler)
 
 	// Templates Routes
 	appGroup.POST("/:aid/templates", a.PostTemplateHandler)
+	appGroup.GET("/:aid/audience", a.GetAudienceHandler)
+	appGroup.GET("/:aid/segments", a.ListSegmentsHandler)
+	appGroup.POST("/:aid/segments", a.PostSegmentHandler)
+	appGroup.GET("/:aid/segments/:sid", a.GetSegmentHandler)
+	appGroup.PUT("/:aid/segments/:sid", a.PutSegmentHandler)
+	appGroup.DELETE("/:aid/segments/:sid", a.DeleteSegmentHandler)
 	appGroup.GET("/:aid/templates", a.ListTemplatesHandler)
 	appGroup.GET("/:aid/templates/:tid", a.GetTemplateHandler)
 	appGroup.PUT("/:aid/templates/:tid", a.PutTemplateHandler)
 	appGroup.DELETE("/:aid/templates/:tid", a.DeleteTemplateHandler)
+	appGroup.POST("/:aid/templates/:tid/test", a.PostTestSendHandler)
+	appGroup.GET("/:aid/templates/:tid/test/:id", a.GetTestSendHandler)
+
+	// Suppressions Routes
+	appGroup.GET("/:aid/suppressions", a.ListSuppressionsHandler)
+	appGroup.POST("/:aid/suppressions", a.PostSuppressionsHandler)
+	appGroup.DELETE("/:aid/suppressions/:userId", a.DeleteSuppressionHandler)
 
 	// Jobs Routes
 	appGroup.POST("/:aid/jobs", a.PostJobHandler)
+	appGroup.POST("/:aid/jobs/preview", a.PreviewJobHandler)
 	appGroup.GET("/:aid/jobs", a.ListJobsHandler)
 	appGroup.GET("/:aid/jobs/:jid", a.GetJobHandler)
 	appGroup.PUT("/:aid/jobs/:jid/pause", a.PauseJobHandler)
 	appGroup.PUT("/:aid/jobs/:jid/stop", a.StopJobHandler)
 	appGroup.PUT("/:aid/jobs/:jid/resume", a.ResumeJobHandler)
+	appGroup.GET("/:aid/jobs/:jid/deliveries", a.ListJobDeliveriesHandler)
+	appGroup.GET("/:aid/jobs/:jid/experiment", a.GetJobExperimentHandler)
+	appGroup.GET("/:aid/jobs/:jid/control-group", a.GetJobControlGroupHandler)
+
+	// Recurrences Routes
+	appGroup.GET("/:aid/recurrences", a.ListRecurrencesHandler)
+	appGroup.POST("/:aid/recurrences", a.PostRecurrenceHandler)
+	appGroup.GET("/:aid/recurrences/:rid", a.GetRecurrenceHandler)
+	appGroup.GET("/:aid/recurrences/:rid/jobs", a.ListRecurrenceJobsHandler)
+	appGroup.PUT("/:aid/recurrences/:rid/pause", a.PauseRecurrenceHandler)
+	appGroup.PUT("/:aid/recurrences/:rid/resume", a.ResumeRecurrenceHandler)
+	appGroup.DELETE("/:aid/recurrences/:rid", a.DeleteRecurrenceHandler)
+
+	// Triggers Routes
+	appGroup.GET("/:aid/triggers", a.ListTriggersHandler)
+	appGroup.POST("/:aid/triggers", a.PostTriggerHandler)
+	appGroup.GET("/:aid/triggers/:tid", a.GetTriggerHandler)
+	appGroup.DELETE("/:aid/triggers/:tid", a.DeleteTriggerHandler)
+
+	// Journeys Routes
+	appGroup.GET("/:aid/journeys", a.ListJourneysHandler)
+	appGroup.POST("/:aid/journeys", a.PostJourneyHandler)
+	appGroup.GET("/:aid/journeys/:jid", a.GetJourneyHandler)
+	appGroup.PUT("/:aid/journeys/:jid/stop", a.StopJourneyHandler)
+	appGroup.DELETE("/:aid/journeys/:jid", a.DeleteJourneyHandler)
 
 	userGroup := e.Group("/users")
 	// AuthMiddleware MUST be the first middleware
@@ -227,6 +274,20 @@ func (a *Application) configureApplication() {
 	userGroup.PUT("/:uid", a.UpdateUserHandler)
 	userGroup.DELETE("/:uid", a.DeleteUserHandler)
 
+	suppressionGroup := e.Group("/suppressions")
+	// AuthMiddleware MUST be the first middleware, the global suppression list is managed only by admins
+	suppressionGroup.Use(NewUserAuthMiddleware(a).Serve)
+	suppressionGroup.Use(NewLoggerMiddleware(a.Logger).Serve)
+	suppressionGroup.Use(NewRecoveryMiddleware(a.OnErrorHandler).Serve)
+	suppressionGroup.Use(NewVersionMiddleware().Serve)
+	suppressionGroup.Use(NewSentryMiddleware(a).Serve)
+	suppressionGroup.Use(NewNewRelicMiddleware(a, a.Logger).Serve)
+
+	// Global Suppressions Routes
+	suppressionGroup.GET("", a.ListSuppressionsHandler)
+	suppressionGroup.POST("", a.PostSuppressionsHandler)
+	suppressionGroup.DELETE("/:userId", a.DeleteSuppressionHandler)
+
 	a.API = e
 }
 
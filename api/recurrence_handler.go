@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5/types"
+)
+
+// ListRecurrencesHandler is the method called when a get to /apps/:aid/recurrences is called
+func (a *Application) ListRecurrencesHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "listRecurrences"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	recurrences := []model.Recurrence{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&recurrences).Where("app_id = ?", aid).Order("created_at DESC").Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list recurrences.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed recurrences successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("recurrences", recurrences))
+	})
+	return c.JSON(http.StatusOK, recurrences)
+}
+
+// PostRecurrenceHandler is the method called when a post to /apps/:aid/recurrences is called
+// the job template is checked like the jobs created directly and the first occurrence is scheduled
+func (a *Application) PostRecurrenceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "postRecurrence"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
+	}
+
+	email := c.Get("user-email").(string)
+	recurrence := &model.Recurrence{
+		CreatedBy: email,
+		CreatedAt: time.Now().UnixNano(),
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, recurrence)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: recurrence})
+	}
+	recurrence.ID = uuid.NewV4()
+	recurrence.AppID = aid
+	recurrence.Status = model.ActiveRecurrenceStatus
+	recurrence.LastRunAt = 0
+
+	job := recurrence.NewJob(0)
+	job.App = *app
+	skip, err := a.applySegment(job, c)
+	if err != nil || skip {
+		return err
+	}
+	skip, err = a.checkFilters(job, c)
+	if err != nil || skip {
+		return err
+	}
+	skip, err = a.checkAudience(job, c)
+	if err != nil || skip {
+		return err
+	}
+	skip, err = a.checkTemplateName(job.TemplateName, job, c)
+	if err != nil || skip {
+		return err
+	}
+	// the segment and the normalized filters are kept as the jobs created directly keep them
+	recurrence.Job.Filters = job.Filters
+	recurrence.Job.FilterExpression = job.FilterExpression
+	recurrence.Job.CSVPath = job.CSVPath
+
+	recurrence.NextRunAt, err = recurrence.NextRunAfter(time.Now().UnixNano())
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: recurrence})
+	}
+	if recurrence.NextRunAt == 0 {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "recurrence has no occurrences before it ends", Value: recurrence})
+	}
+
+	err = WithSegment("create-recurrence", c, func() error {
+		jobGroup := model.JobGroup{
+			ID:    uuid.NewV4(),
+			AppID: aid,
+		}
+		err := WithSegment("create-group", c, func() error {
+			return a.DB.Insert(&jobGroup)
+		})
+		if err != nil {
+			return err
+		}
+		recurrence.JobGroupID = jobGroup.ID
+
+		err = WithSegment("db-insert", c, func() error {
+			return a.DB.Insert(&recurrence)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = a.Worker.ScheduleRecurrenceJob(recurrence, recurrence.NextRunAt)
+		return err
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: recurrence})
+		}
+		log.E(l, "Failed to create recurrence.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: recurrence})
+	}
+	log.D(l, "Created recurrence successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("recurrence", recurrence))
+	})
+	return c.JSON(http.StatusCreated, recurrence)
+}
+
+// getRecurrence retrieves the recurrence of the :aid and :rid params
+func (a *Application) getRecurrence(l zap.Logger, c echo.Context) (*model.Recurrence, bool, error) {
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	rid, err := uuid.FromString(c.Param("rid"))
+	if err != nil {
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	recurrence := &model.Recurrence{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&recurrence).Where("id = ? AND app_id = ?", rid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return nil, true, c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve recurrence.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return nil, true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return recurrence, false, nil
+}
+
+// GetRecurrenceHandler is the method called when a get to /apps/:aid/recurrences/:rid is called
+func (a *Application) GetRecurrenceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "getRecurrence"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("recurrenceId", c.Param("rid")),
+	)
+	recurrence, skip, err := a.getRecurrence(l, c)
+	if err != nil || skip {
+		return err
+	}
+	return c.JSON(http.StatusOK, recurrence)
+}
+
+// ListRecurrenceJobsHandler is the method called when a get to /apps/:aid/recurrences/:rid/jobs is called
+// it lists the jobs already created by the recurrence, the most recent first
+func (a *Application) ListRecurrenceJobsHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "listRecurrenceJobs"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("recurrenceId", c.Param("rid")),
+	)
+	recurrence, skip, err := a.getRecurrence(l, c)
+	if err != nil || skip {
+		return err
+	}
+	jobs := []model.Job{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&jobs).Column("job.*", "App").
+			Where("job.job_group_id = ?", recurrence.JobGroupID).
+			Order("job.starts_at DESC").
+			Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list recurrence jobs.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	for idx := range jobs {
+		jobs[idx].SetExpectedCompletedAt()
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+// PauseRecurrenceHandler is the method called when a put to /apps/:aid/recurrences/:rid/pause is called
+// paused recurrences create no jobs, the jobs already created are not changed
+func (a *Application) PauseRecurrenceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "pauseRecurrence"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("recurrenceId", c.Param("rid")),
+	)
+	recurrence, skip, err := a.getRecurrence(l, c)
+	if err != nil || skip {
+		return err
+	}
+	if recurrence.Status != model.ActiveRecurrenceStatus {
+		return c.JSON(http.StatusForbidden, &Error{Reason: fmt.Sprintf("cannot pause %s recurrence", recurrence.Status)})
+	}
+	return a.updateRecurrenceStatus(l, c, recurrence, model.PausedRecurrenceStatus, 0)
+}
+
+// ResumeRecurrenceHandler is the method called when a put to /apps/:aid/recurrences/:rid/resume is called
+// the occurrences missed while the recurrence was paused are skipped
+func (a *Application) ResumeRecurrenceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "resumeRecurrence"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("recurrenceId", c.Param("rid")),
+	)
+	recurrence, skip, err := a.getRecurrence(l, c)
+	if err != nil || skip {
+		return err
+	}
+	if recurrence.Status != model.PausedRecurrenceStatus {
+		return c.JSON(http.StatusForbidden, &Error{Reason: fmt.Sprintf("cannot resume %s recurrence", recurrence.Status)})
+	}
+	next, err := recurrence.NextRunAfter(time.Now().UnixNano())
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: recurrence})
+	}
+	if next == 0 {
+		return a.updateRecurrenceStatus(l, c, recurrence, model.FinishedRecurrenceStatus, 0)
+	}
+	return a.updateRecurrenceStatus(l, c, recurrence, model.ActiveRecurrenceStatus, next)
+}
+
+// updateRecurrenceStatus sets the status and the next run of the recurrence and schedules the next run
+func (a *Application) updateRecurrenceStatus(l zap.Logger, c echo.Context, recurrence *model.Recurrence, status string, next int64) error {
+	recurrence.Status = status
+	recurrence.NextRunAt = next
+	recurrence.UpdatedAt = time.Now().UnixNano()
+	err := WithSegment("db-update", c, func() error {
+		_, err := a.DB.Model(&recurrence).Column("status").Column("next_run_at").Column("updated_at").Returning("*").Update()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to update recurrence.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: recurrence})
+	}
+	if next > 0 {
+		_, err = a.Worker.ScheduleRecurrenceJob(recurrence, next)
+		if err != nil {
+			log.E(l, "Failed to schedule recurrence.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: recurrence})
+		}
+	}
+	log.D(l, "Updated recurrence successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("recurrence", recurrence))
+	})
+	return c.JSON(http.StatusOK, recurrence)
+}
+
+// DeleteRecurrenceHandler is the method called when a delete to /apps/:aid/recurrences/:rid is called
+// the jobs already created by the recurrence are kept
+func (a *Application) DeleteRecurrenceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "recurrenceHandler"),
+		zap.String("operation", "deleteRecurrence"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("recurrenceId", c.Param("rid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	rid, err := uuid.FromString(c.Param("rid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	recurrence := &model.Recurrence{}
+	var res *types.Result
+	err = WithSegment("db-delete", c, func() error {
+		res, err = a.DB.Model(&recurrence).Where("id = ? AND app_id = ?", rid, aid).Delete()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to delete recurrence.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	if res.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Deleted recurrence successfully.", func(cm log.CM) {
+		cm.Write(zap.String("recurrenceId", rid.String()))
+	})
+	return c.JSON(http.StatusNoContent, "")
+}
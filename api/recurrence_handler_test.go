@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Recurrence Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var existingTemplate *model.Template
+	var baseRoute string
+
+	w := worker.NewWorker(logger, GetConfPath())
+
+	getRecurrencePayload := func() map[string]interface{} {
+		return map[string]interface{}{
+			"cron":     "30 9 * * 1-5",
+			"timezone": "America/Sao_Paulo",
+			"job": map[string]interface{}{
+				"service":      "apns",
+				"templateName": existingTemplate.Name,
+				"filters":      map[string]interface{}{"locale": "en"},
+				"context":      map[string]interface{}{"value": "recurring"},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM recurrences;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		w.RedisClient.FlushAll()
+
+		existingApp = CreateTestApp(app.DB)
+		existingTemplate = CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{
+			"locale": "en",
+		})
+		baseRoute = fmt.Sprintf("/apps/%s/recurrences", existingApp.ID)
+	})
+
+	Describe("Get /apps/:aid/recurrences", func() {
+		It("should return 200 and the recurrences of the app", func() {
+			CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			anotherApp := CreateTestApp(app.DB)
+			CreateTestRecurrence(app.DB, anotherApp.ID, existingTemplate.Name)
+
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+		})
+	})
+
+	Describe("Post /apps/:aid/recurrences", func() {
+		Describe("Sucesfully", func() {
+			It("should return 201 and schedule the first occurrence of the recurrence", func() {
+				pl, _ := json.Marshal(getRecurrencePayload())
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var recurrence model.Recurrence
+				err := json.Unmarshal([]byte(body), &recurrence)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(recurrence.ID).NotTo(Equal(uuid.Nil))
+				Expect(recurrence.AppID).To(Equal(existingApp.ID))
+				Expect(recurrence.JobGroupID).NotTo(Equal(uuid.Nil))
+				Expect(recurrence.Status).To(Equal(model.ActiveRecurrenceStatus))
+				Expect(recurrence.CreatedBy).To(Equal("test@test.com"))
+				Expect(recurrence.Job.FilterExpression).NotTo(BeNil())
+
+				loc, err := time.LoadLocation("America/Sao_Paulo")
+				Expect(err).NotTo(HaveOccurred())
+				nextRun := time.Unix(0, recurrence.NextRunAt).In(loc)
+				Expect(nextRun.After(time.Now())).To(BeTrue())
+				Expect(nextRun.Hour()).To(Equal(9))
+				Expect(nextRun.Minute()).To(Equal(30))
+				Expect(nextRun.Weekday()).NotTo(Equal(time.Saturday))
+				Expect(nextRun.Weekday()).NotTo(Equal(time.Sunday))
+
+				dbRecurrence := &model.Recurrence{ID: recurrence.ID}
+				err = app.DB.Select(&dbRecurrence)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dbRecurrence.Job.TemplateName).To(Equal(existingTemplate.Name))
+
+				scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scheduled).To(HaveLen(1))
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(scheduled[0]), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg["queue"]).To(Equal("recurrence_worker"))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if the cron expression is invalid", func() {
+				payload := getRecurrencePayload()
+				payload["cron"] = "61 * * * *"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid cron"))
+			})
+
+			It("should return 422 if the timezone is unknown", func() {
+				payload := getRecurrencePayload()
+				payload["timezone"] = "Mars/Olympus_Mons"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid timezone"))
+			})
+
+			It("should return 422 if the end date is in the past", func() {
+				payload := getRecurrencePayload()
+				payload["endsAt"] = time.Now().Add(-time.Hour).UnixNano()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the recurrence ends before its first occurrence", func() {
+				payload := getRecurrencePayload()
+				payload["cron"] = "0 0 1 1 *"
+				payload["endsAt"] = time.Now().Add(time.Minute).UnixNano()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the job template is invalid", func() {
+				payload := getRecurrencePayload()
+				payload["job"].(map[string]interface{})["service"] = "email"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid job: invalid service"))
+			})
+
+			It("should return 422 if the template does not exist", func() {
+				payload := getRecurrencePayload()
+				payload["job"].(map[string]interface{})["templateName"] = uuid.NewV4().String()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+	})
+
+	Describe("Get /apps/:aid/recurrences/:rid", func() {
+		It("should return 200 and the recurrence", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			status, body := Get(app, fmt.Sprintf("%s/%s", baseRoute, existingRecurrence.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var recurrence model.Recurrence
+			err := json.Unmarshal([]byte(body), &recurrence)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recurrence.ID).To(Equal(existingRecurrence.ID))
+			Expect(recurrence.Cron).To(Equal(existingRecurrence.Cron))
+		})
+
+		It("should return 404 if the recurrence does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Get /apps/:aid/recurrences/:rid/jobs", func() {
+		It("should return 200 and the jobs created by the recurrence", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			jobs := CreateTestJobs(app.DB, existingApp.ID, existingTemplate.Name, 3)
+			for _, job := range jobs[:2] {
+				_, err := app.DB.Model(job).Set("job_group_id = ?", existingRecurrence.JobGroupID).Where("id = ?", job.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			status, body := Get(app, fmt.Sprintf("%s/%s/jobs", baseRoute, existingRecurrence.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []model.Job
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+			for _, job := range response {
+				Expect(job.JobGroupID).To(Equal(existingRecurrence.JobGroupID))
+			}
+		})
+	})
+
+	Describe("Put /apps/:aid/recurrences/:rid/pause", func() {
+		It("should return 200 and pause the recurrence", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			status, body := Put(app, fmt.Sprintf("%s/%s/pause", baseRoute, existingRecurrence.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var recurrence model.Recurrence
+			err := json.Unmarshal([]byte(body), &recurrence)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recurrence.Status).To(Equal(model.PausedRecurrenceStatus))
+			Expect(recurrence.NextRunAt).To(BeZero())
+		})
+
+		It("should return 403 if the recurrence is not active", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+				"status": model.PausedRecurrenceStatus,
+			})
+			status, _ := Put(app, fmt.Sprintf("%s/%s/pause", baseRoute, existingRecurrence.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Put /apps/:aid/recurrences/:rid/resume", func() {
+		It("should return 200 and schedule the next occurrence of the recurrence", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+				"status":    model.PausedRecurrenceStatus,
+				"nextRunAt": int64(0),
+			})
+			status, body := Put(app, fmt.Sprintf("%s/%s/resume", baseRoute, existingRecurrence.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var recurrence model.Recurrence
+			err := json.Unmarshal([]byte(body), &recurrence)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recurrence.Status).To(Equal(model.ActiveRecurrenceStatus))
+			Expect(recurrence.NextRunAt).To(BeNumerically(">", time.Now().UnixNano()))
+
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(1))
+		})
+
+		It("should return 403 if the recurrence is not paused", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			status, _ := Put(app, fmt.Sprintf("%s/%s/resume", baseRoute, existingRecurrence.ID), "", "test@test.com")
+			Expect(status).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Delete /apps/:aid/recurrences/:rid", func() {
+		It("should return 204 and delete the recurrence", func() {
+			existingRecurrence := CreateTestRecurrence(app.DB, existingApp.ID, existingTemplate.Name)
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, existingRecurrence.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			count, err := app.DB.Model(&model.Recurrence{}).Where("id = ?", existingRecurrence.ID).Count()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(0))
+		})
+
+		It("should return 404 if the recurrence does not exist", func() {
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
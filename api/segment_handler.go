@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5/types"
+)
+
+// ListSegmentsHandler is the method called when a get to /apps/:aid/segments is called
+func (a *Application) ListSegmentsHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "segmentHandler"),
+		zap.String("operation", "listSegments"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	segments := []model.Segment{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&segments).Where("app_id = ?", aid).Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list segments.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed segments successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("segments", segments))
+	})
+	return c.JSON(http.StatusOK, segments)
+}
+
+// PostSegmentHandler is the method called when a post to /apps/:aid/segments is called
+func (a *Application) PostSegmentHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "segmentHandler"),
+		zap.String("operation", "postSegment"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	email := c.Get("user-email").(string)
+	segment := &model.Segment{
+		ID:        uuid.NewV4(),
+		CreatedBy: email,
+		CreatedAt: time.Now().UnixNano(),
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, segment)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+	}
+	segment.AppID = aid
+
+	skip, err := a.computeSegmentSize(segment, c)
+	if err != nil || skip {
+		return err
+	}
+
+	err = WithSegment("db-insert", c, func() error {
+		return a.DB.Insert(&segment)
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: segment})
+		}
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+		}
+		log.E(l, "Failed to create segment.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+	log.D(l, "Created segment successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("segment", segment))
+	})
+	return c.JSON(http.StatusCreated, segment)
+}
+
+// GetSegmentHandler is the method called when a get to /apps/:aid/segments/:sid is called
+func (a *Application) GetSegmentHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "segmentHandler"),
+		zap.String("operation", "getSegment"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("segmentId", c.Param("sid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	sid, err := uuid.FromString(c.Param("sid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	segment := &model.Segment{ID: sid, AppID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&segment).Where("id = ? AND app_id = ?", sid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve segment.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+	return c.JSON(http.StatusOK, segment)
+}
+
+// PutSegmentHandler is the method called when a put to /apps/:aid/segments/:sid is called
+func (a *Application) PutSegmentHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "segmentHandler"),
+		zap.String("operation", "putSegment"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("segmentId", c.Param("sid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	sid, err := uuid.FromString(c.Param("sid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	email := c.Get("user-email").(string)
+	segment := &model.Segment{
+		ID:        sid,
+		AppID:     aid,
+		CreatedBy: email,
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, segment)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+	}
+	segment.ID = sid
+	segment.AppID = aid
+
+	skip, err := a.computeSegmentSize(segment, c)
+	if err != nil || skip {
+		return err
+	}
+
+	var values *types.Result
+	err = WithSegment("db-update", c, func() error {
+		values, err = a.DB.Model(&segment).
+			Column("name").Column("service").Column("filter_expression").Column("csv_path").
+			Column("size").Column("size_computed_at").Column("updated_at").
+			Where("id = ? AND app_id = ?", sid, aid).
+			Returning("*").
+			Update()
+		return err
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: segment})
+		}
+		log.E(l, "Failed to update segment.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+	if values.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Updated segment successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("segment", segment))
+	})
+	return c.JSON(http.StatusOK, segment)
+}
+
+// DeleteSegmentHandler is the method called when a delete to /apps/:aid/segments/:sid is called
+// segments targeted by jobs cannot be deleted so the jobs keep their audience
+func (a *Application) DeleteSegmentHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "segmentHandler"),
+		zap.String("operation", "deleteSegment"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("segmentId", c.Param("sid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	sid, err := uuid.FromString(c.Param("sid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	segment := &model.Segment{}
+	var res *types.Result
+	err = WithSegment("db-delete", c, func() error {
+		res, err = a.DB.Model(&segment).Where("id = ? AND app_id = ?", sid, aid).Delete()
+		return err
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return c.JSON(http.StatusConflict, &Error{Reason: "segment is used by jobs"})
+		}
+		log.E(l, "Failed to delete segment.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+	if res.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Deleted segment successfully.", func(cm log.CM) {
+		cm.Write(zap.String("segmentId", sid.String()))
+	})
+	return c.JSON(http.StatusNoContent, "")
+}
+
+// computeSegmentSize sets the number of tokens matched by the segment filter expression
+// or the number of users in the segment csv
+func (a *Application) computeSegmentSize(segment *model.Segment, c echo.Context) (bool, error) {
+	app := &model.App{ID: segment.AppID}
+	err := WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "app does not exist", Value: segment})
+		}
+		return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+
+	if len(segment.CSVPath) > 0 {
+		var userIDs []string
+		err = WithSegment("s3-get", c, func() error {
+			csv, err := a.S3Client.GetObject(segment.CSVPath)
+			if err != nil {
+				return err
+			}
+			userIDs, err = worker.ParseCSVUserIDs(csv)
+			return err
+		})
+		if err != nil {
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+		}
+		segment.Size = len(userIDs)
+		segment.SizeComputedAt = time.Now().UnixNano()
+		return false, nil
+	}
+
+	tableName := worker.GetPushDBTableName(app.Name, segment.Service)
+	columns, err := worker.GetPushDBColumns(a.PushDB, tableName)
+	if err != nil {
+		return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+	}
+	_, err = worker.BuildFilterQuery(segment.FilterExpression, columns)
+	if err != nil {
+		return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: segment})
+	}
+	var audience *worker.AudienceEstimate
+	err = WithSegment("push-db-select", c, func() error {
+		audience, err = worker.EstimateAudience(a.PushDB, tableName, segment.FilterExpression, a.Config.GetInt("api.audience.sampleThreshold"))
+		return err
+	})
+	if err != nil {
+		return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: segment})
+	}
+	segment.Size = audience.Total
+	segment.SizeComputedAt = time.Now().UnixNano()
+	return false, nil
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Segment Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var baseRoute string
+
+	getSegmentPayload := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name":    uuid.NewV4().String(),
+			"service": "apns",
+			"filterExpression": map[string]interface{}{
+				"column": "locale",
+				"op":     "eq",
+				"value":  "pt",
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM jobs;")
+		app.DB.Exec("DELETE FROM segments;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		existingApp = CreateTestApp(app.DB)
+		baseRoute = fmt.Sprintf("/apps/%s/segments", existingApp.ID)
+	})
+
+	Describe("Get /apps/:aid/segments", func() {
+		It("should return 200 and an empty list if there are no segments", func() {
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(0))
+		})
+
+		It("should return 200 and the segments of the app", func() {
+			CreateTestSegment(app.DB, existingApp.ID)
+			CreateTestSegment(app.DB, existingApp.ID)
+			anotherApp := CreateTestApp(app.DB)
+			CreateTestSegment(app.DB, anotherApp.ID)
+
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+		})
+	})
+
+	Describe("Post /apps/:aid/segments", func() {
+		Describe("Sucesfully", func() {
+			It("should return 201 and the segment with the size of its filter expression", func() {
+				payload := getSegmentPayload()
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var segment model.Segment
+				err := json.Unmarshal([]byte(body), &segment)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(segment.ID).NotTo(Equal(uuid.Nil))
+				Expect(segment.AppID).To(Equal(existingApp.ID))
+				Expect(segment.Name).To(Equal(payload["name"]))
+				Expect(segment.CreatedBy).To(Equal("test@test.com"))
+				Expect(segment.Size).To(Equal(6))
+				Expect(segment.SizeComputedAt).NotTo(BeZero())
+
+				dbSegment := &model.Segment{ID: segment.ID}
+				err = app.DB.Select(&dbSegment)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dbSegment.FilterExpression.Column).To(Equal("locale"))
+				Expect(dbSegment.Size).To(Equal(6))
+			})
+
+			It("should return 201 and the segment with the size of its csv", func() {
+				fakeS3 := NewFakeS3(app.Config)
+				s3Client := app.S3Client
+				app.S3Client = fakeS3
+				defer func() { app.S3Client = s3Client }()
+				csv := []byte("userIds\n9e558649-9c23-469d-a11c-59b05813e3d5\n57be9009-e616-42c6-9cfe-505508ede2d0\n")
+				_, err := fakeS3.PutObject("test/segments/segment.csv", &csv)
+				Expect(err).NotTo(HaveOccurred())
+
+				payload := getSegmentPayload()
+				delete(payload, "filterExpression")
+				payload["csvPath"] = "test/segments/segment.csv"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var segment model.Segment
+				err = json.Unmarshal([]byte(body), &segment)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(segment.CSVPath).To(Equal("test/segments/segment.csv"))
+				Expect(segment.Size).To(Equal(2))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if both filter expression and csv path are given", func() {
+				payload := getSegmentPayload()
+				payload["csvPath"] = "test/segments/segment.csv"
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if neither filter expression nor csv path are given", func() {
+				payload := getSegmentPayload()
+				delete(payload, "filterExpression")
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 422 if the filter expression has an unknown column", func() {
+				payload := getSegmentPayload()
+				payload["filterExpression"] = map[string]interface{}{"column": "password", "op": "eq", "value": "123"}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 409 if there is already a segment with the same name", func() {
+				existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+				payload := getSegmentPayload()
+				payload["name"] = existingSegment.Name
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusConflict))
+			})
+		})
+	})
+
+	Describe("Get /apps/:aid/segments/:sid", func() {
+		It("should return 200 and the segment", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			status, body := Get(app, fmt.Sprintf("%s/%s", baseRoute, existingSegment.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var segment model.Segment
+			err := json.Unmarshal([]byte(body), &segment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(segment.ID).To(Equal(existingSegment.ID))
+			Expect(segment.Name).To(Equal(existingSegment.Name))
+		})
+
+		It("should return 404 if the segment does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Put /apps/:aid/segments/:sid", func() {
+		It("should return 200 and the updated segment with its size recomputed", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			payload := getSegmentPayload()
+			payload["filterExpression"] = map[string]interface{}{"column": "locale", "op": "eq", "value": "en"}
+			pl, _ := json.Marshal(payload)
+			status, body := Put(app, fmt.Sprintf("%s/%s", baseRoute, existingSegment.ID), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var segment model.Segment
+			err := json.Unmarshal([]byte(body), &segment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(segment.Name).To(Equal(payload["name"]))
+			Expect(segment.CreatedBy).To(Equal(existingSegment.CreatedBy))
+			Expect(segment.Size).To(Equal(4))
+		})
+
+		It("should return 404 if the segment does not exist", func() {
+			pl, _ := json.Marshal(getSegmentPayload())
+			status, _ := Put(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Delete /apps/:aid/segments/:sid", func() {
+		It("should return 204 and delete the segment", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, existingSegment.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			status, _ = Get(app, fmt.Sprintf("%s/%s", baseRoute, existingSegment.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+
+		It("should return 409 if the segment is used by a job", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			template := CreateTestTemplate(app.DB, existingApp.ID)
+			CreateTestJob(app.DB, existingApp.ID, template.Name, map[string]interface{}{
+				"segmentId": existingSegment.ID,
+			})
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, existingSegment.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusConflict))
+		})
+
+		It("should return 404 if the segment does not exist", func() {
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Jobs targeting segments", func() {
+		var template *model.Template
+		var jobsRoute string
+
+		BeforeEach(func() {
+			template = CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{
+				"locale": "en",
+			})
+			jobsRoute = fmt.Sprintf("/apps/%s/jobs?template=%s", existingApp.ID, template.Name)
+		})
+
+		It("should create a job with the segment filter expression", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			payload := GetJobPayload()
+			delete(payload, "filters")
+			delete(payload, "csvPath")
+			payload["segmentId"] = existingSegment.ID.String()
+			pl, _ := json.Marshal(payload)
+			status, body := Post(app, jobsRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+
+			var job model.Job
+			err := json.Unmarshal([]byte(body), &job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.SegmentID).To(Equal(existingSegment.ID))
+			Expect(job.FilterExpression).To(Equal(existingSegment.FilterExpression))
+		})
+
+		It("should return 422 if the job has a segment and filters", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			payload := GetJobPayload()
+			delete(payload, "csvPath")
+			payload["segmentId"] = existingSegment.ID.String()
+			pl, _ := json.Marshal(payload)
+			status, _ := Post(app, jobsRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should return 422 if the segment does not exist", func() {
+			payload := GetJobPayload()
+			delete(payload, "filters")
+			delete(payload, "csvPath")
+			payload["segmentId"] = uuid.NewV4().String()
+			pl, _ := json.Marshal(payload)
+			status, _ := Post(app, jobsRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should list only the jobs that targeted the segment", func() {
+			existingSegment := CreateTestSegment(app.DB, existingApp.ID)
+			segmentJob := CreateTestJob(app.DB, existingApp.ID, template.Name, map[string]interface{}{
+				"segmentId": existingSegment.ID,
+			})
+			CreateTestJob(app.DB, existingApp.ID, template.Name)
+
+			route := fmt.Sprintf("/apps/%s/jobs?segment=%s", existingApp.ID, existingSegment.ID)
+			status, body := Get(app, route, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var jobs []model.Job
+			err := json.Unmarshal([]byte(body), &jobs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(HaveLen(1))
+			Expect(jobs[0].ID).To(Equal(segmentJob.ID))
+		})
+
+		It("should return 422 if the segment to list jobs is not an uuid", func() {
+			status, _ := Get(app, fmt.Sprintf("/apps/%s/jobs?segment=not-uuid", existingApp.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+})
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5/orm"
+	"gopkg.in/pg.v5/types"
+)
+
+// suppressions are inserted in chunks to bound the size of the queries
+const suppressionsChunkSize = 1000
+
+// ListSuppressionsHandler is the method called when a get to /apps/:aid/suppressions or /suppressions is called
+func (a *Application) ListSuppressionsHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "suppressionHandler"),
+		zap.String("operation", "listSuppressions"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := getSuppressionsAppID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	suppressions := []model.Suppression{}
+	err = WithSegment("db-select", c, func() error {
+		query := whereSuppressionsApp(a.DB.Model(&suppressions), aid)
+		if userID := c.QueryParam("userId"); userID != "" {
+			query = query.Where("user_id = ?", userID)
+		}
+		return query.Order("created_at DESC").Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list suppressions.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed suppressions successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("suppressions", len(suppressions)))
+	})
+	return c.JSON(http.StatusOK, suppressions)
+}
+
+// PostSuppressionsHandler is the method called when a post to /apps/:aid/suppressions or /suppressions is called
+// the users are given inline or in a csv uploaded with the upload url, users already suppressed are ignored
+func (a *Application) PostSuppressionsHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "suppressionHandler"),
+		zap.String("operation", "postSuppressions"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := getSuppressionsAppID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	list := &model.SuppressionList{}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, list)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: list})
+	}
+
+	if aid != uuid.Nil {
+		app := &model.App{ID: aid}
+		err = WithSegment("db-select", c, func() error {
+			return a.DB.Select(&app)
+		})
+		if err != nil {
+			if err.Error() == RecordNotFoundString {
+				return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "app does not exist", Value: list})
+			}
+			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: list})
+		}
+	}
+
+	userIDs := list.UserIDs
+	if len(list.CSVPath) > 0 {
+		err = WithSegment("s3-get", c, func() error {
+			csv, err := a.S3Client.GetObject(list.CSVPath)
+			if err != nil {
+				return err
+			}
+			userIDs, err = worker.ParseCSVUserIDs(csv)
+			return err
+		})
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: list})
+		}
+	}
+
+	createdBy := c.Get("user-email").(string)
+	created := 0
+	for start := 0; start < len(userIDs); start += suppressionsChunkSize {
+		end := start + suppressionsChunkSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		suppressions := make([]*model.Suppression, 0, end-start)
+		for _, userID := range userIDs[start:end] {
+			if userID == "" {
+				continue
+			}
+			suppressions = append(suppressions, &model.Suppression{
+				ID:        uuid.NewV4(),
+				AppID:     aid,
+				UserID:    userID,
+				Reason:    list.Reason,
+				CreatedBy: createdBy,
+				CreatedAt: time.Now().UnixNano(),
+			})
+		}
+		if len(suppressions) == 0 {
+			continue
+		}
+		var res *types.Result
+		err = WithSegment("db-insert", c, func() error {
+			res, err = a.DB.Model(&suppressions).OnConflict("DO NOTHING").Insert()
+			return err
+		})
+		if err != nil {
+			log.E(l, "Failed to create suppressions.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: list})
+		}
+		created += res.RowsAffected()
+	}
+	log.D(l, "Created suppressions successfully.", func(cm log.CM) {
+		cm.Write(zap.Int("total", len(userIDs)), zap.Int("created", created))
+	})
+	return c.JSON(http.StatusCreated, map[string]int{"total": len(userIDs), "created": created})
+}
+
+// DeleteSuppressionHandler is the method called when a delete to /apps/:aid/suppressions/:userId
+// or /suppressions/:userId is called
+func (a *Application) DeleteSuppressionHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "suppressionHandler"),
+		zap.String("operation", "deleteSuppression"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("userId", c.Param("userId")),
+	)
+	aid, err := getSuppressionsAppID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	suppression := &model.Suppression{}
+	var res *types.Result
+	err = WithSegment("db-delete", c, func() error {
+		res, err = whereSuppressionsApp(a.DB.Model(&suppression), aid).Where("user_id = ?", c.Param("userId")).Delete()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to delete suppression.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	if res.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Deleted suppression successfully.")
+	return c.JSON(http.StatusNoContent, "")
+}
+
+// getSuppressionsAppID returns the app of the suppression list, nil for the global one
+func getSuppressionsAppID(c echo.Context) (uuid.UUID, error) {
+	if c.Param("aid") == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.FromString(c.Param("aid"))
+}
+
+func whereSuppressionsApp(query *orm.Query, aid uuid.UUID) *orm.Query {
+	if aid == uuid.Nil {
+		return query.Where("app_id IS NULL")
+	}
+	return query.Where("app_id = ?", aid)
+}
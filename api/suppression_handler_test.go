@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Suppression Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var baseRoute string
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM suppressions;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		CreateTestUser(app.DB, map[string]interface{}{"email": "notadmin@test.com", "isAdmin": false})
+		existingApp = CreateTestApp(app.DB)
+		baseRoute = fmt.Sprintf("/apps/%s/suppressions", existingApp.ID)
+	})
+
+	AfterEach(func() {
+		app.DB.Exec("DELETE FROM suppressions;")
+	})
+
+	Describe("Get /apps/:aid/suppressions", func() {
+		It("should return 200 and the suppressions of the app", func() {
+			CreateTestSuppression(app.DB, existingApp.ID)
+			CreateTestSuppression(app.DB, existingApp.ID)
+			CreateTestSuppression(app.DB, uuid.Nil)
+			anotherApp := CreateTestApp(app.DB)
+			CreateTestSuppression(app.DB, anotherApp.ID)
+
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+		})
+
+		It("should return 200 and only the suppressions of the user", func() {
+			suppression := CreateTestSuppression(app.DB, existingApp.ID)
+			CreateTestSuppression(app.DB, existingApp.ID)
+
+			status, body := Get(app, fmt.Sprintf("%s?userId=%s", baseRoute, suppression.UserID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []model.Suppression
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(1))
+			Expect(response[0].ID).To(Equal(suppression.ID))
+		})
+	})
+
+	Describe("Post /apps/:aid/suppressions", func() {
+		It("should return 201 and ignore the users already suppressed", func() {
+			CreateTestSuppression(app.DB, existingApp.ID, map[string]interface{}{"userId": "user-1"})
+			payload := map[string]interface{}{
+				"userIds": []string{"user-1", "user-2", "user-3"},
+				"reason":  "qa accounts",
+			}
+			pl, _ := json.Marshal(payload)
+			status, body := Post(app, baseRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+
+			var response map[string]int
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(map[string]int{"total": 3, "created": 2}))
+
+			suppressions := []model.Suppression{}
+			err = app.DB.Model(&suppressions).Where("app_id = ?", existingApp.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suppressions).To(HaveLen(3))
+		})
+
+		It("should return 201 and import the users of a csv", func() {
+			fakeS3 := NewFakeS3(app.Config)
+			s3Client := app.S3Client
+			app.S3Client = fakeS3
+			defer func() { app.S3Client = s3Client }()
+			csv := []byte("userIds\nuser-1\nuser-2\n")
+			_, err := fakeS3.PutObject("test/suppressions/import.csv", &csv)
+			Expect(err).NotTo(HaveOccurred())
+
+			pl, _ := json.Marshal(map[string]interface{}{"csvPath": "test/suppressions/import.csv"})
+			status, body := Post(app, baseRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+
+			var response map[string]int
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(Equal(map[string]int{"total": 2, "created": 2}))
+		})
+
+		It("should return 422 if both userIds and csvPath are given", func() {
+			pl, _ := json.Marshal(map[string]interface{}{"userIds": []string{"user-1"}, "csvPath": "test/suppressions/import.csv"})
+			status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should return 422 if the app does not exist", func() {
+			pl, _ := json.Marshal(map[string]interface{}{"userIds": []string{"user-1"}})
+			status, _ := Post(app, fmt.Sprintf("/apps/%s/suppressions", uuid.NewV4()), string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+
+	Describe("Delete /apps/:aid/suppressions/:userId", func() {
+		It("should return 204 and delete only the suppression of the app", func() {
+			CreateTestSuppression(app.DB, existingApp.ID, map[string]interface{}{"userId": "user-1"})
+			CreateTestSuppression(app.DB, uuid.Nil, map[string]interface{}{"userId": "user-1"})
+
+			status, _ := Delete(app, fmt.Sprintf("%s/user-1", baseRoute), "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			count, err := app.DB.Model(&model.Suppression{}).Where("user_id = 'user-1'").Count()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("should return 404 if the user is not suppressed", func() {
+			status, _ := Delete(app, fmt.Sprintf("%s/user-1", baseRoute), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Global suppressions", func() {
+		It("should create, list and delete global suppressions", func() {
+			pl, _ := json.Marshal(map[string]interface{}{"userIds": []string{"user-1"}, "reason": "opted out"})
+			status, _ := Post(app, "/suppressions", string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+
+			status, body := Get(app, "/suppressions", "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			var response []model.Suppression
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(1))
+			Expect(response[0].AppID).To(Equal(uuid.Nil))
+			Expect(response[0].Reason).To(Equal("opted out"))
+
+			status, _ = Delete(app, "/suppressions/user-1", "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+		})
+
+		It("should return 403 if the user is not an admin", func() {
+			status, _ := Get(app, "/suppressions", "notadmin@test.com")
+			Expect(status).To(Equal(http.StatusForbidden))
+		})
+	})
+})
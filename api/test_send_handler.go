@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+// PostTestSendHandler is the method called when a post to /apps/:aid/templates/:tid/test is called
+// it sends the template to the given devices tagged as a test push without creating a job
+func (a *Application) PostTestSendHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "testSendHandler"),
+		zap.String("operation", "postTestSend"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("templateId", c.Param("tid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	tid, err := uuid.FromString(c.Param("tid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	template := &model.Template{ID: tid, AppID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&template).Column("template.*", "App").Where("template.id = ? AND template.app_id = ?", tid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, template)
+		}
+		log.E(l, "Failed to retrieve template.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: template})
+	}
+
+	email := c.Get("user-email").(string)
+	testSend := &model.TestSend{
+		ID:        uuid.NewV4(),
+		CreatedBy: email,
+		CreatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, testSend)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: testSend})
+	}
+	testSend.AppID = aid
+	testSend.TemplateID = tid
+	testSend.SentPushes = 0
+	testSend.Feedbacks = map[string]interface{}{}
+	if testSend.UserIDs == nil {
+		testSend.UserIDs = []string{}
+	}
+	if testSend.Tokens == nil {
+		testSend.Tokens = []string{}
+	}
+	if testSend.Context == nil {
+		testSend.Context = map[string]interface{}{}
+	}
+	if testSend.Metadata == nil {
+		testSend.Metadata = map[string]interface{}{}
+	}
+
+	job := worker.TestSendJob(testSend, &template.App)
+	err = worker.ValidatePushOptions(job, *template)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: testSend})
+	}
+
+	users := make([]worker.User, 0, len(testSend.UserIDs)+len(testSend.Tokens))
+	if len(testSend.UserIDs) > 0 {
+		err = WithSegment("push-db-select", c, func() error {
+			var usersByID []worker.User
+			usersByID, err = worker.GetUsersByIDs(a.PushDB, job, testSend.UserIDs)
+			users = append(users, usersByID...)
+			return err
+		})
+		if err != nil {
+			log.E(l, "Failed to retrieve users from push db.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: testSend})
+		}
+	}
+	for _, token := range testSend.Tokens {
+		users = append(users, worker.User{Token: token})
+	}
+
+	err = WithSegment("db-insert", c, func() error {
+		return a.DB.Insert(&testSend)
+	})
+	if err != nil {
+		log.E(l, "Failed to create test send.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: testSend})
+	}
+
+	for _, user := range users {
+		err = a.Worker.SendTestPush(testSend, &template.App, *template, user)
+		if err != nil {
+			log.E(l, "Failed to send test push.", func(cm log.CM) {
+				cm.Write(
+					zap.String("userId", user.UserID),
+					zap.String("token", user.Token),
+					zap.Error(err),
+				)
+			})
+			continue
+		}
+		testSend.SentPushes++
+	}
+
+	err = WithSegment("db-update", c, func() error {
+		_, err := a.DB.Model(&testSend).Column("sent_pushes").Update()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to update test send.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: testSend})
+	}
+	log.D(l, "Sent test pushes successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("testSend", testSend))
+	})
+	return c.JSON(http.StatusCreated, testSend)
+}
+
+// GetTestSendHandler is the method called when a get to /apps/:aid/templates/:tid/test/:id is called
+func (a *Application) GetTestSendHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "testSendHandler"),
+		zap.String("operation", "getTestSend"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("templateId", c.Param("tid")),
+		zap.String("testSendId", c.Param("id")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	tid, err := uuid.FromString(c.Param("tid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	testSend := &model.TestSend{ID: id, AppID: aid, TemplateID: tid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&testSend).Where("id = ? AND app_id = ? AND template_id = ?", id, aid, tid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, testSend)
+		}
+		log.E(l, "Failed to retrieve test send.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: testSend})
+	}
+	return c.JSON(http.StatusOK, testSend)
+}
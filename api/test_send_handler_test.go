@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Test Send Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var existingTemplate *model.Template
+	var baseRoute string
+	var fakeKafka *FakeKafkaProducer
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+		existingApp = CreateTestApp(app.DB)
+		existingTemplate = CreateTestTemplate(app.DB, existingApp.ID)
+		baseRoute = fmt.Sprintf("/apps/%s/templates/%s/test", existingApp.ID, existingTemplate.ID)
+		fakeKafka = NewFakeKafkaProducer()
+		app.Worker.Kafka = fakeKafka
+	})
+
+	Describe("Post /apps/:aid/templates/:tid/test", func() {
+		Describe("Sucesfully", func() {
+			It("should return 201 and send the template to the given tokens", func() {
+				payload := map[string]interface{}{
+					"service": "apns",
+					"tokens":  []string{"token1", "token2"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["id"]).NotTo(BeNil())
+				Expect(response["sentPushes"]).To(BeEquivalentTo(2))
+				Expect(response["createdBy"]).To(Equal("test@test.com"))
+				Expect(fakeKafka.APNSMessages).To(HaveLen(2))
+
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(fakeKafka.APNSMessages[0]), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				metadata := msg["metadata"].(map[string]interface{})
+				Expect(metadata["testId"]).To(Equal(response["id"]))
+				Expect(metadata["pushType"]).To(Equal("test"))
+				Expect(metadata["jobId"]).To(BeNil())
+
+				var jobs []model.Job
+				err = app.DB.Model(&jobs).Where("app_id = ?", existingApp.ID).Select()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(jobs).To(BeEmpty())
+
+				testSend := &model.TestSend{}
+				err = app.DB.Model(testSend).Where("id = ?", response["id"]).Select()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(testSend.SentPushes).To(Equal(2))
+			})
+
+			It("should return 201 and send the template to the tokens of the given users", func() {
+				payload := map[string]interface{}{
+					"service": "apns",
+					"userIds": []string{"9e558649-9c23-469d-a11c-59b05813e3d5", "57be9009-e616-42c6-9cfe-505508ede2d0"},
+					"tokens":  []string{"token1"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["sentPushes"]).To(BeEquivalentTo(3))
+				Expect(fakeKafka.APNSMessages).To(HaveLen(3))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 404 if the template does not exist", func() {
+				route := fmt.Sprintf("/apps/%s/templates/%s/test", existingApp.ID, uuid.NewV4())
+				payload := map[string]interface{}{
+					"service": "apns",
+					"tokens":  []string{"token1"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, route, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusNotFound))
+			})
+
+			It("should return 422 if there are no devices", func() {
+				payload := map[string]interface{}{
+					"service": "apns",
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("userIds and tokens"))
+				Expect(fakeKafka.APNSMessages).To(BeEmpty())
+			})
+
+			It("should return 422 if the service is invalid", func() {
+				payload := map[string]interface{}{
+					"service": "blabla",
+					"tokens":  []string{"token1"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+	})
+
+	Describe("Get /apps/:aid/templates/:tid/test/:id", func() {
+		It("should return 200 and the test send with its feedbacks", func() {
+			payload := map[string]interface{}{
+				"service": "apns",
+				"tokens":  []string{"token1"},
+			}
+			pl, _ := json.Marshal(payload)
+			status, body := Post(app, baseRoute, string(pl), "test@test.com")
+			Expect(status).To(Equal(http.StatusCreated))
+			var created map[string]interface{}
+			err := json.Unmarshal([]byte(body), &created)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = app.DB.Exec(`UPDATE test_sends SET feedbacks = '{"ack": 1}' WHERE id = ?`, created["id"])
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body = Get(app, fmt.Sprintf("%s/%s", baseRoute, created["id"]), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+			var response map[string]interface{}
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["id"]).To(Equal(created["id"]))
+			Expect(response["feedbacks"]).To(BeEquivalentTo(map[string]interface{}{"ack": float64(1)}))
+		})
+
+		It("should return 404 if the test send does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5/types"
+)
+
+// ListTriggersHandler is the method called when a get to /apps/:aid/triggers is called
+func (a *Application) ListTriggersHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "triggerHandler"),
+		zap.String("operation", "listTriggers"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	triggers := []model.Trigger{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&triggers).Where("app_id = ?", aid).Select()
+	})
+	if err != nil {
+		log.E(l, "Failed to list triggers.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	log.D(l, "Listed triggers successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("triggers", triggers))
+	})
+	return c.JSON(http.StatusOK, triggers)
+}
+
+// PostTriggerHandler is the method called when a post to /apps/:aid/triggers is called
+// the job the trigger pushes are accounted in is created with the trigger
+func (a *Application) PostTriggerHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "triggerHandler"),
+		zap.String("operation", "postTrigger"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: app})
+	}
+
+	email := c.Get("user-email").(string)
+	trigger := &model.Trigger{
+		CreatedBy: email,
+		CreatedAt: time.Now().UnixNano(),
+		UpdatedAt: time.Now().UnixNano(),
+	}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, trigger)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: trigger})
+	}
+	trigger.ID = uuid.NewV4()
+	trigger.AppID = aid
+	if trigger.Context == nil {
+		trigger.Context = map[string]interface{}{}
+	}
+	if trigger.ContextMapping == nil {
+		trigger.ContextMapping = map[string]string{}
+	}
+	if trigger.Metadata == nil {
+		trigger.Metadata = map[string]interface{}{}
+	}
+
+	job := trigger.NewJob()
+	job.App = *app
+	skip, err := a.checkTemplateName(trigger.TemplateName, job, c)
+	if err != nil || skip {
+		return err
+	}
+	trigger.JobID = job.ID
+
+	err = WithSegment("db-insert", c, func() error {
+		tx, err := a.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if err = tx.Insert(job); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Insert(trigger); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, &Error{Reason: "there is already a trigger of the event for the service", Value: trigger})
+		}
+		log.E(l, "Failed to create trigger.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: trigger})
+	}
+	log.D(l, "Created trigger successfully.", func(cm log.CM) {
+		cm.Write(zap.Object("trigger", trigger))
+	})
+	return c.JSON(http.StatusCreated, trigger)
+}
+
+// GetTriggerHandler is the method called when a get to /apps/:aid/triggers/:tid is called
+func (a *Application) GetTriggerHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "triggerHandler"),
+		zap.String("operation", "getTrigger"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("triggerId", c.Param("tid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	tid, err := uuid.FromString(c.Param("tid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	trigger := &model.Trigger{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(&trigger).Where("id = ? AND app_id = ?", tid, aid).Select()
+	})
+	if err != nil {
+		if err.Error() == RecordNotFoundString {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		log.E(l, "Failed to retrieve trigger.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return c.JSON(http.StatusOK, trigger)
+}
+
+// DeleteTriggerHandler is the method called when a delete to /apps/:aid/triggers/:tid is called
+// the trigger job is kept with the accounting of the pushes already sent
+func (a *Application) DeleteTriggerHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "triggerHandler"),
+		zap.String("operation", "deleteTrigger"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("triggerId", c.Param("tid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	tid, err := uuid.FromString(c.Param("tid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	trigger := &model.Trigger{}
+	var res *types.Result
+	err = WithSegment("db-delete", c, func() error {
+		res, err = a.DB.Model(&trigger).Where("id = ? AND app_id = ?", tid, aid).Delete()
+		return err
+	})
+	if err != nil {
+		log.E(l, "Failed to delete trigger.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	if res.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{})
+	}
+	log.D(l, "Deleted trigger successfully.", func(cm log.CM) {
+		cm.Write(zap.String("triggerId", tid.String()))
+	})
+	return c.JSON(http.StatusNoContent, "")
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Trigger Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var existingTemplate *model.Template
+	var baseRoute string
+
+	getTriggerPayload := func() map[string]interface{} {
+		return map[string]interface{}{
+			"event":          "level_up",
+			"service":        "apns",
+			"templateName":   existingTemplate.Name,
+			"context":        map[string]interface{}{"reward": "gold"},
+			"contextMapping": map[string]string{"level": "newLevel"},
+			"delay":          60,
+		}
+	}
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM triggers;")
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM templates;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+
+		existingApp = CreateTestApp(app.DB)
+		existingTemplate = CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{
+			"locale": "en",
+		})
+		baseRoute = fmt.Sprintf("/apps/%s/triggers", existingApp.ID)
+	})
+
+	Describe("Get /apps/:aid/triggers", func() {
+		It("should return 200 and the triggers of the app", func() {
+			CreateTestTrigger(app.DB, existingApp.ID, existingTemplate.Name)
+			CreateTestTrigger(app.DB, existingApp.ID, existingTemplate.Name)
+			anotherApp := CreateTestApp(app.DB)
+			CreateTestTrigger(app.DB, anotherApp.ID, existingTemplate.Name)
+
+			status, body := Get(app, baseRoute, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response []map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response).To(HaveLen(2))
+		})
+	})
+
+	Describe("Post /apps/:aid/triggers", func() {
+		Describe("Sucesfully", func() {
+			It("should return 201 and create the trigger and its job", func() {
+				pl, _ := json.Marshal(getTriggerPayload())
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				var trigger model.Trigger
+				err := json.Unmarshal([]byte(body), &trigger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(trigger.ID).NotTo(Equal(uuid.Nil))
+				Expect(trigger.AppID).To(Equal(existingApp.ID))
+				Expect(trigger.Event).To(Equal("level_up"))
+				Expect(trigger.ContextMapping).To(Equal(map[string]string{"level": "newLevel"}))
+				Expect(trigger.Delay).To(Equal(60))
+				Expect(trigger.CreatedBy).To(Equal("test@test.com"))
+
+				dbTrigger := &model.Trigger{ID: trigger.ID}
+				err = app.DB.Select(&dbTrigger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dbTrigger.TemplateName).To(Equal(existingTemplate.Name))
+
+				job := &model.Job{ID: trigger.JobID}
+				err = app.DB.Select(&job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(job.AppID).To(Equal(existingApp.ID))
+				Expect(job.TemplateName).To(Equal(existingTemplate.Name))
+				Expect(job.Service).To(Equal("apns"))
+				Expect(job.Status).To(BeEmpty())
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 422 if the event is missing", func() {
+				payload := getTriggerPayload()
+				delete(payload, "event")
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid event"))
+			})
+
+			It("should return 422 if the service is invalid", func() {
+				payload := getTriggerPayload()
+				payload["service"] = "email"
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid service"))
+			})
+
+			It("should return 422 if the delay is too long", func() {
+				payload := getTriggerPayload()
+				payload["delay"] = model.MaxTriggerDelay + 1
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				Expect(body).To(ContainSubstring("invalid delay"))
+			})
+
+			It("should return 422 if the template does not exist", func() {
+				payload := getTriggerPayload()
+				payload["templateName"] = uuid.NewV4().String()
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should return 409 if there is already a trigger of the event for the service", func() {
+				CreateTestTrigger(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+					"event": "level_up",
+				})
+				pl, _ := json.Marshal(getTriggerPayload())
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusConflict))
+			})
+		})
+	})
+
+	Describe("Get /apps/:aid/triggers/:tid", func() {
+		It("should return 200 and the trigger", func() {
+			existingTrigger := CreateTestTrigger(app.DB, existingApp.ID, existingTemplate.Name)
+			status, body := Get(app, fmt.Sprintf("%s/%s", baseRoute, existingTrigger.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var trigger model.Trigger
+			err := json.Unmarshal([]byte(body), &trigger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(trigger.ID).To(Equal(existingTrigger.ID))
+			Expect(trigger.Event).To(Equal(existingTrigger.Event))
+		})
+
+		It("should return 404 if the trigger does not exist", func() {
+			status, _ := Get(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Delete /apps/:aid/triggers/:tid", func() {
+		It("should return 204 and delete the trigger", func() {
+			existingTrigger := CreateTestTrigger(app.DB, existingApp.ID, existingTemplate.Name)
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, existingTrigger.ID), "test@test.com")
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			count, err := app.DB.Model(&model.Trigger{}).Where("id = ?", existingTrigger.ID).Count()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(0))
+		})
+
+		It("should return 404 if the trigger does not exist", func() {
+			status, _ := Delete(app, fmt.Sprintf("%s/%s", baseRoute, uuid.NewV4()), "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -29,6 +29,7 @@ import (
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/Shopify/sarama"
 	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/interfaces"
 	"github.com/topfreegames/marathon/log"
 	"github.com/topfreegames/marathon/messages"
 	"github.com/uber-go/zap"
@@ -104,14 +105,20 @@ func (c *KafkaProducer) connectToKafka() error {
 	c.Producer = producer
 
 	go func() {
-		for range producer.Successes() {
+		for msg := range producer.Successes() {
 			c.Statsd.Incr("send_message_return", []string{"error:false"}, 1)
+			if ack, ok := msg.Metadata.(*kafkaBatchAck); ok {
+				ack.batch.ack(ack.index, nil)
+			}
 		}
 	}()
 
 	go func() {
-		for range producer.Errors() {
+		for err := range producer.Errors() {
 			c.Statsd.Incr("send_message_return", []string{"error:true"}, 1)
+			if ack, ok := err.Msg.Metadata.(*kafkaBatchAck); ok {
+				ack.batch.ack(ack.index, err.Err)
+			}
 		}
 	}()
 
@@ -123,9 +130,34 @@ func (c *KafkaProducer) Close() {
 	c.Producer.AsyncClose()
 }
 
-//SendAPNSPush notification to Kafka
-func (c *KafkaProducer) SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
-	msg := messages.NewAPNSMessage(
+//SendPush builds the message using the registered push service and sends it to Kafka
+func (c *KafkaProducer) SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	msg, err := buildKafkaMessage(service, format, topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+	if err != nil {
+		return err
+	}
+	c.sendPush(msg, nil)
+	return nil
+}
+
+//NewPushBatch creates a batch that tracks the delivery of the pushes sent through it
+func (c *KafkaProducer) NewPushBatch() interfaces.PushBatch {
+	return &KafkaPushBatch{
+		producer: c,
+		errors:   []error{},
+	}
+}
+
+func buildKafkaMessage(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) (*messages.KafkaMessage, error) {
+	pushService, err := messages.GetPushService(service)
+	if err != nil {
+		return nil, err
+	}
+	buildMessage, err := pushService.Builder(format)
+	if err != nil {
+		return nil, err
+	}
+	msg := buildMessage(
 		deviceToken,
 		pushExpiry,
 		payload,
@@ -136,49 +168,42 @@ func (c *KafkaProducer) SendAPNSPush(topic, deviceToken string, payload, message
 
 	if val, ok := pushMetadata["dryRun"]; ok {
 		if dryRun, _ := val.(bool); dryRun {
-			msg.DeviceToken = GenerateFakeID(64)
+			msg.SetDryRun(GenerateFakeID(pushService.FakeTokenSize))
 		}
 	}
 
 	message, err := msg.ToJSON()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.sendPush(messages.NewKafkaMessage(topic, message))
-	return nil
+	return messages.NewKafkaMessage(topic, message), nil
+}
+
+//SendAPNSPush notification to Kafka
+func (c *KafkaProducer) SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	return c.SendPush("apns", "", topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
 }
 
 //SendGCMPush notification to Kafka
 func (c *KafkaProducer) SendGCMPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
-	msg := messages.NewGCMMessage(
-		deviceToken,
-		payload,
-		messageMetadata,
-		pushMetadata,
-		pushExpiry,
-		templateName,
-	)
-
-	if val, ok := pushMetadata["dryRun"]; ok {
-		if dryRun, _ := val.(bool); dryRun {
-			msg.To = GenerateFakeID(152)
-			msg.DryRun = true
-		}
-	}
+	return c.SendPush("gcm", "", topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+}
 
-	message, err := msg.ToJSON()
-	if err != nil {
-		return err
+//SendMessage sends a raw message to a Kafka topic
+func (c *KafkaProducer) SendMessage(topic string, message []byte) error {
+	c.Producer.Input() <- &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(message),
 	}
-	c.sendPush(messages.NewKafkaMessage(topic, message))
 	return nil
 }
 
-//SendPush notification to Kafka
-func (c *KafkaProducer) sendPush(msg *messages.KafkaMessage) {
+//sendPush notification to Kafka
+func (c *KafkaProducer) sendPush(msg *messages.KafkaMessage, metadata interface{}) {
 	message := &sarama.ProducerMessage{
-		Topic: msg.Topic,
-		Value: sarama.StringEncoder(msg.Message),
+		Topic:    msg.Topic,
+		Value:    sarama.StringEncoder(msg.Message),
+		Metadata: metadata,
 	}
 	c.Producer.Input() <- message
 	log.D(c.Logger, "Sent message", func(cm log.CM) {
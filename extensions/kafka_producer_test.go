@@ -165,4 +165,35 @@ var _ = Describe("Kafka Extension", func() {
 			Expect(apnsMessage.Payload.M["a"]).To(BeEquivalentTo(1))
 		})
 	})
+
+	Describe("Send push batch", func() {
+		It("should wait for the delivery confirmation of all messages", func() {
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": 1}
+			meta := map[string]interface{}{"a": 1}
+			expiry := time.Now().Unix()
+			batch := kafka.NewPushBatch()
+			err = batch.SendPush("apns", "", "consumer", "device-token-1", payload, meta, nil, expiry, "template")
+			Expect(err).NotTo(HaveOccurred())
+			err = batch.SendPush("gcm", "", "consumer", "device-token-2", payload, meta, nil, expiry, "template")
+			Expect(err).NotTo(HaveOccurred())
+
+			errs := batch.Wait(10 * time.Second)
+			Expect(errs).To(Equal([]error{nil, nil}))
+		})
+
+		It("should not add messages of unknown services to the batch", func() {
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			batch := kafka.NewPushBatch()
+			err = batch.SendPush("blabla", "", "consumer", "device-token", map[string]interface{}{}, nil, nil, 0, "template")
+			Expect(err).To(HaveOccurred())
+			Expect(batch.Wait(time.Second)).To(BeEmpty())
+		})
+	})
 })
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAckTimeout is returned for the pushes of a batch not confirmed by kafka before the timeout
+var ErrAckTimeout = errors.New("timed out waiting for kafka delivery confirmation")
+
+type kafkaBatchAck struct {
+	batch *KafkaPushBatch
+	index int
+}
+
+// KafkaPushBatch sends pushes to kafka and tracks their delivery confirmations
+type KafkaPushBatch struct {
+	producer *KafkaProducer
+	errors   []error
+	pending  sync.WaitGroup
+	mutex    sync.Mutex
+}
+
+// SendPush sends a push to kafka and adds it to the batch
+func (b *KafkaPushBatch) SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	msg, err := buildKafkaMessage(service, format, topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	index := len(b.errors)
+	b.errors = append(b.errors, ErrAckTimeout)
+	b.mutex.Unlock()
+	b.pending.Add(1)
+	b.producer.sendPush(msg, &kafkaBatchAck{batch: b, index: index})
+	return nil
+}
+
+// Wait blocks until kafka confirms all the pushes of the batch or the timeout expires
+// pushes not confirmed in time are returned with ErrAckTimeout
+func (b *KafkaPushBatch) Wait(timeout time.Duration) []error {
+	done := make(chan struct{})
+	go func() {
+		b.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	errs := make([]error, len(b.errors))
+	copy(errs, b.errors)
+	return errs
+}
+
+func (b *KafkaPushBatch) ack(index int, err error) {
+	b.mutex.Lock()
+	b.errors[index] = err
+	b.mutex.Unlock()
+	b.pending.Done()
+}
@@ -25,6 +25,7 @@ package feedback
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -32,8 +33,11 @@ import (
 	raven "github.com/getsentry/raven-go"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/marathon/extensions"
+	"github.com/topfreegames/marathon/interfaces"
 	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
 	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
 )
 
 var feedbackCacheMutex sync.Mutex
@@ -44,13 +48,43 @@ const APNS = "apns"
 // GCM string representation
 const GCM = "gcm"
 
+// OpenEvent is the event of the feedback messages sent by the apps when an user opens a push
+const OpenEvent = "open"
+
+// JourneyOutcome is the engagement of an user with the push of a journey step
+type JourneyOutcome struct {
+	Delivered bool
+	Opened    bool
+}
+
+// Modes of the cleanup of the invalid tokens, they are deleted from the push db or sent to a topic
+const (
+	DeleteInvalidTokensMode = "delete"
+	TopicInvalidTokensMode  = "topic"
+)
+
+// DeliveryResult is the feedback of a push kept in the delivery log
+type DeliveryResult struct {
+	Result   string
+	ErrorKey string
+	PushedAt int64
+}
+
 // Handler is a feedback handler
 type Handler struct {
 	Config            *viper.Viper
 	pendingMessagesWG *sync.WaitGroup
 	FeedbackCache     map[string]map[string]int
+	TestFeedbackCache map[string]map[string]int
+	OpenHoursCache    map[string]map[string]map[int]int
+	JourneyCache      map[string]map[string]*JourneyOutcome
+	DeliveryCache     map[string]*DeliveryResult
+	InvalidTokens     map[string]map[string]map[string]bool
+	ExperimentCache   map[string]map[string]*model.ExperimentVariant
 	FlushInterval     time.Duration
 	MarathonDB        *extensions.PGClient
+	PushDB            *extensions.PGClient
+	Producer          interfaces.MessageProducer
 	Logger            zap.Logger
 	run               bool
 }
@@ -66,6 +100,8 @@ type Message struct {
 	ID               string                 `json:"id"`
 	Err              map[string]interface{} `json:"Err"`
 	Metadata         map[string]interface{} `json:"metadata"`
+	Event            string                 `json:"event"`
+	Timestamp        int64                  `json:"timestamp"`
 }
 
 // NewHandler creates a new instance of feedback.Handler
@@ -75,6 +111,12 @@ func NewHandler(config *viper.Viper, logger zap.Logger, pendingMessagesWG *sync.
 		Logger:            logger,
 		pendingMessagesWG: pendingMessagesWG,
 		FeedbackCache:     map[string]map[string]int{},
+		TestFeedbackCache: map[string]map[string]int{},
+		OpenHoursCache:    map[string]map[string]map[int]int{},
+		JourneyCache:      map[string]map[string]*JourneyOutcome{},
+		DeliveryCache:     map[string]*DeliveryResult{},
+		InvalidTokens:     map[string]map[string]map[string]bool{},
+		ExperimentCache:   map[string]map[string]*model.ExperimentVariant{},
 	}
 	if len(DBOrNil) > 0 {
 		h.configure(DBOrNil[0])
@@ -89,6 +131,13 @@ func NewHandler(config *viper.Viper, logger zap.Logger, pendingMessagesWG *sync.
 
 func (h *Handler) loadConfigurationDefaults() {
 	h.Config.SetDefault("feedbackListener.flushInterval", 5000)
+	h.Config.SetDefault("deliveryLog.enabled", false)
+	h.Config.SetDefault("feedbackListener.invalidTokens.enabled", false)
+	h.Config.SetDefault("feedbackListener.invalidTokens.mode", DeleteInvalidTokensMode)
+	h.Config.SetDefault("feedbackListener.invalidTokens.batchSize", 1000)
+	h.Config.SetDefault("feedbackListener.invalidTokens.topic", "marathon-invalid-tokens")
+	h.Config.SetDefault("feedbackListener.invalidTokens.apns", []string{"BadDeviceToken", "Unregistered"})
+	h.Config.SetDefault("feedbackListener.invalidTokens.gcm", []string{"NotRegistered", "InvalidRegistration", "BadRegistration", "DeviceUnregistered"})
 }
 
 func (h *Handler) configure(DBOrNil ...*extensions.PGClient) error {
@@ -97,6 +146,7 @@ func (h *Handler) configure(DBOrNil ...*extensions.PGClient) error {
 	h.FlushInterval = time.Duration(interval) * time.Millisecond
 	if len(DBOrNil) > 0 {
 		h.MarathonDB = DBOrNil[0]
+		h.PushDB = DBOrNil[0]
 		return nil
 	}
 	marathonDB, err := extensions.NewPGClient("db", h.Config, h.Logger)
@@ -104,6 +154,30 @@ func (h *Handler) configure(DBOrNil ...*extensions.PGClient) error {
 		return err
 	}
 	h.MarathonDB = marathonDB
+	return h.configureInvalidTokensCleanup()
+}
+
+// configureInvalidTokensCleanup connects to where the invalid tokens are cleaned up, the push db or kafka
+func (h *Handler) configureInvalidTokensCleanup() error {
+	if !h.Config.GetBool("feedbackListener.invalidTokens.enabled") {
+		return nil
+	}
+	switch mode := h.Config.GetString("feedbackListener.invalidTokens.mode"); mode {
+	case DeleteInvalidTokensMode:
+		pushDB, err := extensions.NewPGClient("push.db", h.Config, h.Logger)
+		if err != nil {
+			return err
+		}
+		h.PushDB = pushDB
+	case TopicInvalidTokensMode:
+		producer, err := extensions.NewKafkaProducer(h.Config, h.Logger, nil)
+		if err != nil {
+			return err
+		}
+		h.Producer = producer
+	default:
+		return fmt.Errorf("invalid tokens cleanup mode %s is not valid", mode)
+	}
 	return nil
 }
 
@@ -114,30 +188,176 @@ func (h *Handler) feedbackService(msg *Message) string {
 	return APNS
 }
 
-func (h *Handler) handleSuccessMessage(jobID string) {
+// feedbackCache returns the cache of the feedbacks of the job or test pushes,
+// it must be called holding the lock since the flush swaps the caches
+func (h *Handler) feedbackCache(isTestPush bool) map[string]map[string]int {
+	if isTestPush {
+		return h.TestFeedbackCache
+	}
+	return h.FeedbackCache
+}
+
+func (h *Handler) handleSuccessMessage(id string, isTestPush bool) {
 	feedbackCacheMutex.Lock()
-	if _, ok := h.FeedbackCache[jobID]; ok {
-		h.FeedbackCache[jobID]["ack"]++
+	cache := h.feedbackCache(isTestPush)
+	if _, ok := cache[id]; ok {
+		cache[id]["ack"]++
 	} else {
-		h.FeedbackCache[jobID] = map[string]int{
+		cache[id] = map[string]int{
 			"ack": 1,
 		}
 	}
 	feedbackCacheMutex.Unlock()
 }
 
-func (h *Handler) handleErrorMessage(jobID string, err string) {
+func (h *Handler) handleErrorMessage(id string, err string, isTestPush bool) {
 	feedbackCacheMutex.Lock()
-	if _, ok := h.FeedbackCache[jobID]; ok {
-		h.FeedbackCache[jobID][err]++
+	cache := h.feedbackCache(isTestPush)
+	if _, ok := cache[id]; ok {
+		cache[id][err]++
 	} else {
-		h.FeedbackCache[jobID] = map[string]int{
+		cache[id] = map[string]int{
 			err: 1,
 		}
 	}
 	feedbackCacheMutex.Unlock()
 }
 
+// handleOpenMessage counts the open in the feedbacks and, for job pushes, the hour of the day in UTC
+// in which the user opened it, which is used to send the pushes of jobs at the user optimal time
+func (h *Handler) handleOpenMessage(id string, message *Message, isTestPush bool) {
+	openedAt := time.Now()
+	if message.Timestamp > 0 {
+		openedAt = time.Unix(message.Timestamp, 0)
+	}
+	userID, _ := message.Metadata["userId"].(string)
+	feedbackCacheMutex.Lock()
+	defer feedbackCacheMutex.Unlock()
+	cache := h.feedbackCache(isTestPush)
+	if _, ok := cache[id]; !ok {
+		cache[id] = map[string]int{}
+	}
+	cache[id][OpenEvent]++
+	if isTestPush || len(userID) == 0 {
+		return
+	}
+	if _, ok := h.OpenHoursCache[id]; !ok {
+		h.OpenHoursCache[id] = map[string]map[int]int{}
+	}
+	if _, ok := h.OpenHoursCache[id][userID]; !ok {
+		h.OpenHoursCache[id][userID] = map[int]int{}
+	}
+	h.OpenHoursCache[id][userID][openedAt.UTC().Hour()]++
+}
+
+// handleJourneyMessage records that the user of a journey step push got it and, for open events, opened it,
+// which decides the users of the next steps of the journey
+func (h *Handler) handleJourneyMessage(id string, message *Message, opened bool) {
+	if _, ok := message.Metadata["journeyId"].(string); !ok {
+		return
+	}
+	userID, _ := message.Metadata["userId"].(string)
+	if len(userID) == 0 {
+		return
+	}
+	feedbackCacheMutex.Lock()
+	defer feedbackCacheMutex.Unlock()
+	if _, ok := h.JourneyCache[id]; !ok {
+		h.JourneyCache[id] = map[string]*JourneyOutcome{}
+	}
+	if _, ok := h.JourneyCache[id][userID]; !ok {
+		h.JourneyCache[id][userID] = &JourneyOutcome{}
+	}
+	h.JourneyCache[id][userID].Delivered = true
+	h.JourneyCache[id][userID].Opened = h.JourneyCache[id][userID].Opened || opened
+}
+
+// handleDeliveryMessage records the feedback of a job push to be written to its entry in the delivery log
+func (h *Handler) handleDeliveryMessage(message *Message, result string, errorKey string) {
+	if !h.Config.GetBool("deliveryLog.enabled") {
+		return
+	}
+	muid, _ := message.Metadata["muid"].(string)
+	if len(muid) == 0 {
+		return
+	}
+	pushedAt := time.Now().UnixNano()
+	if pushTime, ok := message.Metadata["pushTime"].(float64); ok && pushTime > 0 {
+		pushedAt = time.Unix(int64(pushTime), 0).UnixNano()
+	}
+	feedbackCacheMutex.Lock()
+	defer feedbackCacheMutex.Unlock()
+	h.DeliveryCache[muid] = &DeliveryResult{
+		Result:   result,
+		ErrorKey: errorKey,
+		PushedAt: pushedAt,
+	}
+}
+
+// normalizeErrorKey lets the configured errors match the keys of the different pushers,
+// e.g. BadDeviceToken, bad-device-token and BAD_DEVICE_TOKEN
+func normalizeErrorKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(key))
+}
+
+// isInvalidTokenError returns whether the error of the feedback means that the token will never be valid again
+func (h *Handler) isInvalidTokenError(service string, errorKey string) bool {
+	for _, key := range h.Config.GetStringSlice(fmt.Sprintf("feedbackListener.invalidTokens.%s", service)) {
+		if normalizeErrorKey(key) == normalizeErrorKey(errorKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleInvalidTokenMessage records the token of the job push to be cleaned up if the error means it is invalid
+func (h *Handler) handleInvalidTokenMessage(id string, service string, message *Message, errorKey string) {
+	if !h.Config.GetBool("feedbackListener.invalidTokens.enabled") || !h.isInvalidTokenError(service, errorKey) {
+		return
+	}
+	token := message.DeviceToken
+	if service == GCM {
+		token = message.From
+	}
+	if len(token) == 0 {
+		return
+	}
+	feedbackCacheMutex.Lock()
+	defer feedbackCacheMutex.Unlock()
+	if _, ok := h.InvalidTokens[id]; !ok {
+		h.InvalidTokens[id] = map[string]map[string]bool{}
+	}
+	if _, ok := h.InvalidTokens[id][service]; !ok {
+		h.InvalidTokens[id][service] = map[string]bool{}
+	}
+	h.InvalidTokens[id][service][token] = true
+}
+
+// handleExperimentMessage counts the feedback or open event of a push of a job experiment in its variant
+func (h *Handler) handleExperimentMessage(id string, message *Message, event string) {
+	variant, _ := message.Metadata["variant"].(string)
+	if len(variant) == 0 {
+		return
+	}
+	feedbackCacheMutex.Lock()
+	defer feedbackCacheMutex.Unlock()
+	if _, ok := h.ExperimentCache[id]; !ok {
+		h.ExperimentCache[id] = map[string]*model.ExperimentVariant{}
+	}
+	if _, ok := h.ExperimentCache[id][variant]; !ok {
+		h.ExperimentCache[id][variant] = &model.ExperimentVariant{Name: variant}
+	}
+	counters := h.ExperimentCache[id][variant]
+	switch event {
+	case OpenEvent:
+		counters.Opened++
+	case model.AckDeliveryResult:
+		counters.Delivered++
+	default:
+		counters.Failed++
+	}
+}
+
 func (h *Handler) handleMessage(msg []byte) {
 	defer func() {
 		if h.pendingMessagesWG != nil {
@@ -167,56 +387,328 @@ func (h *Handler) handleMessage(msg []byte) {
 		return
 	}
 
-	if message.Metadata["jobId"] == nil || len(message.Metadata["jobId"].(string)) == 0 {
+	// test pushes are not part of a job, their feedbacks go to the test send
+	id, _ := message.Metadata["jobId"].(string)
+	isTestPush := false
+	if testID, ok := message.Metadata["testId"].(string); ok && len(testID) > 0 {
+		id = testID
+		isTestPush = true
+	}
+
+	if len(id) == 0 {
+		return
+	}
+
+	if message.Event == OpenEvent {
+		h.handleOpenMessage(id, &message, isTestPush)
+		h.handleJourneyMessage(id, &message, true)
+		if !isTestPush {
+			h.handleExperimentMessage(id, &message, OpenEvent)
+		}
 		return
 	}
 
 	if len(message.Error) == 0 && (message.Err == nil || len(message.Err) == 0) {
-		h.handleSuccessMessage(message.Metadata["jobId"].(string))
+		h.handleSuccessMessage(id, isTestPush)
+		h.handleJourneyMessage(id, &message, false)
+		if !isTestPush {
+			h.handleDeliveryMessage(&message, model.AckDeliveryResult, "")
+			h.handleExperimentMessage(id, &message, model.AckDeliveryResult)
+		}
 	} else {
+		errorKey := message.Error
 		if service == APNS {
-			h.handleErrorMessage(message.Metadata["jobId"].(string), message.Err["Key"].(string))
-		} else if service == GCM {
-			h.handleErrorMessage(message.Metadata["jobId"].(string), message.Error)
+			errorKey = message.Err["Key"].(string)
+		}
+		h.handleErrorMessage(id, errorKey, isTestPush)
+		if !isTestPush {
+			h.handleDeliveryMessage(&message, model.ErrorDeliveryResult, errorKey)
+			h.handleInvalidTokenMessage(id, service, &message, errorKey)
+			h.handleExperimentMessage(id, &message, model.ErrorDeliveryResult)
 		}
 	}
 
 }
 
-func (h *Handler) generatePGIncrJSON(jobID string, values map[string]int) string {
-	q := "UPDATE jobs SET feedbacks = feedbacks || CONCAT('{"
-	m := []string{}
-	for k, v := range values {
-		m = append(m, fmt.Sprintf(`"%s":',COALESCE(feedbacks->>'%s','0')::int + %d,'`, k, k, v))
+func (h *Handler) generatePGIncrJSON(jobID string, values map[string]int) (string, []interface{}) {
+	return h.generatePGIncrJSONForTable("jobs", jobID, values)
+}
+
+// generatePGIncrJSONForTable increments the counters of the feedbacks of the row of the table,
+// the id and the keys come from the messages so they are sent as params
+func (h *Handler) generatePGIncrJSONForTable(table string, id string, values map[string]int) (string, []interface{}) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
 	}
-	joinedModifiers := strings.Join(m, ",")
-	endQ := fmt.Sprintf(`}')::jsonb WHERE id = '%s';`, jobID)
-	query := fmt.Sprintf("%s%s%s", q, joinedModifiers, endQ)
+	sort.Strings(keys)
+	m := make([]string, len(keys))
+	params := []interface{}{}
+	for idx, k := range keys {
+		m[idx] = "?, COALESCE((feedbacks->>?)::int, 0) + ?"
+		params = append(params, k, k, values[k])
+	}
+	params = append(params, id)
+	query := fmt.Sprintf("UPDATE %s SET feedbacks = feedbacks || jsonb_build_object(%s) WHERE id = ?;", table, strings.Join(m, ", "))
 	h.Logger.Debug("will run query", zap.String("query", query))
-	return query
+	return query, params
 }
 
+func (h *Handler) generatePGUpsertOpenHours(jobID string, openHours map[string]map[int]int, updatedAt int64) (string, []interface{}) {
+	values := []string{}
+	params := []interface{}{updatedAt}
+	for userID, hours := range openHours {
+		for hour, opens := range hours {
+			values = append(values, "(?, ?, ?)")
+			params = append(params, userID, hour, opens)
+		}
+	}
+	params = append(params, jobID)
+	query := fmt.Sprintf(
+		"INSERT INTO user_open_hours (app_id, user_id, hour, opens, updated_at) SELECT jobs.app_id, v.user_id, v.hour, v.opens, ? FROM jobs, (VALUES %s) AS v(user_id, hour, opens) WHERE jobs.id = ? ON CONFLICT (app_id, user_id, hour) DO UPDATE SET opens = user_open_hours.opens + EXCLUDED.opens, updated_at = EXCLUDED.updated_at;",
+		strings.Join(values, ","),
+	)
+	return query, params
+}
+
+func (h *Handler) generatePGUpsertJourneyUsers(jobID string, outcomes map[string]*JourneyOutcome, updatedAt int64) (string, []interface{}) {
+	values := []string{}
+	params := []interface{}{updatedAt}
+	for userID, outcome := range outcomes {
+		values = append(values, "(?, ?::boolean, ?::boolean)")
+		params = append(params, userID, outcome.Delivered, outcome.Opened)
+	}
+	params = append(params, jobID)
+	query := fmt.Sprintf(
+		"INSERT INTO journey_users (journey_id, step, user_id, delivered, opened, updated_at) SELECT jobs.journey_id, jobs.journey_step, v.user_id, v.delivered, v.opened, ? FROM jobs, (VALUES %s) AS v(user_id, delivered, opened) WHERE jobs.id = ? AND jobs.journey_id IS NOT NULL ON CONFLICT (journey_id, step, user_id) DO UPDATE SET delivered = journey_users.delivered OR EXCLUDED.delivered, opened = journey_users.opened OR EXCLUDED.opened, updated_at = EXCLUDED.updated_at;",
+		strings.Join(values, ","),
+	)
+	return query, params
+}
+
+func (h *Handler) generatePGUpsertExperimentVariants(jobID string, variants map[string]*model.ExperimentVariant, updatedAt int64) (string, []interface{}) {
+	values := []string{}
+	params := []interface{}{updatedAt}
+	for name, counters := range variants {
+		values = append(values, "(?, ?::integer, ?::integer, ?::integer)")
+		params = append(params, name, counters.Delivered, counters.Failed, counters.Opened)
+	}
+	params = append(params, jobID)
+	query := fmt.Sprintf(
+		"INSERT INTO experiment_variants (job_id, name, delivered, failed, opened, updated_at) SELECT jobs.id, v.name, v.delivered, v.failed, v.opened, ? FROM jobs, (VALUES %s) AS v(name, delivered, failed, opened) WHERE jobs.id = ? ON CONFLICT (job_id, name) DO UPDATE SET delivered = experiment_variants.delivered + EXCLUDED.delivered, failed = experiment_variants.failed + EXCLUDED.failed, opened = experiment_variants.opened + EXCLUDED.opened, updated_at = EXCLUDED.updated_at;",
+		strings.Join(values, ","),
+	)
+	return query, params
+}
+
+// generatePGUpdateDeliveries updates the results of the deliveries, the produced_at bounds around the push times
+// let postgres skip the partitions of the other days of the delivery log
+func (h *Handler) generatePGUpdateDeliveries(results map[string]*DeliveryResult, updatedAt int64) (string, []interface{}) {
+	values := []string{}
+	params := []interface{}{updatedAt}
+	var minPushedAt, maxPushedAt int64
+	for muid, result := range results {
+		values = append(values, "(?, ?, ?)")
+		params = append(params, muid, result.Result, result.ErrorKey)
+		if minPushedAt == 0 || result.PushedAt < minPushedAt {
+			minPushedAt = result.PushedAt
+		}
+		if result.PushedAt > maxPushedAt {
+			maxPushedAt = result.PushedAt
+		}
+	}
+	day := (24 * time.Hour).Nanoseconds()
+	params = append(params, minPushedAt-day, maxPushedAt+day)
+	query := fmt.Sprintf(
+		"UPDATE deliveries AS d SET result = v.result, error_key = v.error_key, updated_at = ? FROM (VALUES %s) AS v(muid, result, error_key) WHERE d.muid = v.muid AND d.produced_at >= ? AND d.produced_at < ?;",
+		strings.Join(values, ","),
+	)
+	return query, params
+}
+
+// flushFeedbacks writes the caches to the databases every flush interval
 func (h *Handler) flushFeedbacks() {
 	ticker := time.NewTicker(h.FlushInterval)
 	for range ticker.C {
-		feedbackCacheMutex.Lock()
-		numFeedbacks := len(h.FeedbackCache)
-		if numFeedbacks > 0 {
-			h.Logger.Info("flushing feedbacks", zap.Int("feedbacks", numFeedbacks))
+		h.flush()
+	}
+}
+
+// flush writes the caches to the databases, each cache is swapped for an empty one while holding the lock
+// and written after releasing it so the handling of the messages is not blocked by the writes
+func (h *Handler) flush() {
+	feedbackCacheMutex.Lock()
+	feedbackCache, testFeedbackCache := h.FeedbackCache, h.TestFeedbackCache
+	h.FeedbackCache = map[string]map[string]int{}
+	h.TestFeedbackCache = map[string]map[string]int{}
+	feedbackCacheMutex.Unlock()
+
+	numFeedbacks := len(feedbackCache) + len(testFeedbackCache)
+	if numFeedbacks > 0 {
+		h.Logger.Info("flushing feedbacks", zap.Int("feedbacks", numFeedbacks))
+	} else {
+		h.Logger.Debug("no feedbacks to flush")
+	}
+	h.flushCache("jobs", feedbackCache)
+	h.flushCache("test_sends", testFeedbackCache)
+	h.flushOpenHours()
+	h.flushJourneyUsers()
+	h.flushExperimentVariants()
+	h.flushDeliveries()
+	h.flushInvalidTokens()
+}
+
+func (h *Handler) flushCache(table string, cache map[string]map[string]int) {
+	for k, v := range cache {
+		query, params := h.generatePGIncrJSONForTable(table, k, v)
+		results, err := h.MarathonDB.DB.ExecOne(query, params...)
+		if err != nil {
+			h.Logger.Error("error updating feedbacks table", zap.String("table", table), zap.Error(err))
 		} else {
-			h.Logger.Debug("no feedbacks to flush")
+			h.Logger.Debug("successfully updated rows", zap.Int("rows affected", results.RowsAffected()))
+		}
+		delete(cache, k)
+	}
+}
+
+func (h *Handler) flushOpenHours() {
+	feedbackCacheMutex.Lock()
+	cache := h.OpenHoursCache
+	h.OpenHoursCache = map[string]map[string]map[int]int{}
+	feedbackCacheMutex.Unlock()
+
+	updatedAt := time.Now().UnixNano()
+	for jobID, openHours := range cache {
+		query, params := h.generatePGUpsertOpenHours(jobID, openHours, updatedAt)
+		_, err := h.MarathonDB.DB.Exec(query, params...)
+		if err != nil {
+			h.Logger.Error("error updating user open hours", zap.String("jobId", jobID), zap.Error(err))
 		}
-		for k, v := range h.FeedbackCache {
-			query := h.generatePGIncrJSON(k, v)
-			results, err := h.MarathonDB.DB.ExecOne(query)
+	}
+}
+
+func (h *Handler) flushJourneyUsers() {
+	feedbackCacheMutex.Lock()
+	cache := h.JourneyCache
+	h.JourneyCache = map[string]map[string]*JourneyOutcome{}
+	feedbackCacheMutex.Unlock()
+
+	updatedAt := time.Now().UnixNano()
+	for jobID, outcomes := range cache {
+		query, params := h.generatePGUpsertJourneyUsers(jobID, outcomes, updatedAt)
+		_, err := h.MarathonDB.DB.Exec(query, params...)
+		if err != nil {
+			h.Logger.Error("error updating journey users", zap.String("jobId", jobID), zap.Error(err))
+		}
+	}
+}
+
+func (h *Handler) flushExperimentVariants() {
+	feedbackCacheMutex.Lock()
+	cache := h.ExperimentCache
+	h.ExperimentCache = map[string]map[string]*model.ExperimentVariant{}
+	feedbackCacheMutex.Unlock()
+
+	updatedAt := time.Now().UnixNano()
+	for jobID, variants := range cache {
+		query, params := h.generatePGUpsertExperimentVariants(jobID, variants, updatedAt)
+		_, err := h.MarathonDB.DB.Exec(query, params...)
+		if err != nil {
+			h.Logger.Error("error updating experiment variants", zap.String("jobId", jobID), zap.Error(err))
+		}
+	}
+}
+
+func (h *Handler) flushDeliveries() {
+	feedbackCacheMutex.Lock()
+	cache := h.DeliveryCache
+	h.DeliveryCache = map[string]*DeliveryResult{}
+	feedbackCacheMutex.Unlock()
+
+	if len(cache) == 0 {
+		return
+	}
+	query, params := h.generatePGUpdateDeliveries(cache, time.Now().UnixNano())
+	_, err := h.MarathonDB.DB.Exec(query, params...)
+	if err != nil {
+		h.Logger.Error("error updating the delivery log", zap.Int("deliveries", len(cache)), zap.Error(err))
+	}
+}
+
+// cleanupInvalidTokens deletes the invalid tokens of an app service from the push db or sends them to the cleanup topic
+// in batches and returns how many were removed
+func (h *Handler) cleanupInvalidTokens(appName string, service string, tokens []string) (int, error) {
+	batchSize := h.Config.GetInt("feedbackListener.invalidTokens.batchSize")
+	if batchSize <= 0 {
+		batchSize = len(tokens)
+	}
+	removed := 0
+	for start := 0; start < len(tokens); start += batchSize {
+		end := start + batchSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		batch := tokens[start:end]
+		if h.Config.GetString("feedbackListener.invalidTokens.mode") == TopicInvalidTokensMode {
+			message, err := json.Marshal(map[string]interface{}{
+				"app":     appName,
+				"service": service,
+				"tokens":  batch,
+			})
+			if err != nil {
+				return removed, err
+			}
+			err = h.Producer.SendMessage(h.Config.GetString("feedbackListener.invalidTokens.topic"), message)
 			if err != nil {
-				h.Logger.Error("error updating feedbacks table", zap.Error(err))
-			} else {
-				h.Logger.Debug("successfully updated rows", zap.Int("rows affected", results.RowsAffected()))
+				return removed, err
 			}
-			delete(h.FeedbackCache, k)
+			removed += len(batch)
+			continue
+		}
+		query := fmt.Sprintf("DELETE FROM %s_%s WHERE token IN (?);", appName, service)
+		res, err := h.PushDB.DB.Exec(query, pg.In(batch))
+		if err != nil {
+			return removed, err
+		}
+		removed += res.RowsAffected()
+	}
+	return removed, nil
+}
+
+// flushInvalidTokens cleans up the invalid tokens of each job and adds how many were removed to the job
+// the tokens are swapped out of the cache under the lock so the cleanup does not block the handling of the messages
+func (h *Handler) flushInvalidTokens() {
+	feedbackCacheMutex.Lock()
+	invalidTokens := h.InvalidTokens
+	h.InvalidTokens = map[string]map[string]map[string]bool{}
+	feedbackCacheMutex.Unlock()
+
+	for jobID, tokensByService := range invalidTokens {
+		var appName string
+		_, err := h.MarathonDB.DB.QueryOne(pg.Scan(&appName), "SELECT apps.name FROM jobs JOIN apps ON apps.id = jobs.app_id WHERE jobs.id = ?", jobID)
+		if err != nil {
+			h.Logger.Error("error getting the app of the invalid tokens", zap.String("jobId", jobID), zap.Error(err))
+			continue
+		}
+		removed := 0
+		for service, tokenSet := range tokensByService {
+			tokens := make([]string, 0, len(tokenSet))
+			for token := range tokenSet {
+				tokens = append(tokens, token)
+			}
+			serviceRemoved, err := h.cleanupInvalidTokens(appName, service, tokens)
+			if err != nil {
+				h.Logger.Error("error cleaning up invalid tokens", zap.String("jobId", jobID), zap.String("service", service), zap.Error(err))
+			}
+			removed += serviceRemoved
+		}
+		if removed == 0 {
+			continue
+		}
+		_, err = h.MarathonDB.DB.Exec("UPDATE jobs SET removed_tokens = removed_tokens + ? WHERE id = ?;", removed, jobID)
+		if err != nil {
+			h.Logger.Error("error updating the job removed tokens", zap.String("jobId", jobID), zap.Error(err))
 		}
-		feedbackCacheMutex.Unlock()
 	}
 }
 
@@ -25,6 +25,7 @@ package feedback
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -32,10 +33,24 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/marathon/extensions"
+	"github.com/topfreegames/marathon/model"
 	"github.com/topfreegames/marathon/testing"
 	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
 )
 
+// blockingProducer blocks the messages sent until it is released
+type blockingProducer struct {
+	sending chan bool
+	release chan bool
+}
+
+func (p *blockingProducer) SendMessage(topic string, message []byte) error {
+	p.sending <- true
+	<-p.release
+	return nil
+}
+
 var _ = Describe("Feedback Handler", func() {
 	var logger zap.Logger
 	var config *viper.Viper
@@ -82,19 +97,35 @@ var _ = Describe("Feedback Handler", func() {
 				"ack":       10,
 				"bad_token": 20,
 			}
-			q := handler.generatePGIncrJSON(jobID.String(), m)
-			Expect(q).Should(SatisfyAny(
-				Equal(fmt.Sprintf(`UPDATE jobs SET feedbacks = feedbacks || CONCAT('{"ack":',COALESCE(feedbacks->>'ack','0')::int + 10,',"bad_token":',COALESCE(feedbacks->>'bad_token','0')::int + 20,'}')::jsonb WHERE id = '%s';`, jobID.String())),
-				Equal(fmt.Sprintf(`UPDATE jobs SET feedbacks = feedbacks || CONCAT('{"bad_token":',COALESCE(feedbacks->>'bad_token','0')::int + 20,',"ack":',COALESCE(feedbacks->>'ack','0')::int + 10,'}')::jsonb WHERE id = '%s';`, jobID.String())),
-			))
+			q, params := handler.generatePGIncrJSON(jobID.String(), m)
+			Expect(q).To(Equal("UPDATE jobs SET feedbacks = feedbacks || jsonb_build_object(?, COALESCE((feedbacks->>?)::int, 0) + ?, ?, COALESCE((feedbacks->>?)::int, 0) + ?) WHERE id = ?;"))
+			Expect(params).To(Equal([]interface{}{"ack", "ack", 10, "bad_token", "bad_token", 20, jobID.String()}))
 		})
 
 		It("should generate the valid postgres query", func() {
 			m := map[string]int{
 				"bad_token": 20,
 			}
-			q := handler.generatePGIncrJSON(jobID.String(), m)
-			Expect(q).To(Equal(fmt.Sprintf(`UPDATE jobs SET feedbacks = feedbacks || CONCAT('{"bad_token":',COALESCE(feedbacks->>'bad_token','0')::int + 20,'}')::jsonb WHERE id = '%s';`, jobID.String())))
+			q, params := handler.generatePGIncrJSON(jobID.String(), m)
+			Expect(q).To(Equal("UPDATE jobs SET feedbacks = feedbacks || jsonb_build_object(?, COALESCE((feedbacks->>?)::int, 0) + ?) WHERE id = ?;"))
+			Expect(params).To(Equal([]interface{}{"bad_token", "bad_token", 20, jobID.String()}))
+		})
+
+		It("should generate the valid postgres query for another table", func() {
+			m := map[string]int{
+				"bad_token": 20,
+			}
+			q, params := handler.generatePGIncrJSONForTable("test_sends", jobID.String(), m)
+			Expect(q).To(Equal("UPDATE test_sends SET feedbacks = feedbacks || jsonb_build_object(?, COALESCE((feedbacks->>?)::int, 0) + ?) WHERE id = ?;"))
+			Expect(params).To(Equal([]interface{}{"bad_token", "bad_token", 20, jobID.String()}))
+		})
+
+		It("should send the ids and error keys of the messages as params", func() {
+			id := "1'; DROP TABLE test_sends; --"
+			q, params := handler.generatePGIncrJSONForTable("test_sends", id, map[string]int{`bad"key'`: 1})
+			Expect(q).NotTo(ContainSubstring("DROP"))
+			Expect(q).NotTo(ContainSubstring("bad"))
+			Expect(params).To(Equal([]interface{}{`bad"key'`, `bad"key'`, 1, id}))
 		})
 	})
 
@@ -123,6 +154,117 @@ var _ = Describe("Feedback Handler", func() {
 			}))
 		})
 
+		It("should aggregate test push feedbacks by test id", func() {
+			testID := uuid.NewV4()
+			m := fmt.Sprintf("{\"from\":\"F8DIN2OFA0X3IOV897KUVPWU9CR2GNGUIOODWUFFVMJTFGQB45CY0ZEKXV758JOY0Z46P2CUCVL9HMNI3UGE5YXZYDM1AM0DX5ENIEGESOOLOV23YCKXG39ODFJXCU3UZFIW5ZCWLSEGGM1MY7SSGT07\",\"message_id\":\"422fc070-bf0e-4005-86e9-6aafaee9f3dd\",\"message_type\":\"ack\",\"error\": null,\"category\":\"\",\"metadata\":{\"testId\":\"%s\",\"pushType\":\"test\"}}", testID.String())
+			handler.handleMessage([]byte(m))
+			Expect(len(handler.FeedbackCache)).To(Equal(0))
+			Expect(len(handler.TestFeedbackCache)).To(Equal(1))
+			Expect(handler.TestFeedbackCache[testID.String()]).To(BeEquivalentTo(map[string]int{
+				"ack": 1,
+			}))
+		})
+
+		It("should count open events and the hour the user opened the push", func() {
+			openedAt := time.Date(2019, time.October, 1, 21, 30, 0, 0, time.UTC)
+			m := fmt.Sprintf("{\"event\":\"open\",\"timestamp\":%d,\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\"}}", openedAt.Unix(), jobID.String())
+			handler.handleMessage([]byte(m))
+			handler.handleMessage([]byte(m))
+			Expect(handler.FeedbackCache[jobID.String()]).To(BeEquivalentTo(map[string]int{
+				"open": 2,
+			}))
+			Expect(handler.OpenHoursCache[jobID.String()]).To(BeEquivalentTo(map[string]map[int]int{
+				"user1": {21: 2},
+			}))
+		})
+
+		It("should not record the open hours of test pushes", func() {
+			testID := uuid.NewV4()
+			m := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"testId\":\"%s\",\"userId\":\"user1\"}}", testID.String())
+			handler.handleMessage([]byte(m))
+			Expect(handler.TestFeedbackCache[testID.String()]).To(BeEquivalentTo(map[string]int{
+				"open": 1,
+			}))
+			Expect(handler.OpenHoursCache).To(BeEmpty())
+		})
+
+		It("should record the users that got and opened the pushes of journey steps", func() {
+			ack := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\",\"journeyId\":\"%s\"}}", jobID.String(), uuid.NewV4().String())
+			handler.handleMessage([]byte(ack))
+			open := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user2\",\"journeyId\":\"%s\"}}", jobID.String(), uuid.NewV4().String())
+			handler.handleMessage([]byte(open))
+			Expect(handler.JourneyCache[jobID.String()]).To(Equal(map[string]*JourneyOutcome{
+				"user1": {Delivered: true},
+				"user2": {Delivered: true, Opened: true},
+			}))
+		})
+
+		It("should not record the users of pushes that are not of journeys", func() {
+			m := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\"}}", jobID.String())
+			handler.handleMessage([]byte(m))
+			Expect(handler.JourneyCache).To(BeEmpty())
+		})
+
+		It("should record the results of the job pushes for the delivery log", func() {
+			ack := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"jobId\":\"%s\",\"muid\":\"muid1\",\"pushTime\":1500000000}}", jobID.String())
+			handler.handleMessage([]byte(ack))
+			nack := fmt.Sprintf("{\"DeviceToken\":\"token\",\"Err\":{\"Key\":\"unregistered\"},\"metadata\":{\"jobId\":\"%s\",\"muid\":\"muid2\",\"pushTime\":1500000000}}", jobID.String())
+			handler.handleMessage([]byte(nack))
+			Expect(handler.DeliveryCache).To(Equal(map[string]*DeliveryResult{
+				"muid1": {Result: "ack", PushedAt: 1500000000 * int64(time.Second)},
+				"muid2": {Result: "error", ErrorKey: "unregistered", PushedAt: 1500000000 * int64(time.Second)},
+			}))
+		})
+
+		It("should not record the results of test pushes for the delivery log", func() {
+			m := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"testId\":\"%s\",\"muid\":\"muid1\"}}", uuid.NewV4().String())
+			handler.handleMessage([]byte(m))
+			Expect(handler.DeliveryCache).To(BeEmpty())
+		})
+
+		It("should not record the results of the pushes if the delivery log is disabled", func() {
+			config.Set("deliveryLog.enabled", false)
+			m := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"jobId\":\"%s\",\"muid\":\"muid1\"}}", jobID.String())
+			handler.handleMessage([]byte(m))
+			Expect(handler.DeliveryCache).To(BeEmpty())
+		})
+
+		It("should record the invalid tokens of the job pushes if their cleanup is enabled", func() {
+			config.Set("feedbackListener.invalidTokens.enabled", true)
+			apns := fmt.Sprintf("{\"DeviceToken\":\"token1\",\"Err\":{\"Key\":\"BadDeviceToken\"},\"metadata\":{\"jobId\":\"%s\"}}", jobID.String())
+			handler.handleMessage([]byte(apns))
+			gcm := fmt.Sprintf("{\"from\":\"token2\",\"message_id\":\"1\",\"message_type\":\"nack\",\"error\":\"DEVICE_UNREGISTERED\",\"metadata\":{\"jobId\":\"%s\"}}", jobID.String())
+			handler.handleMessage([]byte(gcm))
+			other := fmt.Sprintf("{\"DeviceToken\":\"token3\",\"Err\":{\"Key\":\"missing-topic\"},\"metadata\":{\"jobId\":\"%s\"}}", jobID.String())
+			handler.handleMessage([]byte(other))
+			Expect(handler.InvalidTokens).To(Equal(map[string]map[string]map[string]bool{
+				jobID.String(): {
+					"apns": {"token1": true},
+					"gcm":  {"token2": true},
+				},
+			}))
+		})
+
+		It("should not record the invalid tokens if their cleanup is disabled", func() {
+			m := fmt.Sprintf("{\"DeviceToken\":\"token1\",\"Err\":{\"Key\":\"Unregistered\"},\"metadata\":{\"jobId\":\"%s\"}}", jobID.String())
+			handler.handleMessage([]byte(m))
+			Expect(handler.InvalidTokens).To(BeEmpty())
+		})
+
+		It("should count the feedbacks and open events of the experiment pushes by variant", func() {
+			ack := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"jobId\":\"%s\",\"variant\":\"b\"}}", jobID.String())
+			handler.handleMessage([]byte(ack))
+			handler.handleMessage([]byte(ack))
+			nack := fmt.Sprintf("{\"message_type\":\"nack\",\"message_id\":\"1\",\"error\":\"BAD_REGISTRATION\",\"metadata\":{\"jobId\":\"%s\",\"variant\":\"control\"}}", jobID.String())
+			handler.handleMessage([]byte(nack))
+			open := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\",\"variant\":\"b\"}}", jobID.String())
+			handler.handleMessage([]byte(open))
+			Expect(handler.ExperimentCache[jobID.String()]).To(Equal(map[string]*model.ExperimentVariant{
+				"b":       {Name: "b", Delivered: 2, Opened: 1},
+				"control": {Name: "control", Failed: 1},
+			}))
+		})
+
 		It("should do nothing if message has no metadata", func() {
 			Expect(len(handler.FeedbackCache)).To(Equal(0))
 			m := "{\"from\":\"F8DIN2OFA0X3IOV897KUVPWU9CR2GNGUIOODWUFFVMJTFGQB45CY0ZEKXV758JOY0Z46P2CUCVL9HMNI3UGE5YXZYDM1AM0DX5ENIEGESOOLOV23YCKXG39ODFJXCU3UZFIW5ZCWLSEGGM1MY7SSGT07\",\"message_id\":\"422fc070-bf0e-4005-86e9-6aafaee9f3dd\",\"message_type\":\"ack\",\"error\": null,\"category\":\"\"}"
@@ -173,6 +315,226 @@ var _ = Describe("Feedback Handler", func() {
 		})
 	})
 
+	Describe("flush", func() {
+		It("should not lose or race on the feedbacks handled while flushing", func() {
+			mockPG := testing.NewPGMock(0, 0, nil)
+			mockDB, err := extensions.NewPGClient("db", config, logger, mockPG)
+			Expect(err).NotTo(HaveOccurred())
+			h, err := NewHandler(config, logger, nil, mockDB)
+			Expect(err).NotTo(HaveOccurred())
+			m := fmt.Sprintf("{\"DeviceToken\":\"token\",\"metadata\":{\"jobId\":\"%s\"}}", jobID.String())
+			testM := fmt.Sprintf("{\"DeviceToken\":\"token\",\"metadata\":{\"testId\":\"%s\"}}", uuid.NewV4().String())
+
+			handled := make(chan bool)
+			go func() {
+				for i := 0; i < 1000; i++ {
+					h.handleMessage([]byte(m))
+					h.handleMessage([]byte(testM))
+				}
+				close(handled)
+			}()
+			flushes := 0
+			for done := false; !done; flushes++ {
+				select {
+				case <-handled:
+					done = true
+				default:
+				}
+				h.flush()
+			}
+
+			Expect(h.FeedbackCache).To(BeEmpty())
+			Expect(h.TestFeedbackCache).To(BeEmpty())
+			Expect(flushes).To(BeNumerically(">", 0))
+			acks := map[string]int{}
+			for _, op := range mockPG.ExecOnes {
+				query := op[0].(string)
+				params := op[1].([]interface{})
+				table := strings.Fields(query)[1]
+				acks[table] += params[2].(int)
+			}
+			Expect(acks).To(Equal(map[string]int{"jobs": 1000, "test_sends": 1000}))
+		})
+	})
+
+	Describe("generatePGUpsertOpenHours", func() {
+		It("should generate the valid postgres query", func() {
+			q, params := handler.generatePGUpsertOpenHours(jobID.String(), map[string]map[int]int{"user1": {21: 2}}, 10)
+			Expect(q).To(Equal("INSERT INTO user_open_hours (app_id, user_id, hour, opens, updated_at) SELECT jobs.app_id, v.user_id, v.hour, v.opens, ? FROM jobs, (VALUES (?, ?, ?)) AS v(user_id, hour, opens) WHERE jobs.id = ? ON CONFLICT (app_id, user_id, hour) DO UPDATE SET opens = user_open_hours.opens + EXCLUDED.opens, updated_at = EXCLUDED.updated_at;"))
+			Expect(params).To(Equal([]interface{}{int64(10), "user1", 21, 2, jobID.String()}))
+		})
+	})
+
+	Describe("flushOpenHours", func() {
+		It("should delete map keys and exec query in postgres", func() {
+			mockPG := testing.NewPGMock(0, 0, nil)
+			mockDB, err := extensions.NewPGClient("db", config, logger, mockPG)
+			Expect(err).NotTo(HaveOccurred())
+			h, err := NewHandler(config, logger, nil, mockDB)
+			Expect(err).NotTo(HaveOccurred())
+			m := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\"}}", jobID.String())
+			h.handleMessage([]byte(m))
+			Expect(h.OpenHoursCache).To(HaveLen(1))
+			h.flushOpenHours()
+			Expect(h.OpenHoursCache).To(BeEmpty())
+			Expect(mockPG.Execs).To(HaveLen(1))
+		})
+	})
+
+	Describe("generatePGUpsertJourneyUsers", func() {
+		It("should generate the valid postgres query", func() {
+			q, params := handler.generatePGUpsertJourneyUsers(jobID.String(), map[string]*JourneyOutcome{"user1": {Delivered: true, Opened: true}}, 10)
+			Expect(q).To(Equal("INSERT INTO journey_users (journey_id, step, user_id, delivered, opened, updated_at) SELECT jobs.journey_id, jobs.journey_step, v.user_id, v.delivered, v.opened, ? FROM jobs, (VALUES (?, ?::boolean, ?::boolean)) AS v(user_id, delivered, opened) WHERE jobs.id = ? AND jobs.journey_id IS NOT NULL ON CONFLICT (journey_id, step, user_id) DO UPDATE SET delivered = journey_users.delivered OR EXCLUDED.delivered, opened = journey_users.opened OR EXCLUDED.opened, updated_at = EXCLUDED.updated_at;"))
+			Expect(params).To(Equal([]interface{}{int64(10), "user1", true, true, jobID.String()}))
+		})
+	})
+
+	Describe("flushJourneyUsers", func() {
+		It("should delete map keys and exec query in postgres", func() {
+			mockPG := testing.NewPGMock(0, 0, nil)
+			mockDB, err := extensions.NewPGClient("db", config, logger, mockPG)
+			Expect(err).NotTo(HaveOccurred())
+			h, err := NewHandler(config, logger, nil, mockDB)
+			Expect(err).NotTo(HaveOccurred())
+			m := fmt.Sprintf("{\"event\":\"open\",\"metadata\":{\"jobId\":\"%s\",\"userId\":\"user1\",\"journeyId\":\"%s\"}}", jobID.String(), uuid.NewV4().String())
+			h.handleMessage([]byte(m))
+			Expect(h.JourneyCache).To(HaveLen(1))
+			h.flushJourneyUsers()
+			Expect(h.JourneyCache).To(BeEmpty())
+			Expect(mockPG.Execs).To(HaveLen(1))
+		})
+	})
+
+	Describe("generatePGUpsertExperimentVariants", func() {
+		It("should generate the valid postgres query", func() {
+			q, params := handler.generatePGUpsertExperimentVariants(jobID.String(), map[string]*model.ExperimentVariant{"b": {Name: "b", Delivered: 2, Failed: 1, Opened: 1}}, 10)
+			Expect(q).To(Equal("INSERT INTO experiment_variants (job_id, name, delivered, failed, opened, updated_at) SELECT jobs.id, v.name, v.delivered, v.failed, v.opened, ? FROM jobs, (VALUES (?, ?::integer, ?::integer, ?::integer)) AS v(name, delivered, failed, opened) WHERE jobs.id = ? ON CONFLICT (job_id, name) DO UPDATE SET delivered = experiment_variants.delivered + EXCLUDED.delivered, failed = experiment_variants.failed + EXCLUDED.failed, opened = experiment_variants.opened + EXCLUDED.opened, updated_at = EXCLUDED.updated_at;"))
+			Expect(params).To(Equal([]interface{}{int64(10), "b", 2, 1, 1, jobID.String()}))
+		})
+	})
+
+	Describe("generatePGUpdateDeliveries", func() {
+		It("should generate the valid postgres query", func() {
+			pushedAt := 1500000000 * int64(time.Second)
+			q, params := handler.generatePGUpdateDeliveries(map[string]*DeliveryResult{"muid1": {Result: "error", ErrorKey: "unregistered", PushedAt: pushedAt}}, 10)
+			Expect(q).To(Equal("UPDATE deliveries AS d SET result = v.result, error_key = v.error_key, updated_at = ? FROM (VALUES (?, ?, ?)) AS v(muid, result, error_key) WHERE d.muid = v.muid AND d.produced_at >= ? AND d.produced_at < ?;"))
+			day := int64(24 * time.Hour)
+			Expect(params).To(Equal([]interface{}{int64(10), "muid1", "error", "unregistered", pushedAt - day, pushedAt + day}))
+		})
+	})
+
+	Describe("flushDeliveries", func() {
+		It("should clear the cache and exec query in postgres", func() {
+			mockPG := testing.NewPGMock(0, 0, nil)
+			mockDB, err := extensions.NewPGClient("db", config, logger, mockPG)
+			Expect(err).NotTo(HaveOccurred())
+			h, err := NewHandler(config, logger, nil, mockDB)
+			Expect(err).NotTo(HaveOccurred())
+			m := fmt.Sprintf("{\"message_type\":\"ack\",\"message_id\":\"1\",\"metadata\":{\"jobId\":\"%s\",\"muid\":\"muid1\"}}", jobID.String())
+			h.handleMessage([]byte(m))
+			Expect(h.DeliveryCache).To(HaveLen(1))
+			h.flushDeliveries()
+			Expect(h.DeliveryCache).To(BeEmpty())
+			Expect(mockPG.Execs).To(HaveLen(1))
+		})
+	})
+
+	Describe("flushInvalidTokens", func() {
+		var job *model.Job
+		var tokens []string
+
+		BeforeEach(func() {
+			config.Set("feedbackListener.invalidTokens.enabled", true)
+			var err error
+			handler, err = NewHandler(config, logger, nil)
+			Expect(err).NotTo(HaveOccurred())
+			app := testing.CreateTestApp(handler.MarathonDB.DB)
+			job = testing.CreateTestJob(handler.MarathonDB.DB, app.ID, "invalid-tokens")
+			tokens = []string{uuid.NewV4().String(), uuid.NewV4().String()}
+			for _, token := range tokens {
+				_, err = handler.PushDB.DB.Exec("INSERT INTO testapp_apns (user_id, token, region, locale, tz, adid, fiu, vendor_id) VALUES (?, ?, 'US', 'en', '-0300', '', '', '');", uuid.NewV4().String(), token)
+				Expect(err).NotTo(HaveOccurred())
+				m := fmt.Sprintf("{\"DeviceToken\":\"%s\",\"Err\":{\"Key\":\"Unregistered\"},\"metadata\":{\"jobId\":\"%s\"}}", token, job.ID.String())
+				handler.handleMessage([]byte(m))
+			}
+		})
+
+		AfterEach(func() {
+			handler.PushDB.DB.Exec("DELETE FROM testapp_apns WHERE token IN (?);", pg.In(tokens))
+		})
+
+		It("should delete the invalid tokens from the push db and record them in the job", func() {
+			config.Set("feedbackListener.invalidTokens.batchSize", 1)
+			handler.flushInvalidTokens()
+			Expect(handler.InvalidTokens).To(BeEmpty())
+
+			var count int
+			_, err := handler.PushDB.DB.QueryOne(pg.Scan(&count), "SELECT COUNT(*) FROM testapp_apns WHERE token IN (?);", pg.In(tokens))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(0))
+
+			dbJob := &model.Job{ID: job.ID}
+			err = handler.MarathonDB.DB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.RemovedTokens).To(Equal(2))
+		})
+
+		It("should handle messages while the invalid tokens are cleaned up", func() {
+			config.Set("feedbackListener.invalidTokens.mode", "topic")
+			producer := &blockingProducer{sending: make(chan bool, 1), release: make(chan bool)}
+			handler.Producer = producer
+			flushed := make(chan bool)
+			go func() {
+				handler.flushInvalidTokens()
+				close(flushed)
+			}()
+			Eventually(producer.sending).Should(Receive())
+
+			handled := make(chan bool)
+			go func() {
+				m := fmt.Sprintf("{\"DeviceToken\":\"%s\",\"Err\":{\"Key\":\"Unregistered\"},\"metadata\":{\"jobId\":\"%s\"}}", uuid.NewV4().String(), job.ID.String())
+				handler.handleMessage([]byte(m))
+				close(handled)
+			}()
+			Eventually(handled).Should(BeClosed())
+			close(producer.release)
+			Eventually(flushed).Should(BeClosed())
+			Expect(handler.InvalidTokens).To(HaveLen(1))
+		})
+
+		It("should send the invalid tokens to the cleanup topic in batches if the mode is topic", func() {
+			config.Set("feedbackListener.invalidTokens.mode", "topic")
+			config.Set("feedbackListener.invalidTokens.batchSize", 1)
+			producer := testing.NewFakeKafkaProducer()
+			handler.Producer = producer
+			handler.flushInvalidTokens()
+
+			topic := config.GetString("feedbackListener.invalidTokens.topic")
+			Expect(producer.Messages[topic]).To(HaveLen(2))
+			sent := []string{}
+			for _, m := range producer.Messages[topic] {
+				var message map[string]interface{}
+				err := json.Unmarshal([]byte(m), &message)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(message["app"]).To(Equal("testapp"))
+				Expect(message["service"]).To(Equal("apns"))
+				Expect(message["tokens"]).To(HaveLen(1))
+				sent = append(sent, message["tokens"].([]interface{})[0].(string))
+			}
+			Expect(sent).To(ConsistOf(tokens[0], tokens[1]))
+
+			var count int
+			_, err := handler.PushDB.DB.QueryOne(pg.Scan(&count), "SELECT COUNT(*) FROM testapp_apns WHERE token IN (?);", pg.In(tokens))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(2))
+
+			dbJob := &model.Job{ID: job.ID}
+			err = handler.MarathonDB.DB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.RemovedTokens).To(Equal(2))
+		})
+	})
+
 	Describe("HandleMessages", func() {
 		It("should handle messaages if HandleMessages is called", func() {
 			mChan := make(chan []byte)
@@ -22,8 +22,24 @@
 
 package interfaces
 
+import "time"
+
 // PushProducer interface
 type PushProducer interface {
+	NewPushBatch() PushBatch
+	SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error
 	SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error
 	SendGCMPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error
 }
+
+// PushBatch sends pushes and waits for the delivery confirmation of all of them
+// Wait returns one error per push accepted by SendPush, in the order they were sent
+type PushBatch interface {
+	SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error
+	Wait(timeout time.Duration) []error
+}
+
+// MessageProducer sends raw messages to a kafka topic
+type MessageProducer interface {
+	SendMessage(topic string, message []byte) error
+}
@@ -26,6 +26,30 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	RegisterPushService(&PushService{
+		Name:          "apns",
+		FakeTokenSize: 64,
+		BuildMessage:  buildAPNSMessage,
+		OptionKeys:    APNSOptionKeys,
+		Validate: func(metadata map[string]interface{}) error {
+			_, err := ParseAPNSOptions(metadata)
+			return err
+		},
+	})
+}
+
+// buildAPNSMessage builds an APNSMessage using the apns options set in messageMetadata
+// the options are not sent in the message metadata
+func buildAPNSMessage(deviceToken string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) Message {
+	msg := NewAPNSMessage(deviceToken, pushExpiry, payload, withoutKeys(messageMetadata, APNSOptionKeys), pushMetadata, templateName)
+	// options are validated when the job is created
+	if opts, err := ParseAPNSOptions(messageMetadata); err == nil {
+		msg.ApplyAPNSOptions(opts)
+	}
+	return msg
+}
+
 // APNSMessage might need to update the json encoding if we change to snake case
 // For more info on APNS payload building, refer to this document:
 // https://developer.apple.com/library/content/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/CreatingtheNotificationPayload.html#//apple_ref/doc/uid/TP40008194-CH10-SW1
@@ -33,6 +57,9 @@ type APNSMessage struct {
 	DeviceToken string                 `json:"DeviceToken"`
 	Payload     APNSPayloadContent     `json:"Payload"`
 	PushExpiry  int64                  `json:"push_expiry"`
+	Priority    int                    `json:"priority,omitempty"`
+	PushType    string                 `json:"push_type,omitempty"`
+	CollapseID  string                 `json:"collapse_id,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata"`
 }
 
@@ -69,6 +96,11 @@ func NewAPNSMessage(deviceToken string, pushExpiry int64, aps, messageMetadata m
 	return msg
 }
 
+//SetDryRun replaces the device token so the message is never delivered
+func (m *APNSMessage) SetDryRun(fakeToken string) {
+	m.DeviceToken = fakeToken
+}
+
 //ToJSON returns the serialized message
 func (m *APNSMessage) ToJSON() (string, error) {
 	b, err := json.Marshal(m)
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package messages
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// APNSPriorityKey is the metadata key that sets the apns-priority header
+const APNSPriorityKey = "apnsPriority"
+
+// APNSPushTypeKey is the metadata key that sets the apns-push-type header
+const APNSPushTypeKey = "apnsPushType"
+
+// APNSCollapseIDKey is the metadata key that sets the apns-collapse-id header
+const APNSCollapseIDKey = "apnsCollapseId"
+
+// APNSThreadIDKey is the metadata key that sets the aps thread-id
+const APNSThreadIDKey = "threadId"
+
+// APNSMutableContentKey is the metadata key that sets the aps mutable-content
+const APNSMutableContentKey = "mutableContent"
+
+// APNSOptionKeys are the metadata keys that configure an apns push
+var APNSOptionKeys = []string{
+	APNSPriorityKey,
+	APNSPushTypeKey,
+	APNSCollapseIDKey,
+	APNSThreadIDKey,
+	APNSMutableContentKey,
+}
+
+const apnsMaxCollapseIDSize = 64
+
+// APNSOptions holds the headers and aps fields of an apns push
+// For more info on the headers refer to:
+// https://developer.apple.com/documentation/usernotifications/setting_up_a_remote_notification_server/sending_notification_requests_to_apns
+type APNSOptions struct {
+	Priority       int
+	PushType       string
+	CollapseID     string
+	ThreadID       string
+	MutableContent bool
+}
+
+// ParseAPNSOptions reads and validates the apns options set in metadata
+func ParseAPNSOptions(metadata map[string]interface{}) (*APNSOptions, error) {
+	opts := &APNSOptions{}
+
+	if val, ok := metadata[APNSPriorityKey]; ok {
+		priority, ok := toInt(val)
+		if !ok || (priority != 5 && priority != 10) {
+			return nil, fmt.Errorf("%s must be 5 or 10", APNSPriorityKey)
+		}
+		opts.Priority = priority
+	}
+
+	if val, ok := metadata[APNSPushTypeKey]; ok {
+		pushType, ok := val.(string)
+		if !ok || (pushType != "alert" && pushType != "background" && pushType != "voip") {
+			return nil, fmt.Errorf("%s must be one of alert, background, voip", APNSPushTypeKey)
+		}
+		opts.PushType = pushType
+	}
+
+	if opts.PushType == "background" && opts.Priority == 10 {
+		return nil, fmt.Errorf("%s must be 5 for background pushes", APNSPriorityKey)
+	}
+
+	if val, ok := metadata[APNSCollapseIDKey]; ok {
+		collapseID, ok := val.(string)
+		if !ok || len(collapseID) > apnsMaxCollapseIDSize {
+			return nil, fmt.Errorf("%s must be a string with at most %d bytes", APNSCollapseIDKey, apnsMaxCollapseIDSize)
+		}
+		opts.CollapseID = collapseID
+	}
+
+	if val, ok := metadata[APNSThreadIDKey]; ok {
+		threadID, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", APNSThreadIDKey)
+		}
+		opts.ThreadID = threadID
+	}
+
+	if val, ok := metadata[APNSMutableContentKey]; ok {
+		mutableContent, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a boolean", APNSMutableContentKey)
+		}
+		opts.MutableContent = mutableContent
+	}
+
+	return opts, nil
+}
+
+// ApplyAPNSOptions sets the apns options in the message headers and aps
+func (m *APNSMessage) ApplyAPNSOptions(opts *APNSOptions) {
+	m.Priority = opts.Priority
+	m.PushType = opts.PushType
+	m.CollapseID = opts.CollapseID
+	if opts.ThreadID != "" {
+		m.Payload.Aps["thread-id"] = opts.ThreadID
+	}
+	if opts.MutableContent {
+		m.Payload.Aps["mutable-content"] = 1
+	}
+	if opts.PushType == "background" {
+		if _, ok := m.Payload.Aps["content-available"]; !ok {
+			m.Payload.Aps["content-available"] = 1
+		}
+	}
+}
+
+func toInt(val interface{}) (int, bool) {
+	switch v := val.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		if v != float64(int(v)) {
+			return 0, false
+		}
+		return int(v), true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// withoutKeys returns a copy of metadata without keys
+func withoutKeys(metadata map[string]interface{}, keys []string) map[string]interface{} {
+	if metadata == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		res[k] = v
+	}
+	for _, k := range keys {
+		delete(res, k)
+	}
+	return res
+}
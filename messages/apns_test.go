@@ -23,6 +23,8 @@
 package messages_test
 
 import (
+	"strings"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/topfreegames/marathon/messages"
@@ -62,4 +64,80 @@ var _ = Describe("APNS Message", func() {
 			Expect(msg.Metadata).To(BeEquivalentTo(empty))
 		})
 	})
+
+	Describe("Parsing apns options", func() {
+		It("should parse all options", func() {
+			opts, err := messages.ParseAPNSOptions(map[string]interface{}{
+				"apnsPriority":   float64(5),
+				"apnsPushType":   "background",
+				"apnsCollapseId": "collapse",
+				"threadId":       "thread",
+				"mutableContent": true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Priority).To(Equal(5))
+			Expect(opts.PushType).To(Equal("background"))
+			Expect(opts.CollapseID).To(Equal("collapse"))
+			Expect(opts.ThreadID).To(Equal("thread"))
+			Expect(opts.MutableContent).To(BeTrue())
+		})
+
+		It("should return error if priority is invalid", func() {
+			_, err := messages.ParseAPNSOptions(map[string]interface{}{"apnsPriority": 7})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return error if push type is invalid", func() {
+			_, err := messages.ParseAPNSOptions(map[string]interface{}{"apnsPushType": "blabla"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return error if background push has priority 10", func() {
+			_, err := messages.ParseAPNSOptions(map[string]interface{}{
+				"apnsPushType": "background",
+				"apnsPriority": 10,
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return error if collapse id is too long", func() {
+			_, err := messages.ParseAPNSOptions(map[string]interface{}{
+				"apnsCollapseId": strings.Repeat("a", 65),
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Building message with options", func() {
+		It("should set headers and aps fields and remove options from metadata", func() {
+			service, err := messages.GetPushService("apns")
+			Expect(err).NotTo(HaveOccurred())
+			m := map[string]interface{}{
+				"y":              2,
+				"apnsPriority":   5,
+				"apnsPushType":   "background",
+				"apnsCollapseId": "collapse",
+				"threadId":       "thread",
+				"mutableContent": true,
+			}
+			msg := service.BuildMessage("deviceToken", 357, map[string]interface{}{"x": 1}, m, nil, "tplname").(*messages.APNSMessage)
+			Expect(msg.Priority).To(Equal(5))
+			Expect(msg.PushType).To(Equal("background"))
+			Expect(msg.CollapseID).To(Equal("collapse"))
+			Expect(msg.Payload.Aps["thread-id"]).To(Equal("thread"))
+			Expect(msg.Payload.Aps["mutable-content"]).To(Equal(1))
+			Expect(msg.Payload.Aps["content-available"]).To(Equal(1))
+			Expect(msg.Payload.M).To(BeEquivalentTo(map[string]interface{}{"y": 2}))
+			Expect(m).To(HaveKey("apnsPriority"))
+		})
+
+		It("should not serialize headers if not set", func() {
+			msg := messages.NewAPNSMessage("deviceToken", 357, nil, nil, nil, "tplname")
+			msgStr, err := msg.ToJSON()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgStr).NotTo(ContainSubstring("priority"))
+			Expect(msgStr).NotTo(ContainSubstring("push_type"))
+			Expect(msgStr).NotTo(ContainSubstring("collapse_id"))
+		})
+	})
 })
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// fcmPlatformKeys are the template body keys that are sent as FCM per-platform blocks
+var fcmPlatformKeys = []string{"notification", "android", "apns", "webpush"}
+
+// FCMMessage is the struct to store a message in the FCM HTTP v1 format
+// For more info on the FCM v1 message refer to:
+// https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type FCMMessage struct {
+	Message      FCMMessageContent      `json:"message"`
+	ValidateOnly bool                   `json:"validate_only,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata"`
+}
+
+// FCMMessageContent stores the message content of a FCM v1 message
+type FCMMessageContent struct {
+	Token        string                 `json:"token"`
+	Data         map[string]string      `json:"data,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+	Android      map[string]interface{} `json:"android,omitempty"`
+	APNS         map[string]interface{} `json:"apns,omitempty"`
+	Webpush      map[string]interface{} `json:"webpush,omitempty"`
+}
+
+// NewFCMMessage builds a new FCM v1 Message
+// The notification, android, apns and webpush keys of the payload are used as the
+// per-platform blocks of the message and every other key is sent as data
+func NewFCMMessage(token string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) *FCMMessage {
+	if pushMetadata == nil {
+		pushMetadata = map[string]interface{}{}
+	}
+
+	content := FCMMessageContent{
+		Token: token,
+		Data:  map[string]string{},
+	}
+	platforms := map[string]map[string]interface{}{}
+	for key, value := range payload {
+		if isFCMPlatformKey(key) {
+			if block, ok := value.(map[string]interface{}); ok {
+				platforms[key] = block
+				continue
+			}
+		}
+		content.Data[key] = fcmDataValue(value)
+	}
+
+	content.Data["templateName"] = templateName
+	if len(messageMetadata) > 0 {
+		content.Data["m"] = fcmDataValue(messageMetadata)
+	}
+
+	content.Notification = platforms["notification"]
+	content.Android = platforms["android"]
+	content.APNS = platforms["apns"]
+	content.Webpush = platforms["webpush"]
+
+	if pushExpiry > 0 {
+		ttl := pushExpiry - time.Now().Unix()
+		if ttl < 0 {
+			ttl = 0
+		}
+		if content.Android == nil {
+			content.Android = map[string]interface{}{}
+		}
+		if _, ok := content.Android["ttl"]; !ok {
+			content.Android["ttl"] = fmt.Sprintf("%ds", ttl)
+		}
+	}
+
+	return &FCMMessage{
+		Message:  content,
+		Metadata: pushMetadata,
+	}
+}
+
+func isFCMPlatformKey(key string) bool {
+	for _, platformKey := range fcmPlatformKeys {
+		if key == platformKey {
+			return true
+		}
+	}
+	return false
+}
+
+// fcmDataValue converts a value to string since FCM v1 only accepts string data values
+func fcmDataValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+//SetDryRun replaces the device token and asks FCM to only validate the message
+func (m *FCMMessage) SetDryRun(fakeToken string) {
+	m.Message.Token = fakeToken
+	m.ValidateOnly = true
+}
+
+//ToJSON returns the serialized message
+func (m *FCMMessage) ToJSON() (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package messages_test
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/messages"
+)
+
+var _ = Describe("FCM Message", func() {
+	Describe("Creating new message", func() {
+		It("should return message", func() {
+			payload := map[string]interface{}{
+				"x": "1",
+				"y": 2,
+				"notification": map[string]interface{}{
+					"title": "hello",
+				},
+				"android": map[string]interface{}{
+					"priority": "high",
+				},
+			}
+			pushMetadata := map[string]interface{}{"a": "b"}
+			msg := messages.NewFCMMessage("token", 0, payload, nil, pushMetadata, "my-template")
+			Expect(msg).NotTo(BeNil())
+			Expect(msg.Message.Token).To(Equal("token"))
+			Expect(msg.Message.Data).To(Equal(map[string]string{
+				"x":            "1",
+				"y":            "2",
+				"templateName": "my-template",
+			}))
+			Expect(msg.Message.Notification).To(BeEquivalentTo(map[string]interface{}{"title": "hello"}))
+			Expect(msg.Message.Android).To(BeEquivalentTo(map[string]interface{}{"priority": "high"}))
+			Expect(msg.Message.APNS).To(BeNil())
+			Expect(msg.Message.Webpush).To(BeNil())
+			Expect(msg.Metadata).To(BeEquivalentTo(pushMetadata))
+			Expect(msg.ValidateOnly).To(BeFalse())
+		})
+
+		It("should send message metadata as data", func() {
+			mtd := map[string]interface{}{"a": 1}
+			msg := messages.NewFCMMessage("token", 0, nil, mtd, nil, "my-template")
+			var m map[string]interface{}
+			err := json.Unmarshal([]byte(msg.Message.Data["m"]), &m)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(BeEquivalentTo(map[string]interface{}{"a": float64(1)}))
+		})
+
+		It("should set android ttl if push expiry is set", func() {
+			expiry := time.Now().Add(time.Hour).Unix()
+			msg := messages.NewFCMMessage("token", expiry, nil, nil, nil, "my-template")
+			Expect(msg.Message.Android["ttl"]).To(MatchRegexp(`^\d+s$`))
+		})
+
+		It("should not override android ttl given in the template", func() {
+			expiry := time.Now().Add(time.Hour).Unix()
+			payload := map[string]interface{}{
+				"android": map[string]interface{}{"ttl": "10s"},
+			}
+			msg := messages.NewFCMMessage("token", expiry, payload, nil, nil, "my-template")
+			Expect(msg.Message.Android["ttl"]).To(Equal("10s"))
+		})
+
+		It("should serialize in the fcm v1 format", func() {
+			msg := messages.NewFCMMessage("token", 0, nil, nil, nil, "my-template")
+			msgStr, err := msg.ToJSON()
+			Expect(err).NotTo(HaveOccurred())
+			var m map[string]interface{}
+			err = json.Unmarshal([]byte(msgStr), &m)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m["message"].(map[string]interface{})["token"]).To(Equal("token"))
+			Expect(msgStr).NotTo(ContainSubstring("validate_only"))
+		})
+
+		It("should only validate dry run messages", func() {
+			msg := messages.NewFCMMessage("token", 0, nil, nil, nil, "my-template")
+			msg.SetDryRun("FAKE-token")
+			Expect(msg.Message.Token).To(Equal("FAKE-token"))
+			Expect(msg.ValidateOnly).To(BeTrue())
+		})
+	})
+
+	Describe("Choosing the gcm format", func() {
+		It("should build legacy messages by default", func() {
+			service, err := messages.GetPushService("gcm")
+			Expect(err).NotTo(HaveOccurred())
+			builder, err := service.Builder("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(builder("to", 0, nil, nil, nil, "tpl")).To(BeAssignableToTypeOf(&messages.GCMMessage{}))
+		})
+
+		It("should build fcm messages if format is fcm", func() {
+			service, err := messages.GetPushService("gcm")
+			Expect(err).NotTo(HaveOccurred())
+			builder, err := service.Builder("fcm")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(builder("to", 0, nil, nil, nil, "tpl")).To(BeAssignableToTypeOf(&messages.FCMMessage{}))
+		})
+
+		It("should return error if format is invalid", func() {
+			service, err := messages.GetPushService("gcm")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = service.Builder("blabla")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should validate the gcm format in job metadata", func() {
+			service, err := messages.GetPushService("gcm")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.ValidateMetadata(map[string]interface{}{"gcmFormat": "fcm"})).To(Succeed())
+			Expect(service.ValidateMetadata(map[string]interface{}{"gcmFormat": "blabla"})).NotTo(Succeed())
+		})
+	})
+})
@@ -24,8 +24,51 @@ package messages
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
+// GCMLegacyFormat is the legacy GCM message format
+const GCMLegacyFormat = "legacy"
+
+// GCMFCMFormat is the FCM HTTP v1 message format
+const GCMFCMFormat = "fcm"
+
+// GCMFormatKey is the job metadata key used to choose the gcm message format
+const GCMFormatKey = "gcmFormat"
+
+func buildGCMMessage(deviceToken string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) Message {
+	return NewGCMMessage(deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+}
+
+func buildFCMMessage(deviceToken string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) Message {
+	return NewFCMMessage(deviceToken, pushExpiry, payload, messageMetadata, pushMetadata, templateName)
+}
+
+func init() {
+	RegisterPushService(&PushService{
+		Name:          "gcm",
+		FakeTokenSize: 152,
+		BuildMessage:  buildGCMMessage,
+		Formats: map[string]MessageBuilder{
+			GCMLegacyFormat: buildGCMMessage,
+			GCMFCMFormat:    buildFCMMessage,
+		},
+		Validate: validateGCMMetadata,
+	})
+}
+
+func validateGCMMetadata(metadata map[string]interface{}) error {
+	val, ok := metadata[GCMFormatKey]
+	if !ok {
+		return nil
+	}
+	format, ok := val.(string)
+	if !ok || (format != GCMLegacyFormat && format != GCMFCMFormat) {
+		return fmt.Errorf("%s must be one of %s, %s", GCMFormatKey, GCMLegacyFormat, GCMFCMFormat)
+	}
+	return nil
+}
+
 // GCMMessage is the struct to store a gcm message
 // For more info on the GCM Message Data attribute refer to:
 // https://developers.google.com/cloud-messaging/concept-options
@@ -65,6 +108,12 @@ func NewGCMMessage(to string, data, messageMetadata map[string]interface{}, push
 	return msg
 }
 
+//SetDryRun replaces the device token and asks GCM not to deliver the message
+func (m *GCMMessage) SetDryRun(fakeToken string) {
+	m.To = fakeToken
+	m.DryRun = true
+}
+
 //ToJSON returns the serialized message
 func (m *GCMMessage) ToJSON() (string, error) {
 	b, err := json.Marshal(m)
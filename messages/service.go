@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package messages
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Message is a push message that can be serialized and sent to Kafka
+type Message interface {
+	ToJSON() (string, error)
+	SetDryRun(fakeToken string)
+}
+
+// MessageBuilder builds a Message for a given service
+type MessageBuilder func(deviceToken string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) Message
+
+// MetadataValidator validates the job metadata used to build messages of a service
+type MetadataValidator func(metadata map[string]interface{}) error
+
+// TopicNameBuilder builds the name of the Kafka topic of a service
+type TopicNameBuilder func(appName, service, topicTemplate string) string
+
+// PushService holds everything marathon needs to know to send pushes through a service
+// Formats holds alternative message builders for services with more than one payload format
+// OptionKeys are the metadata keys that configure the push and can be defaulted by templates
+type PushService struct {
+	Name          string
+	FakeTokenSize int
+	BuildMessage  MessageBuilder
+	Formats       map[string]MessageBuilder
+	OptionKeys    []string
+	Validate      MetadataValidator
+	TopicName     TopicNameBuilder
+}
+
+var pushServicesMutex sync.RWMutex
+var pushServices = map[string]*PushService{}
+
+// DefaultTopicName builds the topic name filling topicTemplate with appName and service
+func DefaultTopicName(appName, service, topicTemplate string) string {
+	return fmt.Sprintf(topicTemplate, appName, service)
+}
+
+// RegisterPushService adds a push service to the registry, replacing any service with the same name
+func RegisterPushService(service *PushService) {
+	if service.TopicName == nil {
+		service.TopicName = DefaultTopicName
+	}
+	pushServicesMutex.Lock()
+	pushServices[service.Name] = service
+	pushServicesMutex.Unlock()
+}
+
+// UnregisterPushService removes the push service with the given name from the registry
+func UnregisterPushService(name string) {
+	pushServicesMutex.Lock()
+	delete(pushServices, name)
+	pushServicesMutex.Unlock()
+}
+
+// GetPushService returns the registered push service with the given name
+func GetPushService(name string) (*PushService, error) {
+	pushServicesMutex.RLock()
+	service, ok := pushServices[name]
+	pushServicesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("service should be in %v", PushServiceNames())
+	}
+	return service, nil
+}
+
+// PushServiceNames returns the sorted names of all registered push services
+func PushServiceNames() []string {
+	pushServicesMutex.RLock()
+	names := make([]string, 0, len(pushServices))
+	for name := range pushServices {
+		names = append(names, name)
+	}
+	pushServicesMutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// ValidateMetadata validates the job metadata using the service validator, if any
+func (s *PushService) ValidateMetadata(metadata map[string]interface{}) error {
+	if s.Validate == nil {
+		return nil
+	}
+	return s.Validate(metadata)
+}
+
+// Builder returns the message builder for format, or the default one if format is empty
+func (s *PushService) Builder(format string) (MessageBuilder, error) {
+	if format == "" {
+		return s.BuildMessage, nil
+	}
+	builder, ok := s.Formats[format]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid message format for service %s", format, s.Name)
+	}
+	return builder, nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package messages_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/messages"
+)
+
+var _ = Describe("Push Service", func() {
+	Describe("Getting registered services", func() {
+		It("should return apns and gcm", func() {
+			Expect(messages.PushServiceNames()).To(ContainElement("apns"))
+			Expect(messages.PushServiceNames()).To(ContainElement("gcm"))
+		})
+
+		It("should return error if service is not registered", func() {
+			service, err := messages.GetPushService("blabla")
+			Expect(err).To(HaveOccurred())
+			Expect(service).To(BeNil())
+		})
+
+		It("should build apns messages", func() {
+			service, err := messages.GetPushService("apns")
+			Expect(err).NotTo(HaveOccurred())
+			msg := service.BuildMessage("deviceToken", 357, nil, nil, nil, "tplname")
+			Expect(msg).To(BeAssignableToTypeOf(&messages.APNSMessage{}))
+			Expect(msg.(*messages.APNSMessage).DeviceToken).To(Equal("deviceToken"))
+		})
+
+		It("should build gcm messages", func() {
+			service, err := messages.GetPushService("gcm")
+			Expect(err).NotTo(HaveOccurred())
+			msg := service.BuildMessage("to", 357, nil, nil, nil, "tplname")
+			Expect(msg).To(BeAssignableToTypeOf(&messages.GCMMessage{}))
+			Expect(msg.(*messages.GCMMessage).To).To(Equal("to"))
+			Expect(msg.(*messages.GCMMessage).TimeToLive).To(BeEquivalentTo(357))
+		})
+	})
+
+	Describe("Registering a service", func() {
+		AfterEach(func() {
+			messages.UnregisterPushService("testservice")
+			messages.UnregisterPushService("validatedservice")
+		})
+
+		It("should use the default topic name if none is given", func() {
+			messages.RegisterPushService(&messages.PushService{
+				Name: "testservice",
+				BuildMessage: func(deviceToken string, pushExpiry int64, payload, messageMetadata, pushMetadata map[string]interface{}, templateName string) messages.Message {
+					return messages.NewGCMMessage(deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+				},
+			})
+			service, err := messages.GetPushService("testservice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.TopicName("myapp", "testservice", "%s-%s-c")).To(Equal("myapp-testservice-c"))
+			Expect(service.ValidateMetadata(nil)).To(Succeed())
+		})
+
+		It("should use the service validator", func() {
+			messages.RegisterPushService(&messages.PushService{
+				Name: "validatedservice",
+				Validate: func(metadata map[string]interface{}) error {
+					if _, ok := metadata["required"]; !ok {
+						return fmt.Errorf("required is missing")
+					}
+					return nil
+				},
+			})
+			service, err := messages.GetPushService("validatedservice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.ValidateMetadata(map[string]interface{}{})).NotTo(Succeed())
+			Expect(service.ValidateMetadata(map[string]interface{}{"required": true})).To(Succeed())
+		})
+
+		It("should remove an unregistered service", func() {
+			messages.RegisterPushService(&messages.PushService{Name: "testservice"})
+			messages.UnregisterPushService("testservice")
+			_, err := messages.GetPushService("testservice")
+			Expect(err).To(HaveOccurred())
+			Expect(messages.PushServiceNames()).NotTo(ContainElement("testservice"))
+		})
+	})
+})
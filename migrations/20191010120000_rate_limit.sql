@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+ALTER TABLE "apps" ADD COLUMN rate_limit integer NOT NULL DEFAULT 0;
+ALTER TABLE "jobs" ADD COLUMN rate_limit integer NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+ALTER TABLE "jobs" DROP COLUMN rate_limit;
+ALTER TABLE "apps" DROP COLUMN rate_limit;
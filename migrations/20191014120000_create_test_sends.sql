@@ -0,0 +1,38 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "test_sends" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid NOT NULL,
+  "template_id" uuid NOT NULL,
+  "service" text NOT NULL,
+  "user_ids" JSONB NOT NULL DEFAULT '[]'::JSONB,
+  "tokens" JSONB NOT NULL DEFAULT '[]'::JSONB,
+  "context" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "metadata" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "feedbacks" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "sent_pushes" integer NOT NULL DEFAULT 0,
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+ALTER TABLE "test_sends"
+ADD CONSTRAINT test_sends_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "test_sends"
+ADD CONSTRAINT test_sends_template_id_templates_id_foreign
+FOREIGN KEY (template_id)
+REFERENCES templates(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "test_sends";
@@ -0,0 +1,44 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "segments" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid NOT NULL,
+  "name" text NOT NULL,
+  "service" text NOT NULL,
+  "filter_expression" JSONB,
+  "csv_path" text NOT NULL DEFAULT '',
+  "size" integer NOT NULL DEFAULT 0,
+  "size_computed_at" bigint NOT NULL DEFAULT 0,
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  "updated_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX segments_name_app ON "segments"("name", app_id);
+
+ALTER TABLE "segments"
+ADD CONSTRAINT segments_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "jobs" ADD COLUMN segment_id uuid;
+
+ALTER TABLE "jobs"
+ADD CONSTRAINT jobs_segment_id_segments_id_foreign
+FOREIGN KEY (segment_id)
+REFERENCES segments(id)
+ON DELETE NO ACTION
+ON UPDATE CASCADE;
+
+CREATE INDEX ix_jobs_segment_id ON "jobs"(segment_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN segment_id;
+DROP TABLE "segments";
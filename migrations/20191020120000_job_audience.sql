@@ -0,0 +1,12 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE "jobs" ADD COLUMN audience JSONB;
+ALTER TABLE "jobs" ADD COLUMN audience_steps JSONB;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN audience_steps;
+ALTER TABLE "jobs" DROP COLUMN audience;
@@ -0,0 +1,32 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "suppressions" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid,
+  "user_id" text NOT NULL,
+  "reason" text NOT NULL DEFAULT '',
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+-- suppressions without app are global, they apply to every app
+CREATE UNIQUE INDEX suppressions_app_user ON "suppressions"(app_id, user_id) WHERE app_id IS NOT NULL;
+CREATE UNIQUE INDEX suppressions_global_user ON "suppressions"(user_id) WHERE app_id IS NULL;
+
+ALTER TABLE "suppressions"
+ADD CONSTRAINT suppressions_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "jobs" ADD COLUMN suppressed_users integer NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN suppressed_users;
+DROP TABLE "suppressions";
@@ -0,0 +1,12 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE "apps" ADD COLUMN frequency_cap_limit integer NOT NULL DEFAULT 0;
+ALTER TABLE "apps" ADD COLUMN frequency_cap_window integer NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "apps" DROP COLUMN frequency_cap_window;
+ALTER TABLE "apps" DROP COLUMN frequency_cap_limit;
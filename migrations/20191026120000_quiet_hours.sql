@@ -0,0 +1,12 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE "apps" ADD COLUMN quiet_hours JSONB;
+ALTER TABLE "jobs" ADD COLUMN quiet_hours JSONB;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN quiet_hours;
+ALTER TABLE "apps" DROP COLUMN quiet_hours;
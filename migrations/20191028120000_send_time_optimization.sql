@@ -0,0 +1,27 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "user_open_hours" (
+  "app_id" uuid NOT NULL,
+  "user_id" text NOT NULL,
+  "hour" integer NOT NULL,
+  "opens" integer NOT NULL DEFAULT 0,
+  "updated_at" bigint,
+  PRIMARY KEY ("app_id", "user_id", "hour")
+);
+
+ALTER TABLE "user_open_hours"
+ADD CONSTRAINT user_open_hours_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "jobs" ADD COLUMN send_time_strategy TEXT;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN send_time_strategy;
+DROP TABLE "user_open_hours";
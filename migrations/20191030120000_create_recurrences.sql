@@ -0,0 +1,41 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "recurrences" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid NOT NULL,
+  "job_group_id" uuid NOT NULL,
+  "cron" text NOT NULL,
+  "timezone" text NOT NULL DEFAULT '',
+  "ends_at" bigint NOT NULL DEFAULT 0,
+  "job" JSONB NOT NULL,
+  "status" text NOT NULL DEFAULT 'active',
+  "next_run_at" bigint NOT NULL DEFAULT 0,
+  "last_run_at" bigint NOT NULL DEFAULT 0,
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  "updated_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+ALTER TABLE "recurrences"
+ADD CONSTRAINT recurrences_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "recurrences"
+ADD CONSTRAINT recurrences_job_group_id_job_groups_id_foreign
+FOREIGN KEY (job_group_id)
+REFERENCES job_groups(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+CREATE INDEX ix_recurrences_app_id ON "recurrences"(app_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "recurrences";
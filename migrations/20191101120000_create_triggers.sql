@@ -0,0 +1,42 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "triggers" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid NOT NULL,
+  "job_id" uuid NOT NULL,
+  "event" text NOT NULL,
+  "service" text NOT NULL,
+  "template_name" text NOT NULL,
+  "context" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "context_mapping" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "metadata" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "delay" integer NOT NULL DEFAULT 0,
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  "updated_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+-- an event sends at most one push to each token of the user
+CREATE UNIQUE INDEX triggers_app_event_service ON "triggers"(app_id, "event", service);
+
+ALTER TABLE "triggers"
+ADD CONSTRAINT triggers_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "triggers"
+ADD CONSTRAINT triggers_job_id_jobs_id_foreign
+FOREIGN KEY (job_id)
+REFERENCES jobs(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "triggers";
@@ -0,0 +1,68 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "journeys" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "app_id" uuid NOT NULL,
+  "name" text NOT NULL,
+  "service" text NOT NULL,
+  "filters" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "filter_expression" JSONB,
+  "segment_id" uuid,
+  "csv_path" text NOT NULL DEFAULT '',
+  "starts_at" bigint NOT NULL DEFAULT 0,
+  "steps" JSONB NOT NULL DEFAULT '[]'::JSONB,
+  "status" text NOT NULL DEFAULT 'active',
+  "current_step" integer NOT NULL DEFAULT 0,
+  "created_by" text NOT NULL,
+  "created_at" bigint,
+  "updated_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+ALTER TABLE "journeys"
+ADD CONSTRAINT journeys_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+CREATE INDEX ix_journeys_app_id ON "journeys"(app_id);
+
+CREATE TABLE "journey_users" (
+  "journey_id" uuid NOT NULL,
+  "step" integer NOT NULL,
+  "user_id" text NOT NULL,
+  "delivered" boolean NOT NULL DEFAULT false,
+  "opened" boolean NOT NULL DEFAULT false,
+  "updated_at" bigint,
+  PRIMARY KEY ("journey_id", "step", "user_id")
+);
+
+ALTER TABLE "journey_users"
+ADD CONSTRAINT journey_users_journey_id_journeys_id_foreign
+FOREIGN KEY (journey_id)
+REFERENCES journeys(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+ALTER TABLE "jobs" ADD COLUMN journey_id uuid;
+ALTER TABLE "jobs" ADD COLUMN journey_step integer NOT NULL DEFAULT 0;
+
+ALTER TABLE "jobs"
+ADD CONSTRAINT jobs_journey_id_journeys_id_foreign
+FOREIGN KEY (journey_id)
+REFERENCES journeys(id)
+ON DELETE SET NULL
+ON UPDATE CASCADE;
+
+CREATE INDEX ix_jobs_journey_id ON "jobs"(journey_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE "jobs" DROP COLUMN journey_step;
+ALTER TABLE "jobs" DROP COLUMN journey_id;
+DROP TABLE "journey_users";
+DROP TABLE "journeys";
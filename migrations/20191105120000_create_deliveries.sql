@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- deliveries is the parent of the daily partitions deliveries_YYYYMMDD created by the workers,
+-- it does not hold rows itself and its partitions are dropped once expired
+CREATE TABLE "deliveries" (
+  "job_id" uuid NOT NULL,
+  "user_id" text NOT NULL,
+  "token_hash" text NOT NULL,
+  "muid" text NOT NULL,
+  "produced_at" bigint NOT NULL,
+  "result" text NOT NULL DEFAULT 'sent',
+  "error_key" text NOT NULL DEFAULT '',
+  "updated_at" bigint
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "deliveries" CASCADE;
@@ -0,0 +1,29 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE "jobs" ADD COLUMN experiment JSONB;
+
+CREATE TABLE "experiment_variants" (
+  "job_id" uuid NOT NULL,
+  "name" text NOT NULL,
+  "sent" integer NOT NULL DEFAULT 0,
+  "delivered" integer NOT NULL DEFAULT 0,
+  "failed" integer NOT NULL DEFAULT 0,
+  "opened" integer NOT NULL DEFAULT 0,
+  "updated_at" bigint,
+  PRIMARY KEY ("job_id", "name")
+);
+
+ALTER TABLE "experiment_variants"
+ADD CONSTRAINT experiment_variants_job_id_jobs_id_foreign
+FOREIGN KEY (job_id)
+REFERENCES jobs(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "experiment_variants";
+ALTER TABLE "jobs" DROP COLUMN experiment;
@@ -0,0 +1,29 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE "apps" ADD COLUMN holdout double precision NOT NULL DEFAULT 0;
+
+CREATE TABLE "control_group_users" (
+  "job_id" uuid NOT NULL,
+  "user_id" text NOT NULL,
+  "app_id" uuid NOT NULL,
+  "reason" text NOT NULL,
+  "created_at" bigint,
+  PRIMARY KEY ("job_id", "user_id")
+);
+
+CREATE INDEX control_group_users_app_id_reason ON "control_group_users" (app_id, reason);
+
+ALTER TABLE "control_group_users"
+ADD CONSTRAINT control_group_users_job_id_jobs_id_foreign
+FOREIGN KEY (job_id)
+REFERENCES jobs(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "control_group_users";
+ALTER TABLE "apps" DROP COLUMN holdout;
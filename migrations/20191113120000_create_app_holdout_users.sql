@@ -0,0 +1,27 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "app_holdout_users" (
+  "app_id" uuid NOT NULL,
+  "user_id" text NOT NULL,
+  "created_at" bigint,
+  PRIMARY KEY ("app_id", "user_id")
+);
+
+ALTER TABLE "app_holdout_users"
+ADD CONSTRAINT app_holdout_users_app_id_apps_id_foreign
+FOREIGN KEY (app_id)
+REFERENCES apps(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+INSERT INTO "app_holdout_users" (app_id, user_id, created_at)
+SELECT app_id, user_id, MIN(created_at) FROM "control_group_users" WHERE reason = 'holdout' GROUP BY app_id, user_id;
+
+DELETE FROM "control_group_users" WHERE reason = 'holdout';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "app_holdout_users";
@@ -23,19 +23,28 @@
 package model
 
 import (
+	"fmt"
+
 	"github.com/asaskevich/govalidator"
 	"github.com/labstack/echo"
 	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
 )
 
 // App is the app model struct
 type App struct {
-	ID        uuid.UUID `sql:",pk" json:"id"`
-	Name      string    `json:"name"`
-	BundleID  string    `json:"bundleId"`
-	CreatedBy string    `json:"createdBy"`
-	CreatedAt int64     `json:"createdAt"`
-	UpdatedAt int64     `json:"updatedAt"`
+	ID                 uuid.UUID   `sql:",pk" json:"id"`
+	Name               string      `json:"name"`
+	BundleID           string      `json:"bundleId"`
+	GCMFormat          string      `json:"gcmFormat"`
+	RateLimit          int         `json:"rateLimit"`
+	FrequencyCapLimit  int         `json:"frequencyCapLimit"`
+	FrequencyCapWindow int         `json:"frequencyCapWindow"`
+	QuietHours         *QuietHours `json:"quietHours"`
+	Holdout            float64     `json:"holdout"`
+	CreatedBy          string      `json:"createdBy"`
+	CreatedAt          int64       `json:"createdAt"`
+	UpdatedAt          int64       `json:"updatedAt"`
 }
 
 // Validate implementation of the InputValidation interface
@@ -48,6 +57,31 @@ func (a *App) Validate(c echo.Context) error {
 	if !valid {
 		return InvalidField("bundleId")
 	}
+	valid = govalidator.IsNull(a.GCMFormat) || govalidator.IsIn(a.GCMFormat, messages.GCMLegacyFormat, messages.GCMFCMFormat)
+	if !valid {
+		return InvalidField("gcmFormat")
+	}
+	valid = a.RateLimit >= 0
+	if !valid {
+		return InvalidField("rateLimit")
+	}
+	valid = a.FrequencyCapLimit >= 0
+	if !valid {
+		return InvalidField("frequencyCapLimit")
+	}
+	valid = a.FrequencyCapWindow >= 0 && (a.FrequencyCapLimit == 0) == (a.FrequencyCapWindow == 0)
+	if !valid {
+		return InvalidField("frequencyCapWindow")
+	}
+	if a.QuietHours != nil {
+		if err := a.QuietHours.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("quietHours: %s", err.Error()))
+		}
+	}
+	valid = a.Holdout >= 0 && a.Holdout < 1
+	if !valid {
+		return InvalidField("holdout")
+	}
 	valid = govalidator.IsEmail(a.CreatedBy)
 	if !valid {
 		return InvalidField("createdBy")
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Audience is a node of the set operations selecting the users of a job
+// it is either a union, an intersection or a subtraction of other nodes, or a leaf with a filter
+// expression or a csv file, a subtraction removes the users of the other nodes from the first one, e.g.
+// {"subtract": [{"filterExpression": {"column": "region", "op": "eq", "value": "BR"}}, {"csvPath": "bucket/suppressed.csv"}]}
+type Audience struct {
+	Union            []*Audience       `json:"union,omitempty"`
+	Intersect        []*Audience       `json:"intersect,omitempty"`
+	Subtract         []*Audience       `json:"subtract,omitempty"`
+	FilterExpression *FilterExpression `json:"filterExpression,omitempty"`
+	CSVPath          string            `json:"csvPath,omitempty"`
+}
+
+// AudienceStep is the number of users selected by a node of the audience of a job
+// the path locates the node in the audience, e.g. audience.subtract[1]
+type AudienceStep struct {
+	Path      string `json:"path"`
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+}
+
+// Operation returns the kind of the node: union, intersect, subtract, filter or csv
+func (a *Audience) Operation() string {
+	switch {
+	case a.Union != nil:
+		return "union"
+	case a.Intersect != nil:
+		return "intersect"
+	case a.Subtract != nil:
+		return "subtract"
+	case a.FilterExpression != nil:
+		return "filter"
+	}
+	return "csv"
+}
+
+// Children returns the nodes combined by a set operation, leaves have none
+func (a *Audience) Children() []*Audience {
+	switch {
+	case a.Union != nil:
+		return a.Union
+	case a.Intersect != nil:
+		return a.Intersect
+	}
+	return a.Subtract
+}
+
+// HasCSV returns whether any leaf of the audience is a csv file
+func (a *Audience) HasCSV() bool {
+	if a.Operation() == "csv" {
+		return true
+	}
+	for _, child := range a.Children() {
+		if child.HasCSV() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that every node of the audience is well formed, it does not check the filter columns
+func (a *Audience) Validate() error {
+	kinds := 0
+	for _, children := range [][]*Audience{a.Union, a.Intersect, a.Subtract} {
+		if children != nil {
+			kinds++
+		}
+	}
+	if a.FilterExpression != nil {
+		kinds++
+	}
+	if a.CSVPath != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("a node must have exactly one of union, intersect, subtract, filterExpression or csvPath")
+	}
+
+	switch a.Operation() {
+	case "filter":
+		return a.FilterExpression.Validate()
+	case "csv":
+		if strings.Contains(a.CSVPath, "s3://") {
+			return fmt.Errorf("csvPath: cannot contain s3 protocol, just the bucket path")
+		}
+		return nil
+	case "subtract":
+		if len(a.Subtract) < 2 {
+			return fmt.Errorf("subtract must have at least two nodes")
+		}
+	}
+
+	children := a.Children()
+	if len(children) == 0 {
+		return fmt.Errorf("union and intersect must have at least one node")
+	}
+	for _, child := range children {
+		if child == nil {
+			return fmt.Errorf("nodes cannot be null")
+		}
+		if err := child.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
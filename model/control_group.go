@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+)
+
+// reasons why a user was held out of a job
+const (
+	JobControlGroupReason = "job"
+	AppHoldoutReason      = "holdout"
+)
+
+// ControlGroupUser is a user held out of a job by the job control group
+type ControlGroupUser struct {
+	JobID     uuid.UUID `sql:",pk" json:"jobId"`
+	UserID    string    `sql:",pk" json:"userId"`
+	AppID     uuid.UUID `json:"appId"`
+	Reason    string    `json:"reason"`
+	CreatedAt int64     `json:"createdAt"`
+}
+
+// AppHoldoutUser is a user of the app holdout that was held out of at least one job of the app,
+// it is stored once per app however many jobs the user is held out of
+type AppHoldoutUser struct {
+	AppID     uuid.UUID `sql:",pk" json:"appId"`
+	UserID    string    `sql:",pk" json:"userId"`
+	CreatedAt int64     `json:"createdAt"`
+}
+
+// HoldoutPoint maps the user to a point in [0, 1) that is always the same for the salt,
+// a user is held out of a fraction when its point is below it, so raising the fraction only adds users
+func HoldoutPoint(salt, userID string) float64 {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", salt, userID)))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / float64(uint64(1)<<53)
+}
+
+// InControlGroup returns if the user is in the control group of the job
+func (j *Job) InControlGroup(userID string) bool {
+	return j.ControlGroup > 0 && HoldoutPoint(fmt.Sprintf("control:%s", j.ID.String()), userID) < j.ControlGroup
+}
+
+// InHoldout returns if the user is held out of every job of the app
+func (a *App) InHoldout(userID string) bool {
+	return a.Holdout > 0 && HoldoutPoint(fmt.Sprintf("holdout:%s", a.ID.String()), userID) < a.Holdout
+}
+
+// HoldoutReason returns why the user is held out of the job or an empty string if the user should receive it,
+// the app holdout takes precedence over the job control group
+func (j *Job) HoldoutReason(app *App, userID string) string {
+	if app != nil && app.InHoldout(userID) {
+		return AppHoldoutReason
+	}
+	if j.InControlGroup(userID) {
+		return JobControlGroupReason
+	}
+	return ""
+}
+
+// controlGroupInsertBatchSize is the max number of users stored by a single insert
+const controlGroupInsertBatchSize = 1000
+
+// InsertControlGroupUsers stores the held out users, the ones already stored for the job are ignored
+func InsertControlGroupUsers(db interfaces.DB, users []*ControlGroupUser) error {
+	for start := 0; start < len(users); start += controlGroupInsertBatchSize {
+		end := start + controlGroupInsertBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		values := make([]string, end-start)
+		params := []interface{}{}
+		for idx, user := range users[start:end] {
+			values[idx] = "(?, ?, ?, ?, ?)"
+			params = append(params, user.JobID, user.UserID, user.AppID, user.Reason, user.CreatedAt)
+		}
+		query := fmt.Sprintf(
+			"INSERT INTO control_group_users (job_id, user_id, app_id, reason, created_at) VALUES %s ON CONFLICT (job_id, user_id) DO NOTHING",
+			strings.Join(values, ","),
+		)
+		if _, err := db.Exec(query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertAppHoldoutUsers stores the users of the app holdout, the ones already stored for the app are ignored
+func InsertAppHoldoutUsers(db interfaces.DB, users []*AppHoldoutUser) error {
+	for start := 0; start < len(users); start += controlGroupInsertBatchSize {
+		end := start + controlGroupInsertBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		values := make([]string, end-start)
+		params := []interface{}{}
+		for idx, user := range users[start:end] {
+			values[idx] = "(?, ?, ?)"
+			params = append(params, user.AppID, user.UserID, user.CreatedAt)
+		}
+		query := fmt.Sprintf(
+			"INSERT INTO app_holdout_users (app_id, user_id, created_at) VALUES %s ON CONFLICT (app_id, user_id) DO NOTHING",
+			strings.Join(values, ","),
+		)
+		if _, err := db.Exec(query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+	pg "gopkg.in/pg.v5"
+)
+
+// Results of the deliveries, the sent ones are waiting for their feedback
+const (
+	SentDeliveryResult  = "sent"
+	AckDeliveryResult   = "ack"
+	ErrorDeliveryResult = "error"
+)
+
+// deliveryPartitionPrefix is the prefix of the partitions of the deliveries table, one per UTC day
+const deliveryPartitionPrefix = "deliveries_"
+
+// Delivery is a push of a job produced to a token, logged when the delivery log is enabled
+// the deliveries are stored in daily partitions of the deliveries table dropped after the log ttl
+type Delivery struct {
+	JobID      uuid.UUID `json:"jobId"`
+	UserID     string    `json:"userId"`
+	TokenHash  string    `json:"tokenHash"`
+	MUID       string    `json:"muid" sql:"muid"`
+	ProducedAt int64     `json:"producedAt"`
+	Result     string    `json:"result"`
+	ErrorKey   string    `json:"errorKey"`
+	UpdatedAt  int64     `json:"updatedAt"`
+}
+
+// NewDelivery returns the delivery of a push produced now, the token is only kept hashed
+func NewDelivery(jobID uuid.UUID, userID, token, muid string) *Delivery {
+	now := time.Now().UnixNano()
+	return &Delivery{
+		JobID:      jobID,
+		UserID:     userID,
+		TokenHash:  HashToken(token),
+		MUID:       muid,
+		ProducedAt: now,
+		Result:     SentDeliveryResult,
+		UpdatedAt:  now,
+	}
+}
+
+// HashToken returns the hex sha256 of a device token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeliveryPartition returns the partition of the deliveries produced at at
+func DeliveryPartition(at int64) string {
+	return fmt.Sprintf("%s%s", deliveryPartitionPrefix, time.Unix(0, at).UTC().Format("20060102"))
+}
+
+// knownDeliveryPartitions caches the partitions that exist so the deliveries are written without checking them
+var knownDeliveryPartitions = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+func isKnownDeliveryPartition(name string) bool {
+	knownDeliveryPartitions.RLock()
+	defer knownDeliveryPartitions.RUnlock()
+	return knownDeliveryPartitions.names[name]
+}
+
+func setKnownDeliveryPartition(name string, known bool) {
+	knownDeliveryPartitions.Lock()
+	defer knownDeliveryPartitions.Unlock()
+	if known {
+		knownDeliveryPartitions.names[name] = true
+	} else {
+		delete(knownDeliveryPartitions.names, name)
+	}
+}
+
+// EnsureDeliveryPartition creates the partition of the deliveries produced at at if it does not exist,
+// the partitions already created or checked by the process are not checked again
+func EnsureDeliveryPartition(db interfaces.DB, at int64) error {
+	name := DeliveryPartition(at)
+	if isKnownDeliveryPartition(name) {
+		return nil
+	}
+	var exists bool
+	_, err := db.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		setKnownDeliveryPartition(name, true)
+		return nil
+	}
+
+	start := time.Unix(0, at).UTC().Truncate(24 * time.Hour)
+	end := start.Add(24 * time.Hour)
+	queries := []string{
+		fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s (CHECK (produced_at >= %d AND produced_at < %d)) INHERITS (deliveries)",
+			name, start.UnixNano(), end.UnixNano(),
+		),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS ix_%s_job_id_user_id ON %s (job_id, user_id)", name, name),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS ix_%s_muid ON %s (muid)", name, name),
+	}
+	for _, query := range queries {
+		_, err = db.Exec(query)
+		// the same partition can be created concurrently by other workers
+		if err != nil && !strings.Contains(err.Error(), "already exists") && !strings.Contains(err.Error(), "duplicate key") {
+			return err
+		}
+	}
+	setKnownDeliveryPartition(name, true)
+	return nil
+}
+
+// DropExpiredDeliveryPartitions drops the partitions whose deliveries were all produced more than ttl before now
+func DropExpiredDeliveryPartitions(db interfaces.DB, ttl time.Duration, now time.Time) ([]string, error) {
+	var partitions []string
+	_, err := db.Query(
+		&partitions,
+		"SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = 'deliveries'",
+	)
+	if err != nil {
+		return nil, err
+	}
+	dropped := []string{}
+	for _, partition := range partitions {
+		day, err := time.Parse("20060102", strings.TrimPrefix(partition, deliveryPartitionPrefix))
+		if err != nil {
+			continue
+		}
+		if day.Add(24 * time.Hour).After(now.Add(-ttl)) {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", partition))
+		if err != nil {
+			return dropped, err
+		}
+		setKnownDeliveryPartition(partition, false)
+		dropped = append(dropped, partition)
+	}
+	return dropped, nil
+}
+
+// InsertDeliveries writes the deliveries to the partitions of the days they were produced
+func InsertDeliveries(db interfaces.DB, deliveries []*Delivery) error {
+	byPartition := map[string][]*Delivery{}
+	for _, delivery := range deliveries {
+		partition := DeliveryPartition(delivery.ProducedAt)
+		if _, ok := byPartition[partition]; !ok {
+			if err := EnsureDeliveryPartition(db, delivery.ProducedAt); err != nil {
+				return err
+			}
+		}
+		byPartition[partition] = append(byPartition[partition], delivery)
+	}
+	for partition, partitionDeliveries := range byPartition {
+		values := make([]string, len(partitionDeliveries))
+		params := []interface{}{}
+		for idx, delivery := range partitionDeliveries {
+			values[idx] = "(?, ?, ?, ?, ?, ?, ?, ?)"
+			params = append(
+				params,
+				delivery.JobID, delivery.UserID, delivery.TokenHash, delivery.MUID,
+				delivery.ProducedAt, delivery.Result, delivery.ErrorKey, delivery.UpdatedAt,
+			)
+		}
+		query := fmt.Sprintf(
+			"INSERT INTO %s (job_id, user_id, token_hash, muid, produced_at, result, error_key, updated_at) VALUES %s",
+			partition, strings.Join(values, ","),
+		)
+		if _, err := db.Exec(query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDeliveries removes the deliveries of pushes that were not produced, the produced_at bounds
+// let postgres skip the partitions of the other days
+func DeleteDeliveries(db interfaces.DB, deliveries []*Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	muids := make([]string, len(deliveries))
+	var minProducedAt, maxProducedAt int64
+	for idx, delivery := range deliveries {
+		muids[idx] = delivery.MUID
+		if minProducedAt == 0 || delivery.ProducedAt < minProducedAt {
+			minProducedAt = delivery.ProducedAt
+		}
+		if delivery.ProducedAt > maxProducedAt {
+			maxProducedAt = delivery.ProducedAt
+		}
+	}
+	_, err := db.Exec(
+		"DELETE FROM deliveries WHERE muid IN (?) AND produced_at >= ? AND produced_at <= ?",
+		pg.In(muids), minProducedAt, maxProducedAt,
+	)
+	return err
+}
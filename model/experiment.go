@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/satori/go.uuid"
+)
+
+// MaxExperimentVariants is the max number of variants of an experiment
+const MaxExperimentVariants = 10
+
+// experimentZ is the z score of the 95% confidence of the experiment results
+const experimentZ = 1.96
+
+// experimentSignificance is the max p-value of a significant difference from the control
+const experimentSignificance = 0.05
+
+// Variant is a template of an experiment sent to the share of the job users given by its weight
+type Variant struct {
+	Name         string `json:"name"`
+	TemplateName string `json:"templateName"`
+	Weight       int    `json:"weight"`
+}
+
+// Experiment is an A/B test of the templates of a job, the first variant is the control
+// each user is always assigned to the same variant of the job
+type Experiment struct {
+	Variants []*Variant `json:"variants"`
+}
+
+// ExperimentVariant holds the counters of the pushes of a variant of a job experiment,
+// the sent pushes are counted by the workers and the others by the feedback listener
+type ExperimentVariant struct {
+	JobID     uuid.UUID `sql:",pk" json:"jobId"`
+	Name      string    `sql:",pk" json:"name"`
+	Sent      int       `json:"sent"`
+	Delivered int       `json:"delivered"`
+	Failed    int       `json:"failed"`
+	Opened    int       `json:"opened"`
+	UpdatedAt int64     `json:"updatedAt"`
+}
+
+// VariantResult is the conversion of a variant, the opened pushes over the sent ones, with its 95% confidence interval
+// and, except for the control, the lift over the control and the p-value of the difference between them
+type VariantResult struct {
+	*Variant
+	Sent               int       `json:"sent"`
+	Delivered          int       `json:"delivered"`
+	Failed             int       `json:"failed"`
+	Opened             int       `json:"opened"`
+	ConversionRate     float64   `json:"conversionRate"`
+	ConfidenceInterval []float64 `json:"confidenceInterval"`
+	Lift               float64   `json:"lift"`
+	PValue             float64   `json:"pValue"`
+	Significant        bool      `json:"significant"`
+}
+
+// Validate returns an error if there are less than two variants or a variant has no name, template or weight
+func (e *Experiment) Validate() error {
+	if len(e.Variants) < 2 || len(e.Variants) > MaxExperimentVariants {
+		return fmt.Errorf("must have between 2 and %d variants", MaxExperimentVariants)
+	}
+	names := map[string]bool{}
+	for idx, variant := range e.Variants {
+		if variant == nil || len(variant.Name) == 0 {
+			return fmt.Errorf("variant %d must have a name", idx)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("variant %s is repeated", variant.Name)
+		}
+		names[variant.Name] = true
+		if len(variant.TemplateName) == 0 {
+			return fmt.Errorf("variant %s must have a templateName", variant.Name)
+		}
+		if variant.Weight <= 0 {
+			return fmt.Errorf("variant %s must have a positive weight", variant.Name)
+		}
+	}
+	return nil
+}
+
+// TemplateNames returns the names of the templates of the variants without repetitions
+func (e *Experiment) TemplateNames() []string {
+	templateNames := []string{}
+	seen := map[string]bool{}
+	for _, variant := range e.Variants {
+		if !seen[variant.TemplateName] {
+			seen[variant.TemplateName] = true
+			templateNames = append(templateNames, variant.TemplateName)
+		}
+	}
+	return templateNames
+}
+
+// Assign returns the variant of an user, the hash of the experiment id of the job and the user id falls
+// in the range of one of the variants, each one as large as its weight
+func (e *Experiment) Assign(experimentID uuid.UUID, userID string) *Variant {
+	total := 0
+	for _, variant := range e.Variants {
+		total += variant.Weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%s:%s", experimentID.String(), userID)))
+	point := int(h.Sum32() % uint32(total))
+	for _, variant := range e.Variants {
+		if point < variant.Weight {
+			return variant
+		}
+		point -= variant.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// conversionInterval returns the Wilson score interval of a conversion, which holds for few pushes or conversions near 0
+func conversionInterval(opened, sent int) []float64 {
+	if sent == 0 {
+		return []float64{0, 0}
+	}
+	n := float64(sent)
+	p := float64(opened) / n
+	z2 := experimentZ * experimentZ
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	margin := experimentZ * math.Sqrt(p*(1-p)/n+z2/(4*n*n)) / (1 + z2/n)
+	return []float64{math.Max(0, center-margin), math.Min(1, center+margin)}
+}
+
+// conversionPValue returns the two-sided p-value of the z test of the difference between two conversions
+func conversionPValue(controlOpened, controlSent, opened, sent int) float64 {
+	if controlSent == 0 || sent == 0 {
+		return 1
+	}
+	pooled := float64(controlOpened+opened) / float64(controlSent+sent)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(controlSent) + 1/float64(sent)))
+	if se == 0 {
+		return 1
+	}
+	diff := float64(opened)/float64(sent) - float64(controlOpened)/float64(controlSent)
+	return math.Erfc(math.Abs(diff/se) / math.Sqrt2)
+}
+
+// Results returns the results of the variants, in the experiment order, from their counters,
+// the counters of a variant in several jobs, such as the ones of a job group, are summed
+func (e *Experiment) Results(counters []ExperimentVariant) []*VariantResult {
+	byName := map[string]ExperimentVariant{}
+	for _, counter := range counters {
+		total := byName[counter.Name]
+		total.Sent += counter.Sent
+		total.Delivered += counter.Delivered
+		total.Failed += counter.Failed
+		total.Opened += counter.Opened
+		byName[counter.Name] = total
+	}
+	results := make([]*VariantResult, len(e.Variants))
+	for idx, variant := range e.Variants {
+		counter := byName[variant.Name]
+		result := &VariantResult{
+			Variant:            variant,
+			Sent:               counter.Sent,
+			Delivered:          counter.Delivered,
+			Failed:             counter.Failed,
+			Opened:             counter.Opened,
+			ConfidenceInterval: conversionInterval(counter.Opened, counter.Sent),
+			PValue:             1,
+		}
+		if counter.Sent > 0 {
+			result.ConversionRate = float64(counter.Opened) / float64(counter.Sent)
+		}
+		results[idx] = result
+	}
+	control := results[0]
+	for _, result := range results[1:] {
+		if control.ConversionRate > 0 {
+			result.Lift = (result.ConversionRate - control.ConversionRate) / control.ConversionRate
+		}
+		result.PValue = conversionPValue(control.Opened, control.Sent, result.Opened, result.Sent)
+		result.Significant = result.PValue < experimentSignificance
+	}
+	return results
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FilterOperators are the comparisons accepted in the leaves of a filter expression
+var FilterOperators = map[string]bool{
+	"eq":      true,
+	"neq":     true,
+	"gt":      true,
+	"gte":     true,
+	"lt":      true,
+	"lte":     true,
+	"like":    true,
+	"notLike": true,
+	"in":      true,
+	"notIn":   true,
+	"isNull":  true,
+}
+
+// FilterExpression is a node of a boolean expression selecting the users of a job
+// it is either an and, an or or a not of other nodes, or a leaf comparing a column to a value,
+// e.g. {"or": [{"column": "locale", "op": "eq", "value": "pt"}, {"not": {"column": "tz", "op": "isNull", "value": true}}]}
+type FilterExpression struct {
+	And    []*FilterExpression `json:"and,omitempty"`
+	Or     []*FilterExpression `json:"or,omitempty"`
+	Not    *FilterExpression   `json:"not,omitempty"`
+	Column string              `json:"column,omitempty"`
+	Op     string              `json:"op,omitempty"`
+	Value  interface{}         `json:"value"`
+}
+
+// MarshalJSON keeps the value of every leaf, even when it is false, 0 or an empty string,
+// and only leaves it out of the and, or and not nodes
+func (f FilterExpression) MarshalJSON() ([]byte, error) {
+	type node FilterExpression
+	if f.Column != "" {
+		return json.Marshal((*node)(&f))
+	}
+	return json.Marshal(&struct {
+		*node
+		Value interface{} `json:"value,omitempty"`
+	}{
+		node:  (*node)(&f),
+		Value: f.Value,
+	})
+}
+
+// Validate checks that every node of the expression is well formed, it does not check the columns
+func (f *FilterExpression) Validate() error {
+	kinds := 0
+	if f.And != nil {
+		kinds++
+	}
+	if f.Or != nil {
+		kinds++
+	}
+	if f.Not != nil {
+		kinds++
+	}
+	if f.Column != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("a node must have exactly one of and, or, not or column")
+	}
+
+	for _, children := range [][]*FilterExpression{f.And, f.Or} {
+		if children == nil {
+			continue
+		}
+		if len(children) == 0 {
+			return fmt.Errorf("and and or must have at least one node")
+		}
+		for _, child := range children {
+			if child == nil {
+				return fmt.Errorf("nodes cannot be null")
+			}
+			if err := child.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Not != nil {
+		return f.Not.Validate()
+	}
+	if f.Column != "" {
+		return f.validateLeaf()
+	}
+	return nil
+}
+
+func (f *FilterExpression) validateLeaf() error {
+	if !FilterOperators[f.Op] {
+		return fmt.Errorf("%s: unknown operator %s", f.Column, f.Op)
+	}
+	switch f.Op {
+	case "isNull":
+		if _, ok := f.Value.(bool); !ok {
+			return fmt.Errorf("%s: %s value must be a boolean", f.Column, f.Op)
+		}
+	case "in", "notIn":
+		list, ok := f.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return fmt.Errorf("%s: %s value must be a non empty list", f.Column, f.Op)
+		}
+		for _, item := range list {
+			if !isFilterValue(item) {
+				return fmt.Errorf("%s: %s value must have only strings or numbers", f.Column, f.Op)
+			}
+		}
+	default:
+		if !isFilterValue(f.Value) {
+			return fmt.Errorf("%s: %s value must be a string or a number", f.Column, f.Op)
+		}
+	}
+	return nil
+}
+
+func isFilterValue(val interface{}) bool {
+	switch val.(type) {
+	case string, float64, int, int64:
+		return true
+	}
+	return false
+}
+
+// NewFilterExpressionFromFilters converts the flat filters of a job to an expression
+// a filter is either a comma separated string of values, e.g. {"region": "US,CA"}, or an
+// object of operators, e.g. {"created_at": {"gte": "2019-01-01", "lt": "2019-02-01"}},
+// keys prefixed by NOT negate the filter and all the filters must match
+func NewFilterExpressionFromFilters(filters map[string]interface{}) (*FilterExpression, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(filters))
+	for key := range filters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nodes := []*FilterExpression{}
+	for _, key := range keys {
+		column := key
+		negate := strings.HasPrefix(key, "NOT")
+		if negate {
+			column = strings.TrimPrefix(key, "NOT")
+		}
+		if column == "" {
+			return nil, fmt.Errorf("invalid filter %s: empty column", key)
+		}
+
+		var node *FilterExpression
+		switch val := filters[key].(type) {
+		case string:
+			node = newValuesFilterExpression(column, val, negate)
+		case map[string]interface{}:
+			if len(val) == 0 {
+				return nil, fmt.Errorf("invalid filter %s: must have at least one operator", key)
+			}
+			node = newOperatorsFilterExpression(column, val, negate)
+		default:
+			return nil, fmt.Errorf("invalid filter %s: must be a string or an object", key)
+		}
+		nodes = append(nodes, node)
+	}
+
+	expression := &FilterExpression{And: nodes}
+	if len(nodes) == 1 {
+		expression = nodes[0]
+	}
+	if err := expression.Validate(); err != nil {
+		return nil, err
+	}
+	return expression, nil
+}
+
+func newValuesFilterExpression(column, val string, negate bool) *FilterExpression {
+	vals := strings.Split(val, ",")
+	if len(vals) == 1 {
+		op := "eq"
+		if negate {
+			op = "neq"
+		}
+		return &FilterExpression{Column: column, Op: op, Value: val}
+	}
+	op := "in"
+	if negate {
+		op = "notIn"
+	}
+	list := make([]interface{}, len(vals))
+	for i, v := range vals {
+		list[i] = v
+	}
+	return &FilterExpression{Column: column, Op: op, Value: list}
+}
+
+func newOperatorsFilterExpression(column string, operators map[string]interface{}, negate bool) *FilterExpression {
+	ops := make([]string, 0, len(operators))
+	for op := range operators {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	leaves := make([]*FilterExpression, 0, len(ops))
+	for _, op := range ops {
+		leaves = append(leaves, &FilterExpression{Column: column, Op: op, Value: operators[op]})
+	}
+	node := &FilterExpression{And: leaves}
+	if len(leaves) == 1 {
+		node = leaves[0]
+	}
+	if negate {
+		return &FilterExpression{Not: node}
+	}
+	return node
+}
@@ -30,17 +30,26 @@ import (
 	"github.com/labstack/echo"
 	"github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/messages"
 )
 
+// OptimalSendTimeStrategy sends each user of the job at the hour they most often open pushes
+const OptimalSendTimeStrategy = "optimal"
+
 // Job is the job model struct
 type Job struct {
 	ID                  uuid.UUID              `sql:",pk" json:"id"`
 	TotalBatches        int                    `json:"totalBatches"`
 	CompletedBatches    int                    `json:"completedBatches"`
 	ControlGroup        float64                `json:"controlGroup"`
+	RateLimit           int                    `json:"rateLimit"`
+	QuietHours          *QuietHours            `json:"quietHours"`
+	Experiment          *Experiment            `json:"experiment"`
 	TotalUsers          int                    `json:"totalUsers"`
+	SuppressedUsers     int                    `json:"suppressedUsers"`
 	TotalTokens         int                    `json:"totalTokens"`
 	CompletedTokens     int                    `json:"completedTokens"`
+	RemovedTokens       int                    `json:"removedTokens"`
 	DBPageSize          int                    `json:"dbPageSize"`
 	Localized           bool                   `json:"localized"`
 	CompletedAt         int64                  `json:"completedAt"`
@@ -49,6 +58,9 @@ type Job struct {
 	Context             map[string]interface{} `json:"context"`
 	Service             string                 `json:"service"`
 	Filters             map[string]interface{} `json:"filters"`
+	FilterExpression    *FilterExpression      `json:"filterExpression"`
+	Audience            *Audience              `json:"audience"`
+	AudienceSteps       []*AudienceStep        `json:"audienceSteps"`
 	Metadata            map[string]interface{} `json:"metadata"`
 	CSVPath             string                 `json:"csvPath"`
 	ControlGroupCSVPath string                 `json:"controlGroupCsvPath"`
@@ -56,23 +68,32 @@ type Job struct {
 	App                 App                    `json:"app"`
 	AppID               uuid.UUID              `json:"appId"`
 	JobGroupID          uuid.UUID              `json:"jobGroupId" sql:",null"`
+	SegmentID           uuid.UUID              `json:"segmentId" sql:",null"`
+	JourneyID           uuid.UUID              `json:"journeyId" sql:",null"`
+	JourneyStep         int                    `json:"journeyStep"`
 	TemplateName        string                 `json:"templateName"`
 	PastTimeStrategy    string                 `json:"pastTimeStrategy"`
+	SendTimeStrategy    string                 `json:"sendTimeStrategy"`
 	Status              string                 `json:"status"`
 	Feedbacks           map[string]interface{} `json:"feedbacks"`
 	CreatedAt           int64                  `json:"createdAt"`
 	UpdatedAt           int64                  `json:"updatedAt"`
 	StatusEvents        []*Status              `json:"statusEvents"`
+	ExpectedCompletedAt int64                  `json:"expectedCompletedAt" sql:"-"`
 }
 
 // Validate implementation of the InputValidation interface
 func (j *Job) Validate(c echo.Context) error {
-	valid := govalidator.StringMatches(j.Service, "^(apns|gcm)$")
-	if !valid {
+	pushService, err := messages.GetPushService(j.Service)
+	if err != nil {
 		return InvalidField("service")
 	}
 
-	valid = j.ExpiresAt == 0 || time.Now().UnixNano() < j.ExpiresAt
+	if err := pushService.ValidateMetadata(j.Metadata); err != nil {
+		return InvalidField(fmt.Sprintf("metadata: %s", err.Error()))
+	}
+
+	valid := j.ExpiresAt == 0 || time.Now().UnixNano() < j.ExpiresAt
 	if !valid {
 		return InvalidField("expiresAt")
 	}
@@ -87,6 +108,33 @@ func (j *Job) Validate(c echo.Context) error {
 		return InvalidField("controlGroup")
 	}
 
+	valid = j.RateLimit >= 0
+	if !valid {
+		return InvalidField("rateLimit")
+	}
+
+	valid = govalidator.IsNull(j.SendTimeStrategy) || j.SendTimeStrategy == OptimalSendTimeStrategy
+	if !valid {
+		return InvalidField("sendTimeStrategy")
+	}
+
+	valid = j.SendTimeStrategy != OptimalSendTimeStrategy || !j.Localized
+	if !valid {
+		return InvalidField("sendTimeStrategy: optimal cannot be used with localized jobs")
+	}
+
+	if j.QuietHours != nil {
+		if err := j.QuietHours.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("quietHours: %s", err.Error()))
+		}
+	}
+
+	if j.Experiment != nil {
+		if err := j.Experiment.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("experiment: %s", err.Error()))
+		}
+	}
+
 	valid = govalidator.IsEmail(j.CreatedBy)
 	if !valid {
 		return InvalidField("createdBy")
@@ -97,12 +145,100 @@ func (j *Job) Validate(c echo.Context) error {
 		return InvalidField("filters or csvPath must exist, not both")
 	}
 
+	if j.SegmentID != uuid.Nil {
+		valid = len(j.Filters) == 0 && j.FilterExpression == nil && govalidator.IsNull(j.CSVPath)
+		if !valid {
+			return InvalidField("segmentId cannot be used with filters, filterExpression or csvPath")
+		}
+	}
+
+	if j.FilterExpression != nil {
+		if len(j.Filters) != 0 {
+			return InvalidField("filters or filterExpression must exist, not both")
+		}
+		if !govalidator.IsNull(j.CSVPath) {
+			return InvalidField("filterExpression or csvPath must exist, not both")
+		}
+		if err := j.FilterExpression.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("filterExpression: %s", err.Error()))
+		}
+	}
+
+	if j.Audience != nil {
+		valid = len(j.Filters) == 0 && j.FilterExpression == nil && govalidator.IsNull(j.CSVPath) && j.SegmentID == uuid.Nil
+		if !valid {
+			return InvalidField("audience cannot be used with filters, filterExpression, csvPath or segmentId")
+		}
+		if err := j.Audience.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("audience: %s", err.Error()))
+		}
+	}
+
 	if !govalidator.IsNull(j.CSVPath) && govalidator.Contains(j.CSVPath, "s3://") {
 		return InvalidField("csvPath: cannot contain s3 protocol, just the bucket path")
 	}
 	return nil
 }
 
+// GetFilterExpression returns the filter expression of the job
+// jobs created before filter expressions only have the flat filters, which are converted
+func (j *Job) GetFilterExpression() (*FilterExpression, error) {
+	if j.FilterExpression != nil {
+		return j.FilterExpression, nil
+	}
+	return NewFilterExpressionFromFilters(j.Filters)
+}
+
+// SendRateLimit returns the max pushes per second of the job
+// the job pushes also count for the app rate limit so the job one can only lower it, 0 means unlimited
+func (j *Job) SendRateLimit() int {
+	if j.RateLimit > 0 && (j.App.RateLimit <= 0 || j.RateLimit < j.App.RateLimit) {
+		return j.RateLimit
+	}
+	return j.App.RateLimit
+}
+
+// ExperimentID returns the id the users of the job are assigned to the experiment variants by,
+// the jobs of a group share it so each user gets the same variant in all of them
+func (j *Job) ExperimentID() uuid.UUID {
+	if j.JobGroupID != uuid.Nil {
+		return j.JobGroupID
+	}
+	return j.ID
+}
+
+// SendQuietHours returns the quiet hours of the job users
+// the job quiet hours override the app ones and nil means the pushes are sent at any time
+func (j *Job) SendQuietHours() *QuietHours {
+	if j.QuietHours != nil {
+		return j.QuietHours
+	}
+	return j.App.QuietHours
+}
+
+// SetExpectedCompletedAt estimates when the job will finish sending based on its rate limit
+// the estimate is a lower bound since the app limit is shared by all jobs of the app
+func (j *Job) SetExpectedCompletedAt() {
+	j.ExpectedCompletedAt = 0
+	rateLimit := j.SendRateLimit()
+	if rateLimit == 0 || j.CompletedAt > 0 || j.Status == "stopped" {
+		return
+	}
+	total := j.TotalTokens
+	if total == 0 {
+		total = j.TotalUsers
+	}
+	remaining := total - j.CompletedTokens
+	if remaining <= 0 {
+		return
+	}
+	start := time.Now().UnixNano()
+	if j.StartsAt > start {
+		start = j.StartsAt
+	}
+	j.ExpectedCompletedAt = start + int64(remaining)*int64(time.Second)/int64(rateLimit)
+}
+
 // Labels return the labels for metrics
 func (j *Job) Labels() []string {
 	return []string{
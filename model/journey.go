@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/messages"
+)
+
+// Statuses of the journeys, only the active ones create the jobs of their next steps
+const (
+	ActiveJourneyStatus   = "active"
+	StoppedJourneyStatus  = "stopped"
+	FinishedJourneyStatus = "finished"
+)
+
+// Conditions of the steps of a journey on the engagement of the users with the previous step
+const (
+	DeliveredJourneyCondition = "delivered"
+	OpenedJourneyCondition    = "opened"
+	NotOpenedJourneyCondition = "notOpened"
+)
+
+// MaxJourneySteps is the max number of steps of a journey
+const MaxJourneySteps = 10
+
+// MaxJourneyStepDelay is the max delay in hours between the start of a step and the start of the next one
+const MaxJourneyStepDelay = 30 * 24
+
+// JourneyStep is a push of a journey, the steps after the first one are sent to the users
+// of the previous step that match their condition
+type JourneyStep struct {
+	TemplateName string                 `json:"templateName"`
+	Context      map[string]interface{} `json:"context"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	Delay        int                    `json:"delay"`
+	Condition    string                 `json:"condition"`
+}
+
+// JourneyStepFunnel is the number of users that were sent, got and opened the push of a journey step
+type JourneyStepFunnel struct {
+	Step       int       `json:"step"`
+	JobID      uuid.UUID `json:"jobId"`
+	Status     string    `json:"status"`
+	TotalUsers int       `json:"totalUsers"`
+	Delivered  int       `json:"delivered"`
+	Opened     int       `json:"opened"`
+}
+
+// Journey sends its steps in order, each one as a job created when the step starts
+// the first step is sent to the journey users and the next ones depend on the engagement with the previous one
+type Journey struct {
+	ID               uuid.UUID              `sql:",pk" json:"id"`
+	AppID            uuid.UUID              `json:"appId"`
+	Name             string                 `json:"name"`
+	Service          string                 `json:"service"`
+	Filters          map[string]interface{} `json:"filters"`
+	FilterExpression *FilterExpression      `json:"filterExpression"`
+	SegmentID        uuid.UUID              `json:"segmentId" sql:",null"`
+	CSVPath          string                 `json:"csvPath"`
+	StartsAt         int64                  `json:"startsAt"`
+	Steps            []*JourneyStep         `json:"steps"`
+	Status           string                 `json:"status"`
+	CurrentStep      int                    `json:"currentStep"`
+	CreatedBy        string                 `json:"createdBy"`
+	CreatedAt        int64                  `json:"createdAt"`
+	UpdatedAt        int64                  `json:"updatedAt"`
+	Funnel           []*JourneyStepFunnel   `json:"funnel,omitempty" sql:"-"`
+}
+
+// Validate implementation of the InputValidation interface
+func (j *Journey) Validate(c echo.Context) error {
+	valid := govalidator.StringLength(j.Name, "1", "255")
+	if !valid {
+		return InvalidField("name")
+	}
+
+	if _, err := messages.GetPushService(j.Service); err != nil {
+		return InvalidField("service")
+	}
+
+	valid = j.StartsAt == 0 || time.Now().UnixNano() < j.StartsAt
+	if !valid {
+		return InvalidField("startsAt")
+	}
+
+	valid = len(j.Steps) > 0 && len(j.Steps) <= MaxJourneySteps
+	if !valid {
+		return InvalidField(fmt.Sprintf("steps: must have between 1 and %d steps", MaxJourneySteps))
+	}
+
+	for idx, step := range j.Steps {
+		if step == nil || govalidator.IsNull(step.TemplateName) {
+			return InvalidField(fmt.Sprintf("steps[%d]: templateName", idx))
+		}
+		if idx == 0 {
+			valid = step.Delay == 0 && govalidator.IsNull(step.Condition)
+			if !valid {
+				return InvalidField("steps[0]: the first step has no delay or condition")
+			}
+		} else {
+			valid = step.Delay > 0 && step.Delay <= MaxJourneyStepDelay
+			if !valid {
+				return InvalidField(fmt.Sprintf("steps[%d]: delay must be between 1 and %d hours", idx, MaxJourneyStepDelay))
+			}
+			valid = step.Condition == DeliveredJourneyCondition ||
+				step.Condition == OpenedJourneyCondition ||
+				step.Condition == NotOpenedJourneyCondition
+			if !valid {
+				return InvalidField(fmt.Sprintf("steps[%d]: condition", idx))
+			}
+		}
+		if err := j.NewJob(idx, 0).Validate(c); err != nil {
+			return InvalidField(fmt.Sprintf("steps[%d]: %s", idx, err.Error()))
+		}
+	}
+	return nil
+}
+
+// JobID returns the id of the job of the step of the journey
+// it is derived from the step so the job of a step can only be created once
+func (j *Journey) JobID(step int) uuid.UUID {
+	return uuid.NewV5(j.ID, fmt.Sprintf("step:%d", step))
+}
+
+// NewJob returns a new job of the step of the journey starting at startsAt
+// only the job of the first step targets the journey users, the users of the next steps are set by the journey worker
+func (j *Journey) NewJob(step int, startsAt int64) *Job {
+	job := &Job{
+		ID:           j.JobID(step),
+		AppID:        j.AppID,
+		JourneyID:    j.ID,
+		JourneyStep:  step,
+		StartsAt:     startsAt,
+		Service:      j.Service,
+		TemplateName: j.Steps[step].TemplateName,
+		Context:      j.Steps[step].Context,
+		Metadata:     j.Steps[step].Metadata,
+		Filters:      map[string]interface{}{},
+		Feedbacks:    map[string]interface{}{},
+		CreatedBy:    j.CreatedBy,
+		CreatedAt:    time.Now().UnixNano(),
+		UpdatedAt:    time.Now().UnixNano(),
+	}
+	if step == 0 {
+		job.Filters = j.Filters
+		job.FilterExpression = j.FilterExpression
+		job.SegmentID = j.SegmentID
+		job.CSVPath = j.CSVPath
+	}
+	return job
+}
+
+// NextStepAt returns when the step after step starts, 0 if step is the last one
+func (j *Journey) NextStepAt(step int, startedAt int64) int64 {
+	if step+1 >= len(j.Steps) {
+		return 0
+	}
+	delay := time.Duration(j.Steps[step+1].Delay) * time.Hour
+	return time.Unix(0, startedAt).Add(delay).UnixNano()
+}
+
+// LoadFunnel sets the funnel of each step of the journey, the steps not started yet have no job
+func (j *Journey) LoadFunnel(db interfaces.DB) error {
+	var jobs []*Job
+	err := db.Model(&jobs).
+		Column("id", "journey_step", "status", "total_users").
+		Where("journey_id = ?", j.ID).
+		Select()
+	if err != nil {
+		return err
+	}
+	var counts []*JourneyStepFunnel
+	_, err = db.Query(
+		&counts,
+		"SELECT step, COUNT(*) FILTER (WHERE delivered) AS delivered, COUNT(*) FILTER (WHERE opened) AS opened FROM journey_users WHERE journey_id = ? GROUP BY step",
+		j.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	j.Funnel = make([]*JourneyStepFunnel, len(j.Steps))
+	for idx := range j.Steps {
+		j.Funnel[idx] = &JourneyStepFunnel{Step: idx}
+	}
+	for _, job := range jobs {
+		if job.JourneyStep < len(j.Funnel) {
+			j.Funnel[job.JourneyStep].JobID = job.ID
+			j.Funnel[job.JourneyStep].Status = job.Status
+			j.Funnel[job.JourneyStep].TotalUsers = job.TotalUsers
+		}
+	}
+	for _, count := range counts {
+		if count.Step < len(j.Funnel) {
+			j.Funnel[count.Step].Delivered = count.Delivered
+			j.Funnel[count.Step].Opened = count.Opened
+		}
+	}
+	return nil
+}
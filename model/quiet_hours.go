@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietHours is a daily window in the user local time in which massive pushes are not sent,
+// e.g. {"start": "22:00", "end": "08:00"}, the window wraps midnight when it ends before it starts
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func parseQuietHoursTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate returns an error if start or end are not HH:MM times or are the same
+func (q *QuietHours) Validate() error {
+	start, err := parseQuietHoursTime(q.Start)
+	if err != nil {
+		return fmt.Errorf("start must be in the HH:MM format")
+	}
+	end, err := parseQuietHoursTime(q.End)
+	if err != nil {
+		return fmt.Errorf("end must be in the HH:MM format")
+	}
+	if start == end {
+		return fmt.Errorf("start and end must be different")
+	}
+	return nil
+}
+
+// Remaining returns how long the quiet hours last for an user whose time is offsetInSeconds
+// behind UTC, as returned by the workers for the user tz, or 0 if it is not inside them
+func (q *QuietHours) Remaining(now time.Time, offsetInSeconds int) time.Duration {
+	start, err := parseQuietHoursTime(q.Start)
+	if err != nil {
+		return 0
+	}
+	end, err := parseQuietHoursTime(q.End)
+	if err != nil {
+		return 0
+	}
+	local := now.UTC().Add(-time.Duration(offsetInSeconds) * time.Second)
+	minute := local.Hour()*60 + local.Minute()
+	inside := start <= minute && minute < end
+	if start > end {
+		inside = minute >= start || minute < end
+	}
+	if !inside {
+		return 0
+	}
+	endsAt := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, time.UTC)
+	if !endsAt.After(local) {
+		endsAt = endsAt.AddDate(0, 0, 1)
+	}
+	return endsAt.Sub(local)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+)
+
+// Statuses of the recurrences, only the active ones create jobs
+const (
+	ActiveRecurrenceStatus   = "active"
+	PausedRecurrenceStatus   = "paused"
+	FinishedRecurrenceStatus = "finished"
+)
+
+// RecurrenceJob is the template of the jobs created by a recurrence
+type RecurrenceJob struct {
+	Service          string                 `json:"service"`
+	TemplateName     string                 `json:"templateName"`
+	Context          map[string]interface{} `json:"context"`
+	Metadata         map[string]interface{} `json:"metadata"`
+	Filters          map[string]interface{} `json:"filters"`
+	FilterExpression *FilterExpression      `json:"filterExpression"`
+	Audience         *Audience              `json:"audience"`
+	SegmentID        uuid.UUID              `json:"segmentId"`
+	CSVPath          string                 `json:"csvPath"`
+	ControlGroup     float64                `json:"controlGroup"`
+	RateLimit        int                    `json:"rateLimit"`
+	QuietHours       *QuietHours            `json:"quietHours"`
+	SendTimeStrategy string                 `json:"sendTimeStrategy"`
+}
+
+// Recurrence creates a job from its template at each occurrence of its cron schedule
+// the jobs of a recurrence are the jobs of its job group
+type Recurrence struct {
+	ID         uuid.UUID      `sql:",pk" json:"id"`
+	AppID      uuid.UUID      `json:"appId"`
+	JobGroupID uuid.UUID      `json:"jobGroupId"`
+	Cron       string         `json:"cron"`
+	Timezone   string         `json:"timezone"`
+	EndsAt     int64          `json:"endsAt"`
+	Job        *RecurrenceJob `json:"job"`
+	Status     string         `json:"status"`
+	NextRunAt  int64          `json:"nextRunAt"`
+	LastRunAt  int64          `json:"lastRunAt"`
+	CreatedBy  string         `json:"createdBy"`
+	CreatedAt  int64          `json:"createdAt"`
+	UpdatedAt  int64          `json:"updatedAt"`
+}
+
+// Validate implementation of the InputValidation interface
+func (r *Recurrence) Validate(c echo.Context) error {
+	if _, err := ParseCron(r.Cron); err != nil {
+		return InvalidField(fmt.Sprintf("cron: %s", err.Error()))
+	}
+
+	if _, err := r.Location(); err != nil {
+		return InvalidField("timezone")
+	}
+
+	valid := r.EndsAt == 0 || time.Now().UnixNano() < r.EndsAt
+	if !valid {
+		return InvalidField("endsAt")
+	}
+
+	valid = govalidator.IsEmail(r.CreatedBy)
+	if !valid {
+		return InvalidField("createdBy")
+	}
+
+	if r.Job == nil {
+		return InvalidField("job")
+	}
+
+	valid = !govalidator.IsNull(r.Job.TemplateName)
+	if !valid {
+		return InvalidField("job: templateName")
+	}
+
+	if err := r.NewJob(0).Validate(c); err != nil {
+		return InvalidField(fmt.Sprintf("job: %s", err.Error()))
+	}
+	return nil
+}
+
+// Location returns the location the cron schedule is evaluated in, UTC if the recurrence has no timezone
+func (r *Recurrence) Location() (*time.Location, error) {
+	if r.Timezone == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", r.Timezone)
+	}
+	return time.LoadLocation(r.Timezone)
+}
+
+// NextRunAfter returns the first occurrence of the recurrence after at
+// 0 is returned when there are no occurrences left before the end of the recurrence
+func (r *Recurrence) NextRunAfter(at int64) (int64, error) {
+	schedule, err := ParseCron(r.Cron)
+	if err != nil {
+		return 0, err
+	}
+	loc, err := r.Location()
+	if err != nil {
+		return 0, err
+	}
+	next := schedule.Next(time.Unix(0, at), loc)
+	if next.IsZero() || (r.EndsAt > 0 && next.UnixNano() > r.EndsAt) {
+		return 0, nil
+	}
+	return next.UnixNano(), nil
+}
+
+// JobID returns the id of the job of the occurrence of the recurrence at runAt
+// it is derived from the occurrence so the job of an occurrence can only be created once
+func (r *Recurrence) JobID(runAt int64) uuid.UUID {
+	return uuid.NewV5(r.ID, fmt.Sprintf("occurrence:%d", runAt))
+}
+
+// NewJob returns a new job of the recurrence starting at startsAt
+func (r *Recurrence) NewJob(startsAt int64) *Job {
+	return &Job{
+		ID:               r.JobID(startsAt),
+		AppID:            r.AppID,
+		JobGroupID:       r.JobGroupID,
+		StartsAt:         startsAt,
+		Service:          r.Job.Service,
+		TemplateName:     r.Job.TemplateName,
+		Context:          r.Job.Context,
+		Metadata:         r.Job.Metadata,
+		Filters:          r.Job.Filters,
+		FilterExpression: r.Job.FilterExpression,
+		Audience:         r.Job.Audience,
+		SegmentID:        r.Job.SegmentID,
+		CSVPath:          r.Job.CSVPath,
+		ControlGroup:     r.Job.ControlGroup,
+		RateLimit:        r.Job.RateLimit,
+		QuietHours:       r.Job.QuietHours,
+		SendTimeStrategy: r.Job.SendTimeStrategy,
+		CreatedBy:        r.CreatedBy,
+		CreatedAt:        time.Now().UnixNano(),
+		UpdatedAt:        time.Now().UnixNano(),
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
+)
+
+// Segment is a saved audience of an app that jobs can target instead of inline filters or csv
+type Segment struct {
+	ID               uuid.UUID         `sql:",pk" json:"id"`
+	AppID            uuid.UUID         `json:"appId"`
+	Name             string            `json:"name"`
+	Service          string            `json:"service"`
+	FilterExpression *FilterExpression `json:"filterExpression"`
+	CSVPath          string            `json:"csvPath"`
+	Size             int               `json:"size"`
+	SizeComputedAt   int64             `json:"sizeComputedAt"`
+	CreatedBy        string            `json:"createdBy"`
+	CreatedAt        int64             `json:"createdAt"`
+	UpdatedAt        int64             `json:"updatedAt"`
+}
+
+// Validate implementation of the InputValidation interface
+func (s *Segment) Validate(c echo.Context) error {
+	valid := govalidator.StringLength(s.Name, "1", "255")
+	if !valid {
+		return InvalidField("name")
+	}
+
+	if _, err := messages.GetPushService(s.Service); err != nil {
+		return InvalidField("service")
+	}
+
+	valid = (s.FilterExpression == nil) != govalidator.IsNull(s.CSVPath)
+	if !valid {
+		return InvalidField("filterExpression or csvPath must exist, not both")
+	}
+
+	if s.FilterExpression != nil {
+		if err := s.FilterExpression.Validate(); err != nil {
+			return InvalidField(fmt.Sprintf("filterExpression: %s", err.Error()))
+		}
+	}
+
+	if govalidator.Contains(s.CSVPath, "s3://") {
+		return InvalidField("csvPath: cannot contain s3 protocol, just the bucket path")
+	}
+
+	valid = govalidator.IsEmail(s.CreatedBy)
+	if !valid {
+		return InvalidField("createdBy")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+)
+
+// Suppression is a user that must not receive the massive pushes of an app, or of any app when AppID is nil
+type Suppression struct {
+	ID        uuid.UUID `sql:",pk" json:"id"`
+	AppID     uuid.UUID `json:"appId" sql:",null"`
+	UserID    string    `json:"userId"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt int64     `json:"createdAt"`
+}
+
+// SuppressionList is a list of users to suppress, given inline or in a csv file uploaded to s3
+type SuppressionList struct {
+	UserIDs []string `json:"userIds"`
+	CSVPath string   `json:"csvPath"`
+	Reason  string   `json:"reason"`
+}
+
+// Validate implementation of the InputValidation interface
+func (s *SuppressionList) Validate(c echo.Context) error {
+	valid := (len(s.UserIDs) == 0) != govalidator.IsNull(s.CSVPath)
+	if !valid {
+		return InvalidField("userIds or csvPath must exist, not both")
+	}
+
+	for _, userID := range s.UserIDs {
+		if govalidator.IsNull(userID) {
+			return InvalidField("userIds")
+		}
+	}
+
+	if govalidator.Contains(s.CSVPath, "s3://") {
+		return InvalidField("csvPath: cannot contain s3 protocol, just the bucket path")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
+)
+
+// MaxTestSendDevices is the max number of user ids and tokens of a test send
+const MaxTestSendDevices = 100
+
+// TestSend is a template sent to a list of devices for QA, it is not a job
+type TestSend struct {
+	ID         uuid.UUID              `sql:",pk" json:"id"`
+	AppID      uuid.UUID              `json:"appId"`
+	TemplateID uuid.UUID              `json:"templateId"`
+	Service    string                 `json:"service"`
+	UserIDs    []string               `json:"userIds"`
+	Tokens     []string               `json:"tokens"`
+	Context    map[string]interface{} `json:"context"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Feedbacks  map[string]interface{} `json:"feedbacks"`
+	SentPushes int                    `json:"sentPushes"`
+	CreatedBy  string                 `json:"createdBy"`
+	CreatedAt  int64                  `json:"createdAt"`
+}
+
+// Validate implementation of the InputValidation interface
+func (t *TestSend) Validate(c echo.Context) error {
+	pushService, err := messages.GetPushService(t.Service)
+	if err != nil {
+		return InvalidField("service")
+	}
+
+	if err := pushService.ValidateMetadata(t.Metadata); err != nil {
+		return InvalidField(fmt.Sprintf("metadata: %s", err.Error()))
+	}
+
+	devices := len(t.UserIDs) + len(t.Tokens)
+	valid := devices > 0 && devices <= MaxTestSendDevices
+	if !valid {
+		return InvalidField(fmt.Sprintf("userIds and tokens: must have between 1 and %d devices", MaxTestSendDevices))
+	}
+
+	valid = govalidator.IsEmail(t.CreatedBy)
+	if !valid {
+		return InvalidField("createdBy")
+	}
+	return nil
+}
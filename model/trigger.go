@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
+)
+
+// MaxTriggerDelay is the max delay in seconds between an event and the push of its trigger
+const MaxTriggerDelay = 7 * 24 * 60 * 60
+
+// Trigger sends a push to the user of each event of the app with its name
+// the pushes of a trigger are accounted in its job, which is never started by the workers
+type Trigger struct {
+	ID             uuid.UUID              `sql:",pk" json:"id"`
+	AppID          uuid.UUID              `json:"appId"`
+	JobID          uuid.UUID              `json:"jobId"`
+	Event          string                 `json:"event"`
+	Service        string                 `json:"service"`
+	TemplateName   string                 `json:"templateName"`
+	Context        map[string]interface{} `json:"context"`
+	ContextMapping map[string]string      `json:"contextMapping"`
+	Metadata       map[string]interface{} `json:"metadata"`
+	Delay          int                    `json:"delay"`
+	CreatedBy      string                 `json:"createdBy"`
+	CreatedAt      int64                  `json:"createdAt"`
+	UpdatedAt      int64                  `json:"updatedAt"`
+}
+
+// Validate implementation of the InputValidation interface
+func (t *Trigger) Validate(c echo.Context) error {
+	valid := govalidator.StringLength(t.Event, "1", "255")
+	if !valid {
+		return InvalidField("event")
+	}
+
+	pushService, err := messages.GetPushService(t.Service)
+	if err != nil {
+		return InvalidField("service")
+	}
+
+	if err := pushService.ValidateMetadata(t.Metadata); err != nil {
+		return InvalidField(fmt.Sprintf("metadata: %s", err.Error()))
+	}
+
+	valid = !govalidator.IsNull(t.TemplateName)
+	if !valid {
+		return InvalidField("templateName")
+	}
+
+	valid = t.Delay >= 0 && t.Delay <= MaxTriggerDelay
+	if !valid {
+		return InvalidField(fmt.Sprintf("delay: must be between 0 and %d seconds", MaxTriggerDelay))
+	}
+
+	valid = govalidator.IsEmail(t.CreatedBy)
+	if !valid {
+		return InvalidField("createdBy")
+	}
+	return nil
+}
+
+// NewJob returns the job the pushes of the trigger are accounted in
+func (t *Trigger) NewJob() *Job {
+	return &Job{
+		ID:           uuid.NewV4(),
+		AppID:        t.AppID,
+		Service:      t.Service,
+		TemplateName: t.TemplateName,
+		Context:      t.Context,
+		Metadata:     t.Metadata,
+		Filters:      map[string]interface{}{},
+		Feedbacks:    map[string]interface{}{},
+		CreatedBy:    t.CreatedBy,
+		CreatedAt:    time.Now().UnixNano(),
+		UpdatedAt:    time.Now().UnixNano(),
+	}
+}
+
+// BuildContext returns the context of the push of the trigger for an event
+// each template variable of the context mapping is set to the event property it is mapped to
+func (t *Trigger) BuildContext(props map[string]interface{}) map[string]interface{} {
+	context := make(map[string]interface{}, len(t.Context)+len(t.ContextMapping))
+	for k, v := range t.Context {
+		context[k] = v
+	}
+	for variable, prop := range t.ContextMapping {
+		if v, ok := props[prop]; ok {
+			context[variable] = v
+		}
+	}
+	return context
+}
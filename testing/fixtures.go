@@ -54,6 +54,11 @@ func CreateTestApp(db interfaces.DB, options ...map[string]interface{}) *model.A
 	app.Name = getOpt(opts, "name", "testapp").(string)
 	app.BundleID = getOpt(opts, "bundleId", fmt.Sprintf("com.app.%s", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
 	app.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	app.RateLimit = getOpt(opts, "rateLimit", 0).(int)
+	app.FrequencyCapLimit = getOpt(opts, "frequencyCapLimit", 0).(int)
+	app.FrequencyCapWindow = getOpt(opts, "frequencyCapWindow", 0).(int)
+	app.QuietHours = getOpt(opts, "quietHours", (*model.QuietHours)(nil)).(*model.QuietHours)
+	app.Holdout = getOpt(opts, "holdout", 0.0).(float64)
 
 	err := db.Insert(&app)
 	gomega.Expect(err).NotTo(gomega.HaveOccurred())
@@ -237,12 +242,173 @@ func CreateTestJob(db interfaces.DB, appID uuid.UUID, templateName string, optio
 	job.ExpiresAt = getOpt(opts, "expiresAt", time.Now().Add(time.Hour).UnixNano()).(int64)
 	job.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
 	job.StartsAt = getOpt(opts, "startsAt", time.Now().Add(time.Hour).UnixNano()).(int64)
+	job.RateLimit = getOpt(opts, "rateLimit", 0).(int)
+	job.SegmentID = getOpt(opts, "segmentId", uuid.Nil).(uuid.UUID)
+	job.Audience = getOpt(opts, "audience", (*model.Audience)(nil)).(*model.Audience)
+	job.QuietHours = getOpt(opts, "quietHours", (*model.QuietHours)(nil)).(*model.QuietHours)
+	job.SendTimeStrategy = getOpt(opts, "sendTimeStrategy", "").(string)
 
 	err := db.Insert(&job)
 	gomega.Expect(err).NotTo(gomega.HaveOccurred())
 	return job
 }
 
+//CreateTestSegment with specified optional values
+func CreateTestSegment(db interfaces.DB, appID uuid.UUID, options ...map[string]interface{}) *model.Segment {
+	opts := map[string]interface{}{}
+	if len(options) == 1 {
+		opts = options[0]
+	}
+
+	segment := &model.Segment{}
+	segment.AppID = appID
+	segment.ID = getOpt(opts, "id", uuid.NewV4()).(uuid.UUID)
+	segment.Name = getOpt(opts, "name", uuid.NewV4().String()).(string)
+	segment.Service = getOpt(opts, "service", "apns").(string)
+	segment.CSVPath = getOpt(opts, "csvPath", "").(string)
+	if segment.CSVPath == "" {
+		segment.FilterExpression = getOpt(opts, "filterExpression", &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"}).(*model.FilterExpression)
+	}
+	segment.Size = getOpt(opts, "size", 0).(int)
+	segment.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	segment.CreatedAt = time.Now().UnixNano()
+	segment.UpdatedAt = time.Now().UnixNano()
+
+	err := db.Insert(&segment)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return segment
+}
+
+//CreateTestSuppression with specified optional values, a nil app id creates a global suppression
+func CreateTestSuppression(db interfaces.DB, appID uuid.UUID, options ...map[string]interface{}) *model.Suppression {
+	opts := map[string]interface{}{}
+	if len(options) == 1 {
+		opts = options[0]
+	}
+
+	suppression := &model.Suppression{}
+	suppression.AppID = appID
+	suppression.ID = getOpt(opts, "id", uuid.NewV4()).(uuid.UUID)
+	suppression.UserID = getOpt(opts, "userId", uuid.NewV4().String()).(string)
+	suppression.Reason = getOpt(opts, "reason", "").(string)
+	suppression.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	suppression.CreatedAt = time.Now().UnixNano()
+
+	err := db.Insert(&suppression)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return suppression
+}
+
+//CreateTestRecurrence with specified optional values, the recurrence job group is created too
+func CreateTestRecurrence(db interfaces.DB, appID uuid.UUID, templateName string, options ...map[string]interface{}) *model.Recurrence {
+	opts := map[string]interface{}{}
+	if len(options) == 1 {
+		opts = options[0]
+	}
+
+	jobGroup := &model.JobGroup{ID: uuid.NewV4(), AppID: appID}
+	err := db.Insert(jobGroup)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+	recurrence := &model.Recurrence{}
+	recurrence.AppID = appID
+	recurrence.JobGroupID = jobGroup.ID
+	recurrence.ID = getOpt(opts, "id", uuid.NewV4()).(uuid.UUID)
+	recurrence.Cron = getOpt(opts, "cron", "0 10 * * *").(string)
+	recurrence.Timezone = getOpt(opts, "timezone", "").(string)
+	recurrence.EndsAt = getOpt(opts, "endsAt", int64(0)).(int64)
+	recurrence.Status = getOpt(opts, "status", model.ActiveRecurrenceStatus).(string)
+	recurrence.NextRunAt = getOpt(opts, "nextRunAt", time.Now().Add(time.Hour).UnixNano()).(int64)
+	recurrence.Job = &model.RecurrenceJob{
+		Service:      getOpt(opts, "service", "apns").(string),
+		TemplateName: templateName,
+		Context:      getOpt(opts, "context", map[string]interface{}{"value": uuid.NewV4().String()}).(map[string]interface{}),
+		CSVPath:      getOpt(opts, "csvPath", "").(string),
+	}
+	if recurrence.Job.CSVPath == "" {
+		recurrence.Job.Filters = getOpt(opts, "filters", map[string]interface{}{"locale": "en"}).(map[string]interface{})
+	}
+	recurrence.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	recurrence.CreatedAt = time.Now().UnixNano()
+	recurrence.UpdatedAt = time.Now().UnixNano()
+
+	err = db.Insert(&recurrence)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return recurrence
+}
+
+//CreateTestTrigger with specified optional values, the job of the trigger is created along with it
+func CreateTestTrigger(db interfaces.DB, appID uuid.UUID, templateName string, options ...map[string]interface{}) *model.Trigger {
+	opts := map[string]interface{}{}
+	if len(options) == 1 {
+		opts = options[0]
+	}
+
+	trigger := &model.Trigger{}
+	trigger.AppID = appID
+	trigger.ID = getOpt(opts, "id", uuid.NewV4()).(uuid.UUID)
+	trigger.Event = getOpt(opts, "event", strings.Split(uuid.NewV4().String(), "-")[0]).(string)
+	trigger.Service = getOpt(opts, "service", "apns").(string)
+	trigger.TemplateName = templateName
+	trigger.Context = getOpt(opts, "context", map[string]interface{}{}).(map[string]interface{})
+	trigger.ContextMapping = getOpt(opts, "contextMapping", map[string]string{}).(map[string]string)
+	trigger.Metadata = getOpt(opts, "metadata", map[string]interface{}{}).(map[string]interface{})
+	trigger.Delay = getOpt(opts, "delay", 0).(int)
+	trigger.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	trigger.CreatedAt = time.Now().UnixNano()
+	trigger.UpdatedAt = time.Now().UnixNano()
+
+	job := trigger.NewJob()
+	err := db.Insert(job)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	trigger.JobID = job.ID
+
+	err = db.Insert(&trigger)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return trigger
+}
+
+//CreateTestJourney with specified optional values, each template name is a step of the journey
+func CreateTestJourney(db interfaces.DB, appID uuid.UUID, templateNames []string, options ...map[string]interface{}) *model.Journey {
+	opts := map[string]interface{}{}
+	if len(options) == 1 {
+		opts = options[0]
+	}
+
+	journey := &model.Journey{}
+	journey.AppID = appID
+	journey.ID = getOpt(opts, "id", uuid.NewV4()).(uuid.UUID)
+	journey.Name = getOpt(opts, "name", strings.Split(uuid.NewV4().String(), "-")[0]).(string)
+	journey.Service = getOpt(opts, "service", "apns").(string)
+	journey.CSVPath = getOpt(opts, "csvPath", "").(string)
+	journey.Filters = map[string]interface{}{}
+	if journey.CSVPath == "" {
+		journey.Filters = getOpt(opts, "filters", map[string]interface{}{"locale": "en"}).(map[string]interface{})
+	}
+	journey.Status = getOpt(opts, "status", model.ActiveJourneyStatus).(string)
+	journey.CurrentStep = getOpt(opts, "currentStep", 0).(int)
+	condition := getOpt(opts, "condition", model.NotOpenedJourneyCondition).(string)
+	for idx, templateName := range templateNames {
+		step := &model.JourneyStep{
+			TemplateName: templateName,
+			Context:      map[string]interface{}{"value": uuid.NewV4().String()},
+			Metadata:     map[string]interface{}{},
+		}
+		if idx > 0 {
+			step.Delay = getOpt(opts, "delay", 24).(int)
+			step.Condition = condition
+		}
+		journey.Steps = append(journey.Steps, step)
+	}
+	journey.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
+	journey.CreatedAt = time.Now().UnixNano()
+	journey.UpdatedAt = time.Now().UnixNano()
+
+	err := db.Insert(&journey)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return journey
+}
+
 //CreateTestJobs for n apps
 func CreateTestJobs(db interfaces.DB, appID uuid.UUID, templateName string, n int, options ...map[string]interface{}) []*model.Job {
 	jobs := make([]*model.Job, n)
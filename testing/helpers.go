@@ -33,6 +33,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"time"
 
 	pg "gopkg.in/pg.v5"
 	"gopkg.in/pg.v5/orm"
@@ -43,14 +44,19 @@ import (
 	"github.com/spf13/viper"
 	"github.com/topfreegames/marathon/api"
 	"github.com/topfreegames/marathon/extensions"
+	"github.com/topfreegames/marathon/interfaces"
 	"github.com/topfreegames/marathon/messages"
 	"github.com/uber-go/zap"
 )
 
 // FakeKafkaProducer is a mock producer that implements PushProducer interface
+// OnSendPush, if set, is called with the push metadata before each push is produced
 type FakeKafkaProducer struct {
 	APNSMessages []string
 	GCMMessages  []string
+	Messages     map[string][]string
+	AckErrors    map[string]error
+	OnSendPush   func(pushMetadata map[string]interface{})
 }
 
 // NewFakeKafkaProducer creates a new FakeKafkaProducer
@@ -58,12 +64,33 @@ func NewFakeKafkaProducer() *FakeKafkaProducer {
 	return &FakeKafkaProducer{
 		APNSMessages: []string{},
 		GCMMessages:  []string{},
+		Messages:     map[string][]string{},
+		AckErrors:    map[string]error{},
 	}
 }
 
-// SendAPNSPush for testing
-func (f *FakeKafkaProducer) SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
-	msg := messages.NewAPNSMessage(
+// NewPushBatch for testing
+func (f *FakeKafkaProducer) NewPushBatch() interfaces.PushBatch {
+	return &FakePushBatch{
+		producer: f,
+		errors:   []error{},
+	}
+}
+
+// SendPush for testing
+func (f *FakeKafkaProducer) SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	if f.OnSendPush != nil {
+		f.OnSendPush(pushMetadata)
+	}
+	pushService, err := messages.GetPushService(service)
+	if err != nil {
+		return err
+	}
+	buildMessage, err := pushService.Builder(format)
+	if err != nil {
+		return err
+	}
+	msg := buildMessage(
 		deviceToken,
 		pushExpiry,
 		payload,
@@ -74,7 +101,7 @@ func (f *FakeKafkaProducer) SendAPNSPush(topic, deviceToken string, payload, mes
 
 	if val, ok := pushMetadata["dryRun"]; ok {
 		if dryRun, _ := val.(bool); dryRun {
-			msg.DeviceToken = extensions.GenerateFakeID(64)
+			msg.SetDryRun(extensions.GenerateFakeID(pushService.FakeTokenSize))
 		}
 	}
 
@@ -83,40 +110,55 @@ func (f *FakeKafkaProducer) SendAPNSPush(topic, deviceToken string, payload, mes
 		return err
 	}
 
-	f.APNSMessages = append(f.APNSMessages, message)
+	switch service {
+	case "apns":
+		f.APNSMessages = append(f.APNSMessages, message)
+	case "gcm":
+		f.GCMMessages = append(f.GCMMessages, message)
+	default:
+		f.Messages[service] = append(f.Messages[service], message)
+	}
 
 	return nil
 }
 
+// SendAPNSPush for testing
+func (f *FakeKafkaProducer) SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	return f.SendPush("apns", "", topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+}
+
 // SendGCMPush for testing
 func (f *FakeKafkaProducer) SendGCMPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
-	msg := messages.NewGCMMessage(
-		deviceToken,
-		payload,
-		messageMetadata,
-		pushMetadata,
-		pushExpiry,
-		templateName,
-	)
+	return f.SendPush("gcm", "", topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
+}
 
-	if val, ok := pushMetadata["dryRun"]; ok {
-		if dryRun, _ := val.(bool); dryRun {
-			msg.To = extensions.GenerateFakeID(152)
-			msg.DryRun = true
-		}
-	}
+// SendMessage for testing, the messages are kept by topic
+func (f *FakeKafkaProducer) SendMessage(topic string, message []byte) error {
+	f.Messages[topic] = append(f.Messages[topic], string(message))
+	return nil
+}
 
-	message, err := msg.ToJSON()
+// FakePushBatch is a mock batch that confirms the pushes with the producer AckErrors by device token
+type FakePushBatch struct {
+	producer *FakeKafkaProducer
+	errors   []error
+}
 
+// SendPush for testing
+func (b *FakePushBatch) SendPush(service, format, topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	err := b.producer.SendPush(service, format, topic, deviceToken, payload, messageMetadata, pushMetadata, pushExpiry, templateName)
 	if err != nil {
 		return err
 	}
-
-	f.GCMMessages = append(f.GCMMessages, message)
-
+	b.errors = append(b.errors, b.producer.AckErrors[deviceToken])
 	return nil
 }
 
+// Wait for testing
+func (b *FakePushBatch) Wait(timeout time.Duration) []error {
+	return b.errors
+}
+
 //PGMock should be used for tests that need to connect to PG
 type PGMock struct {
 	Execs        [][]interface{}
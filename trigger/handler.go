@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package trigger
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+// Handler matches the events read by the listener against the triggers of their apps
+// and enqueues the pushes of the matched triggers to the trigger worker
+type Handler struct {
+	Config            *viper.Viper
+	Worker            *worker.Worker
+	Logger            zap.Logger
+	RefreshInterval   time.Duration
+	pendingMessagesWG *sync.WaitGroup
+	triggers          map[string]map[string][]*model.Trigger
+	triggersMutex     sync.RWMutex
+	run               bool
+}
+
+// NewHandler creates a new instance of trigger.Handler
+func NewHandler(config *viper.Viper, logger zap.Logger, pendingMessagesWG *sync.WaitGroup, w *worker.Worker) (*Handler, error) {
+	h := &Handler{
+		Config:            config,
+		Worker:            w,
+		Logger:            logger,
+		pendingMessagesWG: pendingMessagesWG,
+		triggers:          map[string]map[string][]*model.Trigger{},
+	}
+	h.loadConfigurationDefaults()
+	h.RefreshInterval = time.Duration(h.Config.GetInt("triggerListener.refreshInterval")) * time.Millisecond
+	err := h.LoadTriggers()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Handler) loadConfigurationDefaults() {
+	h.Config.SetDefault("triggerListener.refreshInterval", 30000)
+}
+
+// LoadTriggers reads the triggers of all apps, indexed by app name and event
+func (h *Handler) LoadTriggers() error {
+	var apps []model.App
+	err := h.Worker.MarathonDB.Model(&apps).Column("id", "name").Select()
+	if err != nil {
+		return err
+	}
+	appNames := make(map[uuid.UUID]string, len(apps))
+	for _, app := range apps {
+		appNames[app.ID] = app.Name
+	}
+
+	var triggers []*model.Trigger
+	err = h.Worker.MarathonDB.Model(&triggers).Select()
+	if err != nil {
+		return err
+	}
+	triggersByAppAndEvent := map[string]map[string][]*model.Trigger{}
+	for _, trigger := range triggers {
+		appName := appNames[trigger.AppID]
+		if _, ok := triggersByAppAndEvent[appName]; !ok {
+			triggersByAppAndEvent[appName] = map[string][]*model.Trigger{}
+		}
+		triggersByAppAndEvent[appName][trigger.Event] = append(triggersByAppAndEvent[appName][trigger.Event], trigger)
+	}
+
+	h.triggersMutex.Lock()
+	h.triggers = triggersByAppAndEvent
+	h.triggersMutex.Unlock()
+	return nil
+}
+
+// GetTriggers returns the triggers of the event of the app
+func (h *Handler) GetTriggers(app, event string) []*model.Trigger {
+	h.triggersMutex.RLock()
+	defer h.triggersMutex.RUnlock()
+	return h.triggers[app][event]
+}
+
+func (h *Handler) refreshTriggers() {
+	ticker := time.NewTicker(h.RefreshInterval)
+	for range ticker.C {
+		err := h.LoadTriggers()
+		if err != nil {
+			raven.CaptureError(err, nil)
+			h.Logger.Error("error refreshing triggers", zap.Error(err))
+		}
+	}
+}
+
+func (h *Handler) handleMessage(msg []byte) {
+	defer func() {
+		if h.pendingMessagesWG != nil {
+			h.pendingMessagesWG.Done()
+		}
+	}()
+	l := h.Logger.With(
+		zap.String("method", "trigger.handler.handleMessage"),
+	)
+
+	var event worker.TriggerEvent
+	err := json.Unmarshal(msg, &event)
+	if err != nil {
+		raven.CaptureError(err, nil)
+		l.Error("error handling message", zap.Error(err))
+		return
+	}
+	if len(event.App) == 0 || len(event.UserID) == 0 || len(event.Event) == 0 {
+		log.D(l, "incomplete event", func(cm log.CM) {
+			cm.Write(zap.Object("event", event))
+		})
+		return
+	}
+
+	// the event id is shared by the pushes of all triggers of the event
+	eventID := worker.BuildTriggerEventID(&event, msg)
+	for _, trigger := range h.GetTriggers(event.App, event.Event) {
+		_, err = h.Worker.CreateTriggerJob(trigger, eventID, &event)
+		if err != nil {
+			raven.CaptureError(err, nil)
+			l.Error("error enqueuing trigger push", zap.String("triggerId", trigger.ID.String()), zap.Error(err))
+		}
+	}
+}
+
+// HandleMessages get messages from msgChan
+func (h *Handler) HandleMessages(msgChan *chan []byte) {
+	h.run = true
+	go h.refreshTriggers()
+	for h.run == true {
+		select {
+		case message := <-*msgChan:
+			h.handleMessage(message)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package trigger
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Trigger Handler", func() {
+	var config *viper.Viper
+	var handler *Handler
+	var app *model.App
+	var trigger *model.Trigger
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, "../config/test.yaml")
+
+	getEvent := func(event map[string]interface{}) []byte {
+		msg, err := json.Marshal(event)
+		Expect(err).NotTo(HaveOccurred())
+		return msg
+	}
+
+	BeforeEach(func() {
+		config = viper.New()
+		config.SetConfigFile("../config/test.yaml")
+		Expect(config.ReadInConfig()).NotTo(HaveOccurred())
+		w.RedisClient.FlushAll()
+		w.MarathonDB.Exec("DELETE FROM triggers;")
+		app = testing.CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "triggerapp"})
+		template := testing.CreateTestTemplate(w.MarathonDB, app.ID)
+		trigger = testing.CreateTestTrigger(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+			"event": "level_up",
+		})
+		var err error
+		handler, err = NewHandler(config, logger, nil, w)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("Create a new instance", func() {
+		It("should return a configured handler", func() {
+			Expect(handler.Config).NotTo(BeNil())
+			Expect(handler.Worker).NotTo(BeNil())
+			Expect(handler.RefreshInterval).NotTo(BeZero())
+			Expect(handler.Logger).NotTo(BeNil())
+		})
+	})
+
+	Describe("LoadTriggers", func() {
+		It("should index the triggers by app name and event", func() {
+			triggers := handler.GetTriggers("triggerapp", "level_up")
+			Expect(triggers).To(HaveLen(1))
+			Expect(triggers[0].ID).To(Equal(trigger.ID))
+			Expect(handler.GetTriggers("triggerapp", "other_event")).To(BeEmpty())
+			Expect(handler.GetTriggers("otherapp", "level_up")).To(BeEmpty())
+		})
+
+		It("should load the triggers created after the handler", func() {
+			template := testing.CreateTestTemplate(w.MarathonDB, app.ID)
+			testing.CreateTestTrigger(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"event": "purchase",
+			})
+			Expect(handler.GetTriggers("triggerapp", "purchase")).To(BeEmpty())
+
+			Expect(handler.LoadTriggers()).To(Succeed())
+			Expect(handler.GetTriggers("triggerapp", "purchase")).To(HaveLen(1))
+		})
+	})
+
+	Describe("handleMessage", func() {
+		It("should enqueue the push of the triggers of the event", func() {
+			handler.handleMessage(getEvent(map[string]interface{}{
+				"app":    "triggerapp",
+				"userId": "57be9009-e616-42c6-9cfe-505508ede2d0",
+				"event":  "level_up",
+				"props":  map[string]interface{}{"level": 10},
+			}))
+
+			res, err := w.RedisClient.LLen("queue:trigger_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(1))
+		})
+
+		It("should give the same event id to the redeliveries of an event", func() {
+			getEventIDs := func() []string {
+				queued, err := w.RedisClient.LRange("queue:trigger_worker", 0, -1).Result()
+				Expect(err).NotTo(HaveOccurred())
+				eventIDs := []string{}
+				for _, data := range queued {
+					var msg map[string]map[string]interface{}
+					Expect(json.Unmarshal([]byte(data), &msg)).To(Succeed())
+					eventIDs = append(eventIDs, msg["args"]["EventID"].(string))
+				}
+				return eventIDs
+			}
+			event := getEvent(map[string]interface{}{
+				"app":    "triggerapp",
+				"userId": "57be9009-e616-42c6-9cfe-505508ede2d0",
+				"event":  "level_up",
+			})
+			handler.handleMessage(event)
+			handler.handleMessage(event)
+			eventIDs := getEventIDs()
+			Expect(eventIDs).To(HaveLen(2))
+			Expect(eventIDs[0]).To(Equal(eventIDs[1]))
+
+			w.RedisClient.Del("queue:trigger_worker")
+			for _, eventID := range []string{"event-1", "event-1", "event-2"} {
+				handler.handleMessage(getEvent(map[string]interface{}{
+					"eventId": eventID,
+					"app":     "triggerapp",
+					"userId":  "57be9009-e616-42c6-9cfe-505508ede2d0",
+					"event":   "level_up",
+				}))
+			}
+			eventIDs = getEventIDs()
+			Expect(eventIDs).To(HaveLen(3))
+			Expect(eventIDs[0]).To(Equal(eventIDs[1]))
+			Expect(eventIDs[0]).NotTo(Equal(eventIDs[2]))
+		})
+
+		It("should schedule the push of delayed triggers", func() {
+			_, err := w.MarathonDB.Model(&model.Trigger{}).Set("delay = 60").Where("id = ?", trigger.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.LoadTriggers()).To(Succeed())
+
+			handler.handleMessage(getEvent(map[string]interface{}{
+				"app":    "triggerapp",
+				"userId": "57be9009-e616-42c6-9cfe-505508ede2d0",
+				"event":  "level_up",
+			}))
+
+			res, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(1))
+		})
+
+		It("should ignore events without triggers", func() {
+			handler.handleMessage(getEvent(map[string]interface{}{
+				"app":    "triggerapp",
+				"userId": "57be9009-e616-42c6-9cfe-505508ede2d0",
+				"event":  "other_event",
+			}))
+
+			res, err := w.RedisClient.LLen("queue:trigger_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(0))
+		})
+
+		It("should ignore incomplete events", func() {
+			handler.handleMessage(getEvent(map[string]interface{}{
+				"app":   "triggerapp",
+				"event": "level_up",
+			}))
+			handler.handleMessage([]byte("not json"))
+
+			res, err := w.RedisClient.LLen("queue:trigger_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(0))
+		})
+	})
+})
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package trigger
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/extensions/kafka"
+	"github.com/topfreegames/marathon/feedback"
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+// Listener will consume the events of the apps users from a queue and send the pushes of their triggers
+type Listener struct {
+	Config     *viper.Viper
+	ConfigFile string
+
+	Queue                   interfaces.Queue
+	Logger                  zap.Logger
+	TriggerHandler          *Handler
+	GracefulShutdownTimeout int
+
+	run         bool
+	stopChannel chan error
+}
+
+// NewListener creates and return a new instance of trigger.Listener
+func NewListener(configFile string, logger zap.Logger) (*Listener, error) {
+	l := &Listener{
+		ConfigFile:  configFile,
+		Logger:      logger,
+		stopChannel: make(chan error),
+	}
+	err := l.configure()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Listener) loadConfigurationDefaults() {
+	l.Config.SetDefault("triggerListener.gracefulShutdownTimeout", 10)
+}
+
+func (l *Listener) configure() error {
+	l.Config = viper.New()
+	l.Config.SetConfigFile(l.ConfigFile)
+	l.Config.SetEnvPrefix("marathon")
+	l.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	l.Config.AutomaticEnv()
+
+	err := l.Config.ReadInConfig()
+	if err != nil {
+		return err
+	}
+	l.loadConfigurationDefaults()
+
+	l.configureSentry()
+	l.GracefulShutdownTimeout = l.Config.GetInt("triggerListener.gracefulShutdownTimeout")
+	log := logrus.New()
+
+	log.Formatter = new(logrus.JSONFormatter)
+	q, err := kafka.NewConsumerWithPrefix(
+		l.Config, log, "triggerListener.kafka", nil,
+	)
+
+	if err != nil {
+		return err
+	}
+	l.Queue = q
+	// the worker enqueues the pushes and reads the triggers, it does not process any queue
+	w := worker.NewWorker(l.Logger, l.ConfigFile)
+	h, err := NewHandler(l.Config, l.Logger, l.Queue.PendingMessagesWaitGroup(), w)
+	if err != nil {
+		return err
+	}
+	l.TriggerHandler = h
+	return nil
+}
+
+func (l *Listener) configureSentry() {
+	ll := l.Logger.With(
+		zap.String("source", "listener"),
+		zap.String("operation", "configureSentry"),
+	)
+	sentryURL := l.Config.GetString("sentry.url")
+	raven.SetDSN(sentryURL)
+	ll.Info("Configured sentry successfully.")
+}
+
+// Start starts the listener
+func (l *Listener) Start() {
+	l.run = true
+	log := l.Logger.With(
+		zap.String("method", "start"),
+	)
+	log.Info("starting the triggers listener...")
+
+	go func() {
+		err := l.Queue.ConsumeLoop()
+		if err != nil {
+			l.stopChannel <- err
+		}
+	}()
+	go l.TriggerHandler.HandleMessages(l.Queue.MessagesChannel())
+
+	sigchan := make(chan os.Signal)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	for l.run == true {
+		select {
+		case sig := <-sigchan:
+			log.Warn("terminating due to caught signal", zap.String("signal", sig.String()))
+			l.run = false
+		case <-l.stopChannel:
+			log.Warn("Stop channel closed\n")
+			l.run = false
+		}
+	}
+	l.Queue.StopConsuming()
+	wg := l.Queue.PendingMessagesWaitGroup()
+	if wg == nil {
+		return
+	}
+	if feedback.WaitTimeout(wg, time.Duration(l.GracefulShutdownTimeout)*time.Second) {
+		log.Warn("exited triggers listener because of graceful shutdown timeout")
+	} else {
+		log.Info("exited triggers listener gracefully")
+	}
+}
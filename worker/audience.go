@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+)
+
+// AudienceEstimate is the number of tokens matched by a filter set broken down by locale, region and tz
+type AudienceEstimate struct {
+	Total    int            `json:"total"`
+	Sampled  bool           `json:"sampled"`
+	ByLocale map[string]int `json:"byLocale"`
+	ByRegion map[string]int `json:"byRegion"`
+	ByTz     map[string]int `json:"byTz"`
+}
+
+type audienceGroup struct {
+	Locale string
+	Region string
+	Tz     string
+	Count  int
+}
+
+// EstimateAudience counts the tokens of the table matched by the filter expression, when the table has more
+// than sampleThreshold rows a sample of about sampleThreshold rows is counted and the result is scaled
+func EstimateAudience(db interfaces.DB, tableName string, expression *model.FilterExpression, sampleThreshold int) (*AudienceEstimate, error) {
+	var tableSize int
+	query := fmt.Sprintf("SELECT reltuples::BIGINT AS estimate FROM pg_class WHERE relname = '%s';", tableName)
+	_, err := db.QueryOne(pg.Scan(&tableSize), query)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &AudienceEstimate{
+		ByLocale: map[string]int{},
+		ByRegion: map[string]int{},
+		ByTz:     map[string]int{},
+	}
+	from := tableName
+	scale := 1.0
+	if sampleThreshold > 0 && tableSize > sampleThreshold {
+		percentage := 100 * float64(sampleThreshold) / float64(tableSize)
+		from = fmt.Sprintf("%s TABLESAMPLE SYSTEM (%f)", tableName, percentage)
+		scale = 100 / percentage
+		estimate.Sampled = true
+	}
+
+	filterQuery, err := GetFilterQuery(db, tableName, expression)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("SELECT COALESCE(locale, '') AS locale, COALESCE(region, '') AS region, COALESCE(tz, '') AS tz, count(1) AS count FROM %s", from)
+	if filterQuery.Where != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, filterQuery.Where)
+	}
+	query = fmt.Sprintf("%s GROUP BY 1, 2, 3;", query)
+	var groups []audienceGroup
+	_, err = db.Query(&groups, query, filterQuery.Params...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		count := int(math.Floor(float64(group.Count)*scale + 0.5))
+		estimate.Total += count
+		estimate.ByLocale[group.Locale] += count
+		estimate.ByRegion[group.Region] += count
+		estimate.ByTz[group.Tz] += count
+	}
+	return estimate, nil
+}
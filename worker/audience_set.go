@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+)
+
+// BuildAudienceQuery compiles an audience without csv files to a where clause on the user_id of the push db
+// table, a user is selected when any of its tokens is matched so every token of the selected users is sent
+func BuildAudienceQuery(audience *model.Audience, tableName string, columns map[string]bool) (*FilterQuery, error) {
+	if err := audience.Validate(); err != nil {
+		return nil, err
+	}
+	query := &FilterQuery{Params: []interface{}{}}
+	where, err := compileAudience(query, audience, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	query.Where = where
+	return query, nil
+}
+
+// GetAudienceQuery builds the audience query for the push db table
+func GetAudienceQuery(db interfaces.DB, tableName string, audience *model.Audience) (*FilterQuery, error) {
+	columns, err := GetPushDBColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return BuildAudienceQuery(audience, tableName, columns)
+}
+
+func compileAudience(query *FilterQuery, node *model.Audience, tableName string, columns map[string]bool) (string, error) {
+	switch node.Operation() {
+	case "csv":
+		return "", fmt.Errorf("audiences with csv files cannot be queried in the push db")
+	case "filter":
+		filterQuery, err := BuildFilterQuery(node.FilterExpression, columns)
+		if err != nil {
+			return "", err
+		}
+		query.Params = append(query.Params, filterQuery.Params...)
+		return fmt.Sprintf("user_id IN (SELECT user_id FROM %s WHERE %s)", tableName, filterQuery.Where), nil
+	}
+
+	clauses := []string{}
+	for _, child := range node.Children() {
+		clause, err := compileAudience(query, child, tableName, columns)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, clause)
+	}
+	switch {
+	case node.Operation() == "subtract":
+		return fmt.Sprintf("(%s AND NOT (%s))", clauses[0], strings.Join(clauses[1:], " OR ")), nil
+	case len(clauses) == 1:
+		return clauses[0], nil
+	case node.Operation() == "union":
+		return fmt.Sprintf("(%s)", strings.Join(clauses, " OR ")), nil
+	}
+	return fmt.Sprintf("(%s)", strings.Join(clauses, " AND ")), nil
+}
+
+// getJobFilterQuery builds the query of the audience of the job or of its filter expression
+func getJobFilterQuery(db interfaces.DB, tableName string, job *model.Job) (*FilterQuery, error) {
+	if job.Audience != nil {
+		return GetAudienceQuery(db, tableName, job.Audience)
+	}
+	expression, err := job.GetFilterExpression()
+	if err != nil {
+		return nil, err
+	}
+	return GetFilterQuery(db, tableName, expression)
+}
+
+// CountAudienceSteps counts the users selected by each node of an audience without csv files
+func CountAudienceSteps(db interfaces.DB, tableName string, audience *model.Audience) ([]*model.AudienceStep, error) {
+	columns, err := GetPushDBColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	steps := []*model.AudienceStep{}
+	err = walkAudience(audience, "audience", func(node *model.Audience, step *model.AudienceStep) error {
+		query, err := BuildAudienceQuery(node, tableName, columns)
+		if err != nil {
+			return err
+		}
+		_, err = db.QueryOne(&step.Count, fmt.Sprintf("SELECT count(DISTINCT user_id) FROM %s WHERE %s", tableName, query.Where), query.Params...)
+		steps = append(steps, step)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// audiencePageSize is the number of user ids loaded from the csv files and read from the resolved
+// audience at a time
+const audiencePageSize = 10000
+
+// ResolveAudience resolves the audience to temp tables in a transaction of the push db, the filters are
+// selected from the push db table and the csv files are loaded from s3, and calls fn with the pages of the
+// user ids it selects, ordered by user id, until fn returns false, it returns the number of users selected
+// by each node of the audience
+func ResolveAudience(db interfaces.DB, s3 interfaces.S3, tableName string, audience *model.Audience, fn func([]string) (bool, error)) ([]*model.AudienceStep, error) {
+	if err := audience.Validate(); err != nil {
+		return nil, err
+	}
+	columns, err := GetPushDBColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// the transaction only creates the temp tables so it is rolled back to drop them
+	defer tx.Rollback()
+	steps := []*model.AudienceStep{}
+	usersTable, err := resolveAudience(tx, s3, tableName, columns, audience, "audience", &steps)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX ON %s (user_id)", usersTable))
+	if err != nil {
+		return nil, err
+	}
+	lastUserID := ""
+	for {
+		var userIDs []string
+		query := fmt.Sprintf("SELECT user_id FROM %s WHERE user_id > ? ORDER BY user_id LIMIT ?", usersTable)
+		_, err = tx.Query(&userIDs, query, lastUserID, audiencePageSize)
+		if err != nil || len(userIDs) == 0 {
+			return steps, err
+		}
+		more, err := fn(userIDs)
+		if err != nil || !more || len(userIDs) < audiencePageSize {
+			return steps, err
+		}
+		lastUserID = userIDs[len(userIDs)-1]
+	}
+}
+
+// resolveAudience creates a temp table with the distinct user ids selected by the node and returns its name
+func resolveAudience(tx *pg.Tx, s3 interfaces.S3, tableName string, columns map[string]bool, node *model.Audience, path string, steps *[]*model.AudienceStep) (string, error) {
+	step := &model.AudienceStep{Path: path, Operation: node.Operation()}
+	*steps = append(*steps, step)
+	table := fmt.Sprintf("audience_%d", len(*steps))
+
+	var query string
+	params := []interface{}{}
+	switch node.Operation() {
+	case "filter":
+		filterQuery, err := BuildFilterQuery(node.FilterExpression, columns)
+		if err != nil {
+			return "", err
+		}
+		query = fmt.Sprintf("SELECT DISTINCT user_id FROM %s WHERE %s", tableName, filterQuery.Where)
+		params = filterQuery.Params
+	case "csv":
+		csvTable, err := loadAudienceCSV(tx, s3, node.CSVPath, table)
+		if err != nil {
+			return "", err
+		}
+		query = fmt.Sprintf("SELECT DISTINCT user_id FROM %s", csvTable)
+	default:
+		selects := []string{}
+		for i, child := range node.Children() {
+			childTable, err := resolveAudience(tx, s3, tableName, columns, child, fmt.Sprintf("%s.%s[%d]", path, node.Operation(), i), steps)
+			if err != nil {
+				return "", err
+			}
+			selects = append(selects, fmt.Sprintf("SELECT user_id FROM %s", childTable))
+		}
+		switch node.Operation() {
+		case "union":
+			query = strings.Join(selects, " UNION ")
+		case "intersect":
+			query = strings.Join(selects, " INTERSECT ")
+		case "subtract":
+			query = fmt.Sprintf("%s EXCEPT (%s)", selects[0], strings.Join(selects[1:], " UNION "))
+		}
+	}
+	res, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS %s", table, query), params...)
+	if err != nil {
+		return "", err
+	}
+	step.Count = res.RowsAffected()
+	return table, nil
+}
+
+// loadAudienceCSV copies the user ids of the csv file to a temp table and returns its name
+func loadAudienceCSV(tx *pg.Tx, s3 interfaces.S3, csvPath string, table string) (string, error) {
+	csv, err := s3.GetObject(csvPath)
+	if err != nil {
+		return "", err
+	}
+	userIDs, err := ParseCSVUserIDs(csv)
+	if err != nil {
+		return "", err
+	}
+	csvTable := fmt.Sprintf("%s_csv", table)
+	_, err = tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (user_id text) ON COMMIT DROP", csvTable))
+	if err != nil {
+		return "", err
+	}
+	for start := 0; start < len(userIDs); start += audiencePageSize {
+		end := start + audiencePageSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		values := make([]string, end-start)
+		params := make([]interface{}, end-start)
+		for idx, userID := range userIDs[start:end] {
+			values[idx] = "(?)"
+			params[idx] = userID
+		}
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (user_id) VALUES %s", csvTable, strings.Join(values, ",")), params...)
+		if err != nil {
+			return "", err
+		}
+	}
+	return csvTable, nil
+}
+
+// walkAudience calls fn for every node of the audience, parents before their children
+func walkAudience(node *model.Audience, path string, fn func(*model.Audience, *model.AudienceStep) error) error {
+	if err := fn(node, &model.AudienceStep{Path: path, Operation: node.Operation()}); err != nil {
+		return err
+	}
+	for i, child := range node.Children() {
+		if err := walkAudience(child, fmt.Sprintf("%s.%s[%d]", path, node.Operation(), i), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"fmt"
+	"sort"
+
+	workers "github.com/jrallison/go-workers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Audience sets", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+	audienceWorker := worker.NewAudienceWorker(w)
+	columns := map[string]bool{"locale": true, "region": true}
+	pt := &model.Audience{FilterExpression: &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"}}
+	en := &model.Audience{FilterExpression: &model.FilterExpression{Column: "locale", Op: "eq", Value: "en"}}
+	suppressed := &model.Audience{CSVPath: "test/suppressed.csv"}
+
+	BeforeEach(func() {
+		w.S3Client = NewFakeS3(w.Config)
+		w.RedisClient.FlushAll()
+		csv := []byte("userIds\n9e558649-9c23-469d-a11c-59b05813e3d5\n57be9009-e616-42c6-9cfe-505508ede2d0\nnot-a-user\n")
+		_, err := w.S3Client.PutObject("test/suppressed.csv", &csv)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("Build audience query", func() {
+		It("should compile the filters to user_id subqueries", func() {
+			audience := &model.Audience{Subtract: []*model.Audience{
+				{Union: []*model.Audience{pt, en}},
+				{FilterExpression: &model.FilterExpression{Column: "region", Op: "eq", Value: "US"}},
+			}}
+			query, err := worker.BuildAudienceQuery(audience, "testapp_apns", columns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal("((user_id IN (SELECT user_id FROM testapp_apns WHERE \"locale\" = ?) OR user_id IN (SELECT user_id FROM testapp_apns WHERE \"locale\" = ?)) AND NOT (user_id IN (SELECT user_id FROM testapp_apns WHERE \"region\" = ?)))"))
+			Expect(query.Params).To(Equal([]interface{}{"pt", "en", "US"}))
+		})
+
+		It("should return an error if the audience has csv files", func() {
+			audience := &model.Audience{Subtract: []*model.Audience{pt, suppressed}}
+			_, err := worker.BuildAudienceQuery(audience, "testapp_apns", columns)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error if a subtract has a single node", func() {
+			audience := &model.Audience{Subtract: []*model.Audience{pt}}
+			_, err := worker.BuildAudienceQuery(audience, "testapp_apns", columns)
+			Expect(err).To(MatchError("subtract must have at least two nodes"))
+		})
+	})
+
+	Describe("Count audience steps", func() {
+		It("should count the users of each node", func() {
+			audience := &model.Audience{Union: []*model.Audience{pt, en}}
+			steps, err := worker.CountAudienceSteps(w.PushDB, "testapp_apns", audience)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(steps).To(Equal([]*model.AudienceStep{
+				{Path: "audience", Operation: "union", Count: 10},
+				{Path: "audience.union[0]", Operation: "filter", Count: 6},
+				{Path: "audience.union[1]", Operation: "filter", Count: 4},
+			}))
+		})
+	})
+
+	Describe("Resolve audience", func() {
+		resolve := func(audience *model.Audience) ([]string, []*model.AudienceStep, error) {
+			userIDs := []string{}
+			steps, err := worker.ResolveAudience(w.PushDB, w.S3Client, "testapp_apns", audience, func(page []string) (bool, error) {
+				userIDs = append(userIDs, page...)
+				return true, nil
+			})
+			return userIDs, steps, err
+		}
+
+		It("should subtract the users of a csv from a filter", func() {
+			audience := &model.Audience{Subtract: []*model.Audience{pt, suppressed}}
+			userIDs, steps, err := resolve(audience)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userIDs).To(HaveLen(5))
+			Expect(userIDs).NotTo(ContainElement("9e558649-9c23-469d-a11c-59b05813e3d5"))
+			Expect(steps).To(Equal([]*model.AudienceStep{
+				{Path: "audience", Operation: "subtract", Count: 5},
+				{Path: "audience.subtract[0]", Operation: "filter", Count: 6},
+				{Path: "audience.subtract[1]", Operation: "csv", Count: 3},
+			}))
+		})
+
+		It("should intersect a csv with a filter", func() {
+			audience := &model.Audience{Intersect: []*model.Audience{suppressed, pt}}
+			userIDs, _, err := resolve(audience)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userIDs).To(ConsistOf("9e558649-9c23-469d-a11c-59b05813e3d5"))
+		})
+
+		It("should return the users in pages ordered by user id until fn stops", func() {
+			csv := []byte("userIds\n")
+			for i := 0; i < 10001; i++ {
+				csv = append(csv, []byte(fmt.Sprintf("user-%05d\n", i))...)
+			}
+			_, err := w.S3Client.PutObject("test/big.csv", &csv)
+			Expect(err).NotTo(HaveOccurred())
+			audience := &model.Audience{Union: []*model.Audience{{CSVPath: "test/big.csv"}, suppressed}}
+
+			userIDs, steps, err := resolve(audience)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userIDs).To(HaveLen(10004))
+			Expect(sort.StringsAreSorted(userIDs)).To(BeTrue())
+			Expect(steps[0].Count).To(Equal(10004))
+
+			pages := 0
+			_, err = worker.ResolveAudience(w.PushDB, w.S3Client, "testapp_apns", audience, func(page []string) (bool, error) {
+				pages++
+				Expect(page).To(HaveLen(10000))
+				return false, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pages).To(Equal(1))
+		})
+
+		It("should return an error if the csv does not exist", func() {
+			audience := &model.Audience{Union: []*model.Audience{pt, {CSVPath: "test/missing.csv"}}}
+			_, _, err := resolve(audience)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Audience worker", func() {
+		It("should write the resolved users to a csv and create the csv split job", func() {
+			app := CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "testapp"})
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters":  map[string]interface{}{},
+				"audience": &model.Audience{Intersect: []*model.Audience{suppressed, pt}},
+			})
+
+			_, err := w.CreateAudienceJob(job)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := w.RedisClient.LPop("queue:audience_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := workers.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			audienceWorker.Process(msg)
+
+			dbJob := &model.Job{ID: job.ID}
+			err = w.MarathonDB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CSVPath).To(Equal("tfg-push-notifications/test/audiences/job-" + job.ID.String() + ".csv"))
+			Expect(dbJob.AudienceSteps).To(HaveLen(3))
+			Expect(dbJob.AudienceSteps[0].Count).To(Equal(1))
+
+			csv, err := w.S3Client.GetObject(dbJob.CSVPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(csv)).To(Equal("userIds\n9e558649-9c23-469d-a11c-59b05813e3d5\n"))
+
+			size, err := w.RedisClient.LLen("queue:csv_split_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(Equal(int64(1)))
+		})
+	})
+})
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Audience", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	Describe("Estimate audience", func() {
+		It("should count all tokens if there are no filters", func() {
+			audience, err := worker.EstimateAudience(w.PushDB, "testapp_apns", nil, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(audience.Sampled).To(BeFalse())
+			Expect(audience.Total).To(Equal(28))
+			Expect(audience.ByLocale["pt"]).To(Equal(6))
+			Expect(audience.ByLocale["cn"]).To(Equal(10))
+		})
+
+		It("should count only the tokens matched by the filters broken down by locale, region and tz", func() {
+			expression := &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"}
+			audience, err := worker.EstimateAudience(w.PushDB, "testapp_apns", expression, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(audience.Total).To(Equal(6))
+			Expect(audience.ByLocale).To(Equal(map[string]int{"pt": 6}))
+			Expect(audience.ByRegion).To(Equal(map[string]int{"BR": 6}))
+			Expect(audience.ByTz).To(Equal(map[string]int{"-0300": 4, "-0500": 2}))
+		})
+
+		It("should sample the table if it is bigger than the threshold", func() {
+			_, err := w.PushDB.Exec("ANALYZE testapp_apns;")
+			Expect(err).NotTo(HaveOccurred())
+			audience, err := worker.EstimateAudience(w.PushDB, "testapp_apns", nil, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(audience.Sampled).To(BeTrue())
+		})
+	})
+})
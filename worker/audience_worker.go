@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	workers "github.com/jrallison/go-workers"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+const nameAudienceWorker = "audience_worker"
+
+// audienceCSVPartSize is the size of the parts in which the csv of the audience users is uploaded
+const audienceCSVPartSize = 5 * 1024 * 1024
+
+// AudienceWorker resolves the audiences with csv files to the csv of their users
+// and then hands the job to the csv split worker
+type AudienceWorker struct {
+	Workers *Worker
+	Logger  zap.Logger
+}
+
+// NewAudienceWorker gets a new AudienceWorker
+func NewAudienceWorker(workers *Worker) *AudienceWorker {
+	b := &AudienceWorker{
+		Logger:  workers.Logger.With(zap.String("worker", "AudienceWorker")),
+		Workers: workers,
+	}
+	b.Logger.Debug("Configured AudienceWorker successfully.")
+	return b
+}
+
+// Process processes the messages sent to audience worker queue
+func (b *AudienceWorker) Process(message *workers.Msg) {
+	var id uuid.UUID
+	err := json.Unmarshal([]byte(message.Args().ToJson()), &id)
+	checkErr(b.Logger, err)
+
+	l := b.Logger.With(
+		zap.String("jobID", id.String()),
+		zap.String("worker", nameAudienceWorker),
+	)
+	log.I(l, "starting")
+
+	job, err := b.Workers.GetJob(id)
+	checkErr(l, err)
+	job.TagRunning(b.Workers.MarathonDB, nameAudienceWorker, "starting")
+
+	if job.Status == stoppedJobStatus {
+		l.Info("stopped job")
+		return
+	}
+
+	folder := b.Workers.Config.GetString("s3.audienceFolder")
+	bucket := b.Workers.Config.GetString("s3.bucket")
+	writePath := fmt.Sprintf("%s/%s/job-%s.csv", bucket, folder, job.ID.String())
+	upload, err := b.Workers.S3Client.InitMultipartUpload(writePath)
+	b.checkErr(job, err)
+
+	parts := []*s3.CompletedPart{}
+	csvBuffer := &bytes.Buffer{}
+	csvBuffer.WriteString("userIds\n")
+	uploadPart := func() error {
+		partNumber := int64(len(parts) + 1)
+		output, err := b.Workers.S3Client.UploadPart(csvBuffer, upload, partNumber)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(partNumber)})
+		csvBuffer = &bytes.Buffer{}
+		return nil
+	}
+	tableName := GetPushDBTableName(job.App.Name, job.Service)
+	steps, err := ResolveAudience(b.Workers.PushDB, b.Workers.S3Client, tableName, job.Audience, func(userIDs []string) (bool, error) {
+		for _, userID := range userIDs {
+			csvBuffer.WriteString(fmt.Sprintf("%s\n", userID))
+		}
+		// the parts but the last one must have at least 5mb
+		if csvBuffer.Len() < audienceCSVPartSize {
+			return true, nil
+		}
+		return true, uploadPart()
+	})
+	b.checkErr(job, err)
+	if csvBuffer.Len() > 0 {
+		err = uploadPart()
+		b.checkErr(job, err)
+	}
+	err = b.Workers.S3Client.CompleteMultipartUpload(upload, parts)
+	b.checkErr(job, err)
+
+	job.CSVPath = writePath
+	job.AudienceSteps = steps
+	_, err = b.Workers.MarathonDB.Model(job).Set("csv_path = ?csv_path").Set("audience_steps = ?audience_steps").Update()
+	b.checkErr(job, err)
+
+	_, err = b.Workers.CreateCSVSplitJob(job)
+	b.checkErr(job, err)
+	log.I(l, "resolved audience", func(cm log.CM) {
+		cm.Write(zap.Int("users", steps[0].Count))
+	})
+	job.TagSuccess(b.Workers.MarathonDB, nameAudienceWorker, "finished")
+}
+
+func (b *AudienceWorker) checkErr(job *model.Job, err error) {
+	if err != nil {
+		job.TagError(b.Workers.MarathonDB, nameAudienceWorker, err.Error())
+		checkErr(b.Logger, err)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"time"
+
+	"github.com/topfreegames/marathon/model"
+)
+
+// HoldOutUsers returns which of the user ids are in the app holdout or in the job control group,
+// they are stored before the pushes of the others are sent so the groups are never lost by a crash,
+// the job control group is stored per job and the app holdout once per app
+func (w *Worker) HoldOutUsers(job *model.Job, userIDs []string) (map[string]bool, error) {
+	heldOut := map[string]bool{}
+	if job.ControlGroup == 0 && job.App.Holdout == 0 {
+		return heldOut, nil
+	}
+	start := time.Now()
+	now := start.UnixNano()
+	controlGroup := []*model.ControlGroupUser{}
+	holdout := []*model.AppHoldoutUser{}
+	for _, userID := range userIDs {
+		if heldOut[userID] {
+			continue
+		}
+		reason := job.HoldoutReason(&job.App, userID)
+		if reason == "" {
+			continue
+		}
+		heldOut[userID] = true
+		if reason == model.AppHoldoutReason {
+			holdout = append(holdout, &model.AppHoldoutUser{
+				AppID:     job.AppID,
+				UserID:    userID,
+				CreatedAt: now,
+			})
+			continue
+		}
+		controlGroup = append(controlGroup, &model.ControlGroupUser{
+			JobID:     job.ID,
+			UserID:    userID,
+			AppID:     job.AppID,
+			Reason:    reason,
+			CreatedAt: now,
+		})
+	}
+	err := model.InsertAppHoldoutUsers(w.MarathonDB, holdout)
+	if err == nil {
+		err = model.InsertControlGroupUsers(w.MarathonDB, controlGroup)
+	}
+	w.Statsd.Timing("save_control_group", time.Now().Sub(start), job.Labels(), 1)
+	return heldOut, err
+}
@@ -24,11 +24,8 @@ package worker
 
 import (
 	"bytes"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"math"
-	"math/rand"
 	"time"
 
 	"gopkg.in/pg.v5"
@@ -60,22 +57,8 @@ func NewCreateBatchesWorker(workers *Worker) *CreateBatchesWorker {
 
 // ReadFromCSV reads CSV from S3 and return correspondent array of strings
 func (b *CreateBatchesWorker) ReadFromCSV(buffer *[]byte, job *model.Job) []string {
-	for i, b := range *buffer {
-		if b == 0x0D {
-			(*buffer)[i] = 0x0A
-		}
-	}
-
-	r := csv.NewReader(bytes.NewReader(*buffer))
-	lines, err := r.ReadAll()
+	res, err := ParseCSVUserIDs(*buffer)
 	b.checkErr(job, err)
-	res := []string{}
-	for i, line := range lines {
-		if i == 0 {
-			continue
-		}
-		res = append(res, line[0])
-	}
 	return res
 }
 
@@ -116,9 +99,13 @@ func (b *CreateBatchesWorker) processBatch(ids *[]string, job *model.Job) {
 		cm.Write(zap.Int("usersInBatch", numUsersFromBatch))
 	})
 
-	b.sendBatches(*usersFromBatch, job)
-
-	b.updateTotalBatches(1, job)
+	// users sent at their optimal time are scheduled in their own batches
+	users, err := b.Workers.ScheduleOptimalSendTimeUsers(job, BuildBatchID(*usersFromBatch), *usersFromBatch)
+	b.checkErr(job, err)
+	if len(users) > 0 || numUsersFromBatch == 0 {
+		b.sendBatches(users, job)
+		b.updateTotalBatches(1, job)
+	}
 	b.updateTotalTokens(numUsersFromBatch, job)
 }
 
@@ -137,34 +124,42 @@ func (b *CreateBatchesWorker) updateTotalUsers(job *model.Job, totalUsers int) {
 	b.checkErr(job, err)
 }
 
+func (b *CreateBatchesWorker) removeSuppressedUsers(userIds []string, job *model.Job) []string {
+	suppressed, err := b.Workers.SuppressUsers(job, userIds)
+	b.checkErr(job, err)
+	if len(suppressed) == 0 {
+		return userIds
+	}
+	remaining := make([]string, 0, len(userIds))
+	for _, userID := range userIds {
+		if !suppressed[userID] {
+			remaining = append(remaining, userID)
+		}
+	}
+	return remaining
+}
+
 func (b *CreateBatchesWorker) processIDs(userIds []string, msg *BatchPart) {
 	l := b.Logger
-	// create a controll group if needed
-	controlGroupSize := int(math.Ceil(float64(len(userIds)) * msg.Job.ControlGroup))
-	if controlGroupSize > 0 {
-		if controlGroupSize >= len(userIds) {
-			panic("control group size cannot be higher than number of users")
-		}
-		log.I(l, "this job has a control group!", func(cm log.CM) {
-			cm.Write(
-				zap.Int("controlGroupSize", controlGroupSize),
-				zap.String("jobID", msg.Job.ID.String()),
-			)
-		})
-		// shuffle slice in place
-		for i := range userIds {
-			j := rand.Intn(i + 1)
-			userIds[i], userIds[j] = userIds[j], userIds[i]
-		}
-		// grab control group
-		controlGroup := userIds[len(userIds)-controlGroupSize:]
-		go b.Workers.SendControlGroupToRedis(&msg.Job, controlGroup)
+	// suppressed users are neither sent nor part of the control group
+	userIds = b.removeSuppressedUsers(userIds, &msg.Job)
 
-		// cut control group from the slice
-		userIds = append(userIds[:len(userIds)-controlGroupSize], userIds[len(userIds):]...)
+	// users held out by the app holdout or by the job control group are stored and not sent
+	heldOut, err := b.Workers.HoldOutUsers(&msg.Job, userIds)
+	b.checkErr(&msg.Job, err)
+	if len(heldOut) > 0 {
+		remaining := make([]string, 0, len(userIds)-len(heldOut))
+		for _, userID := range userIds {
+			if !heldOut[userID] {
+				remaining = append(remaining, userID)
+			}
+		}
+		userIds = remaining
 		log.I(l, "control group cut from the users", func(cm log.CM) {
 			cm.Write(
+				zap.Int("controlGroupSize", len(heldOut)),
 				zap.Int("usersRemaining", len(userIds)),
+				zap.String("jobID", msg.Job.ID.String()),
 			)
 		})
 	}
@@ -290,6 +290,50 @@ stange-token`)
 			Expect(len(wMessage1.Users)).To(BeEquivalentTo(10))
 		})
 
+		It("should not send to suppressed users and count them in the job", func() {
+			w.MarathonDB.Exec("DELETE FROM suppressions;")
+			defer w.MarathonDB.Exec("DELETE FROM suppressions;")
+			a := CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "testapp"})
+			CreateTestSuppression(w.MarathonDB, a.ID, map[string]interface{}{"userId": "9e558649-9c23-469d-a11c-59b05813e3d5"})
+			CreateTestSuppression(w.MarathonDB, uuid.Nil, map[string]interface{}{"userId": "57be9009-e616-42c6-9cfe-505508ede2d0"})
+			CreateTestSuppression(w.MarathonDB, app.ID, map[string]interface{}{"userId": "a8e8d2d5-f178-4d90-9b31-683ad3aae920"})
+			j := CreateTestJob(w.MarathonDB, a.ID, template.Name, map[string]interface{}{
+				"context": context,
+				"filters": map[string]interface{}{},
+				"csvPath": "test/jobs/obj1.csv",
+			})
+
+			_, err := w.CreateCSVSplitJob(j)
+			Expect(err).NotTo(HaveOccurred())
+
+			jobData, err := w.RedisClient.LPop("queue:csv_split_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := workers.NewMsg(string(jobData))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() { createCSVSplitWorker.Process(msg) }).ShouldNot(Panic())
+
+			jobData, err = w.RedisClient.LPop("queue:create_batches_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err = workers.NewMsg(string(jobData))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() { createBatchesWorker.Process(msg) }).ShouldNot(Panic())
+
+			job1, err := w.RedisClient.LPop("queue:process_batch_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			j1 := map[string]interface{}{}
+			err = json.Unmarshal([]byte(job1), &j1)
+			Expect(err).NotTo(HaveOccurred())
+			wMessage1, err := worker.ParseProcessBatchWorkerMessageArray(j1["args"].([]interface{}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(wMessage1.Users)).To(BeEquivalentTo(8))
+
+			dbJob := &model.Job{ID: j.ID}
+			err = w.MarathonDB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.SuppressedUsers).To(Equal(2))
+			Expect(dbJob.TotalUsers).To(Equal(8))
+		})
+
 		It("should create batches with the right number of tokens if a controlGroup is specified", func() {
 			a := CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "testapp"})
 			j := CreateTestJob(w.MarathonDB, a.ID, template.Name, map[string]interface{}{
@@ -324,7 +368,17 @@ stange-token`)
 			Expect(j1["queue"].(string)).To(Equal("process_batch_worker"))
 			wMessage1, err := worker.ParseProcessBatchWorkerMessageArray(j1["args"].([]interface{}))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(len(wMessage1.Users)).To(BeEquivalentTo(8))
+
+			var controlGroup []string
+			_, err = w.MarathonDB.Query(&controlGroup, "SELECT user_id FROM control_group_users WHERE job_id = ? AND reason = 'job'", j.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wMessage1.Users).To(HaveLen(10 - len(controlGroup)))
+			for _, user := range wMessage1.Users {
+				Expect(j.InControlGroup(user.UserID)).To(BeFalse())
+			}
+			for _, userID := range controlGroup {
+				Expect(j.InControlGroup(userID)).To(BeTrue())
+			}
 		})
 
 		It("should create batches with the right number of tokens if a controlGroup is specified", func() {
@@ -362,7 +416,64 @@ stange-token`)
 			Expect(j1["queue"].(string)).To(Equal("process_batch_worker"))
 			wMessage1, err := worker.ParseProcessBatchWorkerMessageArray(j1["args"].([]interface{}))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(len(wMessage1.Users)).To(BeEquivalentTo(6))
+
+			var controlGroup []string
+			_, err = w.MarathonDB.Query(&controlGroup, "SELECT user_id FROM control_group_users WHERE job_id = ? AND reason = 'job'", j.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wMessage1.Users).To(HaveLen(10 - len(controlGroup)))
+			for _, user := range wMessage1.Users {
+				Expect(j.InControlGroup(user.UserID)).To(BeFalse())
+			}
+			for _, userID := range controlGroup {
+				Expect(j.InControlGroup(userID)).To(BeTrue())
+			}
+		})
+
+		It("should hold out the users of the app holdout", func() {
+			a := CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "testapp", "holdout": 0.5})
+			j := CreateTestJob(w.MarathonDB, a.ID, template.Name, map[string]interface{}{
+				"context": context,
+				"filters": map[string]interface{}{},
+				"csvPath": "test/jobs/obj5.csv",
+			})
+
+			_, err := w.CreateCSVSplitJob(j)
+			Expect(err).NotTo(HaveOccurred())
+
+			jobData, err := w.RedisClient.LPop("queue:csv_split_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := workers.NewMsg(string(jobData))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() { createCSVSplitWorker.Process(msg) }).ShouldNot(Panic())
+
+			jobData, err = w.RedisClient.LPop("queue:create_batches_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err = workers.NewMsg(string(jobData))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() { createBatchesWorker.Process(msg) }).ShouldNot(Panic())
+
+			var holdout []string
+			_, err = w.MarathonDB.Query(&holdout, "SELECT user_id FROM app_holdout_users WHERE app_id = ?", a.ID)
+			Expect(err).NotTo(HaveOccurred())
+			for _, userID := range holdout {
+				Expect(a.InHoldout(userID)).To(BeTrue())
+			}
+
+			users := []worker.User{}
+			batches, err := w.RedisClient.LRange("queue:process_batch_worker", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			for _, job1 := range batches {
+				j1 := map[string]interface{}{}
+				err = json.Unmarshal([]byte(job1), &j1)
+				Expect(err).NotTo(HaveOccurred())
+				wMessage1, err := worker.ParseProcessBatchWorkerMessageArray(j1["args"].([]interface{}))
+				Expect(err).NotTo(HaveOccurred())
+				users = append(users, wMessage1.Users...)
+			}
+			Expect(users).To(HaveLen(10 - len(holdout)))
+			for _, user := range users {
+				Expect(a.InHoldout(user.UserID)).To(BeFalse())
+			}
 		})
 
 		It("should create batches with the right tokens and tz and send to process_batches_worker if numPushes < dbPageSize", func() {
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"time"
+
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+// LogDeliveries writes the deliveries of the pushes of a batch to the delivery log when it is enabled,
+// before they are produced so the feedback listener can update them with the feedbacks of the pushes
+// the log is only an audit trail so failing to write it is logged but does not fail the batch
+func (w *Worker) LogDeliveries(l zap.Logger, deliveries []*model.Delivery) {
+	if !w.Config.GetBool("deliveryLog.enabled") || len(deliveries) == 0 {
+		return
+	}
+	err := model.InsertDeliveries(w.MarathonDB, deliveries)
+	if err != nil {
+		log.E(l, "Failed to write the delivery log.", func(cm log.CM) {
+			cm.Write(zap.Int("deliveries", len(deliveries)), zap.Error(err))
+		})
+	}
+}
+
+// UnlogDeliveries removes from the delivery log the deliveries of the pushes kafka did not accept
+func (w *Worker) UnlogDeliveries(l zap.Logger, deliveries []*model.Delivery) {
+	if !w.Config.GetBool("deliveryLog.enabled") || len(deliveries) == 0 {
+		return
+	}
+	err := model.DeleteDeliveries(w.MarathonDB, deliveries)
+	if err != nil {
+		log.E(l, "Failed to remove the failed pushes from the delivery log.", func(cm log.CM) {
+			cm.Write(zap.Int("deliveries", len(deliveries)), zap.Error(err))
+		})
+	}
+}
+
+// DropExpiredDeliveries drops the partitions of the delivery log older than its ttl, failing to drop them is
+// logged and they are dropped by the next run
+func (w *Worker) DropExpiredDeliveries(l zap.Logger) {
+	if !w.Config.GetBool("deliveryLog.enabled") {
+		return
+	}
+	dropped, err := model.DropExpiredDeliveryPartitions(w.MarathonDB, w.Config.GetDuration("deliveryLog.ttl"), time.Now())
+	if err != nil {
+		log.E(l, "Failed to drop the expired partitions of the delivery log.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
+	if len(dropped) > 0 {
+		log.I(l, "dropped the expired partitions of the delivery log", func(cm log.CM) {
+			cm.Write(zap.Object("partitions", dropped))
+		})
+	}
+}
+
+// dropExpiredDeliveriesPeriodically drops the expired partitions of the delivery log when the workers start
+// and then every deliveryLog.dropInterval, the drops of several worker processes do not conflict
+func (w *Worker) dropExpiredDeliveriesPeriodically() {
+	l := w.Logger.With(zap.String("operation", "dropExpiredDeliveries"))
+	w.DropExpiredDeliveries(l)
+	ticker := time.NewTicker(w.Config.GetDuration("deliveryLog.dropInterval"))
+	defer ticker.Stop()
+	for range ticker.C {
+		w.DropExpiredDeliveries(l)
+	}
+}
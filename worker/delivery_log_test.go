@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
+)
+
+var _ = Describe("Delivery Log", func() {
+	var jobID uuid.UUID
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		jobID = uuid.NewV4()
+		w.Config.Set("deliveryLog.enabled", true)
+	})
+
+	AfterEach(func() {
+		w.Config.Set("deliveryLog.enabled", true)
+	})
+
+	Describe("Logging deliveries", func() {
+		It("should write the deliveries to the partition of the day they were produced", func() {
+			delivery := model.NewDelivery(jobID, "user-1", "token-1", "muid-1")
+			w.LogDeliveries(logger, []*model.Delivery{delivery})
+
+			var count int
+			_, err := w.MarathonDB.QueryOne(pg.Scan(&count), "SELECT COUNT(*) FROM "+model.DeliveryPartition(delivery.ProducedAt)+" WHERE job_id = ?", jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("should stamp the deliveries of the pushes when they are produced and not when they are queued", func() {
+			app := CreateTestApp(w.MarathonDB)
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			w.Kafka = NewFakeKafkaProducer()
+			sender := w.NewPushSender(logger, job, "topic", "batch")
+			sender.Send(worker.User{UserID: "user-1", Token: "token-1"}, "muid-1", "", template.Name, map[string]interface{}{}, map[string]interface{}{}, map[string]interface{}{})
+			time.Sleep(10 * time.Millisecond)
+			flushedAt := time.Now().UnixNano()
+			sender.Close()
+
+			deliveries := []model.Delivery{}
+			err := w.MarathonDB.Model(&deliveries).Where("job_id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deliveries).To(HaveLen(1))
+			Expect(deliveries[0].ProducedAt).To(BeNumerically(">=", flushedAt))
+		})
+
+		It("should not write the deliveries if the delivery log is disabled", func() {
+			w.Config.Set("deliveryLog.enabled", false)
+			w.LogDeliveries(logger, []*model.Delivery{model.NewDelivery(jobID, "user-1", "token-1", "muid-1")})
+
+			deliveries := []model.Delivery{}
+			err := w.MarathonDB.Model(&deliveries).Where("job_id = ?", jobID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deliveries).To(BeEmpty())
+		})
+
+		It("should remove the deliveries of the pushes that were not produced", func() {
+			failed := model.NewDelivery(jobID, "user-1", "token-1", "muid-1")
+			sent := model.NewDelivery(jobID, "user-2", "token-2", "muid-2")
+			w.LogDeliveries(logger, []*model.Delivery{failed, sent})
+			w.UnlogDeliveries(logger, []*model.Delivery{failed})
+
+			deliveries := []model.Delivery{}
+			err := w.MarathonDB.Model(&deliveries).Where("job_id = ?", jobID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deliveries).To(HaveLen(1))
+			Expect(deliveries[0].MUID).To(Equal("muid-2"))
+		})
+	})
+
+	Describe("Dropping expired partitions", func() {
+		It("should drop only the partitions older than the ttl", func() {
+			now := time.Now()
+			expiredAt := now.Add(-10 * 24 * time.Hour).UnixNano()
+			recentAt := now.Add(-2 * 24 * time.Hour).UnixNano()
+			err := model.EnsureDeliveryPartition(w.MarathonDB, expiredAt)
+			Expect(err).NotTo(HaveOccurred())
+			err = model.EnsureDeliveryPartition(w.MarathonDB, recentAt)
+			Expect(err).NotTo(HaveOccurred())
+
+			dropped, err := model.DropExpiredDeliveryPartitions(w.MarathonDB, 7*24*time.Hour, now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(ContainElement(model.DeliveryPartition(expiredAt)))
+			Expect(dropped).NotTo(ContainElement(model.DeliveryPartition(recentAt)))
+
+			var exists bool
+			_, err = w.MarathonDB.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", model.DeliveryPartition(recentAt))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+		})
+
+		It("should create a partition again after the process drops it", func() {
+			expiredAt := time.Now().Add(-10 * 24 * time.Hour).UnixNano()
+			Expect(model.EnsureDeliveryPartition(w.MarathonDB, expiredAt)).To(Succeed())
+			w.DropExpiredDeliveries(logger)
+
+			delivery := model.NewDelivery(jobID, "user-1", "token-1", "muid-1")
+			delivery.ProducedAt = expiredAt
+			Expect(model.InsertDeliveries(w.MarathonDB, []*model.Delivery{delivery})).To(Succeed())
+		})
+
+		It("should drop the partitions older than the delivery log ttl", func() {
+			expiredAt := time.Now().Add(-10 * 24 * time.Hour).UnixNano()
+			Expect(model.EnsureDeliveryPartition(w.MarathonDB, expiredAt)).To(Succeed())
+			w.DropExpiredDeliveries(logger)
+
+			var exists bool
+			_, err := w.MarathonDB.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", model.DeliveryPartition(expiredAt))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+	})
+})
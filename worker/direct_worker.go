@@ -27,8 +27,6 @@ package worker
 import (
 	"encoding/json"
 	"fmt"
-	"math"
-	"math/rand"
 	"strings"
 	"time"
 
@@ -64,25 +62,6 @@ func NewDirectWorker(workers *Worker) *DirectWorker {
 	return b
 }
 
-func (b *DirectWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, expiresAt int64, templateName string) error {
-	pushExpiry := expiresAt / 1000000000 // convert from nanoseconds to seconds
-	switch service {
-	case "apns":
-		err := b.Workers.Kafka.SendAPNSPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
-		if err != nil {
-			return err
-		}
-	case "gcm":
-		err := b.Workers.Kafka.SendGCMPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
-		if err != nil {
-			return err
-		}
-	default:
-		panic("service should be in ['apns', 'gcm']")
-	}
-	return nil
-}
-
 func (b *DirectWorker) addCompletedTokens(job *model.Job, nTokens int) error {
 	_, err := b.Workers.MarathonDB.Model(&job).Set("completed_tokens = completed_tokens + ?", nTokens).Where("id = ?", job.ID).Update()
 	return err
@@ -98,14 +77,37 @@ func (b *DirectWorker) checkComplete(job *model.Job) (bool, error) {
 	return job.CompletedBatches == job.TotalBatches, err
 }
 
-func (b *DirectWorker) getQuery(job *model.Job) string {
-	filters := job.Filters
-	whereClause := GetWhereClauseFromFilters(filters)
-	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s WHERE seq_id >= ? AND seq_id < ?", GetPushDBTableName(job.App.Name, job.Service))
-	if (whereClause) != "" {
-		query = fmt.Sprintf("%s AND %s", query, whereClause)
+func (b *DirectWorker) removeSuppressedUsers(users []User, job *model.Job) []User {
+	userIDs := make([]string, len(users))
+	for idx, user := range users {
+		userIDs[idx] = user.UserID
+	}
+	suppressed, err := b.Workers.SuppressUsers(job, userIDs)
+	b.checkErr(job, err)
+	if len(suppressed) == 0 {
+		return users
+	}
+	remaining := make([]User, 0, len(users))
+	for _, user := range users {
+		if !suppressed[user.UserID] {
+			remaining = append(remaining, user)
+		}
+	}
+	return remaining
+}
+
+func (b *DirectWorker) getQuery(job *model.Job, smallestSeqID, biggestSeqID uint64) (string, []interface{}, error) {
+	tableName := GetPushDBTableName(job.App.Name, job.Service)
+	filterQuery, err := getJobFilterQuery(b.Workers.PushDB, tableName, job)
+	if err != nil {
+		return "", nil, err
+	}
+	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s WHERE seq_id >= ? AND seq_id < ?", tableName)
+	if filterQuery.Where != "" {
+		query = fmt.Sprintf("%s AND %s", query, filterQuery.Where)
 	}
-	return query
+	params := append([]interface{}{smallestSeqID, biggestSeqID}, filterQuery.Params...)
+	return query, params, nil
 }
 
 // Process processes the messages sent to batch worker queue and send them to kafka
@@ -149,40 +151,76 @@ func (b *DirectWorker) Process(message *workers.Msg) {
 	topicTemplate := b.Workers.Config.GetString("workers.topicTemplate")
 	topic := BuildTopicName(job.App.Name, job.Service, topicTemplate)
 
+	query, params, err := b.getQuery(job, msg.SmallestSeqID, msg.BiggestSeqID)
+	b.checkErr(job, err)
+
 	var users []User
 	start := time.Now()
-	_, err = b.Workers.PushDB.Query(&users, b.getQuery(job), msg.SmallestSeqID, msg.BiggestSeqID)
+	_, err = b.Workers.PushDB.Query(&users, query, params...)
 	b.Workers.Statsd.Timing("get_from_pg", time.Now().Sub(start), job.Labels(), 1)
+	users = b.removeSuppressedUsers(users, job)
 
 	successfulUsers := len(users)
 
-	// create a controll group if needed
-	controlGroupSize := int(math.Ceil(float64(len(users)) * job.ControlGroup))
-	if controlGroupSize > 0 {
-		if controlGroupSize >= len(users) {
-			panic("control group size cannot be higher than number of users")
-		}
-		// shuffle slice in place
-		for i := range users {
-			j := rand.Intn(i + 1)
-			users[i], users[j] = users[j], users[i]
-		}
-		// grab control group
-		controlGroup := []string{}
-		for i := len(users) - controlGroupSize; i < len(users); i++ {
-			controlGroup = append(controlGroup, users[i].UserID)
+	// users held out by the app holdout or by the job control group are stored and not sent
+	userIDs := make([]string, len(users))
+	for idx, user := range users {
+		userIDs[idx] = user.UserID
+	}
+	heldOut, err := b.Workers.HoldOutUsers(job, userIDs)
+	b.checkErr(job, err)
+	if len(heldOut) > 0 {
+		remaining := make([]User, 0, len(users))
+		for _, user := range users {
+			if !heldOut[user.UserID] {
+				remaining = append(remaining, user)
+			}
 		}
-		go b.Workers.SendControlGroupToRedis(job, controlGroup)
+		users = remaining
+	}
 
-		// cut control group from the slice
-		users = append(users[:len(users)-controlGroupSize], users[len(users):]...)
+	// scheduled and deferred users are counted by their own batches
+	batchID := fmt.Sprintf("%d-%d", msg.SmallestSeqID, msg.BiggestSeqID)
+	remaining, err := b.Workers.ScheduleOptimalSendTimeUsers(job, batchID, users)
+	b.checkErr(job, err)
+	remaining, err = b.Workers.DeferQuietHoursUsers(job, job.App.Name, batchID, remaining)
+	b.checkErr(job, err)
+	successfulUsers -= len(users) - len(remaining)
+	users = remaining
+	muids := make([]string, len(users))
+	for idx, user := range users {
+		muids[idx] = BuildMessageID(job.ID, user.UserID, user.Token)
 	}
+	sender := b.Workers.NewPushSender(l, job, topic, batchID)
+	defer sender.Close()
+	sentPushes, err := sender.SentPushes(muids)
+	b.checkErr(job, err)
+	cappedUsers, err := sender.FrequencyCappedUsers(users, muids, sentPushes)
+	b.checkErr(job, err)
+	skippedUsers := 0
+
+	for idx, user := range users {
+		muid := muids[idx]
+		if sentPushes[muid] {
+			skippedUsers++
+			continue
+		}
+		if cappedUsers[user.UserID] {
+			// capped users are marked as sent so retries of the batch do not count them again
+			skippedUsers++
+			sender.Skip(muid)
+			continue
+		}
 
-	for _, user := range users {
 		templateName := job.TemplateName
 		templateNames := strings.Split(job.TemplateName, ",")
+		variant := ""
 
-		if templateNames != nil && len(templateNames) > 1 {
+		if job.Experiment != nil {
+			assigned := job.Experiment.Assign(job.ExperimentID(), user.UserID)
+			templateName = assigned.TemplateName
+			variant = assigned.Name
+		} else if templateNames != nil && len(templateNames) > 1 {
 			templateName = RandomElementFromSlice(templateNames)
 			log.D(l, "selected template", func(cm log.CM) {
 				cm.Write(zap.Object("name", templateName))
@@ -212,7 +250,7 @@ func (b *DirectWorker) Process(message *workers.Msg) {
 			"templateName": templateName,
 			"jobId":        job.ID.String(),
 			"pushType":     "massive",
-			"muid":         uuid.NewV4().String(),
+			"muid":         muid,
 		}
 
 		dryRun := false
@@ -222,11 +260,21 @@ func (b *DirectWorker) Process(message *workers.Msg) {
 			}
 		}
 
-		err = b.sendToKafka(job.Service, topic, msg, job.Metadata, pushMetadata, user.Token, job.ExpiresAt, templateName)
-		if err != nil {
-			successfulUsers--
+		if job.JourneyID != uuid.Nil {
+			pushMetadata["journeyId"] = job.JourneyID.String()
+			pushMetadata["journeyStep"] = job.JourneyStep
+		}
+
+		if len(variant) > 0 {
+			pushMetadata["variant"] = variant
 		}
+
+		// failed pushes are counted by the sender errors
+		sender.Send(user, muid, variant, templateName, msg, BuildMessageMetadata(job, template), pushMetadata)
 	}
+	sender.Flush()
+	successfulUsers -= sender.Errors
+	successfulUsers -= skippedUsers
 
 	// ignore errors
 	b.addCompletedTokens(job, successfulUsers)
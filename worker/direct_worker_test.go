@@ -21,8 +21,10 @@ package worker_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"time"
 
 	workers "github.com/jrallison/go-workers"
 	. "github.com/onsi/ginkgo"
@@ -149,6 +151,117 @@ var _ = Describe("Complete Test", func() {
 			Expect(len(producer.APNSMessages)).To(Equal(1000))
 		})
 
+		It("should not count the batches again nor change their ranges when the job is retried", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1, '1', '1', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters": map[string]interface{}{
+					"locale": "en",
+				},
+			})
+			Expect(w.CreateDirectBatchesJob(j)).To(Succeed())
+
+			_, err = w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1000000, '2', '2', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.CreateDirectBatchesJob(j)).To(Succeed())
+
+			dbJob := &model.Job{ID: j.ID}
+			Expect(w.MarathonDB.Select(dbJob)).To(Succeed())
+			Expect(dbJob.TotalBatches).To(Equal(1))
+			dataSlice, err := w.RedisClient.LRange("queue:direct_worker", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataSlice).To(HaveLen(2))
+			parts := make([]worker.DirectPartMsg, len(dataSlice))
+			for idx, data := range dataSlice {
+				msg, err := workers.NewMsg(data)
+				Expect(err).NotTo(HaveOccurred())
+				err = json.Unmarshal([]byte(msg.Args().ToJson()), &parts[idx])
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(parts[0]).To(Equal(parts[1]))
+			Expect(parts[0].SmallestSeqID).To(BeEquivalentTo(0))
+		})
+
+		It("should create a single batch when the push table is empty", func() {
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters": map[string]interface{}{
+					"locale": "en",
+				},
+			})
+			Expect(w.CreateDirectBatchesJob(j)).To(Succeed())
+
+			dbJob := &model.Job{ID: j.ID}
+			Expect(w.MarathonDB.Select(dbJob)).To(Succeed())
+			Expect(dbJob.TotalBatches).To(Equal(1))
+			dataSlice, err := w.RedisClient.LRange("queue:direct_worker", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataSlice).To(HaveLen(1))
+		})
+
+		It("should schedule the users with opens to the hour they most often open pushes", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES
+				(1, '1', '1', 'en', 'us', '+0000'),
+				(2, '2', '2', 'en', 'us', '+0000'),
+				(3, '3', '3', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+			now := time.Now().UTC()
+			optimalTime := now.Add(2 * time.Hour).Truncate(time.Hour)
+			for _, userOpenHour := range []*model.UserOpenHour{
+				{AppID: app.ID, UserID: "1", Hour: optimalTime.Hour(), Opens: 3},
+				{AppID: app.ID, UserID: "1", Hour: now.Hour(), Opens: 1},
+				{AppID: app.ID, UserID: "2", Hour: now.Hour(), Opens: 2},
+			} {
+				Expect(w.MarathonDB.Insert(userOpenHour)).To(Succeed())
+			}
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters": map[string]interface{}{
+					"locale": "en",
+				},
+				"sendTimeStrategy": "optimal",
+			})
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			dataSlice, err := w.RedisClient.LRange("queue:direct_worker", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			for _, data := range dataSlice {
+				msg, err := workers.NewMsg(data)
+				Expect(err).NotTo(HaveOccurred())
+				directWorker.Process(msg)
+			}
+			Expect(producer.APNSMessages).To(HaveLen(2))
+
+			dataSlice, err = w.RedisClient.ZRange("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataSlice).To(HaveLen(1))
+			var data workers.EnqueueData
+			err = json.Unmarshal([]byte(dataSlice[0]), &data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.Queue).To(Equal("process_batch_worker"))
+			Expect(int64(data.At * workers.NanoSecondPrecision)).To(BeNumerically("~", optimalTime.UnixNano(), int64(time.Millisecond)))
+			scheduled, err := worker.ParseProcessBatchWorkerMessageArray(data.Args.([]interface{}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled.Users).To(HaveLen(1))
+			Expect(scheduled.Users[0].UserID).To(Equal("1"))
+
+			dbJob := &model.Job{ID: j.ID}
+			err = w.MarathonDB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.TotalBatches).To(Equal(2))
+			Expect(dbJob.CompletedBatches).To(Equal(1))
+			Expect(dbJob.CompletedTokens).To(Equal(2))
+			Expect(dbJob.CompletedAt).To(BeZero())
+		})
+
 		It("should put control group in s3 and also update job with controlGroupCSVPath", func() {
 			_, err := w.PushDB.Query(nil, `
 				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
@@ -181,8 +294,15 @@ var _ = Describe("Complete Test", func() {
 			controlGroupCSV, err := w.S3Client.GetObject(key)
 			Expect(err).NotTo(HaveOccurred())
 
+			controlGroup := []string{}
+			for _, userID := range []string{"1", "10", "2", "20", "3", "30", "4", "40", "5", "50"} {
+				if j.InControlGroup(userID) {
+					controlGroup = append(controlGroup, userID)
+				}
+			}
 			lines := ReadLinesFromIOReader(bytes.NewReader(controlGroupCSV))
-			Expect(len(lines)).To(Equal(5)) //5 -> header + 4 control group userIds
+			Expect(lines[0]).To(Equal("controlGroupUserIds"))
+			Expect(lines[1:]).To(ConsistOf(controlGroup))
 
 			dbJob := &model.Job{
 				ID: j.ID,
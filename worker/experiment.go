@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+// IncrExperimentSent adds the pushes sent by a batch to the counters of the variants of the job experiment,
+// failing to count them is logged but does not fail the batch as the pushes were already sent
+func (w *Worker) IncrExperimentSent(l zap.Logger, job *model.Job, sentByVariant map[string]int) {
+	if job.Experiment == nil || len(sentByVariant) == 0 {
+		return
+	}
+	values := []string{}
+	params := []interface{}{}
+	for variant, sent := range sentByVariant {
+		values = append(values, "(?, ?, ?::integer, ?::bigint)")
+		params = append(params, job.ID, variant, sent, time.Now().UnixNano())
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO experiment_variants (job_id, name, sent, updated_at) VALUES %s ON CONFLICT (job_id, name) DO UPDATE SET sent = experiment_variants.sent + EXCLUDED.sent, updated_at = EXCLUDED.updated_at;",
+		strings.Join(values, ","),
+	)
+	_, err := w.MarathonDB.Exec(query, params...)
+	if err != nil {
+		log.E(l, "Failed to count the experiment pushes sent.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
+}
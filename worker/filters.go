@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+)
+
+// FilterQuery is a where clause built from a filter expression, its values are bound as ? params
+type FilterQuery struct {
+	Where  string
+	Params []interface{}
+}
+
+// filterOperators maps the operators of the filter expression leaves to their sql
+var filterOperators = map[string]string{
+	"eq":      "=",
+	"neq":     "!=",
+	"gt":      ">",
+	"gte":     ">=",
+	"lt":      "<",
+	"lte":     "<=",
+	"like":    "LIKE",
+	"notLike": "NOT LIKE",
+	"in":      "IN",
+	"notIn":   "NOT IN",
+	"isNull":  "IS NULL",
+}
+
+// GetPushDBColumns returns the columns of the push db table, only they can be used in filters
+func GetPushDBColumns(db interfaces.DB, tableName string) (map[string]bool, error) {
+	var columns []string
+	_, err := db.Query(&columns, "SELECT column_name FROM information_schema.columns WHERE table_name = ?", tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+	columnsSet := map[string]bool{}
+	for _, column := range columns {
+		columnsSet[column] = true
+	}
+	return columnsSet, nil
+}
+
+// GetFilterQuery builds the filter query of the expression for the push db table
+func GetFilterQuery(db interfaces.DB, tableName string, expression *model.FilterExpression) (*FilterQuery, error) {
+	if expression == nil {
+		return &FilterQuery{}, nil
+	}
+	columns, err := GetPushDBColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return BuildFilterQuery(expression, columns)
+}
+
+// BuildFilterQuery compiles the filter expression to a where clause, all its columns must be in columns
+func BuildFilterQuery(expression *model.FilterExpression, columns map[string]bool) (*FilterQuery, error) {
+	query := &FilterQuery{Params: []interface{}{}}
+	if expression == nil {
+		return query, nil
+	}
+	if err := expression.Validate(); err != nil {
+		return nil, err
+	}
+	where, err := compileFilterExpression(query, expression, columns)
+	if err != nil {
+		return nil, err
+	}
+	query.Where = where
+	return query, nil
+}
+
+func compileFilterExpression(query *FilterQuery, node *model.FilterExpression, columns map[string]bool) (string, error) {
+	switch {
+	case node.And != nil:
+		return compileFilterExpressions(query, node.And, " AND ", columns)
+	case node.Or != nil:
+		return compileFilterExpressions(query, node.Or, " OR ", columns)
+	case node.Not != nil:
+		clause, err := compileFilterExpression(query, node.Not, columns)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("NOT (%s)", clause), nil
+	}
+
+	if !columns[node.Column] {
+		return "", fmt.Errorf("invalid filter %s: unknown column", node.Column)
+	}
+	operator := filterOperators[node.Op]
+	switch node.Op {
+	case "isNull":
+		if !node.Value.(bool) {
+			operator = "IS NOT NULL"
+		}
+		return fmt.Sprintf("\"%s\" %s", node.Column, operator), nil
+	case "in", "notIn":
+		query.Params = append(query.Params, pg.In(node.Value.([]interface{})))
+		return fmt.Sprintf("\"%s\" %s (?)", node.Column, operator), nil
+	}
+	query.Params = append(query.Params, node.Value)
+	return fmt.Sprintf("\"%s\" %s ?", node.Column, operator), nil
+}
+
+func compileFilterExpressions(query *FilterQuery, nodes []*model.FilterExpression, connector string, columns map[string]bool) (string, error) {
+	clauses := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		clause, err := compileFilterExpression(query, node, columns)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	return fmt.Sprintf("(%s)", strings.Join(clauses, connector)), nil
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
+)
+
+var _ = Describe("Filters", func() {
+	columns := map[string]bool{
+		"user_id":    true,
+		"token":      true,
+		"region":     true,
+		"locale":     true,
+		"tz":         true,
+		"created_at": true,
+	}
+
+	buildFilterQuery := func(filters map[string]interface{}) (*worker.FilterQuery, error) {
+		expression, err := model.NewFilterExpressionFromFilters(filters)
+		if err != nil {
+			return nil, err
+		}
+		return worker.BuildFilterQuery(expression, columns)
+	}
+
+	Describe("Filter expression JSON", func() {
+		It("should keep the false, 0 and empty string values of the leaves", func() {
+			for _, value := range []interface{}{false, float64(0), ""} {
+				expression := &model.FilterExpression{
+					Not: &model.FilterExpression{Column: "tz", Op: "eq", Value: value},
+				}
+				if _, ok := value.(bool); ok {
+					expression.Not.Op = "isNull"
+				}
+				b, err := json.Marshal(expression)
+				Expect(err).NotTo(HaveOccurred())
+
+				var unmarshaled model.FilterExpression
+				err = json.Unmarshal(b, &unmarshaled)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(unmarshaled.Not.Value).To(Equal(value))
+				Expect(unmarshaled.Validate()).To(Succeed())
+				Expect(&unmarshaled).To(Equal(expression))
+			}
+		})
+
+		It("should not write a value in the and, or and not nodes", func() {
+			expression := &model.FilterExpression{
+				Not: &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"},
+			}
+			b, err := json.Marshal(expression)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal(`{"not":{"column":"locale","op":"eq","value":"pt"}}`))
+		})
+	})
+
+	Describe("Build filter query from flat filters", func() {
+		It("should return an empty where clause if filters is empty", func() {
+			query, err := buildFilterQuery(map[string]interface{}{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(""))
+			Expect(query.Params).To(BeEmpty())
+		})
+
+		It("should succeed with one simple filter", func() {
+			filters := map[string]interface{}{
+				"region": "US",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`"region" = ?`))
+			Expect(query.Params).To(Equal([]interface{}{"US"}))
+		})
+
+		It("should succeed with one comma separated filter", func() {
+			filters := map[string]interface{}{
+				"region": "US,CA",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`"region" IN (?)`))
+			Expect(query.Params).To(HaveLen(1))
+		})
+
+		It("should succeed with one negative simple filter", func() {
+			filters := map[string]interface{}{
+				"NOTregion": "US",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`"region" != ?`))
+		})
+
+		It("should succeed with one negative comma separated filter", func() {
+			filters := map[string]interface{}{
+				"NOTregion": "US,CA",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`"region" NOT IN (?)`))
+		})
+
+		It("should succeed with multiple filters in a stable order", func() {
+			filters := map[string]interface{}{
+				"NOTregion": "US,CA",
+				"locale":    "en,fr",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`("region" NOT IN (?) AND "locale" IN (?))`))
+			Expect(query.Params).To(HaveLen(2))
+		})
+
+		It("should bind values instead of writing them in the query", func() {
+			filters := map[string]interface{}{
+				"locale": "en' OR '1'='1",
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`"locale" = ?`))
+			Expect(query.Params).To(Equal([]interface{}{"en' OR '1'='1"}))
+		})
+
+		It("should succeed with a range", func() {
+			filters := map[string]interface{}{
+				"created_at": map[string]interface{}{
+					"gte": "2019-01-01",
+					"lt":  "2019-02-01",
+				},
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`("created_at" >= ? AND "created_at" < ?)`))
+			Expect(query.Params).To(Equal([]interface{}{"2019-01-01", "2019-02-01"}))
+		})
+
+		It("should succeed with in, like and is null operators", func() {
+			filters := map[string]interface{}{
+				"locale": map[string]interface{}{"in": []interface{}{"en", "fr"}},
+				"token":  map[string]interface{}{"like": "abc%"},
+				"tz":     map[string]interface{}{"isNull": false},
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`("locale" IN (?) AND "token" LIKE ? AND "tz" IS NOT NULL)`))
+			Expect(query.Params).To(HaveLen(2))
+		})
+
+		It("should negate operators objects", func() {
+			filters := map[string]interface{}{
+				"NOTtz": map[string]interface{}{"isNull": true},
+			}
+			query, err := buildFilterQuery(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`NOT ("tz" IS NULL)`))
+		})
+
+		It("should fail if the column is unknown", func() {
+			filters := map[string]interface{}{
+				`locale" = 'en' OR "1`: "en",
+			}
+			_, err := buildFilterQuery(filters)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown column"))
+		})
+
+		It("should fail if the operator is unknown", func() {
+			filters := map[string]interface{}{
+				"locale": map[string]interface{}{"between": "en"},
+			}
+			_, err := buildFilterQuery(filters)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown operator"))
+		})
+
+		It("should fail if the value is invalid", func() {
+			filters := map[string]interface{}{
+				"locale": 1,
+			}
+			_, err := buildFilterQuery(filters)
+			Expect(err).To(HaveOccurred())
+
+			filters = map[string]interface{}{
+				"locale": map[string]interface{}{"in": []interface{}{}},
+			}
+			_, err = buildFilterQuery(filters)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Build filter query from an expression", func() {
+		It("should compile nested and, or and not nodes", func() {
+			expression := &model.FilterExpression{
+				Or: []*model.FilterExpression{
+					{Column: "locale", Op: "eq", Value: "pt"},
+					{And: []*model.FilterExpression{
+						{Column: "region", Op: "in", Value: []interface{}{"US", "CA"}},
+						{Not: &model.FilterExpression{Column: "tz", Op: "isNull", Value: true}},
+					}},
+				},
+			}
+			query, err := worker.BuildFilterQuery(expression, columns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`("locale" = ? OR ("region" IN (?) AND NOT ("tz" IS NULL)))`))
+			Expect(query.Params).To(HaveLen(2))
+		})
+
+		It("should fail if a node has more than one kind", func() {
+			expression := &model.FilterExpression{
+				Column: "locale",
+				Op:     "eq",
+				Value:  "pt",
+				Not:    &model.FilterExpression{Column: "tz", Op: "isNull", Value: true},
+			}
+			_, err := worker.BuildFilterQuery(expression, columns)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail if an or is empty", func() {
+			expression := &model.FilterExpression{Or: []*model.FilterExpression{}}
+			_, err := worker.BuildFilterQuery(expression, columns)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail if a nested column is unknown", func() {
+			expression := &model.FilterExpression{
+				Not: &model.FilterExpression{Column: "password", Op: "eq", Value: "123"},
+			}
+			_, err := worker.BuildFilterQuery(expression, columns)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown column"))
+		})
+
+		It("should use the job expression instead of the flat filters", func() {
+			job := &model.Job{
+				Filters:          map[string]interface{}{"locale": "en"},
+				FilterExpression: &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"},
+			}
+			expression, err := job.GetFilterExpression()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expression.Value).To(Equal("pt"))
+
+			job.FilterExpression = nil
+			expression, err = job.GetFilterExpression()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expression.Value).To(Equal("en"))
+		})
+	})
+
+	Describe("Get filter query", func() {
+		logger := zap.New(
+			zap.NewJSONEncoder(zap.NoTime()),
+			zap.FatalLevel,
+		)
+		w := worker.NewWorker(logger, GetConfPath())
+
+		It("should use the columns of the push db table", func() {
+			filters := map[string]interface{}{
+				"locale":     "pt",
+				"created_at": map[string]interface{}{"lte": "2100-01-01"},
+			}
+			expression, err := model.NewFilterExpressionFromFilters(filters)
+			Expect(err).NotTo(HaveOccurred())
+			query, err := worker.GetFilterQuery(w.PushDB, "testapp_apns", expression)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query.Where).To(Equal(`("created_at" <= ? AND "locale" = ?)`))
+
+			var count int
+			_, err = w.PushDB.QueryOne(pg.Scan(&count), "SELECT count(1) FROM testapp_apns WHERE "+query.Where, query.Params...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(6))
+		})
+
+		It("should fail if the table does not exist", func() {
+			expression := &model.FilterExpression{Column: "locale", Op: "eq", Value: "pt"}
+			_, err := worker.GetFilterQuery(w.PushDB, "unknownapp_apns", expression)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	redis "gopkg.in/redis.v5"
+)
+
+// frequencyCapScript keeps in a sorted set the pushes sent to the user in the window,
+// a push already in the set is allowed again so the user tokens and batch retries count once,
+// it returns 0 for a capped user, 1 if the push was already counted and 2 if it reserved a new slot
+const frequencyCapScript = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if redis.call('ZSCORE', KEYS[1], ARGV[4]) then
+	return 1
+end
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+return 2
+`
+
+// FrequencyCapKey is the redis key of the pushes sent to the user of the app in the window
+func FrequencyCapKey(appID, userID string) string {
+	return fmt.Sprintf("%s-frequencycap-%s", appID, userID)
+}
+
+// FrequencyCapper limits the pushes an user of an app receives in a rolling window
+// across all the jobs and triggers of the app and all worker processes
+// PushID identifies the push counted in the window, the job id or, for triggers, the job and event ids
+type FrequencyCapper struct {
+	RedisClient *redis.Client
+	AppID       string
+	PushID      string
+	Limit       int
+	Window      time.Duration
+	reserved    map[string]bool
+}
+
+// NewFrequencyCapper returns the frequency capper of the job app or nil if the app is not capped
+func (w *Worker) NewFrequencyCapper(job *model.Job) *FrequencyCapper {
+	if job.App.FrequencyCapLimit <= 0 || job.App.FrequencyCapWindow <= 0 {
+		return nil
+	}
+	return &FrequencyCapper{
+		RedisClient: w.RedisClient,
+		AppID:       job.AppID.String(),
+		PushID:      job.ID.String(),
+		Limit:       job.App.FrequencyCapLimit,
+		Window:      time.Duration(job.App.FrequencyCapWindow) * time.Second,
+	}
+}
+
+// Capped reserves the slot of the job push for the users and returns the ones that reached the limit,
+// which must not receive it, the slots must be committed once the push is sent or they are released
+func (f *FrequencyCapper) Capped(userIDs []string) (map[string]bool, error) {
+	capped := map[string]bool{}
+	uniqueUserIDs := []string{}
+	seen := map[string]bool{}
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			uniqueUserIDs = append(uniqueUserIDs, userID)
+		}
+	}
+	if len(uniqueUserIDs) == 0 {
+		return capped, nil
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-f.Window).UnixNano()
+	ttl := int(f.Window.Seconds()) + 1
+	cmds := make([]*redis.Cmd, len(uniqueUserIDs))
+	_, err := f.RedisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for idx, userID := range uniqueUserIDs {
+			key := FrequencyCapKey(f.AppID, userID)
+			cmds[idx] = pipe.Eval(frequencyCapScript, []string{key}, now.UnixNano(), windowStart, f.Limit, f.PushID, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.reserved == nil {
+		f.reserved = map[string]bool{}
+	}
+	for idx, cmd := range cmds {
+		allowed, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		switch allowed {
+		case int64(0):
+			capped[uniqueUserIDs[idx]] = true
+		case int64(2):
+			f.reserved[uniqueUserIDs[idx]] = true
+		}
+	}
+	return capped, nil
+}
+
+// Commit keeps the slot reserved for the user since the job push was sent
+func (f *FrequencyCapper) Commit(userID string) {
+	delete(f.reserved, userID)
+}
+
+// Release frees the slots reserved and not committed, so the users whose push failed
+// can still receive the pushes of other jobs, slots reserved by previous runs are kept
+func (f *FrequencyCapper) Release() error {
+	if len(f.reserved) == 0 {
+		return nil
+	}
+	_, err := f.RedisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for userID := range f.reserved {
+			pipe.ZRem(FrequencyCapKey(f.AppID, userID), f.PushID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.reserved = map[string]bool{}
+	return nil
+}
+
+// FrequencyCappedUsers returns the users that must not receive the job push because of the app
+// frequency cap, the users that already received it are not checked again
+// the slots of the other users are committed as their pushes are confirmed and released when the sender is closed
+func (s *PushSender) FrequencyCappedUsers(users []User, muids []string, sentPushes map[string]bool) (map[string]bool, error) {
+	s.frequencyCapper = s.Workers.NewFrequencyCapper(s.Job)
+	if s.frequencyCapper == nil {
+		return map[string]bool{}, nil
+	}
+	s.frequencyCapper.PushID = s.PushID
+	userIDs := []string{}
+	for idx, user := range users {
+		if !sentPushes[muids[idx]] {
+			userIDs = append(userIDs, user.UserID)
+		}
+	}
+	capped, err := s.frequencyCapper.Capped(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = addFrequencyCappedUsers(s.Workers.MarathonDB, s.Job, len(capped))
+	if err != nil {
+		return nil, err
+	}
+	return capped, nil
+}
+
+func addFrequencyCappedUsers(db interfaces.DB, job *model.Job, nUsers int) error {
+	if nUsers == 0 {
+		return nil
+	}
+	_, err := db.Model(job).Set(
+		"feedbacks = feedbacks || jsonb_build_object('frequencyCapped', COALESCE((feedbacks->>'frequencyCapped')::int, 0) + ?)",
+		nUsers,
+	).Where("id = ?", job.ID).Update()
+	return err
+}
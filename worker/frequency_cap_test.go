@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Frequency Capper", func() {
+	var job *model.Job
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		w.RedisClient.FlushAll()
+		job = &model.Job{
+			ID:    uuid.NewV4(),
+			AppID: uuid.NewV4(),
+			App:   model.App{},
+		}
+	})
+
+	Describe("Creating a frequency capper", func() {
+		It("should return nil if the app is not capped", func() {
+			Expect(w.NewFrequencyCapper(job)).To(BeNil())
+		})
+
+		It("should use the app frequency cap", func() {
+			job.App.FrequencyCapLimit = 2
+			job.App.FrequencyCapWindow = 3600
+			frequencyCapper := w.NewFrequencyCapper(job)
+			Expect(frequencyCapper).NotTo(BeNil())
+			Expect(frequencyCapper.Limit).To(Equal(2))
+			Expect(frequencyCapper.Window).To(Equal(time.Hour))
+			Expect(frequencyCapper.AppID).To(Equal(job.AppID.String()))
+		})
+	})
+
+	Describe("Capping users", func() {
+		BeforeEach(func() {
+			job.App.FrequencyCapLimit = 2
+			job.App.FrequencyCapWindow = 3600
+		})
+
+		It("should cap the users that received the limit of pushes from other jobs", func() {
+			for i := 0; i < 2; i++ {
+				otherJob := *job
+				otherJob.ID = uuid.NewV4()
+				capped, err := w.NewFrequencyCapper(&otherJob).Capped([]string{"user1"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(capped).To(BeEmpty())
+			}
+
+			capped, err := w.NewFrequencyCapper(job).Capped([]string{"user1", "user2"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(HaveLen(1))
+			Expect(capped["user1"]).To(BeTrue())
+		})
+
+		It("should count the pushes of the same job once", func() {
+			frequencyCapper := w.NewFrequencyCapper(job)
+			for i := 0; i < 3; i++ {
+				capped, err := frequencyCapper.Capped([]string{"user1", "user1"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(capped).To(BeEmpty())
+			}
+			count, err := w.RedisClient.ZCard(worker.FrequencyCapKey(job.AppID.String(), "user1")).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+		})
+
+		It("should release the slots reserved and not committed", func() {
+			frequencyCapper := w.NewFrequencyCapper(job)
+			capped, err := frequencyCapper.Capped([]string{"user1", "user2"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(BeEmpty())
+			frequencyCapper.Commit("user1")
+			Expect(frequencyCapper.Release()).To(Succeed())
+
+			count, err := w.RedisClient.ZCard(worker.FrequencyCapKey(job.AppID.String(), "user1")).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+			count, err = w.RedisClient.ZCard(worker.FrequencyCapKey(job.AppID.String(), "user2")).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(0))
+		})
+
+		It("should not release the slots reserved by a previous run of the job", func() {
+			_, err := w.NewFrequencyCapper(job).Capped([]string{"user1"})
+			Expect(err).NotTo(HaveOccurred())
+
+			frequencyCapper := w.NewFrequencyCapper(job)
+			capped, err := frequencyCapper.Capped([]string{"user1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(BeEmpty())
+			Expect(frequencyCapper.Release()).To(Succeed())
+
+			count, err := w.RedisClient.ZCard(worker.FrequencyCapKey(job.AppID.String(), "user1")).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+		})
+
+		It("should not count the pushes sent before the window", func() {
+			job.App.FrequencyCapLimit = 1
+			job.App.FrequencyCapWindow = 1
+			otherJob := *job
+			otherJob.ID = uuid.NewV4()
+			capped, err := w.NewFrequencyCapper(&otherJob).Capped([]string{"user1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(BeEmpty())
+
+			capped, err = w.NewFrequencyCapper(job).Capped([]string{"user1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped["user1"]).To(BeTrue())
+
+			time.Sleep(1100 * time.Millisecond)
+			capped, err = w.NewFrequencyCapper(job).Capped([]string{"user1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(BeEmpty())
+		})
+	})
+})
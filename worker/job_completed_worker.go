@@ -54,9 +54,12 @@ func NewJobCompletedWorker(workers *Worker) *JobCompletedWorker {
 }
 
 func (b *JobCompletedWorker) flushControlGroup(job *model.Job) {
-	hash := job.ID.String()
-	hash = fmt.Sprintf("%s-CONTROL", hash)
-	controlGroup, err := b.Workers.RedisClient.LRange(hash, 0, -1).Result()
+	var controlGroup []string
+	_, err := b.Workers.MarathonDB.Query(
+		&controlGroup,
+		"SELECT user_id FROM control_group_users WHERE job_id = ? AND reason = ? ORDER BY user_id",
+		job.ID, model.JobControlGroupReason,
+	)
 	b.checkErr(job, err)
 
 	folder := b.Workers.Config.GetString("s3.controlGroupFolder")
@@ -73,9 +76,6 @@ func (b *JobCompletedWorker) flushControlGroup(job *model.Job) {
 	_, err = b.Workers.S3Client.PutObject(writePath, &csvBytes)
 	b.checkErr(job, err)
 	b.updateJobControlGroupCSVPath(job, writePath)
-
-	err = b.Workers.RedisClient.Del(hash).Err()
-	b.checkErr(job, err)
 }
 
 func (b *JobCompletedWorker) updateJobControlGroupCSVPath(job *model.Job, csvPath string) {
@@ -23,7 +23,9 @@
 package worker_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 
 	workers "github.com/jrallison/go-workers"
 	. "github.com/onsi/ginkgo"
@@ -72,6 +74,27 @@ var _ = Describe("JobCompleted Worker", func() {
 			}).ShouldNot(Panic())
 		})
 
+		It("should put the stored control group of the job in s3", func() {
+			for userID, reason := range map[string]string{"1": model.JobControlGroupReason, "2": model.AppHoldoutReason} {
+				err := w.MarathonDB.Insert(&model.ControlGroupUser{JobID: job.ID, UserID: userID, AppID: app.ID, Reason: reason})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			messageObj := []interface{}{job.ID.String()}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			jobCompletedWorker.Process(message)
+
+			key := fmt.Sprintf("%s/%s/job-%s.csv", w.Config.GetString("s3.bucket"), w.Config.GetString("s3.controlGroupFolder"), job.ID.String())
+			controlGroupCSV, err := fakeS3.GetObject(key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ReadLinesFromIOReader(bytes.NewReader(controlGroupCSV))).To(Equal([]string{"controlGroupUserIds", "1"}))
+		})
+
 		It("should not process when job is not found in db", func() {
 			_, err := w.MarathonDB.Exec("DELETE FROM jobs;")
 			Expect(err).NotTo(HaveOccurred())
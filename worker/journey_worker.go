@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
+)
+
+const nameJourneyWorker = "journey_worker"
+
+// JourneyMsg is the step of a journey to create the job of
+// messages of steps other than the current step of the journey are outdated and ignored
+type JourneyMsg struct {
+	JourneyID uuid.UUID
+	Step      int
+}
+
+// JourneyWorker creates the job of a step of a journey and schedules the next step
+type JourneyWorker struct {
+	Workers *Worker
+	Logger  zap.Logger
+}
+
+// NewJourneyWorker gets a new JourneyWorker
+func NewJourneyWorker(workers *Worker) *JourneyWorker {
+	b := &JourneyWorker{
+		Logger:  workers.Logger.With(zap.String("worker", "JourneyWorker")),
+		Workers: workers,
+	}
+	b.Logger.Debug("Configured JourneyWorker successfully.")
+	return b
+}
+
+// GetJourneyStepUsers returns the users of the step of the journey whose engagement matches the condition,
+// the engagement is recorded by the feedback listener from the feedbacks and open events of the step pushes
+func GetJourneyStepUsers(db interfaces.DB, journeyID uuid.UUID, step int, condition string) ([]string, error) {
+	where := "delivered"
+	switch condition {
+	case model.OpenedJourneyCondition:
+		where = "opened"
+	case model.NotOpenedJourneyCondition:
+		where = "delivered AND NOT opened"
+	}
+	var userIDs []string
+	_, err := db.Query(
+		&userIDs,
+		fmt.Sprintf("SELECT user_id FROM journey_users WHERE journey_id = ? AND step = ? AND %s ORDER BY user_id", where),
+		journeyID, step,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// Process processes the messages sent to journey worker queue
+func (b *JourneyWorker) Process(message *workers.Msg) {
+	msg := &JourneyMsg{}
+	err := json.Unmarshal([]byte(message.Args().ToJson()), msg)
+	checkErr(b.Logger, err)
+
+	l := b.Logger.With(
+		zap.String("journeyID", msg.JourneyID.String()),
+		zap.Int("step", msg.Step),
+		zap.String("worker", nameJourneyWorker),
+	)
+	log.I(l, "starting")
+
+	journey := &model.Journey{}
+	err = b.Workers.MarathonDB.Model(journey).Where("id = ?", msg.JourneyID).Select()
+	if err == pg.ErrNoRows {
+		log.I(l, "deleted journey")
+		return
+	}
+	checkErr(l, err)
+	job := &model.Job{ID: journey.JobID(msg.Step)}
+	if journey.CurrentStep == msg.Step+1 {
+		// a previous run claimed the step and may have failed to schedule the next one or to start its job
+		err = b.Workers.MarathonDB.Select(job)
+		if err == pg.ErrNoRows {
+			log.I(l, "step already processed with no users")
+			return
+		}
+		checkErr(l, err)
+	} else {
+		if journey.Status != model.ActiveJourneyStatus || journey.CurrentStep != msg.Step || msg.Step >= len(journey.Steps) {
+			log.I(l, "outdated step", func(cm log.CM) {
+				cm.Write(zap.String("status", journey.Status), zap.Int("currentStep", journey.CurrentStep))
+			})
+			return
+		}
+		job, err = b.createStepJob(journey, msg.Step)
+		checkErr(l, err)
+		if job == nil {
+			log.I(l, "step already processed or with no users")
+			return
+		}
+	}
+
+	next := journey.NextStepAt(msg.Step, job.CreatedAt)
+	if journey.Status == model.ActiveJourneyStatus && next > 0 {
+		err = b.Workers.runOnce(fmt.Sprintf("%s-scheduled-%d", journey.ID.String(), msg.Step+1), func() error {
+			_, err := b.Workers.ScheduleJourneyJob(journey, msg.Step+1, next)
+			return err
+		})
+		checkErr(l, err)
+	}
+	err = b.Workers.runOnce(fmt.Sprintf("%s-started", job.ID.String()), func() error {
+		return b.Workers.StartJob(job)
+	})
+	if err != nil {
+		job.TagError(b.Workers.MarathonDB, nameJourneyWorker, err.Error())
+		checkErr(l, err)
+	}
+	log.I(l, "created journey step job", func(cm log.CM) {
+		cm.Write(zap.String("jobID", job.ID.String()), zap.Int64("nextStepAt", next))
+	})
+	job.TagSuccess(b.Workers.MarathonDB, nameJourneyWorker, "created job")
+}
+
+// createStepJob writes the CSV of the users of the step and then moves the journey to its next step and
+// creates the job of the step in a single transaction, so the step is never claimed without its job,
+// it returns nil if the step was claimed by another run or if no users match the step condition,
+// in which case the journey is finished
+func (b *JourneyWorker) createStepJob(journey *model.Journey, step int) (*model.Job, error) {
+	now := time.Now().UnixNano()
+	job := journey.NewJob(step, 0)
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	status := model.ActiveJourneyStatus
+	if journey.NextStepAt(step, now) == 0 {
+		status = model.FinishedJourneyStatus
+	}
+
+	if step > 0 {
+		userIDs, err := GetJourneyStepUsers(b.Workers.MarathonDB, journey.ID, step-1, journey.Steps[step].Condition)
+		if err != nil {
+			return nil, err
+		}
+		if len(userIDs) == 0 {
+			// the next steps would have no users either
+			_, err = b.Workers.MarathonDB.Model(journey).
+				Set("current_step = ?", step+1).
+				Set("status = ?", model.FinishedJourneyStatus).
+				Set("updated_at = ?", now).
+				Where("id = ? AND status = ? AND current_step = ?", journey.ID, model.ActiveJourneyStatus, step).
+				Update()
+			return nil, err
+		}
+
+		// the path is the same for every run of the step so a retry overwrites the file of a failed one
+		csvBuffer := &bytes.Buffer{}
+		csvBuffer.WriteString("userIds\n")
+		for _, userID := range userIDs {
+			csvBuffer.WriteString(fmt.Sprintf("%s\n", userID))
+		}
+		folder := b.Workers.Config.GetString("s3.audienceFolder")
+		bucket := b.Workers.Config.GetString("s3.bucket")
+		writePath := fmt.Sprintf("%s/%s/journey-%s-step-%d.csv", bucket, folder, journey.ID.String(), step)
+		csvBytes := csvBuffer.Bytes()
+		_, err = b.Workers.S3Client.PutObject(writePath, &csvBytes)
+		if err != nil {
+			return nil, err
+		}
+		job.CSVPath = writePath
+	}
+
+	tx, err := b.Workers.MarathonDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Model(journey).
+		Set("current_step = ?", step+1).
+		Set("status = ?", status).
+		Set("updated_at = ?", now).
+		Where("id = ? AND status = ? AND current_step = ?", journey.ID, model.ActiveJourneyStatus, step).
+		Update()
+	if err != nil || res.RowsAffected() == 0 {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Insert(job); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	journey.CurrentStep = step + 1
+	journey.Status = status
+	return job, nil
+}
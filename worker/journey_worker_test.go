@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Journey Worker", func() {
+	var journeyWorker *worker.JourneyWorker
+	var app *model.App
+	var templateNames []string
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	getMessage := func(journey *model.Journey, step int) *workers.Msg {
+		msgB, err := json.Marshal(map[string]interface{}{
+			"args": worker.JourneyMsg{
+				JourneyID: journey.ID,
+				Step:      step,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		message, err := workers.NewMsg(string(msgB))
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	getJourneyJobs := func(journey *model.Journey) []model.Job {
+		jobs := []model.Job{}
+		err := w.MarathonDB.Model(&jobs).Where("journey_id = ?", journey.ID).Select()
+		Expect(err).NotTo(HaveOccurred())
+		return jobs
+	}
+
+	getJourney := func(journey *model.Journey) *model.Journey {
+		dbJourney := &model.Journey{ID: journey.ID}
+		err := w.MarathonDB.Select(dbJourney)
+		Expect(err).NotTo(HaveOccurred())
+		return dbJourney
+	}
+
+	addJourneyUser := func(journey *model.Journey, step int, userID string, delivered, opened bool) {
+		_, err := w.MarathonDB.Exec(
+			"INSERT INTO journey_users (journey_id, step, user_id, delivered, opened) VALUES (?, ?, ?, ?, ?)",
+			journey.ID, step, userID, delivered, opened,
+		)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		journeyWorker = worker.NewJourneyWorker(w)
+		w.S3Client = NewFakeS3(w.Config)
+		w.RedisClient.FlushAll()
+		w.MarathonDB.Exec("DELETE FROM journeys;")
+		app = CreateTestApp(w.MarathonDB)
+		templateNames = []string{
+			CreateTestTemplate(w.MarathonDB, app.ID).Name,
+			CreateTestTemplate(w.MarathonDB, app.ID).Name,
+		}
+	})
+
+	Describe("Process", func() {
+		It("should create the job of the first step for the journey users and schedule the next step", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames)
+			journeyWorker.Process(getMessage(journey, 0))
+
+			jobs := getJourneyJobs(journey)
+			Expect(jobs).To(HaveLen(1))
+			Expect(jobs[0].JourneyStep).To(Equal(0))
+			Expect(jobs[0].TemplateName).To(Equal(templateNames[0]))
+			Expect(jobs[0].Filters).To(Equal(journey.Filters))
+			Expect(jobs[0].Context).To(Equal(journey.Steps[0].Context))
+
+			dbJourney := getJourney(journey)
+			Expect(dbJourney.Status).To(Equal(model.ActiveJourneyStatus))
+			Expect(dbJourney.CurrentStep).To(Equal(1))
+
+			scheduled, err := w.RedisClient.ZRangeWithScores("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(HaveLen(1))
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(scheduled[0].Member.(string)), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["queue"]).To(Equal("journey_worker"))
+			at := time.Now().Add(24 * time.Hour).Unix()
+			Expect(scheduled[0].Score).To(BeNumerically("~", at, 10))
+		})
+
+		It("should create the job of a step for the users of the previous step that match its condition", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames, map[string]interface{}{
+				"currentStep": 1,
+			})
+			addJourneyUser(journey, 0, "user1", true, true)
+			addJourneyUser(journey, 0, "user2", true, false)
+			addJourneyUser(journey, 0, "user3", false, false)
+			journeyWorker.Process(getMessage(journey, 1))
+
+			jobs := getJourneyJobs(journey)
+			Expect(jobs).To(HaveLen(1))
+			Expect(jobs[0].JourneyStep).To(Equal(1))
+			Expect(jobs[0].TemplateName).To(Equal(templateNames[1]))
+			Expect(jobs[0].Filters).To(BeEmpty())
+			path := fmt.Sprintf("tfg-push-notifications/test/audiences/journey-%s-step-1.csv", journey.ID.String())
+			Expect(jobs[0].CSVPath).To(Equal(path))
+			csv, err := w.S3Client.GetObject(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(csv)).To(Equal("userIds\nuser2\n"))
+
+			dbJourney := getJourney(journey)
+			Expect(dbJourney.Status).To(Equal(model.FinishedJourneyStatus))
+			Expect(dbJourney.CurrentStep).To(Equal(2))
+		})
+
+		It("should select the users that opened the previous step", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames, map[string]interface{}{
+				"currentStep": 1,
+				"condition":   model.OpenedJourneyCondition,
+			})
+			addJourneyUser(journey, 0, "user1", true, true)
+			addJourneyUser(journey, 0, "user2", true, false)
+			journeyWorker.Process(getMessage(journey, 1))
+
+			jobs := getJourneyJobs(journey)
+			Expect(jobs).To(HaveLen(1))
+			csv, err := w.S3Client.GetObject(jobs[0].CSVPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(csv)).To(Equal("userIds\nuser1\n"))
+		})
+
+		It("should finish the journey if no users match the step condition", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, append(templateNames, templateNames[0]), map[string]interface{}{
+				"currentStep": 1,
+			})
+			addJourneyUser(journey, 0, "user1", true, true)
+			journeyWorker.Process(getMessage(journey, 1))
+
+			Expect(getJourneyJobs(journey)).To(HaveLen(0))
+			Expect(getJourney(journey).Status).To(Equal(model.FinishedJourneyStatus))
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(0))
+		})
+
+		It("should not create a job if the journey is stopped", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames, map[string]interface{}{
+				"status": model.StoppedJourneyStatus,
+			})
+			journeyWorker.Process(getMessage(journey, 0))
+
+			Expect(getJourneyJobs(journey)).To(HaveLen(0))
+		})
+
+		It("should create the job of a step only once", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames)
+			journeyWorker.Process(getMessage(journey, 0))
+			journeyWorker.Process(getMessage(journey, 0))
+
+			Expect(getJourneyJobs(journey)).To(HaveLen(1))
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(1))
+		})
+
+		It("should schedule the next step of a step claimed by a run that failed before scheduling it", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames, map[string]interface{}{
+				"currentStep": 1,
+			})
+			err := w.MarathonDB.Insert(journey.NewJob(0, 0))
+			Expect(err).NotTo(HaveOccurred())
+
+			journeyWorker.Process(getMessage(journey, 0))
+			journeyWorker.Process(getMessage(journey, 0))
+
+			Expect(getJourneyJobs(journey)).To(HaveLen(1))
+			scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(HaveLen(1))
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(scheduled[0]), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["queue"]).To(Equal("journey_worker"))
+			Expect(msg["args"].(map[string]interface{})["Step"]).To(BeEquivalentTo(1))
+		})
+
+		It("should not create a job for a step with no users processed again", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, append(templateNames, templateNames[0]), map[string]interface{}{
+				"currentStep": 1,
+			})
+			journeyWorker.Process(getMessage(journey, 1))
+			journeyWorker.Process(getMessage(journey, 1))
+
+			Expect(getJourneyJobs(journey)).To(HaveLen(0))
+			Expect(getJourney(journey).Status).To(Equal(model.FinishedJourneyStatus))
+		})
+
+		It("should do nothing if the journey was deleted", func() {
+			journey := CreateTestJourney(w.MarathonDB, app.ID, templateNames)
+			_, err := w.MarathonDB.Exec("DELETE FROM journeys WHERE id = ?", journey.ID)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { journeyWorker.Process(getMessage(journey, 0)) }).NotTo(Panic())
+			Expect(getJourneyJobs(journey)).To(HaveLen(0))
+		})
+	})
+})
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+)
+
+var offsetTimezoneRegexp = regexp.MustCompile(`^([+-])(\d{2}):?(\d{2})$`)
+
+// LoadTimezone returns the location of a tz of the push table, either an IANA zone name
+// such as America/Sao_Paulo, whose offset follows the daylight saving time, or a fixed
+// offset from UTC such as -0300 or +05:45
+func LoadTimezone(tz string) (*time.Location, error) {
+	if matches := offsetTimezoneRegexp.FindStringSubmatch(tz); matches != nil {
+		hours, _ := strconv.Atoi(matches[2])
+		minutes, _ := strconv.Atoi(matches[3])
+		if hours > 14 || minutes >= 60 {
+			return nil, fmt.Errorf("invalid timezone offset %s", tz)
+		}
+		offset := (hours*60 + minutes) * 60
+		if matches[1] == "-" {
+			offset *= -1
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+	if tz == "" || tz == "Local" {
+		return nil, fmt.Errorf("invalid timezone %s", tz)
+	}
+	return time.LoadLocation(tz)
+}
+
+// GetJobTimezones returns the distinct timezones of the users of the job in the push table,
+// all the users of the table are considered for jobs with csv files
+func GetJobTimezones(db interfaces.DB, tableName string, job *model.Job) ([]string, error) {
+	filterQuery := &FilterQuery{}
+	if job.CSVPath == "" && (job.Audience == nil || !job.Audience.HasCSV()) {
+		var err error
+		filterQuery, err = getJobFilterQuery(db, tableName, job)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := fmt.Sprintf("SELECT DISTINCT tz FROM %s", tableName)
+	if filterQuery.Where != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, filterQuery.Where)
+	}
+	var tzs []string
+	_, err := db.Query(&tzs, query, filterQuery.Params...)
+	return tzs, err
+}
+
+// LocalizedSend is a job created for the users of a localized job whose timezones reach
+// the job start time at the same instant
+type LocalizedSend struct {
+	Timezones []string
+	StartsAt  int64
+}
+
+// GetLocalizedSends groups the timezones by the instant in which their local time is the time of
+// startsAt in UTC, invalid timezones are ignored and past instants are skipped or moved to the next
+// day according to the past time strategy
+func GetLocalizedSends(tzs []string, startsAt int64, pastTimeStrategy string, now time.Time) []*LocalizedSend {
+	wallClock := time.Unix(0, startsAt).UTC()
+	sendsByInstant := map[int64]*LocalizedSend{}
+	sends := []*LocalizedSend{}
+	for _, tz := range tzs {
+		location, err := LoadTimezone(strings.TrimSpace(tz))
+		if err != nil {
+			continue
+		}
+		sendTime := time.Date(wallClock.Year(), wallClock.Month(), wallClock.Day(), wallClock.Hour(), wallClock.Minute(), wallClock.Second(), wallClock.Nanosecond(), location)
+		if sendTime.Before(now) {
+			if pastTimeStrategy == "skip" {
+				continue
+			}
+			sendTime = time.Date(wallClock.Year(), wallClock.Month(), wallClock.Day()+1, wallClock.Hour(), wallClock.Minute(), wallClock.Second(), wallClock.Nanosecond(), location)
+		}
+		send, ok := sendsByInstant[sendTime.UnixNano()]
+		if !ok {
+			send = &LocalizedSend{StartsAt: sendTime.UnixNano()}
+			sendsByInstant[send.StartsAt] = send
+			sends = append(sends, send)
+		}
+		send.Timezones = append(send.Timezones, tz)
+	}
+	sort.Slice(sends, func(i, j int) bool {
+		return sends[i].StartsAt < sends[j].StartsAt
+	})
+	return sends
+}
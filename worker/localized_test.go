@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Localized jobs", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	Describe("Load timezone", func() {
+		It("should load fixed offsets with or without colon", func() {
+			location, err := worker.LoadTimezone("+05:45")
+			Expect(err).NotTo(HaveOccurred())
+			_, offset := time.Now().In(location).Zone()
+			Expect(offset).To(Equal(5*3600 + 45*60))
+
+			location, err = worker.LoadTimezone("-0300")
+			Expect(err).NotTo(HaveOccurred())
+			_, offset = time.Now().In(location).Zone()
+			Expect(offset).To(Equal(-3 * 3600))
+		})
+
+		It("should load IANA zone names", func() {
+			location, err := worker.LoadTimezone("America/New_York")
+			Expect(err).NotTo(HaveOccurred())
+			_, offset := time.Date(2019, time.July, 1, 12, 0, 0, 0, location).Zone()
+			Expect(offset).To(Equal(-4 * 3600))
+			_, offset = time.Date(2019, time.January, 1, 12, 0, 0, 0, location).Zone()
+			Expect(offset).To(Equal(-5 * 3600))
+		})
+
+		It("should return an error for invalid timezones", func() {
+			for _, tz := range []string{"", "Local", "-4440", "Mars/Olympus"} {
+				_, err := worker.LoadTimezone(tz)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Describe("Get localized sends", func() {
+		startsAt := time.Date(2019, time.July, 1, 10, 0, 0, 0, time.UTC)
+		now := startsAt.Add(-24 * time.Hour)
+
+		It("should group the timezones reaching the start time at the same instant", func() {
+			sends := worker.GetLocalizedSends([]string{"-0400", "America/New_York", "+05:45", "-4440", "UTC", "+0000"}, startsAt.UnixNano(), "", now)
+			Expect(sends).To(HaveLen(3))
+			Expect(sends[0].Timezones).To(Equal([]string{"+05:45"}))
+			Expect(sends[0].StartsAt).To(Equal(startsAt.Add(-5*time.Hour - 45*time.Minute).UnixNano()))
+			Expect(sends[1].Timezones).To(Equal([]string{"UTC", "+0000"}))
+			Expect(sends[1].StartsAt).To(Equal(startsAt.UnixNano()))
+			Expect(sends[2].Timezones).To(Equal([]string{"-0400", "America/New_York"}))
+			Expect(sends[2].StartsAt).To(Equal(startsAt.Add(4 * time.Hour).UnixNano()))
+		})
+
+		It("should follow the daylight saving time of IANA zones", func() {
+			winter := time.Date(2019, time.January, 1, 10, 0, 0, 0, time.UTC)
+			sends := worker.GetLocalizedSends([]string{"America/New_York"}, winter.UnixNano(), "", winter.Add(-24*time.Hour))
+			Expect(sends).To(HaveLen(1))
+			Expect(sends[0].StartsAt).To(Equal(winter.Add(5 * time.Hour).UnixNano()))
+		})
+
+		It("should skip or move to the next day the past sends", func() {
+			now := startsAt.Add(time.Hour)
+			sends := worker.GetLocalizedSends([]string{"+0300", "-0300"}, startsAt.UnixNano(), "skip", now)
+			Expect(sends).To(HaveLen(1))
+			Expect(sends[0].Timezones).To(Equal([]string{"-0300"}))
+
+			sends = worker.GetLocalizedSends([]string{"+0300", "-0300"}, startsAt.UnixNano(), "nextDay", now)
+			Expect(sends).To(HaveLen(2))
+			Expect(sends[0].Timezones).To(Equal([]string{"-0300"}))
+			Expect(sends[1].Timezones).To(Equal([]string{"+0300"}))
+			Expect(sends[1].StartsAt).To(Equal(startsAt.Add(21 * time.Hour).UnixNano()))
+		})
+	})
+
+	Describe("Get job timezones", func() {
+		It("should return the timezones of the job users", func() {
+			job := &model.Job{
+				FilterExpression: &model.FilterExpression{Column: "locale", Op: "eq", Value: "en"},
+			}
+			tzs, err := worker.GetJobTimezones(w.PushDB, "testapp_apns", job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tzs).To(ConsistOf("-0300", "-0500"))
+		})
+
+		It("should return all the timezones of the table for csv jobs", func() {
+			job := &model.Job{CSVPath: "test/users.csv"}
+			tzs, err := worker.GetJobTimezones(w.PushDB, "testapp_apns", job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tzs).To(ConsistOf("-0300", "-0500", "-0800", "-4440"))
+		})
+	})
+})
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/messages"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+)
+
+// JobPreview is the result of rendering a job for a sample of its users without sending it
+type JobPreview struct {
+	EstimatedAudienceSize int              `json:"estimatedAudienceSize"`
+	Messages              []PreviewMessage `json:"messages"`
+}
+
+// PreviewMessage is the push of a job rendered for a user
+type PreviewMessage struct {
+	UserID       string          `json:"userId"`
+	Locale       string          `json:"locale"`
+	TemplateName string          `json:"templateName"`
+	Message      json.RawMessage `json:"message"`
+}
+
+// SampleUsers returns up to n users matched by the job filters
+func SampleUsers(db interfaces.DB, job *model.Job, n int) ([]User, error) {
+	var users []User
+	tableName := GetPushDBTableName(job.App.Name, job.Service)
+	expression, err := job.GetFilterExpression()
+	if err != nil {
+		return nil, err
+	}
+	filterQuery, err := GetFilterQuery(db, tableName, expression)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s", tableName)
+	if filterQuery.Where != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, filterQuery.Where)
+	}
+	params := append(filterQuery.Params, n)
+	_, err = db.Query(&users, fmt.Sprintf("%s LIMIT ?", query), params...)
+	return users, err
+}
+
+// GetUsersByIDs returns the users of the job service with the given ids
+func GetUsersByIDs(db interfaces.DB, job *model.Job, userIDs []string) ([]User, error) {
+	var users []User
+	if len(userIDs) == 0 {
+		return users, nil
+	}
+	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s WHERE user_id IN (?)", GetPushDBTableName(job.App.Name, job.Service))
+	_, err := db.Query(&users, query, pg.In(userIDs))
+	return users, err
+}
+
+// GetTemplateForLocale returns the template for the locale or the 'en' one if there is none
+func GetTemplateForLocale(templatesByLocale map[string]model.Template, locale string) (model.Template, error) {
+	if template, ok := templatesByLocale[strings.ToLower(locale)]; ok {
+		return template, nil
+	}
+	if template, ok := templatesByLocale["en"]; ok {
+		return template, nil
+	}
+	return model.Template{}, fmt.Errorf("there is no template for the given locale or 'en'")
+}
+
+// RenderPush builds the push of the job for the user exactly as it is sent to kafka
+func RenderPush(job *model.Job, template model.Template, templateName string, user User) (string, error) {
+	msgStr, err := BuildMessageFromTemplate(template, job.Context)
+	if err != nil {
+		return "", err
+	}
+	var msg map[string]interface{}
+	err = json.Unmarshal([]byte(msgStr), &msg)
+	if err != nil {
+		return "", err
+	}
+	pushMetadata := map[string]interface{}{
+		"userId":       user.UserID,
+		"templateName": templateName,
+		"jobId":        job.ID.String(),
+		"pushType":     "massive",
+		"muid":         BuildMessageID(job.ID, user.UserID, user.Token),
+	}
+	if job.Experiment != nil {
+		pushMetadata["variant"] = job.Experiment.Assign(job.ExperimentID(), user.UserID).Name
+	}
+
+	pushService, err := messages.GetPushService(job.Service)
+	if err != nil {
+		return "", err
+	}
+	buildMessage, err := pushService.Builder(GetMessageFormat(job))
+	if err != nil {
+		return "", err
+	}
+	pushExpiry := job.ExpiresAt / 1000000000 // convert from nanoseconds to seconds
+	return buildMessage(user.Token, pushExpiry, msg, BuildMessageMetadata(job, template), pushMetadata, templateName).ToJSON()
+}
+
+// PreviewJob renders the pushes of the job for the given users
+// when the job has many templates they are used in turns so all of them are previewed,
+// except for experiments whose users get the template of the variant they are assigned to
+func PreviewJob(job *model.Job, templatesByNameAndLocale map[string]map[string]model.Template, users []User) ([]PreviewMessage, error) {
+	templateNames := strings.Split(job.TemplateName, ",")
+	previews := make([]PreviewMessage, 0, len(users))
+	for idx, user := range users {
+		templateName := templateNames[idx%len(templateNames)]
+		if job.Experiment != nil {
+			templateName = job.Experiment.Assign(job.ExperimentID(), user.UserID).TemplateName
+		}
+		template, err := GetTemplateForLocale(templatesByNameAndLocale[templateName], user.Locale)
+		if err != nil {
+			return nil, err
+		}
+		message, err := RenderPush(job, template, templateName, user)
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, PreviewMessage{
+			UserID:       user.UserID,
+			Locale:       user.Locale,
+			TemplateName: templateName,
+			Message:      json.RawMessage(message),
+		})
+	}
+	return previews, nil
+}
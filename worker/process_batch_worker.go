@@ -81,25 +81,6 @@ func (b *ProcessBatchWorker) incrFailedBatches(jobID uuid.UUID, totalBatches int
 	}
 }
 
-func (b *ProcessBatchWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, expiresAt int64, templateName string) error {
-	pushExpiry := expiresAt / 1000000000 // convert from nanoseconds to seconds
-	switch service {
-	case "apns":
-		err := b.Workers.Kafka.SendAPNSPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
-		if err != nil {
-			return err
-		}
-	case "gcm":
-		err := b.Workers.Kafka.SendGCMPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
-		if err != nil {
-			return err
-		}
-	default:
-		panic("service should be in ['apns', 'gcm']")
-	}
-	return nil
-}
-
 func (b *ProcessBatchWorker) updateJobUsersInfo(jobID uuid.UUID, numUsers int) error {
 	job := model.Job{}
 	_, err := b.Workers.MarathonDB.Model(&job).Set("completed_tokens = completed_tokens + ?", numUsers).Where("id = ?", jobID).Update()
@@ -161,7 +142,6 @@ func (b *ProcessBatchWorker) checkErrWithReEnqueue(parsed *BatchWorkerMessage, l
 
 // Process processes the messages sent to batch worker queue and send them to kafka
 func (b *ProcessBatchWorker) Process(message *workers.Msg) {
-	batchErrorCounter := 0
 	l := b.Logger.With(
 		zap.String("source", "processBatchWorker"),
 		zap.String("operation", "process"),
@@ -215,11 +195,43 @@ func (b *ProcessBatchWorker) Process(message *workers.Msg) {
 	log.D(l, "Built topic name successfully.", func(cm log.CM) {
 		cm.Write(zap.String("topic", topic))
 	})
-	for _, user := range parsed.Users {
+	batchID := BuildBatchID(parsed.Users)
+	users, err := b.Workers.DeferQuietHoursUsers(job, parsed.AppName, batchID, parsed.Users)
+	b.checkErrWithReEnqueue(parsed, l, err)
+	muids := make([]string, len(users))
+	for idx, user := range users {
+		muids[idx] = BuildMessageID(job.ID, user.UserID, user.Token)
+	}
+	sender := b.Workers.NewPushSender(l, job, topic, batchID)
+	defer sender.Close()
+	sentPushes, err := sender.SentPushes(muids)
+	b.checkErrWithReEnqueue(parsed, l, err)
+	cappedUsers, err := sender.FrequencyCappedUsers(users, muids, sentPushes)
+	b.checkErrWithReEnqueue(parsed, l, err)
+	skippedUsers := 0
+
+	for idx, user := range users {
+		muid := muids[idx]
+		if sentPushes[muid] {
+			skippedUsers++
+			continue
+		}
+		if cappedUsers[user.UserID] {
+			// capped users are marked as sent so retries of the batch do not count them again
+			skippedUsers++
+			sender.Skip(muid)
+			continue
+		}
+
 		templateName := job.TemplateName
 		templateNames := strings.Split(job.TemplateName, ",")
+		variant := ""
 
-		if templateNames != nil && len(templateNames) > 1 {
+		if job.Experiment != nil {
+			assigned := job.Experiment.Assign(job.ExperimentID(), user.UserID)
+			templateName = assigned.TemplateName
+			variant = assigned.Name
+		} else if templateNames != nil && len(templateNames) > 1 {
 			templateName = RandomElementFromSlice(templateNames)
 			log.D(l, "selected template", func(cm log.CM) {
 				cm.Write(zap.Object("name", templateName))
@@ -254,7 +266,7 @@ func (b *ProcessBatchWorker) Process(message *workers.Msg) {
 			"templateName": templateName,
 			"jobId":        job.ID.String(),
 			"pushType":     "massive",
-			"muid":         uuid.NewV4().String(),
+			"muid":         muid,
 		}
 
 		dryRun := false
@@ -264,30 +276,30 @@ func (b *ProcessBatchWorker) Process(message *workers.Msg) {
 			}
 		}
 
-		err = b.sendToKafka(job.Service, topic, msg, job.Metadata, pushMetadata, user.Token, job.ExpiresAt, templateName)
-		if err != nil {
-			batchErrorCounter = batchErrorCounter + 1
-			log.E(l, "Failed to send message to Kafka.", func(cm log.CM) {
-				cm.Write(
-					zap.String("service", job.Service),
-					zap.String("topic", topic),
-					zap.Object("msg", msg),
-					zap.Object("metadata", job.Metadata),
-					zap.Object("token", user.Token),
-					zap.Object("expiresAt", job.ExpiresAt),
-					zap.Error(err),
-				)
-			})
+		if job.JourneyID != uuid.Nil {
+			pushMetadata["journeyId"] = job.JourneyID.String()
+			pushMetadata["journeyStep"] = job.JourneyStep
+		}
+
+		if len(variant) > 0 {
+			pushMetadata["variant"] = variant
 		}
+
+		// failed pushes are counted by the sender errors
+		sender.Send(user, muid, variant, templateName, msg, BuildMessageMetadata(job, template), pushMetadata)
 	}
-	log.D(l, "Sent push to pusher for batch users.")
+	sender.Flush()
+	batchErrorCounter := sender.Errors
+	log.D(l, "Sent push to pusher for batch users.", func(cm log.CM) {
+		cm.Write(zap.Int("skippedUsers", skippedUsers))
+	})
 	err = b.updateJobBatchesInfo(parsed.JobID)
 	checkErr(l, err)
 	log.D(l, "Updated job batches info successfully.")
-	err = b.updateJobUsersInfo(parsed.JobID, len(parsed.Users)-batchErrorCounter)
+	err = b.updateJobUsersInfo(parsed.JobID, len(users)-batchErrorCounter-skippedUsers)
 	checkErr(l, err)
 	log.D(l, "Updated job users info successfully.")
-	if float64(batchErrorCounter)/float64(len(parsed.Users)) > b.Workers.Config.GetFloat64("workers.processBatch.maxUserFailureInBatch") {
+	if len(users) > 0 && float64(batchErrorCounter)/float64(len(users)) > b.Workers.Config.GetFloat64("workers.processBatch.maxUserFailureInBatch") {
 		b.incrFailedBatches(job.ID, job.TotalBatches, parsed.AppName)
 		checkErr(l, fmt.Errorf("failed to send message to several users, considering batch as failed"))
 	}
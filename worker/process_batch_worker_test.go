@@ -38,6 +38,7 @@ import (
 	. "github.com/topfreegames/marathon/testing"
 	"github.com/topfreegames/marathon/worker"
 	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
 )
 
 func getNextMessageFrom(kafkaBrokers []string, topic string, partition int32, offset int64) (*sarama.ConsumerMessage, error) {
@@ -403,6 +404,512 @@ var _ = Describe("ProcessBatch Worker", func() {
 			Expect(dbJob.CompletedTokens).To(Equal(len(users)))
 		})
 
+		It("should use a deterministic muid for each user token", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+
+			for idx, m := range mockKafkaProducer.APNSMessages {
+				var apnsMessage messages.APNSMessage
+				err = json.Unmarshal([]byte(m), &apnsMessage)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(apnsMessage.Metadata["muid"]).To(Equal(worker.BuildMessageID(job.ID, users[idx].UserID, users[idx].Token)))
+			}
+		})
+
+		It("should not send pushes again if the batch is processed twice", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+
+			dbJob := model.Job{
+				ID: job.ID,
+			}
+			err = w.MarathonDB.Select(&dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedTokens).To(Equal(len(users)))
+
+			ttl, err := w.RedisClient.TTL(fmt.Sprintf("%s-sentpushes-%s", job.ID.String(), worker.BuildBatchID(users))).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", w.Config.GetDuration("workers.sentPushes.ttl"), 10))
+		})
+
+		It("should not skip the pushes sent by other batches of the job", func() {
+			err := worker.MarkPushesSent(job.ID, worker.BuildBatchID(users[:1]), []string{worker.BuildMessageID(job.ID, users[0].UserID, users[0].Token)}, time.Hour, w.RedisClient)
+			Expect(err).NotTo(HaveOccurred())
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+		})
+
+		It("should only mark as sent the pushes of each chunk confirmed by kafka", func() {
+			w.Config.Set("workers.sentPushes.chunkSize", 1)
+			defer w.Config.Set("workers.sentPushes.chunkSize", 1000)
+			mockKafkaProducer.AckErrors[users[1].Token] = fmt.Errorf("kafka error")
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { processBatchWorker.Process(message) }).Should(Panic())
+
+			muids := []string{
+				worker.BuildMessageID(job.ID, users[0].UserID, users[0].Token),
+				worker.BuildMessageID(job.ID, users[1].UserID, users[1].Token),
+			}
+			sent, err := worker.GetSentPushes(job.ID, worker.BuildBatchID(users), muids, w.RedisClient)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sent).To(Equal(map[string]bool{muids[0]: true}))
+		})
+
+		It("should only send pushes to users not sent yet", func() {
+			err := worker.MarkPushesSent(job.ID, worker.BuildBatchID(users), []string{worker.BuildMessageID(job.ID, users[0].UserID, users[0].Token)}, time.Hour, w.RedisClient)
+			Expect(err).NotTo(HaveOccurred())
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.Metadata["userId"]).To(Equal(users[1].UserID))
+		})
+
+		It("should skip users that reached the app frequency cap", func() {
+			_, err := w.MarathonDB.Model(&model.App{}).Set("frequency_cap_limit = 1, frequency_cap_window = 3600").Where("id = ?", app.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			otherJob := *job
+			otherJob.ID = uuid.NewV4()
+			otherJob.App.FrequencyCapLimit = 1
+			otherJob.App.FrequencyCapWindow = 3600
+			capped, err := w.NewFrequencyCapper(&otherJob).Capped([]string{users[0].UserID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capped).To(BeEmpty())
+
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.Metadata["userId"]).To(Equal(users[1].UserID))
+
+			dbJob := model.Job{
+				ID: job.ID,
+			}
+			err = w.MarathonDB.Select(&dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedTokens).To(Equal(1))
+			Expect(dbJob.Feedbacks["frequencyCapped"]).To(BeEquivalentTo(1))
+		})
+
+		It("should release the frequency cap slot of the users whose push kafka did not confirm", func() {
+			_, err := w.MarathonDB.Model(&model.App{}).Set("frequency_cap_limit = 1, frequency_cap_window = 3600").Where("id = ?", app.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			mockKafkaProducer.AckErrors[users[0].Token] = fmt.Errorf("kafka error")
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { processBatchWorker.Process(message) }).Should(Panic())
+
+			jobs, err := w.RedisClient.ZRange(worker.FrequencyCapKey(app.ID.String(), users[0].UserID), 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(BeEmpty())
+			jobs, err = w.RedisClient.ZRange(worker.FrequencyCapKey(app.ID.String(), users[1].UserID), 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(Equal([]string{job.ID.String()}))
+		})
+
+		It("should defer the users inside the quiet hours to a batch scheduled to their end", func() {
+			now := time.Now().UTC()
+			quietHours := &model.QuietHours{
+				Start: now.Add(-time.Hour).Format("15:04"),
+				End:   now.Add(time.Hour).Format("15:04"),
+			}
+			quietHoursJSON, err := json.Marshal(quietHours)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.MarathonDB.Model(&model.Job{}).Set("quiet_hours = ?", string(quietHoursJSON)).Set("total_batches = 1").Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			users[0].Tz = "+0000"
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.Metadata["userId"]).To(Equal(users[1].UserID))
+
+			dbJob := model.Job{
+				ID: job.ID,
+			}
+			err = w.MarathonDB.Select(&dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.TotalBatches).To(Equal(2))
+			Expect(dbJob.CompletedBatches).To(Equal(1))
+			Expect(dbJob.CompletedTokens).To(Equal(1))
+			Expect(dbJob.CompletedAt).To(BeZero())
+
+			res, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(1))
+			var data workers.EnqueueData
+			jobs, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+			bytes, err := RedisReplyToBytes(jobs[0], err)
+			Expect(err).NotTo(HaveOccurred())
+			json.Unmarshal(bytes, &data)
+			at := time.Unix(0, int64(data.At*workers.NanoSecondPrecision))
+			Expect(at.Unix()).To(BeNumerically("~", now.Add(time.Hour).Truncate(time.Minute).Unix(), 1))
+			Expect(data.Queue).To(Equal("process_batch_worker"))
+			args := data.Args.([]interface{})
+			deferred, err := worker.ParseProcessBatchWorkerMessageArray(args)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deferred.Users).To(HaveLen(1))
+			Expect(deferred.Users[0].UserID).To(Equal(users[0].UserID))
+		})
+
+		It("should defer the users inside the quiet hours once if the batch is processed twice", func() {
+			now := time.Now().UTC()
+			quietHours := &model.QuietHours{
+				Start: now.Add(-time.Hour).Format("15:04"),
+				End:   now.Add(time.Hour).Format("15:04"),
+			}
+			quietHoursJSON, err := json.Marshal(quietHours)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.MarathonDB.Model(&model.Job{}).Set("quiet_hours = ?", string(quietHoursJSON)).Set("total_batches = 1").Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			users[0].Tz = "+0000"
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+
+			dbJob := model.Job{
+				ID: job.ID,
+			}
+			err = w.MarathonDB.Select(&dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.TotalBatches).To(Equal(2))
+
+			res, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(1))
+		})
+
+		It("should not count users whose pushes were not confirmed by kafka", func() {
+			mockKafkaProducer.AckErrors[users[0].Token] = fmt.Errorf("kafka error")
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { processBatchWorker.Process(message) }).Should(Panic())
+
+			dbJob := model.Job{
+				ID: job.ID,
+			}
+			err = w.MarathonDB.Select(&dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedTokens).To(Equal(1))
+
+			failedJobs, err := w.RedisClient.Get(fmt.Sprintf("%s-failedbatches", job.ID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(failedJobs).To(Equal("1"))
+
+			delete(mockKafkaProducer.AckErrors, users[0].Token)
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(3))
+
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[2]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.DeviceToken).To(Equal(users[0].Token))
+		})
+
+		It("should log the deliveries of the pushes confirmed by kafka", func() {
+			mockKafkaProducer.AckErrors[users[0].Token] = fmt.Errorf("kafka error")
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { processBatchWorker.Process(message) }).Should(Panic())
+
+			deliveries := []model.Delivery{}
+			err = w.MarathonDB.Model(&deliveries).Where("job_id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deliveries).To(HaveLen(1))
+			Expect(deliveries[0].UserID).To(Equal(users[1].UserID))
+			Expect(deliveries[0].TokenHash).To(Equal(model.HashToken(users[1].Token)))
+			Expect(deliveries[0].MUID).To(Equal(worker.BuildMessageID(job.ID, users[1].UserID, users[1].Token)))
+			Expect(deliveries[0].Result).To(Equal(model.SentDeliveryResult))
+		})
+
+		It("should log the delivery of a push before producing it", func() {
+			logged := map[string]bool{}
+			mockKafkaProducer.OnSendPush = func(pushMetadata map[string]interface{}) {
+				muid := pushMetadata["muid"].(string)
+				var count int
+				_, err := w.MarathonDB.QueryOne(pg.Scan(&count), "SELECT COUNT(*) FROM deliveries WHERE muid = ?", muid)
+				Expect(err).NotTo(HaveOccurred())
+				logged[muid] = count == 1
+			}
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": []interface{}{job.ID, appName, compressedUsers},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+
+			Expect(logged).To(HaveLen(2))
+			for _, user := range users {
+				Expect(logged[worker.BuildMessageID(job.ID, user.UserID, user.Token)]).To(BeTrue())
+			}
+		})
+
+		It("should send each user the template of their experiment variant and count the pushes of each variant", func() {
+			job.Experiment = &model.Experiment{
+				Variants: []*model.Variant{
+					{Name: "control", TemplateName: template.Name, Weight: 1},
+					{Name: "b", TemplateName: template2.Name, Weight: 1},
+				},
+			}
+			job.TemplateName = fmt.Sprintf("%s,%s", template.Name, template2.Name)
+			err := w.MarathonDB.Update(job)
+			Expect(err).NotTo(HaveOccurred())
+
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+
+			sentByVariant := map[string]int{}
+			for idx, m := range mockKafkaProducer.APNSMessages {
+				var apnsMessage messages.APNSMessage
+				err = json.Unmarshal([]byte(m), &apnsMessage)
+				Expect(err).NotTo(HaveOccurred())
+				variant := job.Experiment.Assign(job.ExperimentID(), users[idx].UserID)
+				Expect(apnsMessage.Metadata["variant"]).To(Equal(variant.Name))
+				Expect(apnsMessage.Metadata["templateName"]).To(Equal(variant.TemplateName))
+				sentByVariant[variant.Name]++
+			}
+
+			counters := []model.ExperimentVariant{}
+			err = w.MarathonDB.Model(&counters).Where("job_id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counters).To(HaveLen(len(sentByVariant)))
+			for _, counter := range counters {
+				Expect(counter.Sent).To(Equal(sentByVariant[counter.Name]))
+			}
+		})
+
+		It("should assign the users of the jobs of a group to the variants by the job group id", func() {
+			groupID := uuid.NewV4()
+			job.JobGroupID = groupID
+			job.Experiment = &model.Experiment{
+				Variants: []*model.Variant{
+					{Name: "control", TemplateName: template.Name, Weight: 1},
+					{Name: "b", TemplateName: template2.Name, Weight: 1},
+				},
+			}
+			job.TemplateName = fmt.Sprintf("%s,%s", template.Name, template2.Name)
+			err := w.MarathonDB.Update(job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(job.ExperimentID()).To(Equal(groupID))
+
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": []interface{}{job.ID, appName, compressedUsers},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+			for idx, m := range mockKafkaProducer.APNSMessages {
+				var apnsMessage messages.APNSMessage
+				err = json.Unmarshal([]byte(m), &apnsMessage)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(apnsMessage.Metadata["variant"]).To(Equal(job.Experiment.Assign(groupID, users[idx].UserID).Name))
+			}
+		})
+
 		It("should not process batch if job is expired", func() {
 			_, err := w.MarathonDB.Model(&model.Job{}).Set("completed_batches = 0").Set("expires_at = ?", time.Now().UnixNano()-50000).Where("id = ?", job.ID).Update()
 			appName := strings.Split(app.BundleID, ".")[2]
@@ -597,6 +1104,33 @@ var _ = Describe("ProcessBatch Worker", func() {
 			}
 		})
 
+		It("should build fcm messages without the format in the pushMetadata if the job gcm format is fcm", func() {
+			fcmJob := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"context":  context,
+				"service":  "gcm",
+				"metadata": map[string]interface{}{messages.GCMFormatKey: messages.GCMFCMFormat},
+			})
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": []interface{}{fcmJob.ID, appName, compressedUsers},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := workers.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+
+			Expect(mockKafkaProducer.GCMMessages).To(HaveLen(len(users)))
+			var fcmMessage messages.FCMMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.GCMMessages[0]), &fcmMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fcmMessage.Message.Token).NotTo(BeEmpty())
+			Expect(fcmMessage.Metadata["jobId"]).To(Equal(fcmJob.ID.String()))
+			Expect(fcmMessage.Metadata).NotTo(HaveKey("messageFormat"))
+		})
+
 		It("should increment failedJobs", func() {
 			// unexistent template
 			w.MarathonDB.Exec("DELETE FROM templates;")
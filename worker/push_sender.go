@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+)
+
+type pendingPush struct {
+	user            User
+	muid            string
+	variant         string
+	templateName    string
+	msg             map[string]interface{}
+	messageMetadata map[string]interface{}
+	pushMetadata    map[string]interface{}
+	delivery        *model.Delivery
+}
+
+// PushSender produces the pushes of a batch to kafka in chunks and marks the message ids of each chunk
+// as sent as soon as kafka confirms them, so a retry of the batch only produces the pushes left behind
+// the deliveries of a chunk are logged before it is produced so its feedbacks always find them
+// PushID is the push counted by the app frequency cap, the job id by default
+type PushSender struct {
+	Workers   *Worker
+	Logger    zap.Logger
+	Job       *model.Job
+	Topic     string
+	BatchID   string
+	PushID    string
+	ChunkSize int
+	Sent      int
+	Errors    int
+	batch     interfaces.PushBatch
+	pending   []*pendingPush
+	skipped   []string
+
+	frequencyCapper *FrequencyCapper
+	rateLimiter     *RateLimiter
+}
+
+// NewPushSender returns a PushSender for the pushes of the batch of the job identified by batchID
+// the pushes are produced within the job rate limit
+func (w *Worker) NewPushSender(l zap.Logger, job *model.Job, topic, batchID string) *PushSender {
+	return &PushSender{
+		Workers:     w,
+		Logger:      l,
+		Job:         job,
+		Topic:       topic,
+		BatchID:     batchID,
+		PushID:      job.ID.String(),
+		ChunkSize:   w.Config.GetInt("workers.sentPushes.chunkSize"),
+		batch:       w.NewPushBatch(),
+		rateLimiter: w.NewRateLimiter(job),
+	}
+}
+
+// SentPushes returns the message ids that were already sent by a previous run of the batch
+func (s *PushSender) SentPushes(muids []string) (map[string]bool, error) {
+	return GetSentPushes(s.Job.ID, s.BatchID, muids, s.Workers.RedisClient)
+}
+
+// Skip marks a push that is not sent, e.g. to a frequency capped user, so retries of the batch skip it too
+func (s *PushSender) Skip(muid string) {
+	s.skipped = append(s.skipped, muid)
+}
+
+// Send queues a push to the user token, the chunk of the push is produced when it is full or flushed
+// and the push counts as sent once kafka confirms it
+func (s *PushSender) Send(user User, muid, variant, templateName string, msg, messageMetadata, pushMetadata map[string]interface{}) {
+	s.pending = append(s.pending, &pendingPush{
+		user:            user,
+		muid:            muid,
+		variant:         variant,
+		templateName:    templateName,
+		msg:             msg,
+		messageMetadata: messageMetadata,
+		pushMetadata:    pushMetadata,
+	})
+	if len(s.pending) >= s.ChunkSize {
+		s.Flush()
+	}
+}
+
+// Flush produces the pushes queued since the last flush, waits for kafka to confirm them and marks them as sent
+func (s *PushSender) Flush() {
+	if len(s.pending) == 0 && len(s.skipped) == 0 {
+		return
+	}
+	// the deliveries are produced now and not when their pushes were queued
+	deliveries := make([]*model.Delivery, len(s.pending))
+	for idx, push := range s.pending {
+		push.delivery = model.NewDelivery(s.Job.ID, push.user.UserID, push.user.Token, push.muid)
+		deliveries[idx] = push.delivery
+	}
+	s.Workers.LogDeliveries(s.Logger, deliveries)
+
+	pushExpiry := s.Job.ExpiresAt / 1000000000 // convert from nanoseconds to seconds
+	format := GetMessageFormat(s.Job)
+	produced := make([]*pendingPush, 0, len(s.pending))
+	failed := []*model.Delivery{}
+	for _, push := range s.pending {
+		var err error
+		if s.rateLimiter != nil {
+			err = s.rateLimiter.Wait()
+		}
+		if err == nil && s.batch != nil {
+			err = s.batch.SendPush(s.Job.Service, format, s.Topic, push.user.Token, push.msg, push.messageMetadata, push.pushMetadata, pushExpiry, push.templateName)
+		} else if err == nil {
+			err = s.Workers.Kafka.SendPush(s.Job.Service, format, s.Topic, push.user.Token, push.msg, push.messageMetadata, push.pushMetadata, pushExpiry, push.templateName)
+		}
+		if err != nil {
+			s.Errors++
+			failed = append(failed, push.delivery)
+			log.E(s.Logger, "Failed to send message to Kafka.", func(cm log.CM) {
+				cm.Write(
+					zap.String("service", s.Job.Service),
+					zap.String("topic", s.Topic),
+					zap.String("muid", push.muid),
+					zap.Object("expiresAt", s.Job.ExpiresAt),
+					zap.Error(err),
+				)
+			})
+			continue
+		}
+		produced = append(produced, push)
+	}
+
+	confirmed := produced
+	if s.batch != nil {
+		confirmed = make([]*pendingPush, 0, len(produced))
+		for idx, err := range s.Workers.WaitPushBatch(s.batch) {
+			if err != nil {
+				s.Errors++
+				failed = append(failed, produced[idx].delivery)
+				log.E(s.Logger, "Kafka failed to confirm message.", func(cm log.CM) {
+					cm.Write(
+						zap.String("service", s.Job.Service),
+						zap.String("topic", s.Topic),
+						zap.String("muid", produced[idx].muid),
+						zap.Error(err),
+					)
+				})
+				continue
+			}
+			confirmed = append(confirmed, produced[idx])
+		}
+		s.batch = s.Workers.NewPushBatch()
+	}
+
+	muids := s.skipped
+	sentByVariant := map[string]int{}
+	for _, push := range confirmed {
+		muids = append(muids, push.muid)
+		if len(push.variant) > 0 {
+			sentByVariant[push.variant]++
+		}
+		if s.frequencyCapper != nil {
+			s.frequencyCapper.Commit(push.user.UserID)
+		}
+	}
+	s.Sent += len(confirmed)
+	s.pending = nil
+	s.skipped = nil
+
+	err := MarkPushesSent(s.Job.ID, s.BatchID, muids, s.Workers.Config.GetDuration("workers.sentPushes.ttl"), s.Workers.RedisClient)
+	if err != nil {
+		log.E(s.Logger, "Failed to mark pushes as sent.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
+	// the retries of the batch log the failed pushes again when they produce them
+	s.Workers.UnlogDeliveries(s.Logger, failed)
+	s.Workers.IncrExperimentSent(s.Logger, s.Job, sentByVariant)
+}
+
+// Close flushes the pushes queued, gives back the rate limit reserved and not used and releases the
+// frequency cap slots of the users that were not sent, it must be deferred so they are released even if the batch fails
+func (s *PushSender) Close() {
+	s.Flush()
+	if s.rateLimiter != nil {
+		if err := s.rateLimiter.Release(); err != nil {
+			log.E(s.Logger, "Failed to release the rate limit.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+		}
+	}
+	if s.frequencyCapper == nil {
+		return
+	}
+	if err := s.frequencyCapper.Release(); err != nil {
+		log.E(s.Logger, "Failed to release the frequency cap slots.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/topfreegames/marathon/model"
+)
+
+// DeferQuietHoursUsers schedules process batches with the users inside the job quiet hours to when
+// the quiet hours end for them and returns the users that can receive the push now, the scheduled
+// batches are added to the job total batches so it completes only after they are processed,
+// they are scheduled once for the batch identified by batchID even if it is retried
+func (w *Worker) DeferQuietHoursUsers(job *model.Job, appName, batchID string, users []User) ([]User, error) {
+	quietHours := job.SendQuietHours()
+	if quietHours == nil {
+		return users, nil
+	}
+	now := time.Now()
+	remaining := make([]User, 0, len(users))
+	deferred := map[int64][]User{}
+	for _, user := range users {
+		offset, err := GetTimeOffsetFromUTCInSeconds(user.Tz, w.Logger)
+		if err != nil {
+			// the local time of users without a valid tz is unknown
+			remaining = append(remaining, user)
+			continue
+		}
+		wait := quietHours.Remaining(now, offset)
+		if wait == 0 {
+			remaining = append(remaining, user)
+			continue
+		}
+		at := now.Add(wait).UnixNano()
+		deferred[at] = append(deferred[at], user)
+	}
+	err := w.ScheduleProcessBatches(job, appName, fmt.Sprintf("quiethours-%s", batchID), deferred)
+	if err != nil {
+		return nil, err
+	}
+	return remaining, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/topfreegames/marathon/model"
+	redis "gopkg.in/redis.v5"
+)
+
+// rateLimitScript reserves up to ARGV[1] pushes of the current second in all the keys, each with
+// its limit in the following ARGV, so a push is only sent when no key exceeds its limit
+const rateLimitScript = `
+local granted = tonumber(ARGV[1])
+for idx, key in ipairs(KEYS) do
+	local available = tonumber(ARGV[idx + 1]) - tonumber(redis.call('GET', key) or '0')
+	if available < granted then
+		granted = available
+	end
+end
+if granted <= 0 then
+	return 0
+end
+for _, key in ipairs(KEYS) do
+	redis.call('INCRBY', key, granted)
+	redis.call('EXPIRE', key, 2)
+end
+return granted
+`
+
+// rateLimitReleaseScript gives back the pushes reserved and not sent in the current second,
+// keys that already expired are not recreated
+const rateLimitReleaseScript = `
+for _, key in ipairs(KEYS) do
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('DECRBY', key, ARGV[1])
+	end
+end
+return 0
+`
+
+// RateLimiter limits the pushes sent per second across all worker processes, the pushes of a job count
+// for the app rate limit and for the job one, so a job never exceeds the limit of its app
+// it reserves chunks of the current second quota in redis to avoid a round trip per push
+type RateLimiter struct {
+	RedisClient *redis.Client
+	Keys        []string
+	Limits      []int
+	ChunkSize   int
+	tokens      int
+	window      int64
+}
+
+// NewRateLimiter returns the rate limiter of the job or nil if the job is not rate limited
+func (w *Worker) NewRateLimiter(job *model.Job) *RateLimiter {
+	limit := job.SendRateLimit()
+	if limit <= 0 {
+		return nil
+	}
+	keys := []string{}
+	limits := []int{}
+	if job.App.RateLimit > 0 {
+		keys = append(keys, fmt.Sprintf("%s-ratelimit", job.AppID.String()))
+		limits = append(limits, job.App.RateLimit)
+	}
+	if job.RateLimit > 0 {
+		keys = append(keys, fmt.Sprintf("%s-ratelimit", job.ID.String()))
+		limits = append(limits, job.RateLimit)
+	}
+	chunkSize := w.Config.GetInt("workers.rateLimit.chunkSize")
+	if chunkSize <= 0 || chunkSize > limit {
+		chunkSize = limit
+	}
+	return &RateLimiter{
+		RedisClient: w.RedisClient,
+		Keys:        keys,
+		Limits:      limits,
+		ChunkSize:   chunkSize,
+	}
+}
+
+// Wait blocks until a push can be sent without exceeding the rate limit
+func (r *RateLimiter) Wait() error {
+	for {
+		now := time.Now()
+		if now.Unix() != r.window {
+			// the pushes reserved for a past second can not be used by anyone anymore
+			r.window = now.Unix()
+			r.tokens = 0
+		}
+		if r.tokens > 0 {
+			r.tokens--
+			return nil
+		}
+		granted, err := r.acquire(r.window)
+		if err != nil {
+			return err
+		}
+		if granted == 0 {
+			time.Sleep(time.Unix(r.window+1, 0).Sub(now))
+			continue
+		}
+		r.tokens = granted
+	}
+}
+
+// Release gives back the pushes reserved for the current second that were not sent,
+// it must be called when the batch stops sending so other batches can use them
+func (r *RateLimiter) Release() error {
+	if r.tokens <= 0 || r.window != time.Now().Unix() {
+		r.tokens = 0
+		return nil
+	}
+	tokens := r.tokens
+	r.tokens = 0
+	return r.RedisClient.Eval(rateLimitReleaseScript, r.windowKeys(r.window), tokens).Err()
+}
+
+func (r *RateLimiter) windowKeys(window int64) []string {
+	keys := make([]string, len(r.Keys))
+	for idx, key := range r.Keys {
+		keys[idx] = fmt.Sprintf("%s-%d", key, window)
+	}
+	return keys
+}
+
+func (r *RateLimiter) acquire(window int64) (int, error) {
+	args := []interface{}{r.ChunkSize}
+	for _, limit := range r.Limits {
+		args = append(args, limit)
+	}
+	granted, err := r.RedisClient.Eval(rateLimitScript, r.windowKeys(window), args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(granted.(int64)), nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Rate Limiter", func() {
+	var job *model.Job
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		w.RedisClient.FlushAll()
+		job = &model.Job{
+			ID:    uuid.NewV4(),
+			AppID: uuid.NewV4(),
+			App:   model.App{},
+		}
+	})
+
+	Describe("Creating a rate limiter", func() {
+		It("should return nil if neither the job nor the app are rate limited", func() {
+			Expect(w.NewRateLimiter(job)).To(BeNil())
+		})
+
+		It("should use the app rate limit", func() {
+			job.App.RateLimit = 1000
+			rateLimiter := w.NewRateLimiter(job)
+			Expect(rateLimiter).NotTo(BeNil())
+			Expect(rateLimiter.Limits).To(Equal([]int{1000}))
+			Expect(rateLimiter.ChunkSize).To(Equal(100))
+			Expect(rateLimiter.Keys).To(Equal([]string{fmt.Sprintf("%s-ratelimit", job.AppID.String())}))
+		})
+
+		It("should limit the job by the job and the app rate limits", func() {
+			job.App.RateLimit = 1000
+			job.RateLimit = 10
+			rateLimiter := w.NewRateLimiter(job)
+			Expect(rateLimiter).NotTo(BeNil())
+			Expect(rateLimiter.Limits).To(Equal([]int{1000, 10}))
+			Expect(rateLimiter.ChunkSize).To(Equal(10))
+			Expect(rateLimiter.Keys).To(Equal([]string{
+				fmt.Sprintf("%s-ratelimit", job.AppID.String()),
+				fmt.Sprintf("%s-ratelimit", job.ID.String()),
+			}))
+		})
+
+		It("should only use the job rate limit if the app is not rate limited", func() {
+			job.RateLimit = 10
+			rateLimiter := w.NewRateLimiter(job)
+			Expect(rateLimiter).NotTo(BeNil())
+			Expect(rateLimiter.Limits).To(Equal([]int{10}))
+			Expect(rateLimiter.Keys).To(Equal([]string{fmt.Sprintf("%s-ratelimit", job.ID.String())}))
+		})
+	})
+
+	Describe("Waiting", func() {
+		It("should not send more than the limit per second across rate limiters", func() {
+			job.App.RateLimit = 4
+			rateLimiter1 := w.NewRateLimiter(job)
+			rateLimiter2 := w.NewRateLimiter(job)
+
+			// align with the beginning of a second so all pushes fall in the same window
+			time.Sleep(time.Unix(time.Now().Unix()+1, 0).Sub(time.Now()))
+			start := time.Now()
+			for i := 0; i < 4; i++ {
+				Expect(rateLimiter1.Wait()).To(Succeed())
+			}
+			Expect(time.Now().Unix()).To(Equal(start.Unix()))
+
+			Expect(rateLimiter2.Wait()).To(Succeed())
+			Expect(time.Now().Unix()).To(BeNumerically(">", start.Unix()))
+		})
+
+		It("should not let a job with a higher rate limit exceed the app rate limit", func() {
+			job.App.RateLimit = 2
+			otherJob := *job
+			otherJob.ID = uuid.NewV4()
+			otherJob.RateLimit = 10
+			rateLimiter1 := w.NewRateLimiter(job)
+			rateLimiter2 := w.NewRateLimiter(&otherJob)
+			rateLimiter1.ChunkSize = 1
+
+			time.Sleep(time.Unix(time.Now().Unix()+1, 0).Sub(time.Now()))
+			start := time.Now()
+			Expect(rateLimiter1.Wait()).To(Succeed())
+			Expect(rateLimiter2.Wait()).To(Succeed())
+			Expect(time.Now().Unix()).To(Equal(start.Unix()))
+
+			Expect(rateLimiter2.Wait()).To(Succeed())
+			Expect(time.Now().Unix()).To(BeNumerically(">", start.Unix()))
+		})
+
+		It("should give back the pushes reserved and not sent", func() {
+			job.App.RateLimit = 4
+			rateLimiter1 := w.NewRateLimiter(job)
+			rateLimiter2 := w.NewRateLimiter(job)
+
+			time.Sleep(time.Unix(time.Now().Unix()+1, 0).Sub(time.Now()))
+			start := time.Now()
+			Expect(rateLimiter1.Wait()).To(Succeed())
+			Expect(rateLimiter1.Release()).To(Succeed())
+			for i := 0; i < 3; i++ {
+				Expect(rateLimiter2.Wait()).To(Succeed())
+			}
+			Expect(time.Now().Unix()).To(Equal(start.Unix()))
+
+			used, err := w.RedisClient.Get(fmt.Sprintf("%s-ratelimit-%d", job.AppID.String(), start.Unix())).Int64()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(used).To(BeEquivalentTo(4))
+		})
+	})
+})
@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
+)
+
+const nameRecurrenceWorker = "recurrence_worker"
+
+// RecurrenceMsg is the occurrence of a recurrence to create a job for
+// messages of occurrences other than the next run of the recurrence are outdated and ignored
+type RecurrenceMsg struct {
+	RecurrenceID uuid.UUID
+	RunAt        int64
+}
+
+// RecurrenceWorker creates the job of an occurrence of a recurrence and schedules the next occurrence
+type RecurrenceWorker struct {
+	Workers *Worker
+	Logger  zap.Logger
+}
+
+// NewRecurrenceWorker gets a new RecurrenceWorker
+func NewRecurrenceWorker(workers *Worker) *RecurrenceWorker {
+	b := &RecurrenceWorker{
+		Logger:  workers.Logger.With(zap.String("worker", "RecurrenceWorker")),
+		Workers: workers,
+	}
+	b.Logger.Debug("Configured RecurrenceWorker successfully.")
+	return b
+}
+
+// Process processes the messages sent to recurrence worker queue
+func (b *RecurrenceWorker) Process(message *workers.Msg) {
+	msg := &RecurrenceMsg{}
+	err := json.Unmarshal([]byte(message.Args().ToJson()), msg)
+	checkErr(b.Logger, err)
+
+	l := b.Logger.With(
+		zap.String("recurrenceID", msg.RecurrenceID.String()),
+		zap.Int64("runAt", msg.RunAt),
+		zap.String("worker", nameRecurrenceWorker),
+	)
+	log.I(l, "starting")
+
+	recurrence := &model.Recurrence{}
+	err = b.Workers.MarathonDB.Model(recurrence).Where("id = ?", msg.RecurrenceID).Select()
+	if err == pg.ErrNoRows {
+		log.I(l, "deleted recurrence")
+		return
+	}
+	checkErr(l, err)
+	job := &model.Job{ID: recurrence.JobID(msg.RunAt)}
+	if recurrence.LastRunAt == msg.RunAt {
+		// a previous run claimed the occurrence and created its job but may have failed to start it
+		err = b.Workers.MarathonDB.Select(job)
+		checkErr(l, err)
+	} else {
+		if recurrence.Status != model.ActiveRecurrenceStatus || recurrence.NextRunAt != msg.RunAt {
+			log.I(l, "outdated occurrence", func(cm log.CM) {
+				cm.Write(zap.String("status", recurrence.Status), zap.Int64("nextRunAt", recurrence.NextRunAt))
+			})
+			return
+		}
+		job, err = b.claimOccurrence(recurrence, msg.RunAt)
+		checkErr(l, err)
+		if job == nil {
+			log.I(l, "occurrence already processed")
+			return
+		}
+	}
+
+	if recurrence.Status == model.ActiveRecurrenceStatus && recurrence.NextRunAt > 0 {
+		err = b.Workers.runOnce(fmt.Sprintf("%s-scheduled-%d", recurrence.ID.String(), recurrence.NextRunAt), func() error {
+			_, err := b.Workers.ScheduleRecurrenceJob(recurrence, recurrence.NextRunAt)
+			return err
+		})
+		checkErr(l, err)
+	}
+	err = b.Workers.runOnce(fmt.Sprintf("%s-started", job.ID.String()), func() error {
+		return b.Workers.StartJob(job)
+	})
+	if err != nil {
+		job.TagError(b.Workers.MarathonDB, nameRecurrenceWorker, err.Error())
+		checkErr(l, err)
+	}
+	log.I(l, "created recurrence job", func(cm log.CM) {
+		cm.Write(zap.String("jobID", job.ID.String()), zap.Int64("nextRunAt", recurrence.NextRunAt))
+	})
+	job.TagSuccess(b.Workers.MarathonDB, nameRecurrenceWorker, "created job")
+}
+
+// claimOccurrence moves the recurrence to its next occurrence and creates the job of the occurrence in a
+// single transaction, so the occurrence is never claimed without its job, it returns nil if the
+// occurrence was claimed by another run
+func (b *RecurrenceWorker) claimOccurrence(recurrence *model.Recurrence, runAt int64) (*model.Job, error) {
+	// the occurrences missed while the workers were down are skipped
+	now := time.Now().UnixNano()
+	after := runAt
+	if after < now {
+		after = now
+	}
+	next, err := recurrence.NextRunAfter(after)
+	if err != nil {
+		return nil, err
+	}
+	status := model.ActiveRecurrenceStatus
+	if next == 0 {
+		status = model.FinishedRecurrenceStatus
+	}
+
+	tx, err := b.Workers.MarathonDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Model(recurrence).
+		Set("next_run_at = ?", next).
+		Set("last_run_at = ?", runAt).
+		Set("status = ?", status).
+		Set("updated_at = ?", now).
+		Where("id = ? AND status = ? AND next_run_at = ?", recurrence.ID, model.ActiveRecurrenceStatus, runAt).
+		Update()
+	if err != nil || res.RowsAffected() == 0 {
+		tx.Rollback()
+		return nil, err
+	}
+	job := recurrence.NewJob(runAt)
+	if err = tx.Insert(job); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	recurrence.NextRunAt = next
+	recurrence.LastRunAt = runAt
+	recurrence.Status = status
+	return job, nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"encoding/json"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Recurrence Worker", func() {
+	var recurrenceWorker *worker.RecurrenceWorker
+	var app *model.App
+	var template *model.Template
+	var runAt int64
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	getMessage := func(recurrence *model.Recurrence, at int64) *workers.Msg {
+		msgB, err := json.Marshal(map[string]interface{}{
+			"args": worker.RecurrenceMsg{
+				RecurrenceID: recurrence.ID,
+				RunAt:        at,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		message, err := workers.NewMsg(string(msgB))
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	getRecurrenceJobs := func(recurrence *model.Recurrence) []model.Job {
+		jobs := []model.Job{}
+		err := w.MarathonDB.Model(&jobs).Where("job_group_id = ?", recurrence.JobGroupID).Select()
+		Expect(err).NotTo(HaveOccurred())
+		return jobs
+	}
+
+	BeforeEach(func() {
+		recurrenceWorker = worker.NewRecurrenceWorker(w)
+		w.RedisClient.FlushAll()
+		w.MarathonDB.Exec("DELETE FROM recurrences;")
+		app = CreateTestApp(w.MarathonDB)
+		template = CreateTestTemplate(w.MarathonDB, app.ID)
+		runAt = time.Now().Add(-time.Second).UnixNano()
+	})
+
+	Describe("Process", func() {
+		It("should create the job of the occurrence and schedule the next occurrence", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+				"csvPath":   "test/jobs/obj1.csv",
+			})
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			jobs := getRecurrenceJobs(recurrence)
+			Expect(jobs).To(HaveLen(1))
+			Expect(jobs[0].AppID).To(Equal(app.ID))
+			Expect(jobs[0].TemplateName).To(Equal(template.Name))
+			Expect(jobs[0].CSVPath).To(Equal("test/jobs/obj1.csv"))
+			Expect(jobs[0].Context).To(Equal(recurrence.Job.Context))
+			Expect(jobs[0].StartsAt).To(Equal(runAt))
+
+			dbRecurrence := &model.Recurrence{ID: recurrence.ID}
+			err := w.MarathonDB.Select(dbRecurrence)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbRecurrence.Status).To(Equal(model.ActiveRecurrenceStatus))
+			Expect(dbRecurrence.LastRunAt).To(Equal(runAt))
+			next, err := recurrence.NextRunAfter(time.Now().UnixNano())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbRecurrence.NextRunAt).To(Equal(next))
+
+			scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(HaveLen(2))
+			queues := []string{}
+			for _, data := range scheduled {
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(data), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				queues = append(queues, msg["queue"].(string))
+			}
+			Expect(queues).To(ConsistOf("recurrence_worker", "csv_split_worker"))
+		})
+
+		It("should finish the recurrence if there are no occurrences before it ends", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+				"csvPath":   "test/jobs/obj1.csv",
+				"endsAt":    time.Now().Add(time.Minute).UnixNano(),
+				"cron":      "0 0 1 1 *",
+			})
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(1))
+			dbRecurrence := &model.Recurrence{ID: recurrence.ID}
+			err := w.MarathonDB.Select(dbRecurrence)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbRecurrence.Status).To(Equal(model.FinishedRecurrenceStatus))
+			Expect(dbRecurrence.NextRunAt).To(BeZero())
+
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(1))
+		})
+
+		It("should not create a job if the recurrence is paused", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+				"csvPath":   "test/jobs/obj1.csv",
+				"status":    model.PausedRecurrenceStatus,
+			})
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(0))
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(0))
+		})
+
+		It("should not create a job if the occurrence is not the next run of the recurrence", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"csvPath": "test/jobs/obj1.csv",
+			})
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(0))
+		})
+
+		It("should create the job of an occurrence only once", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+				"csvPath":   "test/jobs/obj1.csv",
+			})
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(1))
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeEquivalentTo(2))
+		})
+
+		It("should start the job of an occurrence claimed by a run that failed before starting it", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+				"csvPath":   "test/jobs/obj1.csv",
+			})
+			next, err := recurrence.NextRunAfter(time.Now().UnixNano())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.MarathonDB.Model(recurrence).Set("last_run_at = ?", runAt).Set("next_run_at = ?", next).Where("id = ?", recurrence.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			err = w.MarathonDB.Insert(recurrence.NewJob(runAt))
+			Expect(err).NotTo(HaveOccurred())
+
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+			recurrenceWorker.Process(getMessage(recurrence, runAt))
+
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(1))
+			scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			queues := []string{}
+			for _, data := range scheduled {
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(data), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				queues = append(queues, msg["queue"].(string))
+			}
+			Expect(queues).To(ConsistOf("recurrence_worker", "csv_split_worker"))
+		})
+
+		It("should do nothing if the recurrence was deleted", func() {
+			recurrence := CreateTestRecurrence(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"nextRunAt": runAt,
+			})
+			_, err := w.MarathonDB.Exec("DELETE FROM recurrences WHERE id = ?", recurrence.ID)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { recurrenceWorker.Process(getMessage(recurrence, runAt)) }).NotTo(Panic())
+			Expect(getRecurrenceJobs(recurrence)).To(HaveLen(0))
+		})
+	})
+})
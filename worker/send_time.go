@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+)
+
+// GetUsersOpenHours returns the hour of the day in UTC in which each user most often opened the
+// pushes of the app, users that never opened a push are not returned
+func GetUsersOpenHours(db interfaces.DB, appID uuid.UUID, userIDs []string) (map[string]int, error) {
+	openHours := map[string]int{}
+	if len(userIDs) == 0 {
+		return openHours, nil
+	}
+	var userOpenHours []model.UserOpenHour
+	_, err := db.Query(
+		&userOpenHours,
+		"SELECT DISTINCT ON (user_id) user_id, hour FROM user_open_hours WHERE app_id = ? AND user_id IN (?) ORDER BY user_id, opens DESC, updated_at DESC",
+		appID,
+		pg.In(userIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, userOpenHour := range userOpenHours {
+		openHours[userOpenHour.UserID] = userOpenHour.Hour
+	}
+	return openHours, nil
+}
+
+// ScheduleOptimalSendTimeUsers schedules process batches with the users of jobs with the optimal send
+// time strategy to the next time of the hour they most often opened pushes within the send time window,
+// it returns the users that must receive the push now, those without opens or whose hour is the
+// current one, is outside of the window or is after the job expiration, the users of the batch
+// identified by batchID are split and scheduled once even if it is retried
+func (w *Worker) ScheduleOptimalSendTimeUsers(job *model.Job, batchID string, users []User) ([]User, error) {
+	if job.SendTimeStrategy != model.OptimalSendTimeStrategy {
+		return users, nil
+	}
+	userIDs := make([]string, 0, len(users))
+	seen := map[string]bool{}
+	for _, user := range users {
+		if !seen[user.UserID] {
+			seen[user.UserID] = true
+			userIDs = append(userIDs, user.UserID)
+		}
+	}
+	openHours, err := GetUsersOpenHours(w.MarathonDB, job.AppID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the split is made from the time of the first run of the batch so a retry in another hour sends
+	// and schedules the same users
+	startedAtKey := fmt.Sprintf("%s-sendtime-%s-startedat", job.ID.String(), batchID)
+	ttl := w.Config.GetDuration("workers.sentPushes.ttl")
+	_, err = w.RedisClient.SetNX(startedAtKey, time.Now().UnixNano(), ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	startedAt, err := w.RedisClient.Get(startedAtKey).Int64()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Unix(0, startedAt).UTC()
+	window := w.Config.GetDuration("workers.sendTimeOptimization.window")
+	remaining := make([]User, 0, len(users))
+	scheduled := map[int64][]User{}
+	for _, user := range users {
+		hour, ok := openHours[user.UserID]
+		if !ok || hour == now.Hour() {
+			remaining = append(remaining, user)
+			continue
+		}
+		sendTime := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+		if sendTime.Before(now) {
+			sendTime = sendTime.Add(24 * time.Hour)
+		}
+		if sendTime.Sub(now) > window || (job.ExpiresAt > 0 && sendTime.UnixNano() >= job.ExpiresAt) {
+			remaining = append(remaining, user)
+			continue
+		}
+		scheduled[sendTime.UnixNano()] = append(scheduled[sendTime.UnixNano()], user)
+	}
+	err = w.ScheduleProcessBatches(job, job.App.Name, fmt.Sprintf("sendtime-%s", batchID), scheduled)
+	if err != nil {
+		return nil, err
+	}
+	return remaining, nil
+}
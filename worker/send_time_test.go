@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Send Time", func() {
+	var app *model.App
+	var job *model.Job
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		w.RedisClient.FlushAll()
+		app = CreateTestApp(w.MarathonDB)
+		template := CreateTestTemplate(w.MarathonDB, app.ID)
+		job = CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+			"sendTimeStrategy": model.OptimalSendTimeStrategy,
+		})
+		job.App = *app
+	})
+
+	Describe("Scheduling the users to their optimal send time", func() {
+		It("should split the users of a retried batch as in its first run", func() {
+			now := time.Now().UTC()
+			firstRun := now.Add(-time.Hour)
+			for _, userOpenHour := range []*model.UserOpenHour{
+				{AppID: app.ID, UserID: "1", Hour: now.Hour(), Opens: 1},
+				{AppID: app.ID, UserID: "2", Hour: firstRun.Hour(), Opens: 1},
+			} {
+				Expect(w.MarathonDB.Insert(userOpenHour)).To(Succeed())
+			}
+			users := []worker.User{{UserID: "1", Token: "1"}, {UserID: "2", Token: "2"}}
+			key := fmt.Sprintf("%s-sendtime-batch-startedat", job.ID.String())
+			Expect(w.RedisClient.Set(key, firstRun.UnixNano(), time.Hour).Err()).To(Succeed())
+
+			remaining, err := w.ScheduleOptimalSendTimeUsers(job, "batch", users)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(Equal([]worker.User{{UserID: "2", Token: "2"}}))
+
+			remaining, err = w.ScheduleOptimalSendTimeUsers(job, "batch", users)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(Equal([]worker.User{{UserID: "2", Token: "2"}}))
+			scheduled, err := w.RedisClient.ZRange("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
+	"github.com/topfreegames/marathon/model"
+	pg "gopkg.in/pg.v5"
+	redis "gopkg.in/redis.v5"
+)
+
+// GetSuppressedUserIDs returns which of the user ids are in the app or in the global suppression list
+func GetSuppressedUserIDs(db interfaces.DB, appID uuid.UUID, userIDs []string) (map[string]bool, error) {
+	suppressed := map[string]bool{}
+	if len(userIDs) == 0 {
+		return suppressed, nil
+	}
+	var ids []string
+	_, err := db.Query(&ids, "SELECT DISTINCT user_id FROM suppressions WHERE (app_id = ? OR app_id IS NULL) AND user_id IN (?)", appID, pg.In(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		suppressed[id] = true
+	}
+	return suppressed, nil
+}
+
+// SuppressUsers returns which of the user ids are suppressed and counts them in the job suppressed users,
+// each suppressed user is counted once whatever the number of its tokens, of its ids in the list or of
+// the batches and retries in which it shows up
+func (w *Worker) SuppressUsers(job *model.Job, userIDs []string) (map[string]bool, error) {
+	suppressed, err := GetSuppressedUserIDs(w.MarathonDB, job.AppID, userIDs)
+	if err != nil || len(suppressed) == 0 {
+		return suppressed, err
+	}
+	key := fmt.Sprintf("%s-suppressed", job.ID.String())
+	ids := make([]string, 0, len(suppressed))
+	for id := range suppressed {
+		ids = append(ids, id)
+	}
+	cmds, err := w.RedisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, id := range ids {
+			pipe.SAdd(key, id)
+		}
+		pipe.Expire(key, 7*24*time.Hour)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	added := []interface{}{}
+	for idx, id := range ids {
+		if cmds[idx].(*redis.IntCmd).Val() == 1 {
+			added = append(added, id)
+		}
+	}
+	if len(added) == 0 {
+		return suppressed, nil
+	}
+	_, err = w.MarathonDB.Model(job).Set("suppressed_users = suppressed_users + ?", len(added)).Where("id = ?", job.ID).Update()
+	if err != nil {
+		w.RedisClient.SRem(key, added...)
+		return nil, err
+	}
+	job.SuppressedUsers += len(added)
+	return suppressed, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Suppression", func() {
+	var job *model.Job
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		app := CreateTestApp(w.MarathonDB)
+		template := CreateTestTemplate(w.MarathonDB, app.ID)
+		job = CreateTestJob(w.MarathonDB, app.ID, template.Name)
+	})
+
+	Describe("Suppressing users", func() {
+		It("should count each suppressed user once in the job", func() {
+			CreateTestSuppression(w.MarathonDB, job.AppID, map[string]interface{}{"userId": "user-1"})
+			CreateTestSuppression(w.MarathonDB, job.AppID, map[string]interface{}{"userId": "user-2"})
+
+			suppressed, err := w.SuppressUsers(job, []string{"user-1", "user-1", "user-2", "user-3"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suppressed).To(Equal(map[string]bool{"user-1": true, "user-2": true}))
+			Expect(job.SuppressedUsers).To(Equal(2))
+
+			dbJob := &model.Job{ID: job.ID}
+			err = w.MarathonDB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.SuppressedUsers).To(Equal(2))
+		})
+
+		It("should not count again the users of a retried or of another batch", func() {
+			CreateTestSuppression(w.MarathonDB, job.AppID, map[string]interface{}{"userId": "user-1"})
+			CreateTestSuppression(w.MarathonDB, job.AppID, map[string]interface{}{"userId": "user-2"})
+
+			_, err := w.SuppressUsers(job, []string{"user-1", "user-3"})
+			Expect(err).NotTo(HaveOccurred())
+			suppressed, err := w.SuppressUsers(job, []string{"user-1", "user-3"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suppressed).To(Equal(map[string]bool{"user-1": true}))
+			suppressed, err = w.SuppressUsers(job, []string{"user-1", "user-2"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suppressed).To(Equal(map[string]bool{"user-1": true, "user-2": true}))
+			Expect(job.SuppressedUsers).To(Equal(2))
+
+			dbJob := &model.Job{ID: job.ID}
+			err = w.MarathonDB.Select(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.SuppressedUsers).To(Equal(2))
+		})
+
+		It("should not count users that are not suppressed", func() {
+			suppressed, err := w.SuppressUsers(job, []string{"user-1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suppressed).To(BeEmpty())
+			Expect(job.SuppressedUsers).To(Equal(0))
+		})
+	})
+})
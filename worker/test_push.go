@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+)
+
+// TestSendJob returns a job, which is never saved, with the test send options
+// so it can be used with the helpers that build the pushes of a job
+func TestSendJob(testSend *model.TestSend, app *model.App) *model.Job {
+	return &model.Job{
+		AppID:    app.ID,
+		App:      *app,
+		Service:  testSend.Service,
+		Context:  testSend.Context,
+		Metadata: testSend.Metadata,
+	}
+}
+
+// SendTestPush renders the template and sends it to the user tagged as a test push
+func (w *Worker) SendTestPush(testSend *model.TestSend, app *model.App, template model.Template, user User) error {
+	job := TestSendJob(testSend, app)
+	msgStr, err := BuildMessageFromTemplate(template, testSend.Context)
+	if err != nil {
+		return err
+	}
+	var msg map[string]interface{}
+	err = json.Unmarshal([]byte(msgStr), &msg)
+	if err != nil {
+		return err
+	}
+
+	pushMetadata := map[string]interface{}{
+		"userId":       user.UserID,
+		"pushTime":     time.Now().Unix(),
+		"templateName": template.Name,
+		"testId":       testSend.ID.String(),
+		"pushType":     "test",
+		"muid":         uuid.NewV4().String(),
+	}
+
+	topic := BuildTopicName(app.Name, testSend.Service, w.Config.GetString("workers.topicTemplate"))
+	return w.Kafka.SendPush(testSend.Service, GetMessageFormat(job), topic, user.Token, msg, BuildMessageMetadata(job, template), pushMetadata, 0, template.Name)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/uber-go/zap"
+	pg "gopkg.in/pg.v5"
+)
+
+const nameTriggerWorker = "trigger_worker"
+
+// triggerEventNamespace is the namespace of the ids of the trigger events
+var triggerEventNamespace = uuid.NewV5(uuid.NamespaceURL, "marathon/trigger-events")
+
+// TriggerEvent is an event of an user of an app read from the triggers topic
+// the producers should send an id unique to each event so that kafka redeliveries of the event are not sent twice
+type TriggerEvent struct {
+	ID     string                 `json:"eventId"`
+	App    string                 `json:"app"`
+	UserID string                 `json:"userId"`
+	Event  string                 `json:"event"`
+	Props  map[string]interface{} `json:"props"`
+}
+
+// BuildTriggerEventID returns the id of the event read from the kafka message msg, a redelivery of the
+// message gets the same id, it is derived from the event id or from the message if the event has no id
+func BuildTriggerEventID(event *TriggerEvent, msg []byte) uuid.UUID {
+	if len(event.ID) > 0 {
+		return uuid.NewV5(triggerEventNamespace, fmt.Sprintf("%s:%s", event.App, event.ID))
+	}
+	return uuid.NewV5(triggerEventNamespace, string(msg))
+}
+
+// TriggerMsg is the push of a trigger to the user of an event
+// the event id makes the message ids of the pushes of each event unique and keys the pushes already sent
+type TriggerMsg struct {
+	TriggerID uuid.UUID
+	EventID   uuid.UUID
+	UserID    string
+	Props     map[string]interface{}
+}
+
+// TriggerWorker sends the push of a trigger to the tokens of the user of an event
+type TriggerWorker struct {
+	Workers *Worker
+	Logger  zap.Logger
+}
+
+// NewTriggerWorker gets a new TriggerWorker
+func NewTriggerWorker(workers *Worker) *TriggerWorker {
+	b := &TriggerWorker{
+		Logger:  workers.Logger.With(zap.String("worker", "TriggerWorker")),
+		Workers: workers,
+	}
+	b.Logger.Debug("Configured TriggerWorker successfully.")
+	return b
+}
+
+// Process processes the messages sent to trigger worker queue
+func (b *TriggerWorker) Process(message *workers.Msg) {
+	msg := &TriggerMsg{}
+	err := json.Unmarshal([]byte(message.Args().ToJson()), msg)
+	checkErr(b.Logger, err)
+
+	l := b.Logger.With(
+		zap.String("triggerID", msg.TriggerID.String()),
+		zap.String("eventID", msg.EventID.String()),
+		zap.String("worker", nameTriggerWorker),
+	)
+	log.D(l, "starting")
+
+	trigger := &model.Trigger{}
+	err = b.Workers.MarathonDB.Model(trigger).Where("id = ?", msg.TriggerID).Select()
+	if err == pg.ErrNoRows {
+		log.I(l, "deleted trigger")
+		return
+	}
+	checkErr(l, err)
+	job, err := b.Workers.GetJob(trigger.JobID)
+	checkErr(l, err)
+	if job.Status != "" {
+		log.I(l, "trigger job is not running", func(cm log.CM) {
+			cm.Write(zap.String("status", job.Status))
+		})
+		return
+	}
+
+	suppressed, err := b.Workers.SuppressUsers(job, []string{msg.UserID})
+	checkErr(l, err)
+	if suppressed[msg.UserID] {
+		return
+	}
+	heldOut, err := b.Workers.HoldOutUsers(job, []string{msg.UserID})
+	checkErr(l, err)
+	if heldOut[msg.UserID] {
+		log.D(l, "user held out of the trigger job")
+		return
+	}
+	users, err := GetUsersByIDs(b.Workers.PushDB, job, []string{msg.UserID})
+	checkErr(l, err)
+	if len(users) == 0 {
+		log.D(l, "user has no tokens")
+		return
+	}
+
+	if wait := b.quietHoursWait(job, users); wait > 0 {
+		// the event is processed again when the quiet hours of the user end
+		at := time.Now().Add(wait).UnixNano()
+		err = b.Workers.runOnce(fmt.Sprintf("%s-quiethours-%s", job.ID.String(), msg.EventID.String()), func() error {
+			_, err := b.Workers.ScheduleTriggerJob(msg, at)
+			return err
+		})
+		checkErr(l, err)
+		log.D(l, "trigger push deferred by the quiet hours", func(cm log.CM) {
+			cm.Write(zap.Int64("at", at))
+		})
+		return
+	}
+
+	templatesByNameAndLocale, err := job.GetJobTemplatesByNameAndLocale(b.Workers.MarathonDB)
+	checkErr(l, err)
+	job.Context = trigger.BuildContext(msg.Props)
+	topic := BuildTopicName(job.App.Name, job.Service, b.Workers.Config.GetString("workers.topicTemplate"))
+	muids := make([]string, len(users))
+	for idx, user := range users {
+		muids[idx] = BuildMessageID(msg.EventID, user.UserID, user.Token)
+	}
+	sender := b.Workers.NewPushSender(l, job, topic, msg.EventID.String())
+	// each event counts as a push for the frequency cap
+	sender.PushID = fmt.Sprintf("%s-%s", job.ID.String(), msg.EventID.String())
+	defer sender.Close()
+	sentPushes, err := sender.SentPushes(muids)
+	checkErr(l, err)
+	cappedUsers, err := sender.FrequencyCappedUsers(users, muids, sentPushes)
+	checkErr(l, err)
+
+	for idx, user := range users {
+		muid := muids[idx]
+		if sentPushes[muid] {
+			continue
+		}
+		if cappedUsers[user.UserID] {
+			// capped users are marked as sent so retries of the event do not count them again
+			sender.Skip(muid)
+			continue
+		}
+		templateNames := strings.Split(job.TemplateName, ",")
+		templateName := RandomElementFromSlice(templateNames)
+		template, err := GetTemplateForLocale(templatesByNameAndLocale[templateName], user.Locale)
+		checkErr(l, err)
+		msgStr, err := BuildMessageFromTemplate(template, job.Context)
+		checkErr(l, err)
+		var push map[string]interface{}
+		err = json.Unmarshal([]byte(msgStr), &push)
+		checkErr(l, err)
+
+		pushMetadata := map[string]interface{}{
+			"userId":       user.UserID,
+			"pushTime":     time.Now().Unix(),
+			"templateName": templateName,
+			"jobId":        job.ID.String(),
+			"triggerId":    trigger.ID.String(),
+			"pushType":     "trigger",
+			"muid":         muid,
+		}
+		sender.Send(user, muid, "", templateName, push, BuildMessageMetadata(job, template), pushMetadata)
+	}
+	sender.Flush()
+
+	if sender.Sent > 0 {
+		// the user and its tokens are counted by the first run that sends a push of the event,
+		// the retries and redeliveries only count the pushes they send
+		query := b.Workers.MarathonDB.Model(job).Set("completed_tokens = completed_tokens + ?", sender.Sent)
+		if len(sentPushes) == 0 {
+			query = query.
+				Set("total_users = total_users + 1").
+				Set("total_tokens = COALESCE(total_tokens, 0) + ?", len(users))
+		}
+		_, err = query.Where("id = ?", job.ID).Update()
+		checkErr(l, err)
+	}
+	if sender.Errors > 0 {
+		// the retry only sends the pushes kafka did not confirm
+		checkErr(l, fmt.Errorf("kafka failed to confirm %d trigger pushes", sender.Errors))
+	}
+	log.D(l, "sent trigger pushes", func(cm log.CM) {
+		cm.Write(zap.Int("tokens", sender.Sent))
+	})
+}
+
+// quietHoursWait returns how long the quiet hours of the job last for the user of the tokens,
+// the tokens with no valid tz do not defer the push
+func (b *TriggerWorker) quietHoursWait(job *model.Job, users []User) time.Duration {
+	quietHours := job.SendQuietHours()
+	if quietHours == nil {
+		return 0
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, user := range users {
+		offset, err := GetTimeOffsetFromUTCInSeconds(user.Tz, b.Logger)
+		if err != nil {
+			continue
+		}
+		if remaining := quietHours.Remaining(now, offset); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
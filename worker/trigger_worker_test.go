@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2019 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	workers "github.com/jrallison/go-workers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/messages"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Trigger Worker", func() {
+	var triggerWorker *worker.TriggerWorker
+	var app *model.App
+	var template *model.Template
+	var trigger *model.Trigger
+	var mockKafkaProducer *FakeKafkaProducer
+	userID := "57be9009-e616-42c6-9cfe-505508ede2d0"
+
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	w := worker.NewWorker(logger, GetConfPath())
+
+	getMessage := func(eventID uuid.UUID, props map[string]interface{}) *workers.Msg {
+		msgB, err := json.Marshal(map[string]interface{}{
+			"args": worker.TriggerMsg{
+				TriggerID: trigger.ID,
+				EventID:   eventID,
+				UserID:    userID,
+				Props:     props,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		message, err := workers.NewMsg(string(msgB))
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	getJob := func() *model.Job {
+		job := &model.Job{ID: trigger.JobID}
+		err := w.MarathonDB.Select(job)
+		Expect(err).NotTo(HaveOccurred())
+		return job
+	}
+
+	BeforeEach(func() {
+		mockKafkaProducer = NewFakeKafkaProducer()
+		w.Kafka = mockKafkaProducer
+		triggerWorker = worker.NewTriggerWorker(w)
+		w.RedisClient.FlushAll()
+		app = CreateTestApp(w.MarathonDB)
+		template = CreateTestTemplate(w.MarathonDB, app.ID, map[string]interface{}{
+			"defaults": map[string]interface{}{"item": "sword"},
+			"body":     map[string]interface{}{"alert": "Your {{item}} is ready!"},
+			"locale":   "en",
+		})
+		trigger = CreateTestTrigger(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+			"event":          "item_crafted",
+			"contextMapping": map[string]string{"item": "itemName"},
+		})
+	})
+
+	Describe("Process", func() {
+		It("should send the push of the trigger to the tokens of the user", func() {
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{"itemName": "shield"}))
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			var apnsMessage messages.APNSMessage
+			err := json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.DeviceToken).To(Equal("1235"))
+			Expect(apnsMessage.Payload.Aps["alert"]).To(Equal("Your shield is ready!"))
+			Expect(apnsMessage.Metadata["userId"]).To(Equal(userID))
+			Expect(apnsMessage.Metadata["triggerId"]).To(Equal(trigger.ID.String()))
+			Expect(apnsMessage.Metadata["jobId"]).To(Equal(trigger.JobID.String()))
+			Expect(apnsMessage.Metadata["pushType"]).To(Equal("trigger"))
+
+			job := getJob()
+			Expect(job.TotalUsers).To(Equal(1))
+			Expect(job.TotalTokens).To(Equal(1))
+			Expect(job.CompletedTokens).To(Equal(1))
+		})
+
+		It("should use the template defaults if the event has no mapped props", func() {
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			var apnsMessage messages.APNSMessage
+			err := json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.Payload.Aps["alert"]).To(Equal("Your sword is ready!"))
+		})
+
+		It("should send the push of an event only once", func() {
+			eventID := uuid.NewV4()
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+		})
+
+		It("should only count the user of an event in the first run that sends its push", func() {
+			eventID := uuid.NewV4()
+			mockKafkaProducer.AckErrors["1235"] = fmt.Errorf("kafka error")
+			Expect(func() { triggerWorker.Process(getMessage(eventID, map[string]interface{}{})) }).Should(Panic())
+			job := getJob()
+			Expect(job.TotalUsers).To(Equal(0))
+			Expect(job.CompletedTokens).To(Equal(0))
+
+			delete(mockKafkaProducer.AckErrors, "1235")
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+
+			job = getJob()
+			Expect(job.TotalUsers).To(Equal(1))
+			Expect(job.TotalTokens).To(Equal(1))
+			Expect(job.CompletedTokens).To(Equal(1))
+		})
+
+		It("should send a push for each event", func() {
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(2))
+			Expect(getJob().TotalUsers).To(Equal(2))
+		})
+
+		It("should not send the push if the job of the trigger is paused", func() {
+			_, err := w.MarathonDB.Model(&model.Job{}).Set("status = 'paused'").Where("id = ?", trigger.JobID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(BeEmpty())
+		})
+
+		It("should not send the push to suppressed users", func() {
+			CreateTestSuppression(w.MarathonDB, app.ID, map[string]interface{}{"userId": userID})
+
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(BeEmpty())
+		})
+
+		It("should not send the push to users held out by the app holdout", func() {
+			_, err := w.MarathonDB.Model(&model.App{}).Set("holdout = 0.999999").Where("id = ?", app.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(BeEmpty())
+
+			var holdout []string
+			_, err = w.MarathonDB.Query(&holdout, "SELECT user_id FROM app_holdout_users WHERE app_id = ?", app.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(holdout).To(Equal([]string{userID}))
+		})
+
+		It("should not send the push to users capped by the app frequency cap", func() {
+			_, err := w.MarathonDB.Model(&model.App{}).Set("frequency_cap_limit = 1, frequency_cap_window = 3600").Where("id = ?", app.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			eventID := uuid.NewV4()
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+
+			triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			Expect(getJob().Feedbacks["frequencyCapped"]).To(BeEquivalentTo(1))
+		})
+
+		It("should defer the push of users inside the quiet hours to their end once", func() {
+			// the user tz is -0300
+			now := time.Now().UTC()
+			quietHours := &model.QuietHours{
+				Start: now.Add(-4 * time.Hour).Format("15:04"),
+				End:   now.Add(-2 * time.Hour).Format("15:04"),
+			}
+			quietHoursJSON, err := json.Marshal(quietHours)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.MarathonDB.Model(&model.Job{}).Set("quiet_hours = ?", string(quietHoursJSON)).Where("id = ?", trigger.JobID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			eventID := uuid.NewV4()
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			triggerWorker.Process(getMessage(eventID, map[string]interface{}{}))
+			Expect(mockKafkaProducer.APNSMessages).To(BeEmpty())
+			Expect(getJob().TotalUsers).To(Equal(0))
+
+			scheduled, err := w.RedisClient.ZRangeWithScores("schedule", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(HaveLen(1))
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(scheduled[0].Member.(string)), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["queue"]).To(Equal("trigger_worker"))
+			Expect(msg["args"].(map[string]interface{})["EventID"]).To(Equal(eventID.String()))
+			Expect(scheduled[0].Score).To(BeNumerically("~", now.Add(time.Hour).Unix(), 120))
+		})
+
+		It("should do nothing if the trigger was deleted", func() {
+			_, err := w.MarathonDB.Exec("DELETE FROM triggers WHERE id = ?", trigger.ID)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() { triggerWorker.Process(getMessage(uuid.NewV4(), map[string]interface{}{})) }).NotTo(Panic())
+			Expect(mockKafkaProducer.APNSMessages).To(BeEmpty())
+		})
+	})
+})
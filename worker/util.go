@@ -24,14 +24,16 @@ package worker
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
-	"regexp"
-	"strconv"
 	"strings"
+	"time"
 
 	// pg "gopkg.in/pg.v5"
 	"gopkg.in/redis.v5"
@@ -39,6 +41,7 @@ import (
 	raven "github.com/getsentry/raven-go"
 	uuid "github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/messages"
 	"github.com/topfreegames/marathon/model"
 	"github.com/uber-go/zap"
 	"github.com/valyala/fasttemplate"
@@ -100,22 +103,15 @@ func isPageProcessed(page int, jobID uuid.UUID, redisClient *redis.Client, l zap
 	return res
 }
 
-// GetTimeOffsetFromUTCInSeconds returns the offset in seconds from UTC for tz
+// GetTimeOffsetFromUTCInSeconds returns the offset in seconds from UTC for tz at the current time,
+// i.e. the seconds added to the local time to get the UTC time
 func GetTimeOffsetFromUTCInSeconds(tz string, l zap.Logger) (int, error) {
-	r := regexp.MustCompile(`([\+|\-])(\d{2}).*(\d{2})`)
-	matches := r.FindStringSubmatch(tz)
-	if len(matches) < 4 {
-		return 0, nil
-	}
-	hours, err := strconv.Atoi(matches[2])
-	checkErr(l, err)
-	minutes, err := strconv.Atoi(matches[3])
-	checkErr(l, err)
-	offsetInSeconds := (hours*60 + minutes) * 60
-	if matches[1] == "+" {
-		offsetInSeconds *= -1
+	location, err := LoadTimezone(tz)
+	if err != nil {
+		return 0, err
 	}
-	return offsetInSeconds, err
+	_, offsetInSeconds := time.Now().In(location).Zone()
+	return -offsetInSeconds, nil
 }
 
 func checkIsReexecution(jobID uuid.UUID, redisClient *redis.Client, l zap.Logger) bool {
@@ -128,43 +124,76 @@ func markProcessedPage(page int, jobID uuid.UUID, redisClient *redis.Client) {
 	redisClient.SAdd(fmt.Sprintf("%s-processedpages", jobID.String()), page)
 }
 
-func checkErr(l zap.Logger, err error) {
-	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
-		log.P(l, "Worker panic.", func(cm log.CM) {
-			cm.Write(zap.Error(err))
-		})
-	}
+func sentPushesKey(jobID uuid.UUID, batchID string) string {
+	return fmt.Sprintf("%s-sentpushes-%s", jobID.String(), batchID)
 }
 
-// GetWhereClauseFromFilters returns a string cointaining the where clause to use in the query
-func GetWhereClauseFromFilters(filters map[string]interface{}) string {
-	if len(filters) == 0 {
-		return ""
+// BuildBatchID returns a deterministic id for a batch of users so that retries of the batch share the same id
+func BuildBatchID(users []User) string {
+	hash := sha1.New()
+	for _, user := range users {
+		fmt.Fprintf(hash, "%s:%s\n", user.UserID, user.Token)
 	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// BuildMessageID returns a deterministic message id for the push of a job to a user token
+// so that retried batches generate the same muid for the same push
+func BuildMessageID(jobID uuid.UUID, userID, token string) string {
+	return uuid.NewV5(jobID, fmt.Sprintf("%s:%s", userID, token)).String()
+}
 
-	queryFilters := []string{}
-	for key, val := range filters {
-		operator := "="
-		connector := " OR "
-		if strings.Contains(key, "NOT") {
-			key = strings.Trim(key, "NOT")
-			operator = "!="
-			connector = " AND "
+// GetSentPushes returns the message ids that were already sent by the batch of the job
+func GetSentPushes(jobID uuid.UUID, batchID string, muids []string, redisClient *redis.Client) (map[string]bool, error) {
+	sent := map[string]bool{}
+	if len(muids) == 0 {
+		return sent, nil
+	}
+	key := sentPushesKey(jobID, batchID)
+	cmds := make([]*redis.BoolCmd, len(muids))
+	_, err := redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		for idx, muid := range muids {
+			cmds[idx] = pipe.SIsMember(key, muid)
 		}
-		strVal := val.(string)
-		if strings.Contains(strVal, ",") {
-			filterArray := []string{}
-			vals := strings.Split(strVal, ",")
-			for _, fVal := range vals {
-				filterArray = append(filterArray, fmt.Sprintf("\"%s\"%s'%s'", key, operator, fVal))
-			}
-			queryFilters = append(queryFilters, fmt.Sprintf("(%s)", strings.Join(filterArray, connector)))
-		} else {
-			queryFilters = append(queryFilters, fmt.Sprintf("\"%s\"%s'%s'", key, operator, val))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for idx, cmd := range cmds {
+		if cmd.Val() {
+			sent[muids[idx]] = true
 		}
 	}
-	return strings.Join(queryFilters, " AND ")
+	return sent, nil
+}
+
+// MarkPushesSent records the message ids sent by the batch of the job so they are skipped if the batch runs again,
+// the ttl must cover the time in which the batch can be retried
+func MarkPushesSent(jobID uuid.UUID, batchID string, muids []string, ttl time.Duration, redisClient *redis.Client) error {
+	if len(muids) == 0 {
+		return nil
+	}
+	key := sentPushesKey(jobID, batchID)
+	members := make([]interface{}, len(muids))
+	for idx, muid := range muids {
+		members[idx] = muid
+	}
+	_, err := redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.SAdd(key, members...)
+		pipe.Expire(key, ttl)
+		return nil
+	})
+	return err
+}
+
+func checkErr(l zap.Logger, err error) {
+	if err != nil {
+		raven.CaptureErrorAndWait(err, nil)
+		log.P(l, "Worker panic.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
 }
 
 // GetPushDBTableName get the table name using appName and service
@@ -177,7 +206,11 @@ var InvalidMessageArray = "array must be of the form [jobId, appName, users]"
 
 // BuildTopicName builds a topic name based in appName, service and a template
 func BuildTopicName(appName, service, topicTemplate string) string {
-	return fmt.Sprintf(topicTemplate, appName, service)
+	pushService, err := messages.GetPushService(service)
+	if err != nil {
+		return messages.DefaultTopicName(appName, service, topicTemplate)
+	}
+	return pushService.TopicName(appName, service, topicTemplate)
 }
 
 // BatchWorkerMessage is the batch worker message struct
@@ -270,6 +303,29 @@ func ParseProcessBatchWorkerMessageArray(arr []interface{}) (*BatchWorkerMessage
 	return message, nil
 }
 
+// ParseCSVUserIDs returns the user ids in the first column of a csv with header
+func ParseCSVUserIDs(buffer []byte) ([]string, error) {
+	for i, b := range buffer {
+		if b == 0x0D {
+			buffer[i] = 0x0A
+		}
+	}
+
+	r := csv.NewReader(bytes.NewReader(buffer))
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for i, line := range lines {
+		if i == 0 {
+			continue
+		}
+		res = append(res, line[0])
+	}
+	return res, nil
+}
+
 // BuildMessageFromTemplate build a message using a template and the context
 func BuildMessageFromTemplate(template model.Template, context map[string]interface{}) (string, error) {
 	body, err := json.Marshal(template.Body)
@@ -290,6 +346,57 @@ func BuildMessageFromTemplate(template model.Template, context map[string]interf
 	return message, nil
 }
 
+// BuildMessageMetadata returns the job metadata with the push options set in the template defaults
+// options set in the job metadata take precedence over the template ones
+func BuildMessageMetadata(job *model.Job, template model.Template) map[string]interface{} {
+	pushService, err := messages.GetPushService(job.Service)
+	if err != nil {
+		return job.Metadata
+	}
+	var metadata map[string]interface{}
+	for _, key := range pushService.OptionKeys {
+		val, ok := template.Defaults[key]
+		if !ok {
+			continue
+		}
+		if _, ok := job.Metadata[key]; ok {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]interface{}, len(job.Metadata)+1)
+			for k, v := range job.Metadata {
+				metadata[k] = v
+			}
+		}
+		metadata[key] = val
+	}
+	if metadata == nil {
+		return job.Metadata
+	}
+	return metadata
+}
+
+// ValidatePushOptions validates the push options of the job when sent with template
+func ValidatePushOptions(job *model.Job, template model.Template) error {
+	pushService, err := messages.GetPushService(job.Service)
+	if err != nil {
+		return err
+	}
+	return pushService.ValidateMetadata(BuildMessageMetadata(job, template))
+}
+
+// GetMessageFormat returns the message format of the job pushes
+// the format set in the job metadata takes precedence over the app one
+func GetMessageFormat(job *model.Job) string {
+	if job.Service != "gcm" {
+		return ""
+	}
+	if format, ok := job.Metadata[messages.GCMFormatKey].(string); ok && format != "" {
+		return format
+	}
+	return job.App.GCMFormat
+}
+
 // RandomElementFromSlice gets a random element from a slice
 func RandomElementFromSlice(elements []string) string {
 	element := elements[rand.Intn(len(elements))]
@@ -203,54 +203,62 @@ var _ = Describe("Worker Util", func() {
 		})
 	})
 
-	Describe("Get Clause From Filters", func() {
-		It("should return empty string if filters is empty", func() {
-			filters := map[string]interface{}{}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(Equal(""))
-		})
-
-		It("should succeed with one simple filter", func() {
-			filters := map[string]interface{}{
-				"region": "US",
+	Describe("Build message metadata", func() {
+		It("should add apns options from template defaults", func() {
+			job := &model.Job{
+				Service:  "apns",
+				Metadata: map[string]interface{}{"a": "b"},
+			}
+			tpl := model.Template{
+				Defaults: map[string]interface{}{
+					"user_name":    "Someone",
+					"apnsPriority": 5,
+				},
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(Equal("\"region\"='US'"))
+			metadata := worker.BuildMessageMetadata(job, tpl)
+			Expect(metadata).To(Equal(map[string]interface{}{"a": "b", "apnsPriority": 5}))
+			Expect(job.Metadata).NotTo(HaveKey("apnsPriority"))
 		})
 
-		It("should succeedd with one comma separated filter", func() {
-			filters := map[string]interface{}{
-				"region": "US,CA",
+		It("should prefer the job metadata over the template defaults", func() {
+			job := &model.Job{
+				Service:  "apns",
+				Metadata: map[string]interface{}{"apnsPriority": 10},
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(Equal("(\"region\"='US' OR \"region\"='CA')"))
+			tpl := model.Template{
+				Defaults: map[string]interface{}{"apnsPriority": 5},
+			}
+			metadata := worker.BuildMessageMetadata(job, tpl)
+			Expect(metadata).To(Equal(map[string]interface{}{"apnsPriority": 10}))
 		})
 
-		It("should succeed with one negative simple filter", func() {
-			filters := map[string]interface{}{
-				"NOTregion": "US",
+		It("should validate the push options of the template defaults", func() {
+			job := &model.Job{
+				Service:  "apns",
+				Metadata: map[string]interface{}{},
+			}
+			tpl := model.Template{
+				Defaults: map[string]interface{}{"apnsPushType": "blabla"},
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(Equal("\"region\"!='US'"))
+			Expect(worker.ValidatePushOptions(job, tpl)).NotTo(Succeed())
 		})
+	})
 
-		It("should succeed with one negative comma separated filter", func() {
-			filters := map[string]interface{}{
-				"NOTregion": "US,CA",
-			}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(Equal("(\"region\"!='US' AND \"region\"!='CA')"))
+	Describe("Build message id", func() {
+		It("should return the same id for the same job, user and token", func() {
+			id := uuid.NewV4()
+			muid := worker.BuildMessageID(id, users[0].UserID, users[0].Token)
+			Expect(worker.BuildMessageID(id, users[0].UserID, users[0].Token)).To(Equal(muid))
+			_, err := uuid.FromString(muid)
+			Expect(err).NotTo(HaveOccurred())
 		})
 
-		It("should succeed with multiple filters", func() {
-			filters := map[string]interface{}{
-				"NOTregion": "US,CA",
-				"locale":    "en,fr",
-			}
-			where := worker.GetWhereClauseFromFilters(filters)
-			Expect(where).To(ContainSubstring("(\"locale\"='en' OR \"locale\"='fr')"))
-			Expect(where).To(ContainSubstring("(\"region\"!='US' AND \"region\"!='CA')"))
-			Expect(where).To(ContainSubstring(") AND ("))
+		It("should return different ids for different users, tokens or jobs", func() {
+			id := uuid.NewV4()
+			muid := worker.BuildMessageID(id, users[0].UserID, users[0].Token)
+			Expect(worker.BuildMessageID(id, users[1].UserID, users[0].Token)).NotTo(Equal(muid))
+			Expect(worker.BuildMessageID(id, users[0].UserID, users[1].Token)).NotTo(Equal(muid))
+			Expect(worker.BuildMessageID(uuid.NewV4(), users[0].UserID, users[0].Token)).NotTo(Equal(muid))
 		})
 	})
 })
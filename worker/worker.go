@@ -104,6 +104,16 @@ func (w *Worker) loadConfigurationDefaults() {
 	w.Config.SetDefault("database.url", "postgres://localhost:5432/marathon?sslmode=disable")
 	w.Config.SetDefault("workers.statsd.host", "127.0.0.1:8125")
 	w.Config.SetDefault("workers.statsd.prefix", "marathon.")
+	w.Config.SetDefault("workers.kafkaAcks.enabled", false)
+	w.Config.SetDefault("workers.kafkaAcks.timeout", "30s")
+	w.Config.SetDefault("workers.sentPushes.chunkSize", 1000)
+	w.Config.SetDefault("workers.sentPushes.ttl", "1h")
+	w.Config.SetDefault("workers.rateLimit.chunkSize", 100)
+	w.Config.SetDefault("workers.audience.sampleThreshold", 1000000)
+	w.Config.SetDefault("workers.sendTimeOptimization.window", "24h")
+	w.Config.SetDefault("deliveryLog.enabled", false)
+	w.Config.SetDefault("deliveryLog.ttl", "168h")
+	w.Config.SetDefault("deliveryLog.dropInterval", "1h")
 }
 
 func (w *Worker) configureSendgrid() {
@@ -184,6 +194,10 @@ func (w *Worker) configureWorkers() {
 	r := NewResumeJobWorker(w)
 	j := NewJobCompletedWorker(w)
 	directWorker := NewDirectWorker(w)
+	audienceWorker := NewAudienceWorker(w)
+	recurrenceWorker := NewRecurrenceWorker(w)
+	triggerWorker := NewTriggerWorker(w)
+	journeyWorker := NewJourneyWorker(w)
 
 	createCSVSplitWorkerConcurrency := w.Config.GetInt("workers.csvSplitWorker.concurrency")
 	processBatchWorkerConcurrency := w.Config.GetInt("workers.processBatch.concurrency")
@@ -192,6 +206,10 @@ func (w *Worker) configureWorkers() {
 	createBatchesWorkerConcurrency := w.Config.GetInt("workers.createBatches.concurrency")
 
 	jobDirectWorkerConcurrency := w.Config.GetInt("workers.direct.concurrency")
+	audienceWorkerConcurrency := w.Config.GetInt("workers.audience.concurrency")
+	recurrenceWorkerConcurrency := w.Config.GetInt("workers.recurrence.concurrency")
+	triggerWorkerConcurrency := w.Config.GetInt("workers.trigger.concurrency")
+	journeyWorkerConcurrency := w.Config.GetInt("workers.journey.concurrency")
 
 	workers.Process("csv_split_worker", k.Process, createCSVSplitWorkerConcurrency)
 	workers.Process("create_batches_worker", c.Process, createBatchesWorkerConcurrency)
@@ -200,6 +218,10 @@ func (w *Worker) configureWorkers() {
 	workers.Process("job_completed_worker", j.Process, jobCompletedWorkerConcurrency)
 
 	workers.Process("direct_worker", directWorker.Process, jobDirectWorkerConcurrency)
+	workers.Process("audience_worker", audienceWorker.Process, audienceWorkerConcurrency)
+	workers.Process("recurrence_worker", recurrenceWorker.Process, recurrenceWorkerConcurrency)
+	workers.Process("trigger_worker", triggerWorker.Process, triggerWorkerConcurrency)
+	workers.Process("journey_worker", journeyWorker.Process, journeyWorkerConcurrency)
 }
 
 func (w *Worker) configureSentry() {
@@ -220,6 +242,34 @@ func (w *Worker) configureKafkaProducer() {
 	w.Kafka = kafka
 }
 
+// StartJob enqueues the first worker of the job, scheduled to its start time if it has one
+// audiences with csv files are resolved to a csv by the audience worker, the others are queried directly
+func (w *Worker) StartJob(job *model.Job) error {
+	var err error
+	if job.Audience != nil && job.Audience.HasCSV() {
+		if job.StartsAt != 0 {
+			_, err = w.ScheduleAudienceJob(job, job.StartsAt)
+		} else {
+			_, err = w.CreateAudienceJob(job)
+		}
+		return err
+	}
+	if job.StartsAt != 0 {
+		if len(job.CSVPath) > 0 {
+			_, err = w.ScheduleCSVSplitJob(job, job.StartsAt)
+		} else {
+			err = w.ScheduleDirectBatchesJob(job, job.StartsAt)
+		}
+	} else {
+		if len(job.CSVPath) > 0 {
+			_, err = w.CreateCSVSplitJob(job)
+		} else {
+			err = w.CreateDirectBatchesJob(job)
+		}
+	}
+	return err
+}
+
 // CreateCSVSplitJob creates a new CSVSplitWorker job
 func (w *Worker) CreateCSVSplitJob(job *model.Job) (string, error) {
 	maxRetries := w.Config.GetInt("workers.csvSplitWorker.maxRetries")
@@ -247,6 +297,105 @@ func (w *Worker) ScheduleCSVSplitJob(job *model.Job, at int64) (string, error) {
 		})
 }
 
+// CreateAudienceJob creates a new AudienceWorker job
+func (w *Worker) CreateAudienceJob(job *model.Job) (string, error) {
+	maxRetries := w.Config.GetInt("workers.audience.maxRetries")
+	return workers.EnqueueWithOptions(
+		"audience_worker",
+		"Add",
+		job.ID.String(),
+		workers.EnqueueOptions{
+			Retry:      true,
+			RetryCount: maxRetries,
+		})
+}
+
+// ScheduleAudienceJob schedules a new AudienceWorker job
+func (w *Worker) ScheduleAudienceJob(job *model.Job, at int64) (string, error) {
+	maxRetries := w.Config.GetInt("workers.audience.maxRetries")
+	return workers.EnqueueWithOptions(
+		"audience_worker",
+		"Add",
+		job.ID.String(),
+		workers.EnqueueOptions{
+			Retry:      true,
+			RetryCount: maxRetries,
+			At:         float64(at) / workers.NanoSecondPrecision,
+		})
+}
+
+// ScheduleRecurrenceJob schedules a new RecurrenceWorker job for the occurrence of the recurrence at at
+func (w *Worker) ScheduleRecurrenceJob(recurrence *model.Recurrence, at int64) (string, error) {
+	maxRetries := w.Config.GetInt("workers.recurrence.maxRetries")
+	return workers.EnqueueWithOptions(
+		"recurrence_worker",
+		"Add",
+		RecurrenceMsg{
+			RecurrenceID: recurrence.ID,
+			RunAt:        at,
+		},
+		workers.EnqueueOptions{
+			Retry:      true,
+			RetryCount: maxRetries,
+			At:         float64(at) / workers.NanoSecondPrecision,
+		})
+}
+
+// ScheduleJourneyJob schedules a new JourneyWorker job for the step of the journey at at
+func (w *Worker) ScheduleJourneyJob(journey *model.Journey, step int, at int64) (string, error) {
+	maxRetries := w.Config.GetInt("workers.journey.maxRetries")
+	return workers.EnqueueWithOptions(
+		"journey_worker",
+		"Add",
+		JourneyMsg{
+			JourneyID: journey.ID,
+			Step:      step,
+		},
+		workers.EnqueueOptions{
+			Retry:      true,
+			RetryCount: maxRetries,
+			At:         float64(at) / workers.NanoSecondPrecision,
+		})
+}
+
+// CreateTriggerJob enqueues a new TriggerWorker job for the push of the trigger to the user of the event
+// it is scheduled to the trigger delay after now if the trigger has one
+func (w *Worker) CreateTriggerJob(trigger *model.Trigger, eventID uuid.UUID, event *TriggerEvent) (string, error) {
+	maxRetries := w.Config.GetInt("workers.trigger.maxRetries")
+	options := workers.EnqueueOptions{
+		Retry:      true,
+		RetryCount: maxRetries,
+	}
+	if trigger.Delay > 0 {
+		at := time.Now().Add(time.Duration(trigger.Delay) * time.Second).UnixNano()
+		options.At = float64(at) / workers.NanoSecondPrecision
+	}
+	return workers.EnqueueWithOptions(
+		"trigger_worker",
+		"Add",
+		TriggerMsg{
+			TriggerID: trigger.ID,
+			EventID:   eventID,
+			UserID:    event.UserID,
+			Props:     event.Props,
+		},
+		options)
+}
+
+// ScheduleTriggerJob schedules the TriggerWorker job of the message at at
+func (w *Worker) ScheduleTriggerJob(msg *TriggerMsg, at int64) (string, error) {
+	maxRetries := w.Config.GetInt("workers.trigger.maxRetries")
+	return workers.EnqueueWithOptions(
+		"trigger_worker",
+		"Add",
+		msg,
+		workers.EnqueueOptions{
+			Retry:      true,
+			RetryCount: maxRetries,
+			At:         float64(at) / workers.NanoSecondPrecision,
+		})
+}
+
 // CreateBatchesJob creates a new CreateBatchesWorker job
 func (w *Worker) CreateBatchesJob(part *BatchPart) (string, error) {
 	maxRetries := w.Config.GetInt("workers.createBatches.maxRetries")
@@ -296,7 +445,41 @@ func (w *Worker) createDirectBatchesJobWithOption(job *model.Job, options worker
 	if rownsEstimative == 0 {
 		rownsEstimative = 1
 	}
+	// the table estimate only sizes the batches, the job total must consider its filters
+	totalTokens, err := w.getDirectJobTotalTokens(job, tableName)
+	if err != nil {
+		return err
+	}
 	testBatchSize = (200000 * maxSeqID) / rownsEstimative
+	if testBatchSize == 0 {
+		testBatchSize = 1
+	}
+
+	// the first run of the job fixes its batches so a retry enqueues the same seq id ranges and does not count
+	// them again, the batches are added to the total before they are enqueued so the job can not complete
+	// before the last one is counted, the batches deferred by the workers are added to the total as well
+	batchesKey := fmt.Sprintf("%s-directbatches", job.ID.String())
+	first, err := w.RedisClient.SetNX(batchesKey, fmt.Sprintf("%d-%d", maxSeqID, testBatchSize), 7*24*time.Hour).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		layout, err := w.RedisClient.Get(batchesKey).Result()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Sscanf(layout, "%d-%d", &maxSeqID, &testBatchSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		batches := maxSeqID/testBatchSize + 1
+		_, err = w.MarathonDB.Model(job).Set("total_batches = coalesce(total_batches, 0) + ?", batches).Where("id = ?", job.ID).Update()
+		if err != nil {
+			w.RedisClient.Del(batchesKey)
+			return err
+		}
+	}
 
 	for i = 0; i < maxSeqID+1; {
 		_, err = workers.EnqueueWithOptions("direct_worker", "Add",
@@ -311,18 +494,45 @@ func (w *Worker) createDirectBatchesJobWithOption(job *model.Job, options worker
 		i += testBatchSize
 	}
 
-	_, err = w.MarathonDB.Model(job).Set("total_tokens = ?", rownsEstimative).Where("id = ?", job.ID).Update()
+	_, err = w.MarathonDB.Model(job).Set("total_tokens = ?", totalTokens).Where("id = ?", job.ID).Update()
 	if err != nil {
 		return err
 	}
 
-	batches := i / testBatchSize
-	_, err = w.MarathonDB.Model(job).Set("total_batches = ?", batches).Where("id = ?", job.ID).Update()
-	if err != nil {
-		return err
+	return nil
+}
+
+// getDirectJobTotalTokens counts the tokens of the job, the users of each step of its audience are stored in the job
+func (w *Worker) getDirectJobTotalTokens(job *model.Job, tableName string) (int, error) {
+	if job.Audience == nil {
+		expression, err := job.GetFilterExpression()
+		if err != nil {
+			return 0, err
+		}
+		audience, err := EstimateAudience(w.PushDB, tableName, expression, w.Config.GetInt("workers.audience.sampleThreshold"))
+		if err != nil {
+			return 0, err
+		}
+		return audience.Total, nil
 	}
 
-	return nil
+	steps, err := CountAudienceSteps(w.PushDB, tableName, job.Audience)
+	if err != nil {
+		return 0, err
+	}
+	job.AudienceSteps = steps
+	_, err = w.MarathonDB.Model(job).Set("audience_steps = ?audience_steps").Where("id = ?", job.ID).Update()
+	if err != nil {
+		return 0, err
+	}
+	filterQuery, err := GetAudienceQuery(w.PushDB, tableName, job.Audience)
+	if err != nil {
+		return 0, err
+	}
+	var totalTokens int
+	query := fmt.Sprintf("SELECT count(1) FROM %s WHERE %s", tableName, filterQuery.Where)
+	_, err = w.PushDB.QueryOne(&totalTokens, query, filterQuery.Params...)
+	return totalTokens, err
 }
 
 // CreateProcessBatchJob creates a new ProcessBatchWorker job
@@ -386,6 +596,56 @@ func (w *Worker) ScheduleProcessBatchJob(jobID string, appName string, users *[]
 		})
 }
 
+// ScheduleProcessBatches schedules a ProcessBatchWorker job for each group of users at its time
+// the batches are added to the job total batches so it completes only after they are processed,
+// key identifies the batch that deferred the users so its retries do not schedule and count them again
+func (w *Worker) ScheduleProcessBatches(job *model.Job, appName, key string, usersByTime map[int64][]User) error {
+	if len(usersByTime) == 0 {
+		return nil
+	}
+	scheduledKey := fmt.Sprintf("%s-scheduledbatches-%s", job.ID.String(), key)
+	first, err := w.RedisClient.SetNX(scheduledKey, len(usersByTime), w.Config.GetDuration("workers.sentPushes.ttl")).Result()
+	if err != nil || !first {
+		return err
+	}
+	err = w.scheduleProcessBatches(job, appName, usersByTime)
+	if err != nil {
+		w.RedisClient.Del(scheduledKey)
+	}
+	return err
+}
+
+func (w *Worker) scheduleProcessBatches(job *model.Job, appName string, usersByTime map[int64][]User) error {
+	// coalesce is necessary since total_batches can be null
+	_, err := w.MarathonDB.Model(job).Set("total_batches = coalesce(total_batches, 0) + ?", len(usersByTime)).Where("id = ?", job.ID).Update()
+	if err != nil {
+		return err
+	}
+	job.TotalBatches += len(usersByTime)
+	for at, users := range usersByTime {
+		users := users
+		_, err := w.ScheduleProcessBatchJob(job.ID.String(), appName, &users, at)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOnce runs fn only once for the key, retries and duplicated messages of a worker skip it after it succeeded
+// and run it again if it failed
+func (w *Worker) runOnce(key string, fn func() error) error {
+	first, err := w.RedisClient.SetNX(key, 1, 7*24*time.Hour).Result()
+	if err != nil || !first {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		w.RedisClient.Del(key)
+	}
+	return err
+}
+
 // ScheduleJobCompletedJob schedules a new JobCompletedWorker job
 func (w *Worker) ScheduleJobCompletedJob(jobID string, at int64) (string, error) {
 	maxRetries := w.Config.GetInt("workers.jobCompleted.maxRetries")
@@ -429,19 +689,22 @@ func (w *Worker) Start() {
 			panic(err)
 		}
 	}()
+	go w.dropExpiredDeliveriesPeriodically()
 	workers.Run()
 }
 
-// SendControlGroupToRedis send a sequency of users ids to redis
-func (w *Worker) SendControlGroupToRedis(job *model.Job, ids []string) {
-	start := time.Now()
-	hash := job.ID.String()
-	var args []interface{}
-	for _, id := range ids {
-		args = append(args, id)
+// NewPushBatch returns a batch that waits for kafka delivery confirmations
+// or nil if the workers are configured to send pushes without waiting for them
+func (w *Worker) NewPushBatch() interfaces.PushBatch {
+	if !w.Config.GetBool("workers.kafkaAcks.enabled") {
+		return nil
 	}
-	w.RedisClient.LPush(fmt.Sprintf("%s-CONTROL", hash), args...).Result()
-	w.Statsd.Timing("save_control_group", time.Now().Sub(start), job.Labels(), 1)
+	return w.Kafka.NewPushBatch()
+}
+
+// WaitPushBatch waits for the delivery confirmations of the pushes sent in the batch
+func (w *Worker) WaitPushBatch(batch interfaces.PushBatch) []error {
+	return batch.Wait(w.Config.GetDuration("workers.kafkaAcks.timeout"))
 }
 
 // GetJob get a job from the db